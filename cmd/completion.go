@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// usageLineRe matches the lines of usage statements listing a command or flag: its name, its argument
+// (if any), and the first line of its description
+var usageLineRe = regexp.MustCompile(`^ (-?[a-z][a-z0-9-]*)(?: (<[^>]*>|-x <xml>(?: <dat>)?))?\s+(\S.*)$`)
+
+// usageEntry is a command or flag listed by a usage statement
+type usageEntry struct {
+	name   string // without the leading dash, for flags
+	hasArg bool
+	desc   string
+}
+
+// usageEntries returns the commands and flags listed by a usage statement, in order
+func usageEntries(usage string) (commands, flags []usageEntry) {
+	for _, line := range strings.Split(usage, "\n") {
+		m := usageLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		desc := strings.TrimRight(m[3], ";, ")
+		if name, isFlag := strings.CutPrefix(m[1], "-"); isFlag {
+			flags = append(flags, usageEntry{name: name, hasArg: len(m[2]) != 0, desc: desc})
+		} else {
+			commands = append(commands, usageEntry{name: m[1], hasArg: len(m[2]) != 0, desc: desc})
+		}
+	}
+	return commands, flags
+}
+
+// usageFlags returns the flags listed by a usage statement (see usageEntries)
+func usageFlags(usage string) []usageEntry {
+	_, flags := usageEntries(usage)
+	return flags
+}
+
+// completionShells are the shells completion scripts are generated for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// flagValues are the values completed for flags taking one of a fixed set of values; other
+// flags taking an argument complete file names
+var flagValues = map[string][]string{
+	"b":         棕熊.DbTypes,
+	"fmt":       {棕熊.FORMAT_SQL, 棕熊.FORMAT_AVRO, 棕熊.FORMAT_DTA, 棕熊.FORMAT_PGCOPY},
+	"case":      {棕熊.CASE_LOWER, 棕熊.CASE_UPPER, 棕熊.CASE_PRESERVE},
+	"model":     {棕熊.MODEL_FLAT, 棕熊.MODEL_STAR},
+	"decimals":  {棕熊.DECIMALS_NUMERIC, 棕熊.DECIMALS_DOUBLE, 棕熊.DECIMALS_REAL, 棕熊.DECIMALS_SCALED},
+	"repwt-fmt": {棕熊.REPWT_LONG, 棕熊.REPWT_ARRAY},
+	"qflags":    {棕熊.QFLAGS_SIDE, 棕熊.QFLAGS_DROP},
+	"nulls":     {"any", "blank", "trim", "strict"},
+	"emit":      棕熊.EmitKinds(),
+	"format":    棕熊.HeadFormats,
+}
+
+// completionCommand is a command completed by the scripts, with its flags; the conversion itself is the
+// command named ""
+type completionCommand struct {
+	usageEntry
+	flags []usageEntry
+}
+
+// completionCommands returns the commands of ipums2db, and their flags, as listed by their usage statements
+func completionCommands() []completionCommand {
+	commands, mainFlags := usageEntries(mainUsage)
+	cmdFlags := map[string][]usageEntry{
+		// convert takes the conversion's options, but the DDI, found among the extract's files
+		"convert":  slices.DeleteFunc(slices.Clone(mainFlags), func(f usageEntry) bool { return f.name == "x" }),
+		"watch":    usageFlags(watchUsage),
+		"dict":     usageFlags(dictUsage),
+		"extract":  usageFlags(extractUsage),
+		"tui":      usageFlags(tuiUsage),
+		"diff":     usageFlags(diffUsage),
+		"freq":     usageFlags(freqUsage),
+		"stats":    usageFlags(statsUsage),
+		"head":     usageFlags(headUsage),
+		"describe": usageFlags(describeUsage),
+	}
+	cmds := []completionCommand{{flags: mainFlags}}
+	for _, c := range commands {
+		cmds = append(cmds, completionCommand{usageEntry: c, flags: cmdFlags[c.name]})
+	}
+	return cmds
+}
+
+// runCompletion prints a completion script of ipums2db for a shell (bash, zsh, or fish)
+func runCompletion(args []string) {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = printCompletionUsage
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Printf("ipums2db completion: must provide exactly one shell (bash, zsh, or fish)\nsee completion --help for more\n")
+		os.Exit(exitUsage)
+	}
+	var script string
+	switch shell := fs.Arg(0); shell {
+	case "bash":
+		script = bashCompletion(completionCommands())
+	case "zsh":
+		script = zshCompletion(completionCommands())
+	case "fish":
+		script = fishCompletion(completionCommands())
+	default:
+		checkUsageErr(fmt.Errorf("shell '%s' not in {'bash', 'zsh', 'fish'}", shell), "completion")
+	}
+	fmt.Print(script)
+}
+
+// bashCompletion returns the bash completion script, completing commands, flags, flag values, and files
+func bashCompletion(cmds []completionCommand) string {
+	var b strings.Builder
+	b.WriteString("# bash completion for ipums2db; generated by `ipums2db completion bash`\n")
+	b.WriteString("_ipums2db() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd=\"\"\n")
+	var names []string
+	for _, c := range cmds[1:] {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(&b, "\tif [[ ${COMP_CWORD} -gt 1 ]]; then\n\t\tcase \"${COMP_WORDS[1]}\" in %s) cmd=\"${COMP_WORDS[1]}\" ;; esac\n\tfi\n", strings.Join(names, "|"))
+	b.WriteString("\tif [[ \"$cmd\" == completion ]]; then\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(completionShells, " "))
+	b.WriteString("\tlocal flags=\"\" argflags=\"\"\n\tcase \"$cmd\" in\n")
+	for _, c := range cmds {
+		if c.name == "completion" {
+			continue
+		}
+		var flags, argFlags []string
+		for _, f := range c.flags {
+			flags = append(flags, "-"+f.name)
+			if f.hasArg {
+				argFlags = append(argFlags, "-"+f.name)
+			}
+		}
+		label := c.name
+		if len(label) == 0 {
+			label = "\"\""
+		}
+		fmt.Fprintf(&b, "\t%s) flags=\"%s\" argflags=\" %s \" ;;\n", label, strings.Join(flags, " "), strings.Join(argFlags, " "))
+	}
+	b.WriteString("\tesac\n")
+	// values of the previous flag
+	b.WriteString("\tcase \"$prev\" in\n")
+	for _, name := range sortedKeys(flagValues) {
+		fmt.Fprintf(&b, "\t-%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", name, strings.Join(flagValues[name], " "))
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ \"$argflags\" == *\" $prev \"* ]]; then\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\treturn\n\tfi\n")
+	b.WriteString("\tif [[ \"$cur\" == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(&b, "\tif [[ ${COMP_CWORD} -eq 1 ]]; then\n\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\tfi\n", strings.Join(names, " "))
+	b.WriteString("\tCOMPREPLY+=($(compgen -f -- \"$cur\"))\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o filenames -F _ipums2db ipums2db\n")
+	return b.String()
+}
+
+// zshCompletion returns the zsh completion script (see bashCompletion), with descriptions
+func zshCompletion(cmds []completionCommand) string {
+	var b strings.Builder
+	b.WriteString("#compdef ipums2db\n# zsh completion for ipums2db; generated by `ipums2db completion zsh`\n")
+	b.WriteString("_ipums2db() {\n")
+	b.WriteString("\tlocal -a commands\n\tcommands=(\n")
+	for _, c := range cmds[1:] {
+		fmt.Fprintf(&b, "\t\t'%s:%s'\n", c.name, zshQuote(c.desc))
+	}
+	b.WriteString("\t)\n")
+	b.WriteString("\tcase $words[2] in\n")
+	for _, c := range cmds[1:] {
+		fmt.Fprintf(&b, "\t%s)\n\t\tshift words; (( CURRENT-- ))\n", c.name)
+		if c.name == "completion" {
+			fmt.Fprintf(&b, "\t\t_arguments '1:shell:(%s)'\n\t\t;;\n", strings.Join(completionShells, " "))
+			continue
+		}
+		fmt.Fprintf(&b, "\t\t_arguments %s '*:file:_files'\n\t\t;;\n", zshFlagSpecs(c.flags))
+	}
+	b.WriteString("\t*)\n")
+	b.WriteString("\t\tif (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n")
+	b.WriteString("\t\t\t_describe -t commands 'command' commands\n\t\t\t_files\n\t\t\treturn\n\t\tfi\n")
+	fmt.Fprintf(&b, "\t\t_arguments %s '*:dat file:_files'\n\t\t;;\n", zshFlagSpecs(cmds[0].flags))
+	b.WriteString("\tesac\n}\n")
+	// run when autoloaded from $fpath; registered when sourced
+	b.WriteString("if [[ \"$funcstack[1]\" == _ipums2db ]]; then\n\t_ipums2db \"$@\"\nelse\n\tcompdef _ipums2db ipums2db\nfi\n")
+	return b.String()
+}
+
+// zshFlagSpecs returns the _arguments specs of flags, completing their values (or files)
+func zshFlagSpecs(flags []usageEntry) string {
+	specs := make([]string, len(flags))
+	for i, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, zshQuote(f.desc))
+		switch vals, ok := flagValues[f.name]; {
+		case ok:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(vals, " "))
+		case f.hasArg:
+			spec += fmt.Sprintf(":%s:_files", f.name)
+		}
+		specs[i] = "'" + spec + "'"
+	}
+	return strings.Join(specs, " \\\n\t\t\t")
+}
+
+// zshQuote makes a description safe within a single-quoted _arguments spec: quotes are dropped, brackets
+// (which would end the description) become parentheses, and colons are escaped
+func zshQuote(desc string) string {
+	return strings.NewReplacer("'", "", "[", "(", "]", ")", ":", "\\:").Replace(desc)
+}
+
+// fishCompletion returns the fish completion script (see bashCompletion), with descriptions
+func fishCompletion(cmds []completionCommand) string {
+	var b strings.Builder
+	b.WriteString("# fish completion for ipums2db; generated by `ipums2db completion fish`\n")
+	var names []string
+	for _, c := range cmds[1:] {
+		names = append(names, c.name)
+	}
+	noCmd := "not __fish_seen_subcommand_from " + strings.Join(names, " ")
+	for _, c := range cmds[1:] {
+		fmt.Fprintf(&b, "complete -c ipums2db -n '__fish_use_subcommand' -a %s -d %s\n", c.name, fishQuote(c.desc))
+	}
+	fmt.Fprintf(&b, "complete -c ipums2db -n '__fish_seen_subcommand_from completion' -x -a '%s'\n", strings.Join(completionShells, " "))
+	for _, c := range cmds {
+		cond := noCmd
+		if len(c.name) != 0 {
+			cond = "__fish_seen_subcommand_from " + c.name
+		}
+		for _, f := range c.flags {
+			fmt.Fprintf(&b, "complete -c ipums2db -n '%s' -o %s -d %s", cond, f.name, fishQuote(f.desc))
+			switch vals, ok := flagValues[f.name]; {
+			case ok:
+				fmt.Fprintf(&b, " -x -a '%s'", strings.Join(vals, " "))
+			case f.hasArg:
+				b.WriteString(" -r")
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// fishQuote single-quotes a description for fish
+func fishQuote(desc string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(desc) + "'"
+}
+
+// sortedKeys returns the keys of flagValues, sorted, so that scripts are generated reproducibly
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// printCompletionUsage prints usage of ipums2db completion
+func printCompletionUsage() {
+	usageStatement := `Usage: %s completion <bash|zsh|fish>
+Prints a completion script for the shell, completing commands, flags, flag
+values (e.g., database types), and files.
+
+Examples:
+ # bash: load in the current shell, or save it to load in every shell
+ source <(%s completion bash)
+ %s completion bash > /etc/bash_completion.d/ipums2db
+ # zsh: save it to a directory of your $fpath
+ %s completion zsh > "${fpath[1]}/_ipums2db"
+ # fish
+ %s completion fish > ~/.config/fish/completions/ipums2db.fish
+`
+	fmt.Printf(usageStatement, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
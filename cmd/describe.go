@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runDescribe prints the codebook entry of variables of a data dictionary, looked up by name,
+// or searched for by name or label.
+func runDescribe(args []string) {
+	var ddiPath string
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.Usage = printDescribeUsage
+	terms := parseInterspersed(fs, args) // e.g., describe incwage -x usa.xml
+	checkDDIFlag(ddiPath)
+
+	if len(terms) == 0 {
+		fmt.Printf("ipums2db describe: must provide at least one variable (or search term)\nsee describe --help for more\n")
+		os.Exit(exitUsage)
+	}
+
+	ddi, err := 棕熊.NewDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	found := true
+	for i, term := range terms {
+		if i > 0 {
+			fmt.Println()
+		}
+		matches := 棕熊.SearchVars(&ddi, term)
+		switch len(matches) {
+		case 0:
+			fmt.Printf("no variable named, or labeled, like '%s'\n", term)
+			found = false
+		case 1:
+			fmt.Print(棕熊.Describe(matches[0]))
+		default:
+			fmt.Printf("%d variables named, or labeled, like '%s':\n", len(matches), term)
+			for _, v := range matches {
+				fmt.Printf("  %-16s %s\n", v.Name, v.Label)
+			}
+		}
+	}
+	if !found {
+		os.Exit(exitFailure)
+	}
+}
+
+// describeUsage is the usage statement of ipums2db describe; its flag lines are also read by completion (see usageFlags)
+const describeUsage = `Usage: %s describe -x <xml> <var> [<var>...]
+Prints the codebook entry of each variable: its label, type, position,
+width, implied decimals, universe, description, and every category, without
+opening the XML. A term naming no variable is searched for in the variables'
+names and labels instead: a single match is described, and several are listed.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+
+Example:
+ %s describe -x usa_00012.xml incwage
+ %s describe -x usa_00012.xml income
+`
+
+// printDescribeUsage prints usage of ipums2db describe
+func printDescribeUsage() {
+	fmt.Printf(describeUsage, os.Args[0], os.Args[0], os.Args[0])
+}
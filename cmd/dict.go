@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runDict exports the data dictionary (one row per variable) and its value labels
+// as CSV or Markdown, for documentation and code review.
+func runDict(args []string) {
+	var (
+		ddiPath    string
+		outFile    string
+		silentProg bool
+	)
+	fs := flag.NewFlagSet("dict", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.StringVar(&outFile, "o", "ipums_dict.csv", "output file name")
+	fs.BoolVar(&silentProg, "s", false, "silence output")
+	fs.Usage = printDictUsage
+	fs.Parse(args)
+	checkDDIFlag(ddiPath)
+
+	ddi, err := 棕熊.NewDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	labelsFile, err := 棕熊.ExportDict(&ddi, outFile)
+	checkErr(err, "dict")
+	if !silentProg {
+		fmt.Printf("data dictionary written to %s\nvalue labels written to %s\n", outFile, labelsFile)
+	}
+}
+
+// dictUsage is the usage statement of ipums2db dict; its flag lines are also read by completion (see usageFlags)
+const dictUsage = `Usage: %s dict [options...] -x <xml>
+Exports the data dictionary (name, label, type, position, width, decimals,
+interval, and category count per variable) and all value labels.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+ -o <outFile>                 Output file (default 'ipums_dict.csv'); a '.md'
+                              extension writes Markdown tables instead of CSV
+ -s                           Silent output (default false)
+
+Value labels are written next to <outFile>, with a "_labels" suffix
+(e.g., dict.csv -> dict_labels.csv).
+
+Example:
+ %s dict -o usa_dict.md -x usa_00012.xml
+`
+
+// printDictUsage prints usage of ipums2db dict
+func printDictUsage() {
+	fmt.Printf(dictUsage, os.Args[0], os.Args[0])
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runDiff reports the variables added, removed, and retyped between two data dictionaries,
+// and writes the ALTER TABLE statements evolving a table loaded from the first into one of the second.
+func runDiff(args []string) {
+	var (
+		dbType     string
+		tabName    string
+		outFile    string
+		silentProg bool
+	)
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.StringVar(&dbType, "b", "postgres", "database type")
+	fs.StringVar(&tabName, "t", "ipums_tab", "table name")
+	fs.StringVar(&outFile, "o", "ipums_migration.sql", "output file name")
+	fs.BoolVar(&silentProg, "s", false, "silence output")
+	fs.Usage = printDiffUsage
+	ddiPaths := parseInterspersed(fs, args) // e.g., diff old.xml new.xml -b mysql
+	if len(ddiPaths) != 2 {
+		fmt.Printf("ipums2db diff: must provide exactly two data dictionaries (old, then new)\nsee diff --help for more\n")
+		os.Exit(exitUsage)
+	}
+
+	oldDDI, err := 棕熊.NewDataDict(ddiPaths[0])
+	checkErr(err, "DataDict")
+	newDDI, err := 棕熊.NewDataDict(ddiPaths[1])
+	checkErr(err, "DataDict")
+	dbfmtr, err := 棕熊.NewDBFormatter(dbType, tabName, true, nil)
+	checkUsageErr(err, "DatabaseFormatter")
+
+	diff := dbfmtr.DiffSchemas(&oldDDI, &newDDI)
+	if diff.IsEmpty() {
+		if !silentProg {
+			fmt.Printf("schemas match; no migration needed\n")
+		}
+		return
+	}
+	checkErr(diff.WriteMigration(outFile), "diff")
+	if silentProg {
+		return
+	}
+	for _, v := range diff.Added {
+		fmt.Printf("+ %-16s %s\n", v.Name, v.Label)
+	}
+	for _, v := range diff.Removed {
+		fmt.Printf("- %-16s %s\n", v.Name, v.Label)
+	}
+	for _, rv := range diff.Retyped {
+		fmt.Printf("~ %-16s %s -> %s\n", rv.Name, rv.OldType, rv.NewType)
+	}
+	fmt.Printf("%d added, %d removed, %d retyped\nmigration written to %s\n",
+		len(diff.Added), len(diff.Removed), len(diff.Retyped), outFile)
+}
+
+// diffUsage is the usage statement of ipums2db diff; its flag lines are also read by completion (see usageFlags)
+const diffUsage = `Usage: %s diff [options...] <oldXml> <newXml>
+Reports the variables added, removed, and retyped between two data
+dictionaries (e.g., an extract, and its refresh with extra variables), and
+writes the ALTER TABLE statements evolving a table loaded from the first.
+Flags:
+ -b <dbType>                  Database type (default 'postgres')
+ -t <tabName>                 Table name (default 'ipums_tab')
+ -o <outFile>                 Output file (default 'ipums_migration.sql')
+ -s                           Silent output (default false)
+
+Added columns go at the end of the table, so its columns no longer follow
+the order of a fresh dump of <newXml>; load refreshed data with explicit
+column lists, rather than with -append. Nothing is written if the schemas
+match.
+
+Example:
+ %s diff usa_00012.xml usa_00013.xml -b mysql -o migrate.sql
+`
+
+// printDiffUsage prints usage of ipums2db diff
+func printDiffUsage() {
+	fmt.Printf(diffUsage, os.Args[0], os.Args[0])
+}
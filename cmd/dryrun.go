@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// dryRunPlan is the resolved configuration of a conversion, checked and printed by -dry-run
+type dryRunPlan struct {
+	dbType, tabName, outFile, outFmt, model string
+	datFileName                             string
+	recType, srcFileName                    string // with -rectype, the record type, and the hierarchical file it's copied out of
+	rectangle                               bool   // with -rectangularize, records are joined with their households'
+	levelName                               string // with -levels, the level converted
+	idx                                     []string
+	makeItDir, ordered, staged              bool
+	compressWorkers                         int
+	split                                   棕熊.OutputSplit
+	userJobs                                棕熊.JobConfig
+}
+
+// runDryRun checks a conversion's inputs and configuration as the conversion would, up to (but not
+// including) writing anything, then prints the resolved configuration: the dialect, table, columns,
+// indices, output files, and parsing jobs. gzip compressed data files aren't decompressed, so their rows
+// (and anything decided by them) aren't known.
+//
+// Misconfigurations exit as the conversion would, with the same exit codes (see checkErr, and checkUsageErr).
+func runDryRun(plan dryRunPlan, ddi *棕熊.DataDict, dbfmtr *棕熊.DatabaseFormatter) {
+	// the table (or Avro schema, or Stata file layout), and its indices
+	var table []byte
+	var err error
+	switch plan.outFmt {
+	case 棕熊.FORMAT_AVRO:
+		_, err = dbfmtr.AvroSchema(ddi)
+	case 棕熊.FORMAT_DTA:
+		_, err = dbfmtr.DtaSchema(ddi)
+	default:
+		table, err = dbfmtr.CreateMainTable(ddi)
+	}
+	checkErr(err, "write DDL")
+	_, err = dbfmtr.CreateIndices(ddi, plan.idx)
+	checkErr(err, "write DDL")
+	// the output, which can't exist in directory format
+	if plan.makeItDir && !棕熊.IsObjectURL(plan.outFile) {
+		dirName := strings.TrimSuffix(plan.outFile, ".sql")
+		if _, err := os.Stat(dirName); err == nil {
+			checkErr(&os.PathError{Op: "mkdir", Path: dirName, Err: os.ErrExist}, "DumpWriter")
+		}
+	}
+
+	// the data file: its size, line endings, and rows
+	compressed := strings.HasSuffix(棕熊.InputName(plan.datFileName), ".gz")
+	totBytes, err := 棕熊.TotalBytes(plan.datFileName)
+	checkErr(err, "totBytes")
+	totRows := -1
+	switch {
+	case compressed:
+	case ddi.Flavor == 棕熊.AGGREGATE:
+		totRows, err = 棕熊.CountCSVRecords(plan.datFileName)
+		checkErr(err, "parsing")
+	default:
+		totRows, err = 棕熊.DetectLineEndings(plan.datFileName, ddi)
+		checkErr(err, "line endings")
+	}
+
+	// the files, writers, and jobs
+	files, writers := 棕熊.PlanWriters(totBytes, plan.makeItDir, plan.split, plan.ordered)
+	jCFG, err := 棕熊.NewUserJobConfig(plan.userJobs, totBytes, writers)
+	checkUsageErr(err, "jobs")
+	checkUsageErr(jCFG.Validate(ddi, plan.split), "jobs")
+	bytesPerJob := jCFG.MaxBytesPerJob
+	if ddi.Flavor == 棕熊.AGGREGATE {
+		jCFG.NumParsers = 1
+	} else if totRows > 0 {
+		bytesPerJob = jCFG.BytesPerJob(棕熊.BytesPerRow(ddi), len(ddi.Vars), totRows, plan.split)
+	}
+
+	fmt.Printf("dry run (nothing written):\n")
+	dialect := plan.dbType
+	if dbfmtr.DbVersion != nil {
+		dialect += " " + dbfmtr.DbVersion.String()
+	}
+	fmt.Printf(" dialect:  %s (%s format, %s model)\n", dialect, plan.outFmt, plan.model)
+	fmt.Printf(" table:    %s\n", plan.tabName)
+	cols := dbfmtr.VariableNames(ddi)
+	fmt.Printf(" columns:  %d: %s\n", len(cols), strings.Join(cols, ", "))
+	if len(plan.idx) != 0 {
+		fmt.Printf(" indices:  %s\n", strings.Join(plan.idx, ", "))
+	} else {
+		fmt.Printf(" indices:  none\n")
+	}
+	switch {
+	case compressed:
+		fmt.Printf(" data:     %s (%s, gzip compressed; rows unknown until decompressed)\n", plan.datFileName, 棕熊.FormatSize(int64(totBytes)))
+	case len(plan.levelName) != 0:
+		fmt.Printf(" data:     %s (level %s: %d records, with their parents' keys, %s once copied out)\n", plan.srcFileName, plan.levelName, totRows, 棕熊.FormatSize(int64(totBytes)))
+	case plan.rectangle:
+		fmt.Printf(" data:     %s (%d records, joined with their households', %s once rectangularized)\n", plan.srcFileName, totRows, 棕熊.FormatSize(int64(totBytes)))
+	case len(plan.recType) != 0:
+		fmt.Printf(" data:     %s (%d records of type %s, %s once copied out)\n", plan.srcFileName, totRows, plan.recType, 棕熊.FormatSize(int64(totBytes)))
+	default:
+		fmt.Printf(" data:     %s (%s, %d rows)\n", 棕熊.DatName(plan.datFileName), 棕熊.FormatSize(int64(totBytes)), totRows)
+	}
+	if ddi.Hierarchical() {
+		types := make([]string, len(ddi.RecGroups))
+		for i, g := range ddi.RecGroups {
+			types[i] = fmt.Sprintf("%s: %s, %d chars", g.RecType, g.Label, ddi.RecordLength(g.RecType))
+		}
+		fmt.Printf(" records:  hierarchical (%s)\n", strings.Join(types, "; "))
+	}
+	switch {
+	case !plan.makeItDir:
+		fmt.Printf(" output:   %s (single file)\n", plan.outFile)
+	case len(plan.split.ShardBy) != 0:
+		fmt.Printf(" output:   %s (directory; one insertion file per value of %s)\n", plan.outFile, plan.split.ShardBy)
+	case plan.split.Rows > 0 && totRows >= 0:
+		fmt.Printf(" output:   %s (directory; %d insertion files of at most %d rows)\n", plan.outFile, max((totRows+plan.split.Rows-1)/plan.split.Rows, 1), plan.split.Rows)
+	case plan.split.IsSet():
+		fmt.Printf(" output:   %s (directory; %d insertion files up front, more as split limits are reached)\n", plan.outFile, files)
+	default:
+		fmt.Printf(" output:   %s (directory; %d insertion files)\n", plan.outFile, files)
+	}
+	fmt.Printf(" parsers:  %d\n writers:  %d\n", jCFG.NumParsers, writers)
+	if plan.staged {
+		fmt.Printf(" compress: %d workers\n", plan.compressWorkers)
+	}
+	switch {
+	case compressed:
+		fmt.Printf(" jobs:     sized once decompressed; %d results buffered\n", jCFG.ParsedResChanSize)
+	case ddi.Flavor == 棕熊.AGGREGATE:
+		fmt.Printf(" jobs:     blocks of records, read sequentially; %d results buffered\n", jCFG.ParsedResChanSize)
+	default:
+		fmt.Printf(" jobs:     at most %s each; %d results buffered\n", 棕熊.FormatSize(int64(bytesPerJob)), jCFG.ParsedResChanSize)
+	}
+	if len(table) != 0 {
+		fmt.Printf("\n%s", table)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// exit codes, so that wrapper scripts and schedulers can branch on the type of failure
+const (
+	exitOK          = 0   // success
+	exitFailure     = 1   // any other failure (e.g., a DDL statement that can't be generated)
+	exitUsage       = 2   // bad flags or arguments
+	exitDDI         = 3   // the data dictionary can't be parsed
+	exitData        = 4   // the data file can't be parsed (e.g., a malformed field or line)
+	exitIO          = 5   // a file can't be read, written, or created
+	exitInterrupted = 130 // interrupted (SIGINT or SIGTERM); 128 + SIGINT, by shell convention
+)
+
+// dataTopics are the checkErr topics of errors reading the data itself
+var dataTopics = map[string]bool{"line endings": true, "parsing": true, "decompress": true, "case counts": true, "rectype": true, "levels": true}
+
+// exitCode returns the exit code of an error checked under topic: I/O errors first (even those
+// encountered parsing), then data dictionary and data parsing errors, by type (or topic)
+func exitCode(err error, topic string) int {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var sysErr *os.SyscallError
+	var ddiErr *棕熊.DDIError
+	var parseErr *棕熊.ParseError
+	switch {
+	case errors.As(err, &pathErr), errors.As(err, &linkErr), errors.As(err, &sysErr):
+		return exitIO
+	case errors.As(err, &ddiErr):
+		return exitDDI
+	case errors.As(err, &parseErr), dataTopics[topic]:
+		return exitData
+	default:
+		return exitFailure
+	}
+}
+
+// exitOnInterrupt runs the exit cleanups (e.g., removing the dump's temporary files), and exits with
+// exitInterrupted, when the run is interrupted by SIGINT (e.g., Ctrl-C) or SIGTERM
+func exitOnInterrupt() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(os.Stderr, "\ninterrupted: %v\n", sig)
+		exitWithCleanups(exitInterrupted)
+	}()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// stringList collects the arguments of a repeatable flag (e.g., -where, -add-const)
+type stringList []string
+
+func (c *stringList) String() string { return strings.Join(*c, ", ") }
+
+func (c *stringList) Set(s string) error {
+	*c = append(*c, s)
+	return nil
+}
+
+// runExtract writes a subset of a fixed-width file (selected variables and/or filtered rows)
+// as a new fixed-width file, along with a data dictionary describing it.
+func runExtract(args []string) {
+	var (
+		ddiPath    string
+		outFile    string
+		keepVars   string
+		where      stringList
+		silentProg bool
+	)
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.StringVar(&outFile, "o", "ipums_extract.dat", "output file name")
+	fs.StringVar(&keepVars, "vars", "", "variables to keep (default all)")
+	fs.Var(&where, "where", "condition rows must meet (repeatable)")
+	fs.BoolVar(&silentProg, "s", false, "silence output")
+	fs.Usage = printExtractUsage
+	fs.Parse(args)
+	checkDDIFlag(ddiPath)
+
+	if fs.NArg() != 1 {
+		fmt.Printf("ipums2db extract: must provide exactly one fixed-width file\nsee extract --help for more\n")
+		os.Exit(exitUsage)
+	}
+	datPath := fs.Arg(0)
+
+	ddi, err := 棕熊.NewDataDictNoCats(ddiPath)
+	checkErr(err, "DataDict")
+	conds := make([]棕熊.RowCondition, len(where))
+	for i, cond := range where {
+		conds[i], err = 棕熊.ParseRowCondition(&ddi, cond)
+		checkUsageErr(err, "where")
+	}
+	res, err := 棕熊.WriteExtract(ddiPath, datPath, outFile, parseIndicesFlag(keepVars), conds)
+	checkErr(err, "extract")
+	if !silentProg {
+		fmt.Printf("extract written to %s (%d of %d rows, %d of %d variables)\nDDI written to %s\n",
+			outFile, res.RowsOut, res.RowsIn, res.VarsOut, len(ddi.Vars), res.DDIFile)
+	}
+}
+
+// extractUsage is the usage statement of ipums2db extract; its flag lines are also read by completion (see usageFlags)
+const extractUsage = `Usage: %s extract [options...] -x <xml> <dat>
+Writes a subset of a fixed-width file (selected variables and/or rows) as a
+new fixed-width file, along with a rewritten DDI describing it.
+Flags:
+ -x <xml>                     DDI XML path (mandatory)
+ -o <outFile>                 Output file (default 'ipums_extract.dat'); a
+                              '.gz' extension compresses it with gzip
+ -vars <var1[,var2]>          Variables to keep (default all)
+ -where <condition>           Condition rows must meet, of the form
+                              VAR<op>VALUE, with op one of =, !=, <, <=,
+                              >, >=; = and != take comma-separated values.
+                              Repeat to require several (default all rows)
+ -s                           Silent output (default false)
+
+The DDI is written next to <outFile>, with a '.xml' extension
+(e.g., usa_small.dat -> usa_small.xml).
+
+Example:
+ %s extract -vars year,statefip,age,incwage -where statefip=6,36 \
+    -where "age>=18" -o usa_small.dat -x usa_00012.xml usa_00012.dat.gz
+`
+
+// printExtractUsage prints usage of ipums2db extract
+func printExtractUsage() {
+	fmt.Printf(extractUsage, os.Args[0], os.Args[0])
+}
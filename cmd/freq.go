@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runFreq prints the value counts of selected variables of a fixed-width file, joined with
+// their category labels, as a sanity check of an extract before it's loaded.
+func runFreq(args []string) {
+	var (
+		ddiPath  string
+		freqVars string
+		nulls    string
+	)
+	fs := flag.NewFlagSet("freq", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.StringVar(&freqVars, "vars", "", "variables to count (MANDATORY)")
+	fs.StringVar(&nulls, "nulls", "", "blank field policy, as of the conversion")
+	fs.Usage = printFreqUsage
+	datPaths := parseInterspersed(fs, args) // e.g., freq -x usa.xml usa.dat -vars sex
+	checkDDIFlag(ddiPath)
+
+	if len(datPaths) != 1 {
+		fmt.Printf("ipums2db freq: must provide exactly one fixed-width file\nsee freq --help for more\n")
+		os.Exit(exitUsage)
+	}
+	if len(strings.TrimSpace(freqVars)) == 0 {
+		fmt.Printf("ipums2db freq: must provide variables to count (-vars)\nsee freq --help for more\n")
+		os.Exit(exitUsage)
+	}
+	nullPolicy, err := 棕熊.ParseNullsFlag(nulls)
+	checkUsageErr(err, "nulls")
+	datPath := datPaths[0]
+
+	ddi, err := 棕熊.NewDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	if strings.HasSuffix(datPath, ".gz") {
+		tmpDat, err := 棕熊.DecompressDat(datPath)
+		checkErr(err, "decompress")
+		removeOnExit(tmpDat)
+		defer os.Remove(tmpDat)
+		datPath = tmpDat
+	}
+	tables, err := 棕熊.Frequencies(datPath, &ddi, parseIndicesFlag(freqVars), nullPolicy)
+	checkErr(err, "freq")
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Println()
+		}
+		printFreqTable(t)
+	}
+}
+
+// printFreqTable prints the frequency table of a variable: a line per value, with its count, share of
+// the rows, and category label
+func printFreqTable(t 棕熊.FreqTable) {
+	fmt.Printf("%s: %s (%d rows, %d values)\n", t.Var.Name, t.Var.Label, t.Rows, len(t.Counts))
+	vals := make([]string, len(t.Counts))
+	width := len("value")
+	for i, c := range t.Counts {
+		vals[i] = c.Value
+		if len(vals[i]) == 0 {
+			vals[i] = "(blank)"
+		}
+		width = max(width, len(vals[i]))
+	}
+	fmt.Printf("  %-*s %12s %8s  %s\n", width, "value", "count", "share", "label")
+	for i, c := range t.Counts {
+		share := 0.0
+		if t.Rows > 0 {
+			share = 100 * float64(c.Count) / float64(t.Rows)
+		}
+		fmt.Printf("  %-*s %12d %7.2f%%  %s\n", width, vals[i], c.Count, share, c.Label)
+	}
+}
+
+// freqUsage is the usage statement of ipums2db freq; its flag lines are also read by completion (see usageFlags)
+const freqUsage = `Usage: %s freq [options...] -x <xml> -vars <var1[,var2]> <dat>
+Scans a fixed-width file, in parallel, and prints the count of rows holding
+each value of the variables, joined with their category labels; a quick
+sanity check of an extract before loading anything.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+ -vars <var1[,var2]>          Variables to count (mandatory)
+ -nulls <p|key=p[,..]>        Blank field policy, as of the conversion
+                              (default 'any')
+
+Numeric values are printed with implied decimals applied, and leading zeros
+trimmed. Fields the conversion would load as null are counted as blank.
+<dat> may be gzip compressed (e.g., usa_00012.dat.gz).
+
+Example:
+ %s freq -x usa_00012.xml usa_00012.dat -vars sex,race,statefip
+`
+
+// printFreqUsage prints usage of ipums2db freq
+func printFreqUsage() {
+	fmt.Printf(freqUsage, os.Args[0], os.Args[0])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runHead prints the first rows of a fixed-width file, decoded, so that the offsets and implied
+// decimals of the data dictionary can be checked by eye.
+func runHead(args []string) {
+	var (
+		ddiPath  string
+		nRows    int
+		headVars string
+		labels   bool
+		headFmt  string
+		nulls    string
+	)
+	fs := flag.NewFlagSet("head", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.IntVar(&nRows, "n", 10, "number of rows")
+	fs.StringVar(&headVars, "vars", "", "variables to print (default all)")
+	fs.BoolVar(&labels, "labels", false, "print category labels in place of codes")
+	fs.StringVar(&headFmt, "format", 棕熊.HEAD_TABLE, "output format")
+	fs.StringVar(&nulls, "nulls", "", "blank field policy, as of the conversion")
+	fs.Usage = printHeadUsage
+	datPaths := parseInterspersed(fs, args) // e.g., head -x usa.xml usa.dat -n 20
+	checkDDIFlag(ddiPath)
+
+	if len(datPaths) != 1 {
+		fmt.Printf("ipums2db head: must provide exactly one fixed-width file\nsee head --help for more\n")
+		os.Exit(exitUsage)
+	}
+	if nRows < 0 {
+		checkUsageErr(fmt.Errorf("-n (%d) cannot be negative", nRows), "n")
+	}
+	if !slices.Contains(棕熊.HeadFormats, headFmt) {
+		checkUsageErr(fmt.Errorf("'%s' not in {'%s'}", headFmt, strings.Join(棕熊.HeadFormats, "', '")), "format")
+	}
+
+	nullPolicy, err := 棕熊.ParseNullsFlag(nulls)
+	checkUsageErr(err, "nulls")
+
+	// categories are only needed to print labels
+	newDataDict := 棕熊.NewDataDictNoCats
+	if labels {
+		newDataDict = 棕熊.NewDataDict
+	}
+	ddi, err := newDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	head, err := 棕熊.ReadHead(datPaths[0], &ddi, parseIndicesFlag(headVars), nRows, labels, nullPolicy)
+	checkErr(err, "head")
+	checkErr(head.Write(os.Stdout, headFmt), "head")
+}
+
+// headUsage is the usage statement of ipums2db head; its flag lines are also read by completion (see usageFlags)
+const headUsage = `Usage: %s head [options...] -x <xml> <dat>
+Prints the first rows of a fixed-width file, decoded as they'd be loaded
+under the blank field policy (-nulls), then trimmed, with implied decimals
+applied, to check that the data dictionary's offsets and decimals are
+interpreted correctly.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+ -n <rows>                    Number of rows (default 10)
+ -vars <var1[,var2]>          Variables to print (default all)
+ -labels                      Print category labels in place of codes
+                              (default false)
+ -format <fmt>                Output format: 'table' (aligned columns),
+                              'csv', or 'json' (default 'table')
+ -nulls <p|key=p[,..]>        Blank field policy, as of the conversion
+                              (default 'any'); null fields are blank
+
+Only the first rows are read; <dat> may be gzip compressed.
+
+Example:
+ %s head -n 20 -vars year,age,incwage -x usa_00012.xml usa_00012.dat
+`
+
+// printHeadUsage prints usage of ipums2db head
+func printHeadUsage() {
+	fmt.Printf(headUsage, os.Args[0], os.Args[0])
+}
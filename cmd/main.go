@@ -1,9 +1,14 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -11,134 +16,1062 @@ import (
 	棕熊 "github.com/rhawrami/ipums2db/internal"
 )
 
+// version is the ipums2db version; set at build time by goreleaser (-X main.version=...)
+var version = "dev"
+
+// subcommands maps the name of each ipums2db subcommand to the function that runs it.
+// Running ipums2db without a subcommand performs a conversion.
+var subcommands = map[string]func(args []string){
+	"watch":      runWatch,
+	"dict":       runDict,
+	"extract":    runExtract,
+	"completion": runCompletion,
+	"tui":        runTui,
+	"diff":       runDiff,
+	"freq":       runFreq,
+	"stats":      runSummaryStats,
+	"head":       runHead,
+	"describe":   runDescribe,
+}
+
 func main() {
+	// subcommands ----------------------------------------
+	if len(os.Args) > 1 {
+		if runSub, ok := subcommands[os.Args[1]]; ok {
+			runSub(os.Args[2:])
+			return
+		}
+	}
+
+	// `ipums2db convert [options...] <dir | files...>` converts the one extract found among its arguments
+	// (see PairExtract), taking the same options
+	convertCmd := len(os.Args) > 1 && os.Args[1] == "convert"
+
 	// flags ----------------------------------------
 	var (
 		dbType     string
+		dbVersionF string
 		ddiPath    string
 		tabName    string
 		indices    string
 		outFile    string
+		emit       string
+		rename     string
+		typesFile  string
+		decimals   string
+		notNull    bool
+		rngChecks  bool
+		preFile    string
+		postFile   string
+		resSuffix  string
+		idCase     string
+		sqlStyleF  string
+		compact    bool
+		collate    string
+		refSchema  string
+		useSchema  string
+		grant      string
+		owner      string
+		refPrefix  string
+		refSuffix  string
+		nulls      string
+		splitSize  string
+		archive    string
+		outFmtF    string
+		hashVars   string
+		recodeFile string
+		derive     string
+		addConsts  stringList
+		dateCols   stringList
+		rowID      string
+		hhKeys     bool
+		repwts     string
+		repwtFmt   string
+		model      string
+		melts      stringList
+		qflags     string
+		qflagVars  string
+		splitGrps  string
+		salt       string
+		splitRows  int
+		shardBy    string
+		ordered    bool
+		strictCnt  bool
+		recType    string
+		rectangle  bool
+		byLevel    bool
+		compressW  int
+		nParsersF  int
+		jobSize    string
+		resBuffer  int
+		cpuProf    string
+		memProf    string
+		traceFile  string
+		statsFile  string
+		estimate   bool
+		dryRun     bool
 		makeItDir  bool
 		silentProg bool
+		quietProg  bool
+		verbose    bool
+		withMeta   bool
+		withDocs   bool
+		noRefTabs  bool
+		refUpsert  bool
+		truncate   bool
+		natKey     string
+		uniqueF    string
+		idxNames   string
+		conNames   string
+		appendTo   string
 	)
 	flag.StringVar(&dbType, "b", "postgres", "database type")
+	flag.StringVar(&dbVersionF, "db-version", "", "database release targeted, e.g. postgres:12 (default none)")
 	flag.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
 	flag.StringVar(&tabName, "t", "ipums_tab", "main table name")
 	flag.StringVar(&indices, "i", "", "indices to create; comma-delim for multiple")
 	flag.BoolVar(&makeItDir, "d", false, "make directory output format")
 	flag.StringVar(&outFile, "o", "ipums_dump.sql", "output file/dir name")
+	flag.StringVar(&outFmtF, "fmt", "sql", "output format: sql, avro, dta, or pgcopy")
+	flag.IntVar(&splitRows, "split-rows", 0, "max rows per insertion file (directory format)")
+	flag.StringVar(&splitSize, "split-size", "", "max SQL size per insertion file, e.g. 2G (directory format)")
+	flag.StringVar(&shardBy, "shard-by", "", "variable whose values shard the insertion files (directory format)")
+	flag.BoolVar(&ordered, "ordered", false, "write rows in file order, reproducibly from run to run")
+	flag.StringVar(&recType, "rectype", "", "record type of a hierarchical extract to convert, alone (e.g., P)")
+	flag.BoolVar(&rectangle, "rectangularize", false, "join household variables onto each person record of a hierarchical extract")
+	flag.BoolVar(&byLevel, "levels", false, "convert each level of a multi-level hierarchical extract into a table of its own")
+	flag.BoolVar(&strictCnt, "strict-counts", false, "fail, rather than warn, if rows don't match the DDI's case counts")
+	flag.IntVar(&compressW, "compress-workers", 0, "workers compressing insertion files (default one per CPU)")
+	flag.IntVar(&nParsersF, "parsers", 0, "number of concurrent parsers (default decided by CPU count)")
+	flag.StringVar(&jobSize, "job-size", "", "max fixed-width bytes per parsing job, e.g. 16M (default adapted to the rows)")
+	flag.IntVar(&resBuffer, "result-buffer", 0, "parsed results buffered between parsers and writers (default the number of parsers)")
+	flag.StringVar(&cpuProf, "cpuprofile", "", "write a CPU profile of the run to file")
+	flag.StringVar(&memProf, "memprofile", "", "write a heap profile at the end of the run to file")
+	flag.StringVar(&traceFile, "trace", "", "write an execution trace of the run to file")
+	flag.StringVar(&statsFile, "stats", "", "write a JSON report of the run's metrics to file")
+	flag.BoolVar(&dryRun, "dry-run", false, "check the inputs, print the resolved configuration, and exit, writing nothing")
+	flag.BoolVar(&estimate, "estimate", false, "estimate the dump's size, files, and duration from a sample of rows, writing nothing")
+	flag.StringVar(&archive, "archive", "", "pack the dump into a .tar, .tar.gz, .tar.zst, or .zip archive with a manifest")
 	flag.BoolVar(&silentProg, "s", false, "silence output")
+	flag.BoolVar(&quietProg, "q", false, "print only errors and the final line")
+	flag.BoolVar(&verbose, "v", false, "log each parsing job")
+	flag.StringVar(&rename, "rename", "", "columns to rename (old=new, comma-delim), or a mapping file")
+	flag.StringVar(&resSuffix, "rename-reserved", "", "suffix for columns named after reserved words (e.g., _v)")
+	flag.StringVar(&idCase, "case", "lower", "identifier casing: lower, upper, or preserve")
+	flag.StringVar(&sqlStyleF, "sql-style", "", "SQL style: keywords=upper|lower, indent=tab|<n>, labels=on|off")
+	flag.BoolVar(&compact, "compact", false, "write each insert on a single line, without comments or indentation")
+	flag.StringVar(&collate, "collate", "", "collations of character columns: a default, var=collation, or labels=collation")
+	flag.BoolVar(&noRefTabs, "no-ref-tables", false, "skip ref table creation")
+	flag.StringVar(&natKey, "natural-key", "", "variables uniquely identifying a row; inserts skip rows already loaded")
+	flag.StringVar(&uniqueF, "unique", "", "unique constraints to create (var1+var2, comma-delim for multiple)")
+	flag.StringVar(&idxNames, "index-name-template", "", "index name template, of {table} and {cols} (default idx_{cols})")
+	flag.StringVar(&conNames, "constraint-name-template", "", "unique constraint name template, of {table} and {cols}")
+	flag.StringVar(&appendTo, "append", "", "schema file of the tables to append to; only inserts are written")
+	flag.BoolVar(&truncate, "truncate", false, "empty the tables (and upserted ref tables) ahead of the inserts")
+	flag.BoolVar(&refUpsert, "ref-upsert", false, "create ref tables if not exists, inserting only missing labels")
+	flag.StringVar(&refSchema, "ref-schema", "", "schema to create ref tables in")
+	flag.StringVar(&refPrefix, "ref-prefix", "ref_", "ref table name prefix")
+	flag.StringVar(&refSuffix, "ref-suffix", "", "ref table name suffix")
+	flag.StringVar(&nulls, "nulls", "", "blank field policy: any, blank, trim, or strict; per type/var as key=policy")
+	flag.StringVar(&typesFile, "types", "", "JSON/YAML file overriding column types")
+	flag.StringVar(&decimals, "decimals", "numeric", "storage of decimal variables (numeric, double, real, scaled)")
+	flag.BoolVar(&notNull, "not-null", false, "make columns of variables applying to every record, without missing codes, NOT NULL")
+	flag.BoolVar(&rngChecks, "range-checks", false, "add CHECK constraints of valid ranges (or top codes) of numeric variables")
+	flag.StringVar(&emit, "emit", "", "artifacts to generate alongside the dump; comma-delim for multiple")
+	flag.BoolVar(&withMeta, "meta", false, "record provenance in an ipums2db_meta table")
+	flag.BoolVar(&withDocs, "docs", false, "create citation, sample, and universe tables from the DDI")
+	flag.StringVar(&owner, "owner", "", "role to hand created objects over to")
+	flag.StringVar(&grant, "grant", "", "privileges to grant on created objects, privilege:role (comma-delim)")
+	flag.StringVar(&useSchema, "use", "", "schema (database, in mysql and mssql) set at the top of every file")
+	flag.StringVar(&preFile, "pre", "", "SQL file inserted at the top of the DDL")
+	flag.StringVar(&postFile, "post", "", "SQL file inserted at the end of the dump")
+	flag.StringVar(&hashVars, "hash-vars", "", "identifier variables to replace with salted hashes; comma-delim for multiple")
+	flag.StringVar(&salt, "salt", "", "salt of hashed variables (default $IPUMS2DB_SALT)")
+	flag.StringVar(&recodeFile, "recode", "", "JSON/YAML file of value recoding rules")
+	flag.StringVar(&derive, "derive", "", "derived columns (name=expr, semicolon-delim), or a definitions file")
+	flag.Var(&addConsts, "add-const", "constant column, name=value (repeatable)")
+	flag.Var(&dateCols, "date", "date column, name[=YEAR,MONTH[,DAY]] (repeatable)")
+	flag.StringVar(&rowID, "row-id", "", "name of a surrogate row id column (default none)")
+	flag.BoolVar(&hhKeys, "hh-keys", false, "create household-person keys, and a households view")
+	flag.StringVar(&repwts, "repwts", "", "name prefixes of replicate weights to group apart; comma-delim for multiple")
+	flag.StringVar(&repwtFmt, "repwt-fmt", "long", "format of grouped replicate weights (long, array)")
+	flag.StringVar(&model, "model", "flat", "table model (flat, star)")
+	flag.Var(&melts, "melt", "group of variables to melt into a long table, name=VAR1,VAR2 (repeatable)")
+	flag.StringVar(&qflags, "qflags", "", "data quality flags to set apart (side, drop)")
+	flag.StringVar(&qflagVars, "qflag-vars", "", "name patterns of data quality flags; comma-delim for multiple")
+	flag.StringVar(&splitGrps, "split-groups", "", "variable groups to split into tables of their own (ids or labels, or all); comma-delim for multiple")
 	// usage
 	flag.Usage = printUsage
 	// parse flags
-	flag.Parse()
+	var convertArgs []string
+	if convertCmd {
+		flag.CommandLine.Parse(os.Args[2:])
+		if len(ddiPath) != 0 {
+			checkUsageErr(fmt.Errorf("the DDI is found among the extract's files; drop -x"), "convert")
+		}
+		pair, err := 棕熊.PairExtract(flag.Args())
+		checkUsageErr(err, "convert")
+		ddiPath, convertArgs = pair.DDIPath, []string{pair.DatPath}
+	} else {
+		flag.Parse()
+	}
 	// check if DDI path isn't empty
 	checkDDIFlag(ddiPath)
+	// output level
+	level, err := parseOutputFlags(silentProg, quietProg, verbose)
+	checkUsageErr(err, "output")
+	silentErrors = level == levelSilent
 	// get indices
-	idx := parseIndicesFlag(indices)
+	idx, err := 棕熊.ParseIndexFlag(indices)
+	checkUsageErr(err, "i")
+	// get column renames
+	renames, err := 棕熊.ParseRenameFlag(rename)
+	checkUsageErr(err, "rename")
+	// get identifier casing policy
+	caseP, err := 棕熊.ParseCaseFlag(idCase)
+	checkUsageErr(err, "case")
+	sqlStyle, err := 棕熊.ParseSQLStyleFlag(sqlStyleF)
+	checkUsageErr(err, "sql-style")
+	// get collations of character columns
+	collations, err := 棕熊.ParseCollateFlag(collate)
+	checkUsageErr(err, "collate")
+	// get null policy
+	nullPolicy, err := 棕熊.ParseNullsFlag(nulls)
+	checkUsageErr(err, "nulls")
+	// get insertion file split limits
+	split, err := parseSplitFlags(splitRows, splitSize, shardBy, makeItDir)
+	checkUsageErr(err, "split")
+	// get parsing job settings; unset (zero) settings are decided by heuristics
+	jobBytes, err := 棕熊.ParseSizeFlag(jobSize)
+	checkUsageErr(err, "job-size")
+	userJobs := 棕熊.JobConfig{NumParsers: nParsersF, MaxBytesPerJob: jobBytes, ParsedResChanSize: resBuffer}
+	// get archive format
+	archiveFmt, err := 棕熊.ParseArchiveFlag(archive)
+	checkUsageErr(err, "archive")
+	if len(archiveFmt) != 0 && 棕熊.IsObjectURL(outFile) {
+		checkUsageErr(fmt.Errorf("cannot archive a dump written to object storage"), "archive")
+	}
+	// get output format
+	outFmt, err := 棕熊.ParseFormatFlag(outFmtF)
+	checkUsageErr(err, "fmt")
+	// Avro and Stata output hold the rows alone, without SQL
+	fmtName := formatName(outFmt)
+	if len(fmtName) != 0 && len(idx) != 0 {
+		checkUsageErr(fmt.Errorf("indices don't apply to %s output", fmtName), "fmt")
+	}
+	if len(fmtName) != 0 && len(useSchema) != 0 {
+		checkUsageErr(fmt.Errorf("-use doesn't apply to %s output", fmtName), "fmt")
+	}
+	if outFmt == 棕熊.FORMAT_DTA && makeItDir {
+		checkUsageErr(fmt.Errorf("Stata output is a single .dta file; -d doesn't apply"), "fmt")
+	}
+	if outFmt == 棕熊.FORMAT_PGCOPY && !strings.EqualFold(dbType, 棕熊.POSTGRES) {
+		checkUsageErr(fmt.Errorf("binary COPY files are loaded by postgres; use -b postgres"), "fmt")
+	}
+	// get the database release targeted
+	dbVersion, err := 棕熊.ParseDbVersionFlag(dbVersionF, dbType)
+	checkUsageErr(err, "db-version")
+	// get privileges to grant
+	grants, err := 棕熊.ParseGrantFlag(grant)
+	checkUsageErr(err, "grant")
+	if len(fmtName) != 0 && len(grants) != 0 {
+		checkUsageErr(fmt.Errorf("-grant doesn't apply to %s output", fmtName), "fmt")
+	}
+	if len(fmtName) != 0 && len(owner) != 0 {
+		checkUsageErr(fmt.Errorf("-owner doesn't apply to %s output", fmtName), "fmt")
+	}
+	if len(fmtName) != 0 && truncate {
+		checkUsageErr(fmt.Errorf("-truncate doesn't apply to %s output", fmtName), "fmt")
+	}
+	// get unique keys
+	uniqueKeys, err := 棕熊.ParseUniqueFlag(uniqueF)
+	checkUsageErr(err, "unique")
+	if len(fmtName) != 0 && len(uniqueKeys) != 0 {
+		checkUsageErr(fmt.Errorf("-unique doesn't apply to %s output", fmtName), "fmt")
+	}
+	// get index and constraint name templates
+	idxNames, err = 棕熊.ParseNameTemplate(idxNames)
+	checkUsageErr(err, "index-name-template")
+	conNames, err = 棕熊.ParseNameTemplate(conNames)
+	checkUsageErr(err, "constraint-name-template")
+	// get type overrides
+	var overrides *棕熊.TypeOverrides
+	if len(typesFile) != 0 {
+		overrides, err = 棕熊.LoadTypeOverrides(typesFile)
+		checkUsageErr(err, "types")
+	}
+	// get storage of decimal variables
+	decimals, err = 棕熊.ParseDecimalsFlag(decimals)
+	checkUsageErr(err, "decimals")
+	// get prologue and epilogue SQL
+	prologue, epilogue, err := readPrePostFlags(preFile, postFile, outFmt)
+	checkUsageErr(err, "pre/post")
+	// get artifacts to emit
+	emitKinds, err := 棕熊.ParseEmitFlag(emit, dbType)
+	checkUsageErr(err, "emit")
+	// get identifier variables to hash; the salt is best kept out of shell history, in the environment
+	if len(salt) == 0 {
+		salt = os.Getenv("IPUMS2DB_SALT")
+	}
+	hasher, err := 棕熊.NewHasher(hashVars, salt)
+	checkUsageErr(err, "hash-vars")
+	if hasher != nil {
+		checkUsageErr(棕熊.CheckRawDataEmit(emitKinds, "hashing"), "emit")
+	}
+	// get value recoding rules
+	var recodes *棕熊.Recodes
+	if len(recodeFile) != 0 {
+		recodes, err = 棕熊.LoadRecodes(recodeFile)
+		checkUsageErr(err, "recode")
+		checkUsageErr(棕熊.CheckRawDataEmit(emitKinds, "recoding"), "emit")
+	}
+	// get derived columns
+	derived, err := 棕熊.ParseDeriveFlag(derive)
+	checkUsageErr(err, "derive")
+
+	// get replicate weight groups
+	repWeights, err := 棕熊.NewRepWeights(repwts, repwtFmt)
+	checkUsageErr(err, "repwts")
+
+	// get constant columns
+	consts, err := 棕熊.ParseConstFlag(addConsts)
+	checkUsageErr(err, "add-const")
+
+	// get date columns
+	dates, err := 棕熊.ParseDateFlag(dateCols)
+	checkUsageErr(err, "date")
+
+	// get melted variable groups
+	meltGroups, err := 棕熊.ParseMeltFlag(melts)
+	checkUsageErr(err, "melt")
+
+	// get data quality flag handling
+	qflagSet, err := 棕熊.NewQFlags(qflags, qflagVars)
+	checkUsageErr(err, "qflags")
+
+	// get variable groups to split
+	varGroups, err := 棕熊.NewVarGroups(splitGrps)
+	checkUsageErr(err, "split-groups")
+
+	// get table model
+	model, err = 棕熊.ParseModelFlag(model)
+	checkUsageErr(err, "model")
+	if model == 棕熊.MODEL_STAR {
+		checkUsageErr(棕熊.CheckRawDataEmit(emitKinds, "surrogate keys"), "emit")
+	}
+
+	// get the fingerprint of the tables appended to, if any
+	var appendFP string
+	if len(appendTo) != 0 {
+		if len(fmtName) != 0 {
+			checkUsageErr(fmt.Errorf("-append doesn't apply to %s output", fmtName), "append")
+		}
+		if model == 棕熊.MODEL_STAR {
+			checkUsageErr(fmt.Errorf("surrogate keys are assigned by each extract's categories, so star model tables can't be appended to"), "append")
+		}
+		appendFP, err = 棕熊.ReadFingerprint(appendTo)
+		checkUsageErr(err, "append")
+	}
 	// args
 	cmdArgs := flag.Args()
-	// ensure at most one argument is provided
-	checkOneArg(cmdArgs, silentProg)
+	if convertCmd {
+		cmdArgs = convertArgs
+	}
+	// ensure that several arguments are the parts of a data file
+	checkDatArgs(cmdArgs, level == levelQuiet)
+
+	// on interrupt, clean up (e.g., the dump's temporary files) before exiting
+	exitOnInterrupt()
+
+	// profile the run, if requested; profiles are written even if the run fails
+	stopProfiling, err := startProfiling(cpuProf, memProf, traceFile)
+	checkUsageErr(err, "profile")
+	cleanupOnExit(stopProfiling)
+	defer stopProfiling()
+
+	// files at HTTP(S) URLs that are read through whole are downloaded to a temporary file first (see
+	// FetchURL); once, if passed as both the DDI and data file (e.g., an extract's .zip)
+	fetched := make(map[string]string)
+	local := func(name string) string {
+		if tmp, ok := fetched[name]; ok || !棕熊.IsHTTPURL(name) {
+			return cmp.Or(tmp, name)
+		}
+		tmp, err := 棕熊.FetchURL(name)
+		checkErr(err, "fetch")
+		removeOnExit(tmp)
+		fetched[name] = tmp
+		return tmp
+	}
+	defer func() {
+		for _, tmp := range fetched {
+			os.Remove(tmp)
+		}
+	}()
+
+	// zip archives (e.g., extracts as downloaded, holding the .dat and DDI) are unpacked first: the DDI and
+	// data file are copied out of them to temporary files, located by extension (see UnzipMember); provenance
+	// still names the archives
+	srcDDIPath := ddiPath
+	if 棕熊.IsZipPath(ddiPath) {
+		tmpDDI, member, err := 棕熊.UnzipMember(local(ddiPath), 棕熊.ZIP_DDI, "")
+		checkErr(err, "unzip")
+		removeOnExit(tmpDDI)
+		defer os.Remove(tmpDDI)
+		ddiPath, srcDDIPath = tmpDDI, srcDDIPath+":"+member
+	}
+	var datFromZip string
+	if len(cmdArgs) != 0 && 棕熊.IsZipPath(cmdArgs[0]) {
+		tmpDat, _, err := 棕熊.UnzipMember(local(cmdArgs[0]), 棕熊.ZIP_DAT, 棕熊.ZipStem(srcDDIPath))
+		checkErr(err, "unzip")
+		removeOnExit(tmpDat)
+		defer os.Remove(tmpDat)
+		datFromZip = tmpDat
+	}
+
+	if estimate && len(cmdArgs) == 0 {
+		checkUsageErr(fmt.Errorf("estimates are of a data file's conversion; provide one"), "estimate")
+	}
+	if dryRun && len(cmdArgs) == 0 {
+		checkUsageErr(fmt.Errorf("dry runs plan a data file's conversion; provide one"), "dry-run")
+	}
+	if len(appendTo) != 0 && len(cmdArgs) == 0 {
+		checkUsageErr(fmt.Errorf("appending writes a data file's inserts; provide one"), "append")
+	}
+	if byLevel && (len(recType) != 0 || rectangle) {
+		checkUsageErr(fmt.Errorf("levels are each converted whole; -rectype and -rectangularize convert a single one"), "levels")
+	}
+	if byLevel && (len(archive) != 0 || len(appendTo) != 0) {
+		checkUsageErr(fmt.Errorf("levels are converted into a dump each; they can't be archived, or appended, as one"), "levels")
+	}
+
+	// lock the output (and archive), so that a simultaneous run writing to it fails fast; estimates write nothing
+	lockTarget := outFile
+	if len(cmdArgs) == 0 {
+		lockTarget = 棕熊.DDLFileName(outFile)
+	}
+	for _, target := range []string{lockTarget, archive} {
+		if len(target) == 0 || estimate || dryRun {
+			continue
+		}
+		unlock, err := 棕熊.LockOutput(target)
+		checkErr(err, "lock")
+		cleanupOnExit(unlock)
+		defer unlock()
+	}
 
 	// in case of schema only, we can just generate the DDL, then exit
 	if len(cmdArgs) == 0 {
-		err := 棕熊.MkDDL(dbType, tabName, ddiPath, outFile, idx, silentProg)
+		dbfmtr, err := 棕熊.NewDBFormatter(dbType, tabName, true, overrides)
+		checkErr(err, "DBFormatter")
+		dbfmtr.DbVersion = dbVersion
+		if withMeta {
+			dbfmtr.Meta = newConversionMeta(tabName, srcDDIPath, "", -1)
+		}
+		dbfmtr.DocTables = withDocs
+		dbfmtr.Renames = renames
+		dbfmtr.ReservedSuffix = resSuffix
+		dbfmtr.Case = caseP
+		dbfmtr.Style, dbfmtr.Compact = sqlStyle, compact
+		dbfmtr.Collations = collations
+		dbfmtr.RefSchema, dbfmtr.RefPrefix, dbfmtr.RefSuffix = refSchema, refPrefix, refSuffix
+		dbfmtr.NoRefTables, dbfmtr.RefUpsert = noRefTabs, refUpsert
+		dbfmtr.Truncate = truncate
+		dbfmtr.NaturalKey = parseIndicesFlag(natKey)
+		dbfmtr.UniqueKeys = uniqueKeys
+		dbfmtr.IndexNames, dbfmtr.ConstraintNames = idxNames, conNames
+		dbfmtr.Nulls = nullPolicy
+		dbfmtr.Format = outFmt
+		dbfmtr.Hash = hasher
+		dbfmtr.Recodes = recodes
+		dbfmtr.Derived = derived
+		dbfmtr.Consts = consts
+		dbfmtr.Dates = dates
+		dbfmtr.RowID = rowID
+		dbfmtr.HouseholdKeys = hhKeys
+		dbfmtr.RepWeights = repWeights
+		dbfmtr.Melts = meltGroups
+		dbfmtr.QFlags = qflagSet
+		dbfmtr.VarGroups = varGroups
+		dbfmtr.Model = model
+		dbfmtr.Decimals, dbfmtr.NotNull, dbfmtr.RangeChecks = decimals, notNull, rngChecks
+		dbfmtr.UseSchema = useSchema
+		dbfmtr.Grants, dbfmtr.Owner = grants, owner
+		dbfmtr.Prologue, dbfmtr.Epilogue = prologue, epilogue
+		ddi, err := 棕熊.NewDataDict(ddiPath)
+		checkErr(err, "DataDict")
+		ddi, err = recordsDict(&ddi, recType, rectangle)
+		checkUsageErr(err, "rectype")
+		if byLevel {
+			// a DDL file per level (see -levels below)
+			recLevels, err := ddi.Levels()
+			checkUsageErr(err, "levels")
+			dbfmtr.RefUpsert = true
+			for _, lvl := range recLevels {
+				dbfmtr.TableName = tabName + "_" + lvl.Name
+				switch outFmt {
+				case 棕熊.FORMAT_AVRO:
+					err = 棕熊.MkAvroSchema(dbfmtr, &lvl.Dict, levelOutput(outFile, lvl.Name), level < levelQuiet)
+				case 棕熊.FORMAT_DTA:
+					err = 棕熊.MkDtaSchema(dbfmtr, &lvl.Dict, levelOutput(棕熊.DtaFileName(outFile), lvl.Name), level < levelQuiet)
+				default:
+					err = 棕熊.MkDDL(dbfmtr, &lvl.Dict, levelOutput(棕熊.DDLFileName(outFile), lvl.Name), idx, level < levelQuiet)
+				}
+				checkErr(err, "DDLWriter")
+			}
+			exitWithCleanups(exitOK) // stops profiling, and releases the output lock
+		}
+		checkUsageErr(棕熊.CheckEmitLayout(emitKinds, &ddi), "emit")
+		switch outFmt {
+		case 棕熊.FORMAT_AVRO:
+			err = 棕熊.MkAvroSchema(dbfmtr, &ddi, outFile, level < levelQuiet)
+		case 棕熊.FORMAT_DTA:
+			err = 棕熊.MkDtaSchema(dbfmtr, &ddi, outFile, level < levelQuiet)
+		default:
+			err = 棕熊.MkDDL(dbfmtr, &ddi, outFile, idx, level < levelQuiet)
+		}
 		checkErr(err, "DDLWriter")
-		os.Exit(0)
+		if len(emitKinds) != 0 {
+			written, err := 棕熊.WriteEmitted(emitKinds, &ddi, dbfmtr, "", 棕熊.DDLFileName(outFile), false)
+			checkErr(err, "emit")
+			printEmitted(level < levelNormal, written)
+		}
+		exitWithCleanups(exitOK) // stops profiling, and releases the output lock
 	}
 
 	datFileName := cmdArgs[0]
+	if len(datFromZip) != 0 {
+		datFileName = datFromZip
+	}
+	// the data file as provided, for printing and provenance: each part, if multi-part
+	srcDatName := strings.Join(cmdArgs, ", ")
 
-	start := time.Now() // start time here; prior to file creations
-
-	// setup ----------------------------------------
-	// get totalBytes in the datFile
-	totBytes, err := 棕熊.TotalBytes(datFileName)
-	checkErr(err, "totBytes")
+	// snowflake dumps stage the data as CSV files, loaded by the DDL file's PUT and COPY INTO statements
+	staged := strings.EqualFold(dbType, 棕熊.SNOWFLAKE) && outFmt == 棕熊.FORMAT_SQL
+	if staged && (!makeItDir || 棕熊.IsObjectURL(outFile)) {
+		checkUsageErr(fmt.Errorf("snowflake dumps are a local directory of CSV files; use -d, with a local -o"), "snowflake")
+	}
+	// binary COPY dumps hold the data as binary COPY files, loaded by the dump's load.sh
+	if outFmt == 棕熊.FORMAT_PGCOPY && (!makeItDir || 棕熊.IsObjectURL(outFile)) {
+		checkUsageErr(fmt.Errorf("binary COPY dumps are a local directory of data files; use -d, with a local -o"), "fmt")
+	}
+	// only staged CSV files are compressed, by a pool of workers
+	compressWorkers, err := 棕熊.NumCompressWorkers(compressW)
+	checkUsageErr(err, "compress-workers")
+	if compressW != 0 && !staged {
+		checkUsageErr(fmt.Errorf("-compress-workers applies to compressed (snowflake) dumps only"), "compress-workers")
+	}
 
-	// gen new DatabaseFormatter
-	dbfmtr, err := 棕熊.NewDBFormatter(dbType, tabName, false)
-	checkErr(err, "DBFormatter")
+	start := time.Now() // start time here; prior to file creations
 
 	// gen new DataDict
 	ddi, err := 棕熊.NewDataDict(ddiPath)
 	checkErr(err, "DataDict")
+	// artifacts describing the data file's layout (e.g., bcp format files) are checked against that of the
+	// records converted, before anything is written: with -rectype or -levels, once they're described below
+	if len(recType) == 0 && !rectangle && !byLevel {
+		checkUsageErr(棕熊.CheckEmitLayout(emitKinds, &ddi), "emit")
+	}
 
-	// gen new DumpWriter
-	dw, err := 棕熊.NewDumpWriter(totBytes, outFile, makeItDir)
-	checkErr(err, "DumpWriter")
-
-	// gen new JobConfig
-	// MaxBytesPerJob: the max byte size that a single parser (writer) will parse (write)
-	// NumParsers: number of concurrent parsers
-	// ParsedResChanSize: size of buffered ParsedResult channel
-	nWriters := len(dw.OutFiles)
-	jCFG := 棕熊.NewJobConfig(totBytes, nWriters)
-	maxBperJob, nParsers, nBuffRes := jCFG.MaxBytesPerJob, jCFG.NumParsers, jCFG.ParsedResChanSize
-
-	// bytes per row in datFile
-	bPerR := 棕熊.BytesPerRow(&ddi)
-
-	// gen new DatParser
-	dp := 棕熊.NewDatParser(datFileName, nParsers, &ddi, dbfmtr)
-
-	// job submission summary ----------------------------------------
-	棕熊.PrintJobSummary(silentProg, "=", dbType, tabName, indices, ddiPath, datFileName)
-	// print loading message
-	go 棕熊.PrintLoadingMessage(silentProg) // technically never closes/terminates, but it's fine
-
-	// write ddl
-	// note: this includes table and index creations, as well as ref_table[s] creation and inserts
-	err = dw.WriteDDL(dbfmtr, &ddi, idx)
-	checkErr(err, "write DDL")
-
-	// channels and waitgroups ----------------------------------------
-	// jobStream: channel of ParsingJobs that will be consumed by DatParser[s]
-	// parsedBlockStream: buffered channel of ParsedResults that will be consumed by DumpWriter[s]
-	jobStream := make(chan 棕熊.ParsingJob)
-	parsedBlockStream := make(chan 棕熊.ParsedResult, nBuffRes)
-	// gen waitgroups; one for each of the three steps
-	var jobMakerWG, parserWG, writerWG sync.WaitGroup
-
-	// goroutines ----------------------------------------
-	// spawn a single JobMaker
-	jobMakerWG.Add(1)
-	go func() {
-		defer jobMakerWG.Done()
-		err := 棕熊.MakeParsingJobsStream(bPerR, int(totBytes), maxBperJob, jobStream)
-		checkErr(err, "parsing")
-	}()
+	// data files at HTTP(S) URLs are read in place, by range requests (see OpenDat), if the server serves
+	// them; those read through whole (gzip compressed, aggregate, copied out by record type or level, or
+	// sampled by estimates) are downloaded first
+	readWhole := ddi.Flavor == 棕熊.AGGREGATE || len(recType) != 0 || rectangle || byLevel || estimate
+	switch {
+	case len(cmdArgs) > 1:
+		// the parts of a multi-part data file are read as one logical file (see JoinDatParts), rows numbered
+		// continuously across them; gzip compressed parts are decompressed first, and parts read through
+		// whole are concatenated into a temporary file
+		if ddi.Flavor == 棕熊.AGGREGATE {
+			checkUsageErr(fmt.Errorf("multi-part data files are fixed-width (microdata) files only"), "args")
+		}
+		parts := make([]string, len(cmdArgs))
+		for i, part := range cmdArgs {
+			compressed := strings.HasSuffix(棕熊.InputName(part), ".gz")
+			if 棕熊.IsHTTPURL(part) && (compressed || !棕熊.ServesRanges(part)) {
+				part = local(part)
+			}
+			if compressed {
+				tmpDat, err := 棕熊.DecompressDat(part)
+				checkErr(err, "decompress")
+				removeOnExit(tmpDat)
+				defer os.Remove(tmpDat)
+				part = tmpDat
+			}
+			parts[i] = part
+		}
+		datFileName = 棕熊.JoinDatParts(parts)
+		if readWhole {
+			tmpDat, err := 棕熊.ConcatDat(datFileName)
+			checkErr(err, "concat")
+			removeOnExit(tmpDat)
+			defer os.Remove(tmpDat)
+			datFileName = tmpDat
+		}
+	case 棕熊.IsHTTPURL(datFileName):
+		compressed := strings.HasSuffix(棕熊.InputName(datFileName), ".gz")
+		if (compressed && !dryRun) || readWhole || !棕熊.ServesRanges(datFileName) {
+			datFileName = local(datFileName)
+		}
+	}
+
+	// with -rectype, only the records of one type of a hierarchical extract are converted, as if a rectangular
+	// extract of their own; with -rectangularize, person records are, each joined with its household's record.
+	// Either way, they're copied to a temporary file (decompressed, if need be), and described by their own
+	// data dictionary (see recordsDict)
+	if len(recType) != 0 || rectangle {
+		recDDI, err := recordsDict(&ddi, recType, rectangle)
+		checkUsageErr(err, "rectype")
+		if !byLevel {
+			checkUsageErr(棕熊.CheckEmitLayout(emitKinds, &recDDI), "emit")
+		}
+		var tmpDat string
+		if rectangle {
+			tmpDat, err = 棕熊.Rectangularize(datFileName, &ddi, recType)
+		} else {
+			tmpDat, err = 棕熊.FilterRecType(datFileName, &ddi, recType)
+		}
+		checkErr(err, "rectype")
+		removeOnExit(tmpDat)
+		defer os.Remove(tmpDat)
+		datFileName, ddi = tmpDat, recDDI
+	}
+
+	// with -levels, the records of each level are copied to a temporary file of their own (decompressed, if
+	// need be), along with the keys of their parents' records (see Levels)
+	var recLevels []棕熊.Level
+	var levelFiles []string
+	var levelRows []int
+	if byLevel {
+		recLevels, err = ddi.Levels()
+		checkUsageErr(err, "levels")
+		for _, lvl := range recLevels {
+			checkUsageErr(棕熊.CheckEmitLayout(emitKinds, &lvl.Dict), "emit")
+		}
+		levelFiles, levelRows, err = 棕熊.SplitLevels(datFileName, &ddi, recLevels)
+		checkErr(err, "levels")
+		for _, f := range levelFiles {
+			removeOnExit(f)
+			defer os.Remove(f)
+		}
+	}
+
+	// gzip compressed fixed-width files are decompressed to a temporary file first; estimates sample them as
+	// they are, and dry runs leave them be
+	if strings.HasSuffix(datFileName, ".gz") && !estimate && !dryRun && !byLevel {
+		tmpDat, err := 棕熊.DecompressDat(datFileName)
+		checkErr(err, "decompress")
+		removeOnExit(tmpDat)
+		defer os.Remove(tmpDat)
+		datFileName = tmpDat
+	}
+
+	// convert converts the data file into a table, as described by the data dictionary; once per level of a
+	// multi-level extract, with -levels, whose table and outputs are named after the level
+	convert := func(datFileName string, ddi 棕熊.DataDict, levelName string) {
+		tabName, outFile, statsFile := tabName, outFile, statsFile
+		if len(levelName) != 0 {
+			tabName, outFile, statsFile = tabName+"_"+levelName, levelOutput(outFile, levelName), levelOutput(statsFile, levelName)
+		}
+		// setup ----------------------------------------
+		// get totalBytes in the datFile
+		totBytes, err := 棕熊.TotalBytes(datFileName)
+		checkErr(err, "totBytes")
+		// metrics of the run, if requested
+		var runStats *棕熊.RunStats
+		if len(statsFile) != 0 {
+			runStats = 棕熊.NewRunStats(start, totBytes)
+		}
+
+		// gen new DatabaseFormatter
+		dbfmtr, err := 棕熊.NewDBFormatter(dbType, tabName, false, overrides)
+		checkErr(err, "DBFormatter")
+		dbfmtr.DbVersion = dbVersion
+		dbfmtr.DocTables = withDocs
+		dbfmtr.Renames = renames
+		dbfmtr.ReservedSuffix = resSuffix
+		dbfmtr.Case = caseP
+		dbfmtr.Style, dbfmtr.Compact = sqlStyle, compact
+		dbfmtr.Collations = collations
+		dbfmtr.RefSchema, dbfmtr.RefPrefix, dbfmtr.RefSuffix = refSchema, refPrefix, refSuffix
+		dbfmtr.NoRefTables, dbfmtr.RefUpsert = noRefTabs, refUpsert || byLevel
+		dbfmtr.Truncate = truncate
+		dbfmtr.NaturalKey = parseIndicesFlag(natKey)
+		dbfmtr.UniqueKeys = uniqueKeys
+		dbfmtr.IndexNames, dbfmtr.ConstraintNames = idxNames, conNames
+		dbfmtr.AppendTo = appendFP
+		dbfmtr.Nulls = nullPolicy
+		dbfmtr.Format = outFmt
+		dbfmtr.Hash = hasher
+		dbfmtr.Recodes = recodes
+		dbfmtr.Derived = derived
+		dbfmtr.Consts = consts
+		dbfmtr.Dates = dates
+		dbfmtr.RowID = rowID
+		dbfmtr.HouseholdKeys = hhKeys
+		dbfmtr.RepWeights = repWeights
+		dbfmtr.Melts = meltGroups
+		dbfmtr.QFlags = qflagSet
+		dbfmtr.VarGroups = varGroups
+		dbfmtr.Model = model
+		dbfmtr.Decimals, dbfmtr.NotNull, dbfmtr.RangeChecks = decimals, notNull, rngChecks
+		dbfmtr.UseSchema = useSchema
+		dbfmtr.Grants, dbfmtr.Owner = grants, owner
+		dbfmtr.Prologue, dbfmtr.Epilogue = prologue, epilogue
+		dbfmtr.ShardBy = split.ShardBy
+
+		// with -dry-run, the configuration is checked and printed, rather than run
+		if dryRun {
+			plan := dryRunPlan{
+				dbType: dbType, tabName: tabName, outFile: outFile, outFmt: outFmt, model: model,
+				datFileName: datFileName, recType: recType, rectangle: rectangle, levelName: levelName, srcFileName: srcDatName, idx: idx,
+				makeItDir: makeItDir, ordered: ordered, staged: staged, compressWorkers: compressWorkers,
+				split: split, userJobs: userJobs,
+			}
+			runDryRun(plan, &ddi, dbfmtr)
+			return
+		}
+
+		// with -estimate, the dump is planned from a sample of rows, rather than written
+		if estimate {
+			estJobs, err := 棕熊.NewUserJobConfig(userJobs, totBytes, 1)
+			checkUsageErr(err, "jobs")
+			est, err := 棕熊.EstimateDump(datFileName, &ddi, dbfmtr, estJobs.NumParsers, makeItDir, split, staged)
+			checkErr(err, "estimate")
+			printEstimate(est, outFile, makeItDir, split.ShardBy)
+			return
+		}
+
+		// line endings ("\n" or "\r\n") and row count of fixed-width files
+		var totRows int
+		if ddi.Flavor != 棕熊.AGGREGATE {
+			totRows, err = 棕熊.DetectLineEndings(datFileName, &ddi)
+			checkErr(err, "line endings")
+		}
+		// rows missing from (or added to) the data file, per the case counts declared by the DDI, if any;
+		// reported under the data file's own name, rather than that of a temporary copy
+		var ccErr *棕熊.CaseCountError
+		err = 棕熊.CheckCaseCounts(datFileName, &ddi, totRows)
+		if errors.As(err, &ccErr) {
+			ccErr.File = srcDatName
+		}
+		if ccErr != nil && !strictCnt {
+			if level >= levelQuiet {
+				fmt.Fprintf(os.Stderr, "%s: warning: %v\n", os.Args[0], err)
+			}
+		} else {
+			checkErr(err, "case counts")
+		}
+
+		// provenance, if requested (or needed for an archive manifest)
+		var runMeta *棕熊.ConversionMeta
+		if withMeta || len(archiveFmt) != 0 {
+			rowCount := totRows
+			if ddi.Flavor == 棕熊.AGGREGATE {
+				rowCount, err = 棕熊.CountCSVRecords(datFileName)
+				checkErr(err, "meta")
+			}
+			runMeta = newConversionMeta(tabName, srcDDIPath, srcDatName, rowCount)
+			runMeta.DDIID = ddi.ID
+		}
+		if withMeta {
+			dbfmtr.Meta = runMeta
+		}
+
+		// gen new DumpWriter
+		var dw 棕熊.DumpWriter
+		var avroSchema []byte
+		switch {
+		case outFmt == 棕熊.FORMAT_AVRO:
+			avroSchema, err = dbfmtr.AvroSchema(&ddi)
+			checkErr(err, "avro schema")
+			dw, err = 棕熊.NewAvroDumpWriter(totBytes, outFile, makeItDir, split, avroSchema)
+		case outFmt == 棕熊.FORMAT_DTA:
+			var dtaSchema 棕熊.DtaSchema
+			dtaSchema, err = dbfmtr.DtaSchema(&ddi)
+			checkErr(err, "stata schema")
+			dw, err = 棕熊.NewDtaDumpWriter(totBytes, outFile, dtaSchema)
+		case staged:
+			dw, err = 棕熊.NewStagedDumpWriter(totBytes, outFile, split, compressWorkers)
+		case outFmt == 棕熊.FORMAT_PGCOPY:
+			dw, err = 棕熊.NewCopyDumpWriter(totBytes, outFile, split)
+		default:
+			dw, err = 棕熊.NewDumpWriter(totBytes, outFile, makeItDir, split)
+		}
+		checkErr(err, "DumpWriter")
+		// the dump is written under a temporary name (or uploaded, but not completed) until it's
+		// complete; remove it if we exit early
+		cleanupOnExit(dw.FileCleanup)
+
+		// gen new JobConfig
+		// MaxBytesPerJob: the max byte size that a single parser (writer) will parse (write)
+		// NumParsers: number of concurrent parsers
+		// ParsedResChanSize: size of buffered ParsedResult channel
+		dw.Ordered = ordered
+		dw.Stats = runStats
+		nWriters := dw.NumWriters()
+		// any of them may be set by flags; the rest are decided by NewJobConfig's heuristics
+		jCFG, err := 棕熊.NewUserJobConfig(userJobs, totBytes, nWriters)
+		checkUsageErr(err, "jobs")
+		err = jCFG.Validate(&ddi, split)
+		checkUsageErr(err, "jobs")
+		maxBperJob, nParsers, nBuffRes := jCFG.MaxBytesPerJob, jCFG.NumParsers, jCFG.ParsedResChanSize
+
+		// job submission summary ----------------------------------------
+		棕熊.PrintJobSummary(level < levelNormal, "=", dbType, tabName, indices, srcDDIPath, srcDatName)
+		// print loading message; verbose runs log each job instead
+		go 棕熊.PrintLoadingMessage(level != levelNormal) // technically never closes/terminates, but it's fine
+
+		// write ddl
+		// note: this includes table and index creations, as well as ref_table[s] creation and inserts
+		// Avro dumps have no DDL, only the schema; Stata files hold theirs in their header
+		switch outFmt {
+		case 棕熊.FORMAT_AVRO:
+			err = dw.WriteAvroSchema(avroSchema)
+		case 棕熊.FORMAT_SQL, 棕熊.FORMAT_PGCOPY:
+			err = dw.WriteDDL(dbfmtr, &ddi, idx)
+		}
+		checkErr(err, "write DDL")
+		// in directory format, the insertion files set the session's namespace as well
+		checkErr(dw.SetFileHeader(dbfmtr.UseStatement()), "DumpWriter")
+
+		// write any requested artifacts (e.g., import scripts); these only depend on the data dictionary
+		// in directory format, they're written to the (temporary) directory, along with the dump
+		emitOut := outFile
+		if makeItDir && !棕熊.IsObjectURL(outFile) {
+			emitOut = dw.StagingName()
+		}
+		// artifacts read a single data file: the DDI's, if multi-part
+		emitDat := cmdArgs[0]
+		if len(cmdArgs) > 1 {
+			emitDat = ""
+		}
+		_, err = dw.WriteEmitted(emitKinds, &ddi, dbfmtr, emitDat, emitOut, makeItDir)
+		checkErr(err, "emit")
 
-	// spawn parser[s]
-	dp.ParseBlocks(&parserWG, jobStream, parsedBlockStream)
-	// close parsedBlockStream when parsers are done consuming from jobStream
-	go func() {
+		// channels and waitgroups ----------------------------------------
+		// jobStream: channel of ParsingJobs that will be consumed by DatParser[s]
+		// parsedBlockStream: buffered channel of ParsedResults that will be consumed by DumpWriter[s]
+		jobStream := make(chan 棕熊.ParsingJob)
+		parsedBlockStream := make(chan 棕熊.ParsedResult, nBuffRes)
+		// writeStream: the ParsedResults consumed by DumpWriter[s]; parsedBlockStream, unless put in order
+		var writeStream <-chan 棕熊.ParsedResult = parsedBlockStream
+		// gen waitgroups; one for each of the three steps
+		var jobMakerWG, parserWG, writerWG sync.WaitGroup
+
+		// goroutines ----------------------------------------
+		if ddi.Flavor == 棕熊.AGGREGATE {
+			// aggregate extracts are comma-delimited, so rows can't be located by byte offset;
+			// a single parser reads the file sequentially instead
+			cp := 棕熊.NewCSVParser(datFileName, &ddi, dbfmtr, split.Rows)
+			nParsers = 1
+			runStats.SetParsers(nParsers)
+			parserWG.Add(1)
+			go func() {
+				defer parserWG.Done()
+				cp.ParseCSV(parsedBlockStream)
+			}()
+		} else {
+			// bytes per row in datFile; rows are read by byte offset, so a missing final
+			// newline is accounted for by counting the rows' bytes, rather than the file's
+			bPerR := 棕熊.BytesPerRow(&ddi)
+			rowBytes := totRows * bPerR
+			// jobs are sized by the cost of the rows, rather than by their bytes alone, unless set (see BytesPerJob)
+			maxBperJob = jCFG.BytesPerJob(bPerR, len(ddi.Vars), totRows, split)
+			// in directory format, each insertion file holds a contiguous range of rows (see AssignRows)
+			rowsPerPart := dw.AssignRows(totRows)
+
+			// spawn a single JobMaker
+			jobMakerWG.Add(1)
+			go func() {
+				defer jobMakerWG.Done()
+				err := 棕熊.MakeParsingJobsStream(bPerR, rowBytes, maxBperJob, rowsPerPart, jobStream)
+				checkErr(err, "parsing")
+			}()
+
+			// spawn parser[s]
+			// to write rows in file order, jobs are throttled, and their results put back in order (see Sequencer)
+			dp := 棕熊.NewDatParser(datFileName, nParsers, &ddi, dbfmtr)
+			runStats.SetParsers(nParsers)
+			if ordered {
+				seq := 棕熊.NewSequencer(2 * nParsers)
+				throttledJobStream := make(chan 棕熊.ParsingJob)
+				go seq.Throttle(jobStream, throttledJobStream)
+				dp.ParseBlocks(&parserWG, throttledJobStream, parsedBlockStream)
+				orderedStream := make(chan 棕熊.ParsedResult, nBuffRes)
+				go seq.Sequence(parsedBlockStream, orderedStream)
+				writeStream = orderedStream
+			} else {
+				dp.ParseBlocks(&parserWG, jobStream, parsedBlockStream)
+			}
+		}
+		// close parsedBlockStream when parsers are done consuming from jobStream
+		go func() {
+			parserWG.Wait()
+			close(parsedBlockStream)
+		}()
+
+		// in verbose runs, log the job configuration, then each job as it's written
+		if level == levelVerbose {
+			fmt.Fprintf(os.Stderr, "jobs: parsers=%d, max bytes per job=%d, results buffered=%d, writers=%d\n", nParsers, maxBperJob, nBuffRes, nWriters)
+			dw.JobLog = os.Stderr
+		}
+
+		// spawn writer[s]
+		// in case of any write errors, delete files/directories and exit immediately
+		dw.WriteParsedResults(&writerWG, writeStream, checkErr)
+
+		// wait on groups
+		jobMakerWG.Wait()
 		parserWG.Wait()
-		close(parsedBlockStream)
-	}()
+		writerWG.Wait()
 
-	// spawn writer[s]
-	// in case of any write errors, delete files/directories and exit immediately
-	dw.WriteParsedResults(&writerWG, parsedBlockStream, checkErr)
+		// all writes succeeded; either pack the dump into an archive, or give it its real name
+		if len(archiveFmt) != 0 {
+			err = dw.WriteArchive(archive, archiveFmt, dbType, runMeta)
+			checkErr(err, "archive")
+			dw.FileCleanup()
+		} else {
+			err = dw.Commit()
+			checkErr(err, "DumpWriter")
+		}
 
-	// wait on groups
-	jobMakerWG.Wait()
-	parserWG.Wait()
-	writerWG.Wait()
+		// end summary ----------------------------------------
+		end := time.Now()
+		棕熊.PrintFinalSummary(level < levelQuiet, start, end, int(totBytes))
+		if runStats != nil {
+			err = runStats.WriteReport(statsFile)
+			checkErr(err, "stats")
+		}
+	}
 
-	// end summary ----------------------------------------
-	end := time.Now()
-	棕熊.PrintFinalSummary(silentProg, start, end, int(totBytes))
+	// with -levels, each level of a multi-level hierarchical extract (e.g., households, persons, and
+	// activities) is converted into a table of its own, in a dump of its own, both named after the level
+	// (e.g., ipums_tab_activity, in ipums_dump_activity.sql); ref tables are shared by the levels, so they're
+	// created if not exists
+	if byLevel {
+		for i, lvl := range recLevels {
+			if levelRows[i] == 0 {
+				if level >= levelQuiet {
+					fmt.Fprintf(os.Stderr, "%s: warning: %s holds no records of type %s; level %s skipped\n", os.Args[0], srcDatName, lvl.Group.RecType, lvl.Name)
+				}
+				continue
+			}
+			convert(levelFiles[i], lvl.Dict, lvl.Name)
+		}
+		return
+	}
+	convert(datFileName, ddi, "")
 }
 
 // Helper Functions
-// checkErr checks if err != nil; prints error and exits if so
+// levelOutput returns the name of a level's output (see -levels), given the run's: the level's name is
+// appended to the run's, ahead of any extension (e.g., "ipums_dump.sql" -> "ipums_dump_person.sql"); unset
+// outputs are left unset
+func levelOutput(fName, level string) string {
+	if len(fName) == 0 {
+		return ""
+	}
+	ext := path.Ext(fName)
+	return strings.TrimSuffix(fName, ext) + "_" + level + ext
+}
+
+// recordsDict returns the data dictionary of the records converted: with rectangle (-rectangularize), those
+// of a record type (recType, or else persons') joined with their households'; with a record type (-rectype),
+// those of the type alone; or else, every record
+func recordsDict(ddi *棕熊.DataDict, recType string, rectangle bool) (棕熊.DataDict, error) {
+	switch {
+	case rectangle:
+		return ddi.Rectangularized(recType)
+	case len(recType) != 0:
+		return ddi.OfRecType(recType)
+	default:
+		return *ddi, nil
+	}
+}
+
+// exitCleanups hold cleanups (e.g., removing temporary files) that should be run if the program exits early
+var exitCleanups []func()
+
+// exitMu guards exitCleanups; it's held from running them until exiting, so that they're run once,
+// even if errors (or an interrupt) arrive from several goroutines at once
+var exitMu sync.Mutex
+
+// removeOnExit registers a temporary file to be removed by checkErr on exit
+func removeOnExit(fName string) {
+	cleanupOnExit(func() { _ = os.Remove(fName) })
+}
+
+// cleanupOnExit registers a cleanup to be run by checkErr on exit
+func cleanupOnExit(cleanup func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitCleanups = append(exitCleanups, cleanup)
+}
+
+// exitWithCleanups runs the exit cleanups, then exits with code
+func exitWithCleanups(code int) {
+	exitMu.Lock() // never unlocked; we're exiting
+	for _, cleanup := range exitCleanups {
+		cleanup()
+	}
+	os.Exit(code)
+}
+
+// silentErrors is set for fully silent runs (-s), whose errors are told by their exit code alone
+var silentErrors bool
+
+// checkErr checks if err != nil; prints error (unless silentErrors) and exits if so, with the exit code
+// of the error (see exitCode)
 func checkErr(err error, topic string) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v: %v\n", topic, err)
-		os.Exit(1)
+		if !silentErrors {
+			fmt.Fprintf(os.Stderr, "%s%s: %v\n", 棕熊.ClearLine(os.Stderr), 棕熊.ErrorLabel(os.Stderr, topic), err)
+		}
+		exitWithCleanups(exitCode(err, topic))
+	}
+}
+
+// newConversionMeta returns the provenance of the current run
+func newConversionMeta(tabName, ddiPath, datPath string, rowCount int) *棕熊.ConversionMeta {
+	return &棕熊.ConversionMeta{
+		TableName:   tabName,
+		DDIFile:     ddiPath,
+		DatFile:     datPath,
+		ConvertedAt: time.Now(),
+		ToolVersion: toolVersion(),
+		RowCount:    rowCount,
+		Options:     strings.Join(os.Args[1:], " "),
+	}
+}
+
+// toolVersion returns the ipums2db version; for builds outside of goreleaser
+// (e.g., go install), the module version is used, if available
+func toolVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// checkUsageErr checks if err != nil for errors in flag arguments; prints error and exits if so, after
+// the exit cleanups (e.g., releasing the output lock, for arguments checked against the data dictionary)
+func checkUsageErr(err error, topic string) {
+	if err != nil {
+		fmt.Printf("ipums2db: %s: %v\nsee --help for more\n", 棕熊.ErrorLabel(os.Stdout, topic), err)
+		exitWithCleanups(exitUsage)
+	}
+}
+
+// printEmitted prints the paths of emitted artifacts, unless silent
+func printEmitted(silent bool, written []string) {
+	if silent {
+		return
+	}
+	for _, w := range written {
+		fmt.Printf("artifact written to %s\n", w)
 	}
 }
 
@@ -146,8 +1079,19 @@ func checkErr(err error, topic string) {
 func checkDDIFlag(ddiF string) {
 	if len(ddiF) == 0 {
 		fmt.Printf("ipums2db: must pass path to XML file (e.x. -x cps_001.xml)\nsee --help for more\n")
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+}
+
+// parseInterspersed parses the flags of a subcommand, which may be interspersed with its positional
+// arguments (e.g., diff old.xml new.xml -b mysql), returning the positional arguments, in order
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for fs.Parse(args); fs.NArg() != 0; fs.Parse(args) {
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
 	}
+	return positional
 }
 
 // parseIndicesFlag returns the comma-delimited indices flag argument as a string slice
@@ -159,33 +1103,255 @@ func parseIndicesFlag(indF string) []string {
 	return indices
 }
 
-// checkOneArg checks if either there is more than one argument provided, or if no arguments are provided
-// if no arguments are provided, assume that user only wants schema file
-func checkOneArg(args []string, silence bool) {
-	if len(args) > 1 {
-		fmt.Printf("ipums2db: args: only provide one argument (path to .dat file)\nsee --help for more\n")
-		os.Exit(2)
+// parseSplitFlags returns the insertion file split limits given by the -split-rows and -split-size flags,
+// or the shard variable given by -shard-by; returns error if either limit is malformed, if limits are
+// combined with sharding, or if any is set without directory format
+func parseSplitFlags(splitRows int, splitSize, shardBy string, makeItDir bool) (棕熊.OutputSplit, error) {
+	if splitRows < 0 {
+		return 棕熊.OutputSplit{}, fmt.Errorf("-split-rows (%d) cannot be negative", splitRows)
+	}
+	sizeB, err := 棕熊.ParseSizeFlag(splitSize)
+	if err != nil {
+		return 棕熊.OutputSplit{}, err
+	}
+	split := 棕熊.OutputSplit{Rows: splitRows, Bytes: sizeB}
+	if split.IsSet() && !makeItDir {
+		return 棕熊.OutputSplit{}, fmt.Errorf("-split-rows and -split-size require directory format (-d)")
+	}
+	if shardBy = strings.TrimSpace(shardBy); len(shardBy) != 0 {
+		if !makeItDir {
+			return 棕熊.OutputSplit{}, fmt.Errorf("-shard-by requires directory format (-d)")
+		}
+		if split.IsSet() {
+			return 棕熊.OutputSplit{}, fmt.Errorf("-shard-by can't be combined with -split-rows or -split-size")
+		}
+		split.ShardBy = shardBy
+	}
+	return split, nil
+}
+
+// formatName returns the name of an output format without SQL, as used in messages (e.g., "Avro"); empty, for SQL
+func formatName(outFmt string) string {
+	return map[string]string{棕熊.FORMAT_AVRO: "Avro", 棕熊.FORMAT_DTA: "Stata"}[outFmt]
+}
+
+// readPrePostFlags returns the contents of the -pre and -post SQL files, if given; returns error if
+// either can't be read, or the output has no SQL (Avro, or Stata) to insert them into
+func readPrePostFlags(preFile, postFile, outFmt string) ([]byte, []byte, error) {
+	if len(preFile) == 0 && len(postFile) == 0 {
+		return nil, nil, nil
+	}
+	if len(formatName(outFmt)) != 0 {
+		return nil, nil, fmt.Errorf("-pre and -post don't apply to %s output", formatName(outFmt))
+	}
+	var contents [2][]byte
+	for i, name := range []string{preFile, postFile} {
+		if len(name) == 0 {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		// statements following (or followed by) generated SQL start on their own line
+		if len(b) != 0 && b[len(b)-1] != '\n' {
+			b = append(b, '\n')
+		}
+		contents[i] = b
+	}
+	return contents[0], contents[1], nil
+}
+
+// printEstimate prints the plan of a conversion (see 棕熊.EstimateDump)
+func printEstimate(est 棕熊.DumpEstimate, outFile string, makeItDir bool, shardBy string) {
+	fmt.Printf("estimate from %d of %d rows (nothing written):\n", est.SampleRows, est.Rows)
+	fmt.Printf(" rows:      %d (%s of data)\n", est.Rows, 棕熊.FormatSize(int64(est.DatBytes)))
+	fmt.Printf(" dump size: ~%s of inserted rows (DDL not counted), to %s\n", 棕熊.FormatSize(est.DumpBytes), outFile)
+	switch {
+	case !makeItDir:
+	case len(shardBy) != 0:
+		fmt.Printf(" files:     one insertion file per value of %s\n", shardBy)
+	default:
+		fmt.Printf(" files:     ~%d insertion files\n", est.Files)
 	}
-	if len(args) == 0 && silence {
+	precision := time.Second
+	if est.Duration < time.Minute {
+		precision = 100 * time.Millisecond
+	}
+	fmt.Printf(" duration:  ~%v of parsing (%.0f rows/s; parsers: %d)\n", est.Duration.Round(precision), est.RowsPerSec, est.Parsers)
+}
+
+// outputLevel is how much a conversion prints (see parseOutputFlags)
+type outputLevel int
+
+const (
+	levelSilent  outputLevel = iota // nothing, not even errors (-s)
+	levelQuiet                      // errors, warnings, and the final line (-q)
+	levelNormal                     // the job summary banner, loading message, and final line
+	levelVerbose                    // normal, with the job configuration and a line per parsing job, to stderr (-v)
+)
+
+// parseOutputFlags returns the output level of the -s, -q, and -v flags
+//
+// returns error if more than one is set
+func parseOutputFlags(silent, quiet, verbose bool) (outputLevel, error) {
+	switch {
+	case silent && (quiet || verbose), quiet && verbose:
+		return 0, fmt.Errorf("only one of -s, -q, and -v may be set")
+	case silent:
+		return levelSilent, nil
+	case quiet:
+		return levelQuiet, nil
+	case verbose:
+		return levelVerbose, nil
+	default:
+		return levelNormal, nil
+	}
+}
+
+// checkDatArgs checks if either several arguments are provided, which must be the parts of a data file (not
+// zip archives), or if no arguments are provided
+// if no arguments are provided, assume that user only wants schema file; quiet runs are warned of it
+func checkDatArgs(args []string, quiet bool) {
+	if len(args) > 1 && slices.ContainsFunc(args, 棕熊.IsZipPath) {
+		fmt.Printf("ipums2db: args: only provide one .zip argument (multi-part data files are .dat[.gz] files)\nsee --help for more\n")
+		os.Exit(exitUsage)
+	}
+	if len(args) == 0 && quiet {
 		fmt.Printf("%s: warning: generating only schema/DDL\n", os.Args[0])
 	}
 }
 
-// printUsage prints usage of ipums2db
-// this will need to be manually updated for future command updates,
-// but I think it's worth it
-func printUsage() {
-	usageStatement := `Usage: %s [options...] -x <xml> <dat>
+// mainUsage is the usage statement of ipums2db; its flag lines are also read by completion (see usageFlags)
+const mainUsage = `Usage: %s [options...] -x <xml> <dat>
+       %s <command> [options...]
+Commands:
+ convert <dir|files...>       Convert the extract among <dir> or files (e.g.,
+                              usa_00012*), pairing its .xml and .dat by name
+ watch <dir>                  Convert new extracts as they land in <dir>
+ dict -x <xml>                Export the data dictionary as CSV/Markdown
+ extract -x <xml> <dat>       Write a subset of the data, with a new DDI
+ completion <shell>           Print a bash, zsh, or fish completion script
+ tui -x <xml>                 Pick columns, indexes, and options in a menu
+ diff <oldXml> <newXml>       Report schema changes, and write migration SQL
+ freq -x <xml> <dat>          Print value counts of variables, with labels
+ stats -x <xml> <dat>         Print summary statistics of numeric variables
+ head -x <xml> <dat>          Print the first rows, decoded
+ describe -x <xml> <var>      Print a variable's codebook entry
 Flags:
- -x <xml>                     DDI XML path (mandatory)
+ -x <xml>                     DDI XML (or .sps/.sas/.do, .zip) path (mandatory)
  -b <dbType>                  Database type (default 'postgres')
+ -db-version <[db:]version>   Database release targeted (e.g., postgres:12,
+                              mysql:5.7, mssql:2016) (default none)
  -t <tabName>                 Table name (default 'ipums_tab')
- -i <idx1[,idx2]>             Variable[s] to index on (default no idx)
+ -i <idx1[:method][,idx2]>    Variable[s] to index on, with an optional index
+                              method (e.g., year:brin), and WHERE predicate
+                              (e.g., 'incwage WHERE incwage > 0') (default no idx)
  -d                           Make directory format (default false)
  -o <outFileOrDir>            File/Directory to output (default 'ipums_dump.sql')
- -s                           Silent output (default false)
+                              or s3://, gs://, az:// URL
+ -fmt <sql|avro|dta|pgcopy>   Output format (default 'sql')
+ -s                           Silent output, errors included (default false)
+ -q                           Quiet output: only errors and the final line
+ -v                           Verbose output: log each parsing job to stderr
+ -split-rows <n>              Max rows per insertion file, with -d
+ -split-size <size>           Max SQL size per insertion file (e.g., 2G), with -d
+ -shard-by <var>              Insertion file per value of a variable, with -d
+ -ordered                     Write rows in file order (reproducible output)
+ -strict-counts               Fail if rows don't match the DDI's case counts
+ -rectype <type>              Convert only the records of one type (e.g., P)
+                              of a hierarchical extract
+ -rectangularize              Join household variables onto each person record
+                              of a hierarchical extract
+ -levels                      Convert each level of a multi-level hierarchical
+                              extract (e.g., ATUS) into a table of its own
+ -compress-workers <n>        Workers compressing insertion files (default one
+                              per CPU); for compressed (snowflake) dumps
+ -parsers <n>                 Concurrent parsers (default by CPU count)
+ -job-size <size>             Max fixed-width bytes per parsing job (e.g., 16M)
+ -result-buffer <n>           Parsed blocks buffered ahead of the writers
+ -cpuprofile <file>           Write a CPU profile of the run (go tool pprof)
+ -memprofile <file>           Write a heap profile at the end of the run
+ -trace <file>                Write an execution trace of the run (go tool trace)
+ -stats <file>                Write a JSON report of the run's metrics
+ -estimate                    Estimate dump size, files, and duration from a
+                              sample of rows, writing nothing
+ -dry-run                     Check the inputs, print the resolved configuration
+                              (columns, files, parsers, jobs), and exit
+ -archive <file>              Pack the dump into a .tar, .tar.gz, .tar.zst, or
+                              .zip archive
+ -rename <old=new[,..]|file>  Rename columns; a file holds one old=new per line
+ -rename-reserved <suffix>    Suffix columns named after reserved words
+ -case <lower|upper|preserve> Identifier casing (default 'lower')
+ -sql-style <opt=v[,..]>      SQL style: keywords=upper|lower, indent=tab|<n>,
+                              labels=on|off (default as generated)
+ -compact                     Write each insert on a single line, without
+                              comments or indentation (default false)
+ -collate <c|var=c[,..]>      Collate character columns: a default, var=c, or
+                              labels=c; 'binary' is code order (default none)
+ -no-ref-tables               Skip ref table creation (default false)
+ -ref-upsert                  Make ref tables safe to re-run (default false)
+ -append <schema>             Append to the tables of a previous schema file (or
+                              dump), writing only inserts; columns must match
+ -truncate                    Empty the tables ahead of the inserts, replacing
+                              their data (default false)
+ -natural-key <v1[,v2]>       Variables uniquely identifying a row; inserts skip
+                              rows already loaded, so reruns are safe
+ -unique <v1+v2[,v3]>         Unique constraints to create, catching rows loaded
+                              twice (default none)
+ -index-name-template <tmpl>  Index name template, of {table} and {cols}
+                              (default 'idx_{cols}')
+ -constraint-name-template <tmpl>
+                              Unique constraint name template, of {table} and
+                              {cols} (default 'uk_{table}', 'uq_{table}_{cols}')
+ -ref-schema <schema>         Schema to create ref tables in (default none)
+ -ref-prefix <prefix>         Ref table name prefix (default 'ref_')
+ -ref-suffix <suffix>         Ref table name suffix (default none)
+ -use <schema>                Schema (mysql/mssql: database) set at the top of
+                              every file (default none)
+ -grant <priv:role[,..]>      Grant privileges (select, insert, update, delete,
+                              all) on the created tables and views to roles
+ -owner <role>                Role owning the created tables and views
+ -nulls <p|key=p[,..]>        Blank field policy: any, blank, trim, strict
+                              (default 'any'); key is string, numeric, or a var
+ -types <file>                JSON/YAML file overriding column types
+ -decimals <storage>          Decimal storage: numeric, double, real, or scaled
+                              integers (default 'numeric')
+ -not-null                    Make columns of variables of every record, without
+                              missing codes, NOT NULL (default false)
+ -range-checks                Add CHECK constraints of valid ranges (or top
+                              codes) of numeric variables (default false)
+ -meta                        Record provenance in an ipums2db_meta table
+ -docs                        Create citation/sample/universe tables
+ -pre <file>                  SQL file inserted at the top of the DDL
+ -post <file>                 SQL file inserted at the end of the dump
+ -hash-vars <v1[,v2]>         Identifier variables to replace with salted hashes
+ -salt <salt>                 Salt of hashed variables (default $IPUMS2DB_SALT)
+ -recode <file>               JSON/YAML file of value recoding rules
+ -derive <n=expr[;..]|file>   Derived columns, computed from the variables
+ -add-const <name=value>      Column holding value in every row (repeatable)
+ -date <name[=y,m[,d]]>       Date column from year/month/day vars (repeatable)
+ -row-id <name>               Surrogate row id column, numbering the rows
+ -hh-keys                     Household-person keys and a households view
+ -repwts <p1[,p2]>            Replicate weights (e.g., REPWTP<n>) to group apart
+ -repwt-fmt <long|array>      Grouped weight format (default 'long')
+ -melt <name=v1,v2[,..]>      Variables to melt into a long table (repeatable)
+ -qflags <side|drop>          Data quality flags (e.g., QAGE) to set apart
+ -qflag-vars <p1[,p2]>        Name patterns of flags (e.g., Q*; default Q<var>)
+ -split-groups <g1[,g2]|all>  Variable groups (<varGrp>) to split into tables
+                              of their own, sharing the main table's key
+ -model <flat|star>           Table model (default 'flat'); star makes a fact
+                              table keyed to dimension tables
+ -emit <a1[,a2]>              Artifacts to generate alongside the dump;
+                              options: stata, r, python, erd, erd-dot,
+                              docs, sqlldr, bcp, sqlalchemy, django, go
+                              (default none)
 
 If <dat> is not provided, only the schema/DDL file will be generated.
+<dat> may be gzip compressed (e.g., myACS.dat.gz).
+<dat> may be several parts, read as one (e.g., myACS_1.dat myACS_2.dat).
+<xml> and <dat> may be the extract's .zip (e.g., -x myACS.zip myACS.zip).
+<xml> and <dat> may be HTTP(S) URLs (e.g., https://example.org/myACS.dat).
 
 Schema Only Usage Example:
  %s -b mysql -o my_schema.sql -x myACS.xml
@@ -193,5 +1359,10 @@ Full Usage Example:
  %s -b mysql -t mytab -i age,sex -o mydump.sql -x myACS.xml myACS.dat
 For more information, visit https://github.com/rhawrami/ipums2db
 `
-	fmt.Printf(usageStatement, os.Args[0], os.Args[0], os.Args[0])
+
+// printUsage prints usage of ipums2db
+// this will need to be manually updated for future command updates,
+// but I think it's worth it
+func printUsage() {
+	fmt.Printf(mainUsage, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
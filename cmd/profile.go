@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+// startProfiling starts writing the requested profiles of the run, in the standard formats read by
+// `go tool pprof` and `go tool trace`: a CPU profile to cpuFile, and an execution trace to traceFile,
+// as the run goes; and a heap profile to memFile, once it's done. Files left empty are not written.
+//
+// It returns the function stopping the profiles (and writing the heap profile), which may be called more
+// than once; it's meant to be run both when the run completes, and when it exits early, so that slow or
+// failing runs can be profiled alike. returns error if a profile can't be created or started.
+func startProfiling(cpuFile, memFile, traceFile string) (func(), error) {
+	var stops []func()
+	stopAll := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+	if len(cpuFile) != 0 {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("starting CPU profile: %w", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if len(traceFile) != 0 {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stopAll()
+			return nil, fmt.Errorf("starting trace: %w", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	if len(memFile) != 0 {
+		// created up front, so that a bad path is reported before the run, rather than after it
+		f, err := os.Create(memFile)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, func() {
+			defer f.Close()
+			runtime.GC() // up-to-date statistics of live objects
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				fmt.Fprintf(os.Stderr, "memprofile: %v\n", err)
+			}
+		})
+	}
+	var once sync.Once
+	return func() { once.Do(stopAll) }, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runSummaryStats prints summary statistics of numeric variables of a fixed-width file, so that an
+// extract's contents can be checked against expectations before it's converted.
+func runSummaryStats(args []string) {
+	var (
+		ddiPath   string
+		statsVars string
+		nulls     string
+	)
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.StringVar(&statsVars, "vars", "", "variables to summarize (default all continuous)")
+	fs.StringVar(&nulls, "nulls", "", "blank field policy, as of the conversion")
+	fs.Usage = printStatsUsage
+	datPaths := parseInterspersed(fs, args) // e.g., stats -x usa.xml usa.dat -vars incwage
+	checkDDIFlag(ddiPath)
+
+	if len(datPaths) != 1 {
+		fmt.Printf("ipums2db stats: must provide exactly one fixed-width file\nsee stats --help for more\n")
+		os.Exit(exitUsage)
+	}
+	nullPolicy, err := 棕熊.ParseNullsFlag(nulls)
+	checkUsageErr(err, "nulls")
+	datPath := datPaths[0]
+
+	ddi, err := 棕熊.NewDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	if strings.HasSuffix(datPath, ".gz") {
+		tmpDat, err := 棕熊.DecompressDat(datPath)
+		checkErr(err, "decompress")
+		removeOnExit(tmpDat)
+		defer os.Remove(tmpDat)
+		datPath = tmpDat
+	}
+	summaries, err := 棕熊.Summarize(datPath, &ddi, parseIndicesFlag(statsVars), nullPolicy)
+	checkErr(err, "stats")
+	printSummaries(summaries)
+}
+
+// printSummaries prints a line of summary statistics per variable; values are printed to the variable's
+// implied decimals, and means to two more
+func printSummaries(summaries []棕熊.VarSummary) {
+	width := len("variable")
+	for _, vs := range summaries {
+		width = max(width, len(vs.Var.Name))
+	}
+	fmt.Printf("%-*s %10s %8s %14s %14s %16s %14s\n", width, "variable", "rows", "missing", "min", "max", "mean", "median")
+	for _, vs := range summaries {
+		dcml := vs.Var.DecimalPoint
+		if vs.Missing == vs.Rows {
+			fmt.Printf("%-*s %10d %7.2f%% %14s %14s %16s %14s\n", width, vs.Var.Name, vs.Rows, 100*vs.MissingShare(), "-", "-", "-", "-")
+			continue
+		}
+		fmt.Printf("%-*s %10d %7.2f%% %14.*f %14.*f %16.*f %14.*f\n", width, vs.Var.Name, vs.Rows, 100*vs.MissingShare(),
+			dcml, vs.Min, dcml, vs.Max, dcml+2, vs.Mean, dcml+1, vs.Median)
+	}
+}
+
+// statsUsage is the usage statement of ipums2db stats; its flag lines are also read by completion (see usageFlags)
+const statsUsage = `Usage: %s stats [options...] -x <xml> <dat>
+Scans a fixed-width file, in parallel, and prints the min, max, mean,
+median, and share of missing values of numeric variables, with implied
+decimals applied; a check that an extract holds what's expected.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+ -vars <var1[,var2]>          Variables to summarize (default all continuous)
+ -nulls <p|key=p[,..]>        Blank field policy, as of the conversion
+                              (default 'any')
+
+Blank fields, fields the conversion would load as null, and codes labeled as
+missing (e.g., 'N/A', 'NIU', 'Missing', 'Unknown'), count as missing, and are
+left out of the other statistics.
+<dat> may be gzip compressed (e.g., usa_00012.dat.gz).
+
+Example:
+ %s stats -x usa_00012.xml usa_00012.dat -vars age,incwage
+`
+
+// printStatsUsage prints usage of ipums2db stats
+func printStatsUsage() {
+	fmt.Printf(statsUsage, os.Args[0], os.Args[0])
+}
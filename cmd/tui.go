@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// tuiPageSize is the number of variables listed per page of the menu
+const tuiPageSize = 20
+
+// tuiState holds the choices made in the menu of ipums2db tui
+type tuiState struct {
+	ddiPath string
+	datPath string // empty for schema only
+	ddi     棕熊.DataDict
+
+	keep    []bool // per variable of ddi, whether it's converted
+	index   []bool // per variable of ddi, whether it's indexed
+	dbType  string
+	tabName string
+	outFile string
+	makeDir bool
+
+	filter string // shown variables' names or labels contain filter (case-insensitive)
+	page   int
+}
+
+// runTui presents a menu listing the variables of an extract, where columns are toggled, indexes picked,
+// and the database type and output chosen, then runs the conversion. Deselected columns are dropped by
+// writing a subset extract (see runExtract) to a temporary directory, and converting it instead; the
+// conversion runs as its own ipums2db process, as in watch.
+func runTui(args []string) {
+	var ddiPath string
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	fs.StringVar(&ddiPath, "x", "", "XML path (MANDATORY)")
+	fs.Usage = printTuiUsage
+	fs.Parse(args)
+	checkDDIFlag(ddiPath)
+	if fs.NArg() > 1 {
+		fmt.Printf("ipums2db tui: must provide at most one data file\nsee tui --help for more\n")
+		os.Exit(exitUsage)
+	}
+
+	ddi, err := 棕熊.NewDataDict(ddiPath)
+	checkErr(err, "DataDict")
+	st := &tuiState{
+		ddiPath: ddiPath,
+		datPath: fs.Arg(0),
+		ddi:     ddi,
+		keep:    make([]bool, len(ddi.Vars)),
+		index:   make([]bool, len(ddi.Vars)),
+		dbType:  棕熊.POSTGRES,
+		tabName: "ipums_tab",
+		outFile: "ipums_dump.sql",
+	}
+	for i := range st.keep {
+		st.keep[i] = true
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	msg := ""
+	for {
+		st.render(os.Stdout, msg)
+		fmt.Print("> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		var run, quit bool
+		run, quit, msg = st.apply(in.Text())
+		if quit {
+			return
+		}
+		if run {
+			convArgs, err := st.conversionArgs()
+			if err != nil {
+				msg = err.Error()
+				continue
+			}
+			checkErr(st.convert(convArgs), "tui")
+			return
+		}
+	}
+}
+
+// shown returns the indexes of the variables matching the filter
+func (st *tuiState) shown() []int {
+	var shown []int
+	filter := strings.ToLower(st.filter)
+	for i, v := range st.ddi.Vars {
+		if strings.Contains(strings.ToLower(v.Name), filter) || strings.Contains(strings.ToLower(v.Label), filter) {
+			shown = append(shown, i)
+		}
+	}
+	return shown
+}
+
+// render prints the menu: the current page of variables, the options, the commands, and a message about
+// the last command (if any)
+func (st *tuiState) render(w io.Writer, msg string) {
+	shown := st.shown()
+	pages := max((len(shown)+tuiPageSize-1)/tuiPageSize, 1)
+	st.page = min(st.page, pages-1)
+	nKeep, nIdx := 0, 0
+	for i := range st.keep {
+		if st.keep[i] {
+			nKeep++
+		}
+		if st.index[i] {
+			nIdx++
+		}
+	}
+	fmt.Fprintf(w, "\n%s: %d of %d columns selected, %d indexed", st.ddiPath, nKeep, len(st.keep), nIdx)
+	if len(st.filter) != 0 {
+		fmt.Fprintf(w, " (showing %d matching '%s')", len(shown), st.filter)
+	}
+	fmt.Fprintf(w, "\n\n   %4s  %-3s %-3s %-16s %s\n", "#", "col", "idx", "variable", "label")
+	start := st.page * tuiPageSize
+	for _, i := range shown[start:min(start+tuiPageSize, len(shown))] {
+		v := st.ddi.Vars[i]
+		fmt.Fprintf(w, "   %4d  %-3s %-3s %-16s %s\n", i+1, checkMark(st.keep[i]), checkMark(st.index[i]), v.Name, v.Label)
+	}
+	data := st.datPath
+	if len(data) == 0 {
+		data = "none (schema only)"
+	}
+	fmt.Fprintf(w, "\n   page %d of %d\n", st.page+1, pages)
+	fmt.Fprintf(w, "   database: %s   table: %s   output: %s   directory format: %v   data: %s\n",
+		st.dbType, st.tabName, st.outFile, st.makeDir, data)
+	fmt.Fprintf(w, "\n%s", tuiCommands)
+	if len(msg) != 0 {
+		fmt.Fprintf(w, "\n%s\n", msg)
+	}
+}
+
+// tuiCommands are the commands of the menu, listed below it
+const tuiCommands = ` <n[,n-m]> toggle columns    i <n[,n-m]> toggle indexes   all | none  select columns
+ b <dbType> database type     t <name> table name          o <file> output file
+ d toggle directory format    f <text> filter (f to clear) n | p next/previous page
+ r run the conversion         q quit
+`
+
+// checkMark returns "[x]" if set, "[ ]" if not
+func checkMark(set bool) string {
+	if set {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
+// apply applies a command of the menu (see tuiCommands), returning whether to run the conversion or
+// quit, and a message about the command; bad commands are reported in the message
+func (st *tuiState) apply(line string) (run, quit bool, msg string) {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "":
+	case "r":
+		return true, false, ""
+	case "q":
+		return false, true, ""
+	case "n":
+		st.page++
+	case "p":
+		st.page = max(st.page-1, 0)
+	case "all", "none":
+		for _, i := range st.shown() {
+			st.keep[i] = cmd == "all"
+		}
+	case "i":
+		nums, err := parseVarNumbers(arg, len(st.ddi.Vars))
+		if err != nil {
+			return false, false, err.Error()
+		}
+		for _, i := range nums {
+			st.index[i] = !st.index[i]
+		}
+	case "b":
+		if !slices.Contains(棕熊.DbTypes, arg) {
+			return false, false, fmt.Sprintf("database type '%s' not in {%s}", arg, strings.Join(棕熊.DbTypes, ", "))
+		}
+		st.dbType = arg
+	case "t", "o":
+		if len(arg) == 0 {
+			return false, false, fmt.Sprintf("%s takes a name", cmd)
+		}
+		if cmd == "t" {
+			st.tabName = arg
+		} else {
+			st.outFile = arg
+		}
+	case "d":
+		st.makeDir = !st.makeDir
+	case "f":
+		st.filter, st.page = arg, 0
+	default:
+		nums, err := parseVarNumbers(line, len(st.ddi.Vars))
+		if err != nil {
+			return false, false, fmt.Sprintf("unrecognized command '%s'", strings.TrimSpace(line))
+		}
+		for _, i := range nums {
+			st.keep[i] = !st.keep[i]
+		}
+	}
+	return false, false, ""
+}
+
+// parseVarNumbers parses a list of variable numbers (as listed, from 1 to n) and ranges of them
+// (e.g., "1,4-6"), returning their indexes
+//
+// returns error if a number isn't one of the variables
+func parseVarNumbers(list string, n int) ([]int, error) {
+	var nums []int
+	for _, part := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		to, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || from < 1 || to > n || from > to {
+			return nil, fmt.Errorf("'%s' is not a variable number (or range of them) from 1 to %d", strings.TrimSpace(part), n)
+		}
+		for i := from; i <= to; i++ {
+			nums = append(nums, i-1)
+		}
+	}
+	return nums, nil
+}
+
+// conversionArgs returns the arguments of the conversion chosen, without -x and the data file (which
+// depend on whether columns are dropped; see convert)
+//
+// returns error if no column is selected, or a dropped column is indexed
+func (st *tuiState) conversionArgs() ([]string, error) {
+	var idx []string
+	nKeep := 0
+	for i, v := range st.ddi.Vars {
+		if st.keep[i] {
+			nKeep++
+		}
+		if !st.index[i] {
+			continue
+		}
+		if !st.keep[i] {
+			return nil, fmt.Errorf("cannot index %s, which is not selected", v.Name)
+		}
+		idx = append(idx, strings.ToLower(v.Name))
+	}
+	if nKeep == 0 {
+		return nil, fmt.Errorf("no columns selected")
+	}
+	convArgs := []string{"-b", st.dbType, "-t", st.tabName, "-o", st.outFile}
+	if len(idx) != 0 {
+		convArgs = append(convArgs, "-i", strings.Join(idx, ","))
+	}
+	if st.makeDir {
+		convArgs = append(convArgs, "-d")
+	}
+	return convArgs, nil
+}
+
+// convert runs the conversion, with convArgs (see conversionArgs), printing the equivalent commands first.
+// If columns are dropped, the subset extract is written to a temporary directory, removed afterwards; with
+// no data file, the extract is written from an empty one, so that only its DDI is used.
+func (st *tuiState) convert(convArgs []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ddiPath, datPath := st.ddiPath, st.datPath
+	if slices.Contains(st.keep, false) {
+		var keep []string
+		for i, v := range st.ddi.Vars {
+			if st.keep[i] {
+				keep = append(keep, strings.ToLower(v.Name))
+			}
+		}
+		tmpDir, err := os.MkdirTemp("", "ipums2db-tui-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		cleanupOnExit(func() { os.RemoveAll(tmpDir) })
+
+		src := datPath
+		if len(src) == 0 {
+			src = os.DevNull
+		}
+		subset := filepath.Join(tmpDir, "subset.dat")
+		fmt.Printf("\n$ %s extract -vars %s -o %s -x %s %s\n", os.Args[0], strings.Join(keep, ","), subset, ddiPath, src)
+		res, err := 棕熊.WriteExtract(ddiPath, src, subset, keep, nil)
+		if err != nil {
+			return err
+		}
+		ddiPath = res.DDIFile
+		if len(datPath) != 0 {
+			datPath = subset
+		}
+	}
+	convArgs = append(convArgs, "-x", ddiPath)
+	if len(datPath) != 0 {
+		convArgs = append(convArgs, datPath)
+	}
+	fmt.Printf("\n$ %s %s\n", os.Args[0], strings.Join(convArgs, " "))
+	conv := exec.Command(self, convArgs...)
+	conv.Stdin, conv.Stdout, conv.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := conv.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitWithCleanups(exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// tuiUsage is the usage statement of ipums2db tui; its flag lines are also read by completion (see usageFlags)
+const tuiUsage = `Usage: %s tui -x <xml> [<dat>]
+Lists the variables of an extract, with their labels, in a menu where columns
+are toggled, indexes picked, and the database type and output chosen; then
+runs the conversion, printing the equivalent commands.
+Flags:
+ -x <xml>                     DDI XML (or .sps/.sas/.do) path (mandatory)
+
+If <dat> is not provided, only the schema/DDL file will be generated.
+
+Example:
+ %s tui -x usa_00012.xml usa_00012.dat.gz
+`
+
+// printTuiUsage prints usage of ipums2db tui
+func printTuiUsage() {
+	fmt.Printf(tuiUsage, os.Args[0], os.Args[0])
+}
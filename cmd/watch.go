@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// runWatch monitors a directory for new DDI and fixed-width file pairs, converting each
+// pair once it has finished downloading. Each conversion runs as its own ipums2db process,
+// so that one bad extract does not take down the daemon.
+func runWatch(args []string) {
+	var (
+		dbType    string
+		tabName   string
+		indices   string
+		outTmpl   string
+		makeItDir bool
+		interval  time.Duration
+		settle    time.Duration
+		runOnce   bool
+	)
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.StringVar(&dbType, "b", "postgres", "database type")
+	fs.StringVar(&tabName, "t", "ipums_tab", "main table name")
+	fs.StringVar(&indices, "i", "", "indices to create; comma-delim for multiple")
+	fs.BoolVar(&makeItDir, "d", false, "make directory output format")
+	fs.StringVar(&outTmpl, "o", "{dir}/{name}.sql", "output file/dir name template")
+	fs.DurationVar(&interval, "n", 5*time.Second, "poll interval")
+	fs.DurationVar(&settle, "settle", 30*time.Second, "time files must be unchanged before converting")
+	fs.BoolVar(&runOnce, "once", false, "scan once, convert ready pairs, then exit")
+	fs.Usage = printWatchUsage
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Printf("ipums2db watch: must provide exactly one directory to watch\nsee watch --help for more\n")
+		os.Exit(exitUsage)
+	}
+	dir := fs.Arg(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Printf("ipums2db watch: %s is not a directory\n", dir)
+		os.Exit(exitUsage)
+	}
+
+	self, err := os.Executable()
+	checkErr(err, "watch")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := 棕熊.NewWatcher(dir, settle)
+	if runOnce {
+		w.Settle = 0
+	}
+	fmt.Printf("watching %s for new extracts (Ctrl-C to stop)\n", dir)
+	for {
+		pairs, err := w.Poll(time.Now())
+		checkErr(err, "watch")
+		for _, p := range pairs {
+			outName := expandOutTemplate(outTmpl, dir, p.Name)
+			// in directory format, the ".sql" suffix is dropped from the output name
+			existName := outName
+			if makeItDir {
+				existName = strings.TrimSuffix(outName, ".sql")
+			}
+			if _, err := os.Stat(existName); err == nil {
+				fmt.Printf("skip %s: %s already exists\n", p.Name, existName)
+				continue
+			}
+			convArgs := []string{"-q", "-b", dbType, "-t", tabName, "-o", outName, "-x", p.DDIPath}
+			if len(indices) != 0 {
+				convArgs = append(convArgs, "-i", indices)
+			}
+			if makeItDir {
+				convArgs = append(convArgs, "-d")
+			}
+			convArgs = append(convArgs, p.DatPath)
+
+			fmt.Printf("converting %s -> %s\n", p.Name, outName)
+			start := time.Now()
+			conv := exec.CommandContext(ctx, self, convArgs...)
+			conv.Stdout, conv.Stderr = os.Stdout, os.Stderr
+			if err := conv.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "watch: %s: conversion failed: %v\n", p.Name, err)
+				continue
+			}
+			fmt.Printf("done %s (%v)\n", p.Name, time.Since(start).Round(time.Millisecond))
+		}
+		if runOnce {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("stopped watching %s\n", dir)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// expandOutTemplate replaces the {dir} and {name} placeholders of an output name template
+func expandOutTemplate(tmpl, dir, name string) string {
+	r := strings.NewReplacer("{dir}", dir, "{name}", name)
+	return filepath.Clean(r.Replace(tmpl))
+}
+
+// watchUsage is the usage statement of ipums2db watch; its flag lines are also read by completion (see usageFlags)
+const watchUsage = `Usage: %s watch [options...] <dir>
+Watches <dir> for new <name>.xml + <name>.dat[.gz] pairs, converting each
+pair once neither file has changed for the settle duration.
+Flags:
+ -b <dbType>                  Database type (default 'postgres')
+ -t <tabName>                 Table name (default 'ipums_tab')
+ -i <idx1[:method][,idx2]>    Variable[s] to index on, with an optional index
+                              method (e.g., year:brin), and WHERE predicate
+                              (e.g., 'incwage WHERE incwage > 0') (default no idx)
+ -d                           Make directory format (default false)
+ -o <template>                Output name template; {dir} and {name} are
+                              replaced by <dir> and the pair's basename
+                              (default '{dir}/{name}.sql')
+ -n <interval>                Poll interval (default 5s)
+ -settle <duration>           Time files must be unchanged (default 30s)
+ -once                        Convert ready pairs once, then exit
+
+Pairs whose output already exists are skipped.
+
+Example:
+ %s watch -b mysql -d -o '/data/dumps/{name}' /data/incoming
+`
+
+// printWatchUsage prints usage of ipums2db watch
+func printWatchUsage() {
+	fmt.Printf(watchUsage, os.Args[0], os.Args[0])
+}
@@ -0,0 +1,90 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fingerprintPrefix starts the comment line of a schema file recording the fingerprint of its main table
+// (see schemaFingerprint)
+const fingerprintPrefix = "-- ipums2db schema: "
+
+// schemaFingerprint returns the fingerprint of the main table, given its columns (as name, type, and label):
+// a hash of its name, and of its columns' names and types, in order, followed by them; for example,
+// "5c1f0e4a9b3d2e71 ipums_tab (year int, serial int)". Inserts list their values in column order, so
+// dumps whose main tables share a fingerprint can be appended to one another's tables (see AppendTo).
+func (dbf *DatabaseFormatter) schemaFingerprint(cols [][3]string) string {
+	defs := make([]string, len(cols))
+	for i, col := range cols {
+		defs[i] = col[0] + " " + col[1]
+	}
+	schema := fmt.Sprintf("%s (%s)", dbf.ident(dbf.TableName), strings.Join(defs, ", "))
+	sum := sha256.Sum256([]byte(schema))
+	return hex.EncodeToString(sum[:8]) + " " + schema
+}
+
+// ReadFingerprint returns the fingerprint of the main table recorded in a schema file, or the DDL of a
+// single file dump (see schemaFingerprint); it's found ahead of the main table's creation.
+//
+// returns error if the file can't be read, or records no fingerprint (e.g., it wasn't generated by ipums2db)
+func ReadFingerprint(schemaFile string) (string, error) {
+	f, err := os.Open(schemaFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if fp, ok := strings.CutPrefix(line, fingerprintPrefix); ok {
+			return strings.TrimSpace(fp), nil
+		}
+		if strings.HasPrefix(line, "CREATE TABLE") || strings.HasPrefix(line, "INSERT INTO") {
+			break
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%s records no schema fingerprint; was it generated by ipums2db?", schemaFile)
+}
+
+// checkAppend ensures that the main table matches the one appended to, if any (see AppendTo), given
+// its fingerprint (see schemaFingerprint)
+//
+// returns error if not the case, naming the first difference
+func (dbf *DatabaseFormatter) checkAppend(fingerprint string) error {
+	if len(dbf.AppendTo) == 0 || dbf.AppendTo == fingerprint {
+		return nil
+	}
+	_, schema, _ := strings.Cut(fingerprint, " ")
+	_, prevSchema, _ := strings.Cut(dbf.AppendTo, " ")
+	table, defs, _ := strings.Cut(strings.TrimSuffix(schema, ")"), " (")
+	prevTable, prevDefs, _ := strings.Cut(strings.TrimSuffix(prevSchema, ")"), " (")
+	if table != prevTable {
+		return fmt.Errorf("can't append to %s: the schema appended to creates %s", table, prevTable)
+	}
+	cols, prevCols := strings.Split(defs, ", "), strings.Split(prevDefs, ", ")
+	for i := 0; i < max(len(cols), len(prevCols)); i++ {
+		switch {
+		case i >= len(cols):
+			return fmt.Errorf("can't append to %s: column %d (%s) is missing from this extract", table, i+1, prevCols[i])
+		case i >= len(prevCols):
+			return fmt.Errorf("can't append to %s: column %d (%s) isn't in the table", table, i+1, cols[i])
+		case cols[i] != prevCols[i]:
+			return fmt.Errorf("can't append to %s: column %d is %s, but %s in the table", table, i+1, cols[i], prevCols[i])
+		}
+	}
+	return fmt.Errorf("can't append to %s: the schema appended to has a different fingerprint", table)
+}
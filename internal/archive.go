@@ -0,0 +1,220 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archive formats, by file extension
+const (
+	ARCHIVE_TAR    = "tar"
+	ARCHIVE_TARGZ  = "tar.gz"
+	ARCHIVE_TARZST = "tar.zst"
+	ARCHIVE_ZIP    = "zip"
+)
+
+// manifestName is the name of the manifest file in an archive
+const manifestName = "manifest.json"
+
+// ParseArchiveFlag returns the archive format of an archive file name, by its extension:
+// ".tar", ".tar.gz" (or ".tgz"), ".tar.zst" (or ".tzst"), or ".zip"; returns "" if the name is empty
+//
+// returns error if the extension is not supported
+func ParseArchiveFlag(archiveF string) (string, error) {
+	lower := strings.ToLower(archiveF)
+	switch {
+	case len(archiveF) == 0:
+		return "", nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ARCHIVE_TARGZ, nil
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return ARCHIVE_TARZST, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return ARCHIVE_TAR, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return ARCHIVE_ZIP, nil
+	default:
+		return "", fmt.Errorf("archive '%s' not in {'.tar', '.tar.gz', '.tgz', '.tar.zst', '.tzst', '.zip'}", archiveF)
+	}
+}
+
+// ArchiveManifest describes the contents of an archived dump: its provenance, and each of its files
+type ArchiveManifest struct {
+	TableName   string         `json:"table_name"`
+	DbType      string         `json:"db_type"`
+	DDIFile     string         `json:"ddi_file"`
+	DatFile     string         `json:"dat_file"`
+	DDIID       string         `json:"ddi_id"`
+	ConvertedAt time.Time      `json:"converted_at"`
+	ToolVersion string         `json:"tool_version"`
+	RowCount    int            `json:"row_count"`
+	Options     string         `json:"options"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a file of an archived dump, by its path in the archive
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// archiveWriter adds files to a tar (optionally gzip or zstd compressed) or zip archive
+type archiveWriter struct {
+	tw   *tar.Writer
+	zw   *zip.Writer
+	comp io.WriteCloser // compressor of the tar archive, if any
+}
+
+// newArchiveWriter returns an archiveWriter of the given format, writing to w
+func newArchiveWriter(w io.Writer, format string) *archiveWriter {
+	switch format {
+	case ARCHIVE_ZIP:
+		return &archiveWriter{zw: zip.NewWriter(w)}
+	case ARCHIVE_TARGZ:
+		gz := gzip.NewWriter(w)
+		return &archiveWriter{tw: tar.NewWriter(gz), comp: gz}
+	case ARCHIVE_TARZST:
+		zst := newZstdWriter(w)
+		return &archiveWriter{tw: tar.NewWriter(zst), comp: zst}
+	default:
+		return &archiveWriter{tw: tar.NewWriter(w)}
+	}
+}
+
+// create starts a new file in the archive, returning a writer for its contents
+func (aw *archiveWriter) create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	if aw.zw != nil {
+		return aw.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return aw.tw, nil
+}
+
+// close finishes the archive
+func (aw *archiveWriter) close() error {
+	if aw.zw != nil {
+		return aw.zw.Close()
+	}
+	if err := aw.tw.Close(); err != nil {
+		return err
+	}
+	if aw.comp != nil {
+		return aw.comp.Close()
+	}
+	return nil
+}
+
+// WriteArchive packs the dump (as written under its temporary name; see Commit) into a single archive,
+// along with a manifest listing each file's size and SHA-256 checksum. Files are stored under the
+// dump's real name (e.g., "ipums_dump/ddl.sql"). The archive is written under a temporary name,
+// and renamed once complete. The dump itself is left as is; see FileCleanup.
+//
+// returns error if the dump cannot be read, or the archive cannot be written
+func (dw DumpWriter) WriteArchive(archiveName, format, dbType string, meta *ConversionMeta) error {
+	files, err := dw.archiveFiles()
+	if err != nil {
+		return err
+	}
+	f, err := createTemp(archiveName)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(f, format, files, dbType, meta)
+	return finishTemp(f, archiveName, err)
+}
+
+// archiveFiles maps the path of each of the dump's files in the archive to its path on disk
+func (dw DumpWriter) archiveFiles() ([][2]string, error) {
+	if !dw.makeItDir {
+		return [][2]string{{filepath.Base(dw.final), dw.staging}}, nil
+	}
+	var files [][2]string
+	dirName := filepath.Base(dw.final)
+	err := filepath.WalkDir(dw.staging, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dw.staging, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, [2]string{path.Join(dirName, filepath.ToSlash(rel)), p})
+		return nil
+	})
+	return files, err
+}
+
+// writeArchive writes each file, then the manifest, to an archive of the given format
+func writeArchive(w io.Writer, format string, files [][2]string, dbType string, meta *ConversionMeta) error {
+	aw := newArchiveWriter(w, format)
+	manifest := ArchiveManifest{DbType: dbType, RowCount: -1, Files: make([]ManifestFile, 0, len(files))}
+	if meta != nil {
+		manifest.TableName, manifest.DDIFile, manifest.DatFile = meta.TableName, meta.DDIFile, meta.DatFile
+		manifest.DDIID, manifest.ConvertedAt, manifest.ToolVersion = meta.DDIID, meta.ConvertedAt, meta.ToolVersion
+		manifest.RowCount, manifest.Options = meta.RowCount, meta.Options
+	}
+	for _, file := range files {
+		mf, err := addArchiveFile(aw, file[0], file[1])
+		if err != nil {
+			return fmt.Errorf("archiving %s: %w", file[1], err)
+		}
+		manifest.Files = append(manifest.Files, mf)
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := manifestName
+	if len(files) > 0 && path.Dir(files[0][0]) != "." {
+		manifestPath = path.Join(path.Dir(files[0][0]), manifestName)
+	}
+	mw, err := aw.create(manifestPath, int64(len(manifestJSON)+1), time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err = mw.Write(append(manifestJSON, '\n')); err != nil {
+		return err
+	}
+	return aw.close()
+}
+
+// addArchiveFile copies a file into an archive, returning its manifest entry
+func addArchiveFile(aw *archiveWriter, name, fileName string) (ManifestFile, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	w, err := aw.create(name, stat.Size(), stat.ModTime())
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), f)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Name: name, Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,136 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// createTemp creates a temporary file next to fileName, of the form "<fileName>.<random>.tmp", to be
+// renamed to fileName once completely written (see finishTemp). Being in the same directory, the rename
+// is atomic, so a crashed or killed run never leaves a truncated file under the real name; the file is
+// flushed to disk before the rename, and the rename after it, so that a power loss doesn't either.
+//
+// If fileName is an existing special file (e.g., /dev/stdout, or a named pipe), it's written to directly.
+func createTemp(fileName string) (*os.File, error) {
+	if isSpecialFile(fileName) {
+		return os.Create(fileName)
+	}
+	f, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// finishTemp closes a file made by createTemp, and renames it to fileName if err (the error writing
+// the file, if any) is nil, flushing the file, then its directory, to disk; otherwise, or if flushing,
+// closing, or renaming fails, the temporary file is removed.
+// returns the first error
+func finishTemp(f *os.File, fileName string, err error) error {
+	if f.Name() == fileName {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameSynced(f.Name(), fileName)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// renameSynced renames a file (or directory) already flushed to disk, then flushes the directory it's
+// renamed into, so that the rename survives a power loss
+func renameSynced(oldName, newName string) error {
+	if err := os.Rename(oldName, newName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newName))
+}
+
+// syncDir flushes a directory's entries (e.g., the files created or renamed in it) to disk; directories
+// can't be flushed on Windows, where it does nothing
+func syncDir(dirName string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncTree flushes a file, or a directory and everything under it, to disk; the files are reopened, as
+// they're flushed once closed (e.g., the files of a dump, once all are written)
+func syncTree(root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return syncDir(p)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// isSpecialFile reports whether a file exists, and is not a regular file (e.g., a device, or a named pipe)
+func isSpecialFile(fileName string) bool {
+	stat, err := os.Stat(fileName)
+	return err == nil && !stat.Mode().IsRegular() && !stat.IsDir()
+}
+
+// createTempDir creates a temporary directory next to dirName, of the form "<dirName>.<random>.tmp",
+// to be renamed to dirName once all of its files are completely written (see createTemp)
+func createTempDir(dirName string) (string, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dirName), filepath.Base(dirName)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmpDir, 0755); err != nil {
+		_ = os.Remove(tmpDir)
+		return "", err
+	}
+	return tmpDir, nil
+}
+
+// writeFileAtomic writes data to fileName through a temporary file (see createTemp)
+func writeFileAtomic(fileName string, data []byte) error {
+	f, err := createTemp(fileName)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return finishTemp(f, fileName, err)
+}
@@ -0,0 +1,552 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// output formats
+const (
+	FORMAT_SQL    string = "sql"
+	FORMAT_AVRO   string = "avro"
+	FORMAT_DTA    string = "dta"
+	FORMAT_PGCOPY string = "pgcopy"
+)
+
+// ParseFormatFlag returns the output format named by the -fmt flag: "sql" (the default, if empty), "avro",
+// "dta" (Stata), or "pgcopy" (postgres binary COPY files)
+//
+// returns error if the format is not supported
+func ParseFormatFlag(fmtF string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(fmtF)); f {
+	case "", FORMAT_SQL:
+		return FORMAT_SQL, nil
+	case FORMAT_AVRO:
+		return FORMAT_AVRO, nil
+	case FORMAT_DTA:
+		return FORMAT_DTA, nil
+	case FORMAT_PGCOPY:
+		return FORMAT_PGCOPY, nil
+	default:
+		return "", fmt.Errorf("format '%s' not in {'sql', 'avro', 'dta', 'pgcopy'}", fmtF)
+	}
+}
+
+// writesSQL reports whether rows are written as SQL (inserts, or the staged CSV or binary COPY files loaded by
+// SQL), rather than as Avro or Stata files, which hold the main table's rows alone
+func (dbf *DatabaseFormatter) writesSQL() bool {
+	return dbf.Format != FORMAT_AVRO && dbf.Format != FORMAT_DTA
+}
+
+// writesInserts reports whether rows are written as SQL inserts, rather than as files of the main table's rows
+// alone: staged CSV (see stagesCSV), binary COPY (see copiesBinary), Avro, or Stata files
+func (dbf *DatabaseFormatter) writesInserts() bool {
+	return dbf.writesSQL() && !dbf.stagesCSV() && !dbf.copiesBinary()
+}
+
+// avroMagic opens every Avro object container file
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroNameRe matches valid Avro record and field names
+var avroNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// maxAvroLongDigits is the max number of digits of numbers written as Avro longs (or as decimals,
+// without going through big integers); 18 digits always fit in 64 bits
+const maxAvroLongDigits = 18
+
+// avroSchema is an Avro record schema
+type avroSchema struct {
+	Type   string      `json:"type"`
+	Name   string      `json:"name"`
+	Doc    string      `json:"doc,omitempty"`
+	Fields []avroField `json:"fields"`
+}
+
+// avroField is a field of an Avro record schema; every field is nullable, defaulting to null
+type avroField struct {
+	Name    string `json:"name"`
+	Type    []any  `json:"type"`
+	Doc     string `json:"doc,omitempty"`
+	Default any    `json:"default"`
+}
+
+// avroDecimal is the Avro decimal logical type, stored as the bytes of the unscaled value
+type avroDecimal struct {
+	Type        string `json:"type"`
+	LogicalType string `json:"logicalType"`
+	Precision   int    `json:"precision"`
+	Scale       int    `json:"scale"`
+}
+
+// avroDate is the Avro date logical type, stored as the number of days since the Unix epoch
+type avroDate struct {
+	Type        string `json:"type"`
+	LogicalType string `json:"logicalType"`
+}
+
+// avroKind returns the Avro type of a variable's column, given the column's type (see columnType):
+//
+//   - "string" columns are strings
+//   - "int" columns are ints, unless they may not fit in 32 bits (10 digits, or no width), then longs
+//   - "bigint" columns are longs
+//   - "float" columns are decimals (of the column's width and implied decimal places), unless they
+//     have no decimal places and up to 18 digits, then longs; aggregate extracts, whose columns have
+//     no width, and decimals stored as native floats (see floats) get doubles
+func (dbf *DatabaseFormatter) avroKind(colType string, v Var) string {
+	width := v.Location.Width
+	switch colType {
+	case "string":
+		return "string"
+	case "int":
+		if width > 0 && width < maxPlacesFori32 {
+			return "int"
+		}
+		return "long"
+	case "bigint":
+		return "long"
+	default:
+		switch {
+		case width == 0 || dbf.floats(v):
+			return "double"
+		case v.DecimalPoint == 0 && width <= maxAvroLongDigits:
+			return "long"
+		default:
+			return "decimal"
+		}
+	}
+}
+
+// AvroSchema generates the Avro record schema of the main table, as JSON: the record is named after
+// the table, and has a nullable field for each column, documented with the variable's label.
+//
+// returns error if the table or a column is not a valid Avro name, or on the same checks as CreateMainTable
+// (see checkColumns)
+func (dbf *DatabaseFormatter) AvroSchema(ddi *DataDict) ([]byte, error) {
+	if err := dbf.checkColumns(ddi); err != nil {
+		return nil, err
+	}
+	schema := avroSchema{Type: "record", Name: dbf.ident(dbf.TableName), Fields: make([]avroField, 0, len(ddi.Vars)+1)}
+	if !avroNameRe.MatchString(schema.Name) {
+		return nil, fmt.Errorf("table name '%s' is not a valid Avro name (letters, digits, and underscores only)", schema.Name)
+	}
+	if len(ddi.ID) != 0 {
+		schema.Doc = fmt.Sprintf("IPUMS extract %s", ddi.ID)
+	}
+	if len(dbf.RowID) != 0 {
+		v := dbf.rowIDVar()
+		schema.Fields = append(schema.Fields, avroField{Name: dbf.columnName(v), Type: []any{"null", "long"}, Doc: v.Label})
+	}
+	for _, v := range ddi.Vars {
+		name := dbf.columnName(v)
+		if !avroNameRe.MatchString(name) {
+			return nil, fmt.Errorf("column name '%s' is not a valid Avro name (letters, digits, and underscores only)", name)
+		}
+		var fieldType any = dbf.avroKind(dbf.columnType(v), v)
+		if fieldType == "decimal" {
+			fieldType = avroDecimal{Type: "bytes", LogicalType: "decimal", Precision: max(v.Location.Width, v.DecimalPoint), Scale: v.DecimalPoint}
+		}
+		schema.Fields = append(schema.Fields, avroField{Name: name, Type: []any{"null", fieldType}, Doc: v.Label + dbf.scaleNote(v)})
+	}
+	types := dbf.appendedTypes()
+	for i, v := range dbf.appendedVars() {
+		name := dbf.columnName(v)
+		if !avroNameRe.MatchString(name) {
+			return nil, fmt.Errorf("column name '%s' is not a valid Avro name (letters, digits, and underscores only)", name)
+		}
+		var fieldType any = appendedAvroKind(types[i])
+		if fieldType == "date" {
+			fieldType = avroDate{Type: "int", LogicalType: "date"}
+		}
+		schema.Fields = append(schema.Fields, avroField{Name: name, Type: []any{"null", fieldType}, Doc: v.Label})
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// checkColumns runs the checks of CreateMainTable that apply to the columns and rows of dumps without
+// SQL (see AvroSchema, and DtaSchema)
+//
+// returns error if any fails
+func (dbf *DatabaseFormatter) checkColumns(ddi *DataDict) error {
+	if err := dbf.checkRenames(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkTypeOverrides(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkDecimals(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkNullPolicy(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkHashVars(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkRecodes(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkAppended(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkRowID(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkRepWeights(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkMelts(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkQFlags(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkVarGroups(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkModel(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkShardBy(ddi); err != nil {
+		return err
+	}
+	return nil
+}
+
+// avroRecord generates the Avro binary encoding of a fixed-width row, in place of an insertion tuple
+// (see insertTuple). Numbers are parsed as they'd be inserted.
+//
+// returns error if start and end positions are not valid for row, or if a field cannot be parsed.
+func (dbf *DatabaseFormatter) avroRecord(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	record := make([]byte, 0, len(row)+len(ddi.Vars))
+	if len(dbf.RowID) != 0 {
+		record = appendAvroRowID(record, rowNum)
+	}
+	for i, v := range ddi.Vars {
+		start, end := v.Location.Start-1, v.Location.End
+		if (start < 0) || (end > len(row)) {
+			return nil, fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+		}
+		colType := colTypes[v.Name]
+		chars, isNull, err := applyNullPolicy(row[start:end], nullPolicies[i], colType == "string")
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		if !isNull {
+			if chars, isNull, err = dbf.transformChars(v, chars); err != nil {
+				return nil, err
+			}
+		}
+		if isNull {
+			record = binary.AppendVarint(record, 0) // union branch 0: null
+			continue
+		}
+		val := string(chars)
+		if colType != "string" {
+			dcml := 0
+			if colType == "float" {
+				dcml = v.DecimalPoint
+			}
+			if val, err = fixedWidthNumber(chars, dcml); err != nil {
+				return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+			}
+		}
+		if record, err = appendAvroValue(record, dbf.avroKind(colType, v), v.DecimalPoint, val); err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+	}
+	if dbf.hasAppended() {
+		vals, err := dbf.appendedFromRow(ddi, row, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		return dbf.appendAvroAppended(record, vals)
+	}
+	return record, nil
+}
+
+// avroRecords generates an Avro data block (see avroBlock) from comma-delimited records, in place of
+// insertion statements (see BulkInsertRecords); fields are in the order of the data dictionary.
+//
+// returns error if any record cannot be parsed.
+func (dbf *DatabaseFormatter) avroRecords(ddi *DataDict, records [][]string, firstRow int, colIdx []int) ([]byte, error) {
+	colTypes := dbf.columnTypes(ddi)
+	var out []byte
+	for r, rec := range records {
+		if len(dbf.RowID) != 0 {
+			out = appendAvroRowID(out, firstRow+r)
+		}
+		for i, v := range ddi.Vars {
+			var field string
+			if colIdx[i] >= 0 && colIdx[i] < len(rec) {
+				field = strings.TrimSpace(rec[colIdx[i]])
+			}
+			var err error
+			if len(field) != 0 {
+				if field, _, err = dbf.transformField(v, field, 0); err != nil {
+					return nil, fmt.Errorf("record %v: %w", rec, err)
+				}
+			}
+			if len(field) == 0 {
+				out = binary.AppendVarint(out, 0)
+				continue
+			}
+			if out, err = appendAvroValue(out, dbf.avroKind(colTypes[v.Name], v), v.DecimalPoint, field); err != nil {
+				return nil, fmt.Errorf("record %v: variable %s: %w", rec, v.Name, err)
+			}
+		}
+		if dbf.hasAppended() {
+			vals, err := dbf.appendedFromRecord(rec, colIdx)
+			if err == nil {
+				out, err = dbf.appendAvroAppended(out, vals)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", rec, err)
+			}
+		}
+	}
+	return avroBlock(out, len(records))
+}
+
+// appendAvroRowID appends a row id (see DatabaseFormatter.RowID) to an Avro record
+func appendAvroRowID(record []byte, rowNum int) []byte {
+	record = binary.AppendVarint(record, 1) // union branch 1: long
+	return binary.AppendVarint(record, int64(rowNum))
+}
+
+// appendAvroValue appends the non-null branch of a nullable field to an Avro record, encoding a
+// value (a number, as formatted by fixedWidthNumber, or a string) as an Avro type (see avroKind)
+//
+// returns error if the value doesn't fit the type
+func appendAvroValue(record []byte, kind string, scale int, val string) ([]byte, error) {
+	record = binary.AppendVarint(record, 1) // union branch 1: the value
+	switch kind {
+	case "string":
+		record = binary.AppendVarint(record, int64(len(val)))
+		return append(record, val...), nil
+	case "int", "long":
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || (kind == "int" && (n > math.MaxInt32 || n < math.MinInt32)) {
+			return nil, fmt.Errorf("'%s' is not an Avro %s", val, kind)
+		}
+		return binary.AppendVarint(record, n), nil
+	case "double":
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", val)
+		}
+		return binary.LittleEndian.AppendUint64(record, math.Float64bits(f)), nil
+	case "date":
+		t, err := time.Parse(dateLayout, val)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a date", val)
+		}
+		return binary.AppendVarint(record, t.Unix()/(24*60*60)), nil
+	default:
+		unscaled, err := decimalBytes(val, scale)
+		if err != nil {
+			return nil, err
+		}
+		record = binary.AppendVarint(record, int64(len(unscaled)))
+		return append(record, unscaled...), nil
+	}
+}
+
+// decimalBytes returns the Avro decimal encoding of a number at a given scale: the two's complement,
+// big-endian bytes of its unscaled value (e.g., "-1.50" at scale 2 -> -150 -> 0xff6a)
+//
+// returns error if the number is malformed, or has more (non-zero) decimal places than the scale
+func decimalBytes(num string, scale int) ([]byte, error) {
+	sign, digits := "", num
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		sign, digits = digits[:1], digits[1:]
+	}
+	intPart, frac, _ := strings.Cut(digits, ".")
+	if len(frac) > scale {
+		if strings.Trim(frac[scale:], "0") != "" {
+			return nil, fmt.Errorf("'%s' has more than %d decimal places", num, scale)
+		}
+		frac = frac[:scale]
+	}
+	unscaled := strings.TrimLeft(intPart+frac+strings.Repeat("0", scale-len(frac)), "0")
+	if len(unscaled) == 0 {
+		return []byte{0}, nil
+	}
+	if strings.Trim(unscaled, "0123456789") != "" {
+		return nil, fmt.Errorf("'%s' is not a number", num)
+	}
+	if len(unscaled) <= maxAvroLongDigits {
+		n, _ := strconv.ParseInt(sign+unscaled, 10, 64)
+		return twosComplement(n), nil
+	}
+	n, _ := new(big.Int).SetString(sign+unscaled, 10)
+	size := n.BitLen()/8 + 1 // room for the sign bit
+	if n.Sign() < 0 {
+		n.Add(n, new(big.Int).Lsh(big.NewInt(1), uint(8*size)))
+	}
+	return n.FillBytes(make([]byte, size)), nil
+}
+
+// twosComplement returns the shortest two's complement, big-endian bytes of n
+func twosComplement(n int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(n))
+	// drop leading bytes that only extend the sign
+	for len(b) > 1 && ((b[0] == 0 && b[1]&0x80 == 0) || (b[0] == 0xff && b[1]&0x80 != 0)) {
+		b = b[1:]
+	}
+	return b
+}
+
+// avroBlock compresses Avro records into a data block, prefixed with the record count and the
+// compressed size; the block's sync marker is appended as it's written (see avroFile)
+func avroBlock(records []byte, count int) ([]byte, error) {
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(records); err != nil {
+		return nil, err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+	block := binary.AppendVarint(make([]byte, 0, compressed.Len()+20), int64(count))
+	block = binary.AppendVarint(block, int64(compressed.Len()))
+	return append(block, compressed.Bytes()...), nil
+}
+
+// avroParts are the files of Avro dumps: schema.avsc, and deflate compressed Avro object container
+// files of the form data_{i}.avro, each holding the schema in its header
+func avroParts(schema []byte) dumpParts {
+	return dumpParts{nameFmt: "data_%d.avro", schemaName: "schema.avsc", ext: ".avro", wrap: func(f *os.File) (DumpFile, error) {
+		return newAvroFile(f, schema)
+	}}
+}
+
+// NewAvroDumpWriter returns a DumpWriter of Avro object container files (see NewDumpWriter): a single
+// .avro file, or, in directory format, the schema (schema.avsc) along with one or more data_{i}.avro
+// files. Every file can be read on its own, as each holds the schema.
+//
+// returns error if writerName is an object storage URL
+func NewAvroDumpWriter(totBytes int, writerName string, makeItDir bool, split OutputSplit, schema []byte) (DumpWriter, error) {
+	if IsObjectURL(writerName) {
+		return DumpWriter{}, fmt.Errorf("Avro dumps can't be written to object storage; write to a local file or directory")
+	}
+	return newDumpWriter(totBytes, writerName, makeItDir, split, avroParts(schema))
+}
+
+// WriteAvroSchema writes the Avro schema to the schema file (schema.avsc) of a directory format dump;
+// single file dumps hold the schema in their header already. If the write cannot be completed,
+// a non-nil error is returned.
+func (dw DumpWriter) WriteAvroSchema(schema []byte) error {
+	if !dw.makeItDir {
+		return nil
+	}
+	defer dw.SchemaFile.Close()
+	if _, err := dw.SchemaFile.Write(append(schema, '\n')); err != nil {
+		return fmt.Errorf("ipums2db: schema write: %w", err)
+	}
+	return nil
+}
+
+// avroFile is a DumpFile written as an Avro object container file: the header (holding the schema,
+// the codec, and the file's sync marker) is written up front, and each write, which must be a single
+// data block (see avroBlock), is followed by the sync marker
+type avroFile struct {
+	f    *os.File
+	sync [16]byte
+}
+
+// newAvroFile writes the header of an Avro object container file to f, returning it as an avroFile
+//
+// returns error if the header cannot be written
+func newAvroFile(f *os.File, schema []byte) (DumpFile, error) {
+	af := &avroFile{f: f}
+	if _, err := rand.Read(af.sync[:]); err != nil {
+		return nil, err
+	}
+	header := append([]byte{}, avroMagic...)
+	header = binary.AppendVarint(header, 2) // metadata map: a single block of two entries
+	for _, kv := range [][2]string{{"avro.schema", string(schema)}, {"avro.codec", "deflate"}} {
+		header = binary.AppendVarint(header, int64(len(kv[0])))
+		header = append(header, kv[0]...)
+		header = binary.AppendVarint(header, int64(len(kv[1])))
+		header = append(header, kv[1]...)
+	}
+	header = binary.AppendVarint(header, 0) // end of the metadata map
+	header = append(header, af.sync[:]...)
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+// Write writes a data block, followed by the sync marker
+func (af *avroFile) Write(p []byte) (int, error) {
+	n, err := af.f.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = af.f.Write(af.sync[:])
+	return n, err
+}
+
+// Close closes the file
+func (af *avroFile) Close() error {
+	return af.f.Close()
+}
+
+// Name returns the file name
+func (af *avroFile) Name() string {
+	return af.f.Name()
+}
+
+// AvroSchemaFileName returns the name of the Avro schema file written for schema file-only generation
+// (e.g., "acs.sql" -> "acs.avsc")
+func AvroSchemaFileName(outFileName string) string {
+	for _, ext := range []string{".sql", ".avro", ".avsc"} {
+		outFileName = strings.TrimSuffix(outFileName, ext)
+	}
+	return outFileName + ".avsc"
+}
+
+// MkAvroSchema writes the Avro schema only; used for when only -x flag is passed, and not dat file arg (see MkDDL)
+func MkAvroSchema(dbfmtr *DatabaseFormatter, ddi *DataDict, outFileName string, silence bool) error {
+	schema, err := dbfmtr.AvroSchema(ddi)
+	if err != nil {
+		return err
+	}
+	outFileName = AvroSchemaFileName(outFileName)
+	dw, err := NewDumpWriterDDLOnly(outFileName)
+	if err != nil {
+		return err
+	}
+	_, err = dw.SchemaFile.Write(append(schema, '\n'))
+	if closeErr := dw.SchemaFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = dw.Commit()
+	}
+	if err != nil {
+		dw.FileCleanup()
+		return err
+	}
+	if !silence {
+		fmt.Printf("Avro schema written to %s\n", outFileName)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// azureAPIVersion is the Azure Blob Storage REST API version requests are made with
+const azureAPIVersion = "2021-08-06"
+
+// azureStore is a container of Azure Blob Storage, written to as block blobs: each part is staged
+// as a block, and the blob is committed from its block list. Requests are authorized with a SAS token.
+type azureStore struct {
+	endpoint  string // e.g., "https://myaccount.blob.core.windows.net"
+	container string
+	sas       string // shared access signature query string
+	client    *http.Client
+}
+
+// newAzureStore returns the azureStore of a container of the storage account AZURE_STORAGE_ACCOUNT,
+// authorized with the SAS token AZURE_STORAGE_SAS_TOKEN; AZURE_STORAGE_BLOB_ENDPOINT overrides the
+// account's endpoint (e.g., for the Azurite emulator).
+//
+// returns error if the account or SAS token are missing
+func newAzureStore(container string) (*azureStore, error) {
+	account, sas := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	endpoint := os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT")
+	if len(sas) == 0 || (len(account) == 0 && len(endpoint) == 0) {
+		return nil, fmt.Errorf("az: AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_SAS_TOKEN must be set")
+	}
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+	return &azureStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		container: container,
+		sas:       strings.TrimPrefix(sas, "?"),
+		client:    &http.Client{},
+	}, nil
+}
+
+// url returns the URL of a blob
+func (a *azureStore) url(key string) string {
+	return fmt.Sprintf("az://%s/%s", a.container, key)
+}
+
+// startUpload does nothing; staged blocks need no upload ID
+func (a *azureStore) startUpload(key string) (string, error) {
+	return "", nil
+}
+
+// uploadPart stages a block, returning its block ID
+func (a *azureStore) uploadPart(key, uploadID string, partNum int, data []byte) (string, error) {
+	// block IDs must all be of the same length
+	blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", partNum)))
+	_, err := a.send(http.MethodPut, key, "comp=block&blockid="+url.QueryEscape(blockID), data)
+	return blockID, err
+}
+
+// completeUpload commits the blob from its staged blocks
+func (a *azureStore) completeUpload(key, uploadID string, blockIDs []string) error {
+	var blocks bytes.Buffer
+	blocks.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		blocks.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blocks.WriteString("</BlockList>")
+	_, err := a.send(http.MethodPut, key, "comp=blocklist", blocks.Bytes())
+	return err
+}
+
+// abortUpload does nothing; uncommitted blocks are discarded by the service after a week
+func (a *azureStore) abortUpload(key, uploadID string) error {
+	return nil
+}
+
+// send sends a request on a blob
+func (a *azureStore) send(method, key, query string, body []byte) ([]byte, error) {
+	reqURL := fmt.Sprintf("%s/%s/%s?%s&%s", a.endpoint, uriEncode(a.container, false), uriEncode(key, true), query, a.sas)
+	_, respBody, err := sendWithRetry(a.client, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		return req, nil
+	})
+	return respBody, err
+}
@@ -0,0 +1,145 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// bcpFormatVersion is the version of the generated bcp format files: that of SQL Server 2008,
+// whose format files later releases read
+const bcpFormatVersion = "10.0"
+
+// bcpField is a field of a bcp format file: a variable, or a filler over columns no variable spans
+type bcpField struct {
+	name   string
+	length int
+	v      *Var // nil for fillers, which aren't loaded
+}
+
+// bcpFields returns the fields of the data file's lines, in position order: a field per variable, and
+// a filler field ahead of each variable not starting right after the previous one
+//
+// returns error if the extract is aggregate (comma-delimited), or hierarchical, or if variables overlap
+func bcpFields(ddi *DataDict) ([]bcpField, error) {
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return nil, fmt.Errorf("bcp format files describe fixed-width data files, not comma-delimited ones")
+	case ddi.Hierarchical():
+		return nil, fmt.Errorf("hierarchical data files mix record types, whose layouts differ; bcp format files describe a single layout")
+	}
+	vars := slices.Clone(ddi.Vars)
+	slices.SortStableFunc(vars, func(a, b Var) int { return a.Location.Start - b.Location.Start })
+	var (
+		fields []bcpField
+		end    int
+	)
+	for i := range vars {
+		v := &vars[i]
+		if v.Location.Start <= end {
+			return nil, fmt.Errorf("variable %s overlaps another variable, at column %d; bcp reads each column once", v.Name, v.Location.Start)
+		}
+		if gap := v.Location.Start - end - 1; gap > 0 {
+			fields = append(fields, bcpField{name: fmt.Sprintf("FILLER_%d", end+1), length: gap})
+		}
+		fields = append(fields, bcpField{name: v.Name, length: v.Location.End - v.Location.Start + 1, v: v})
+		end = v.Location.End
+	}
+	return fields, nil
+}
+
+// checkBcpLayout ensures that a bcp format file can describe the data file's layout (see bcpFields)
+//
+// returns error if not the case
+func checkBcpLayout(ddi *DataDict) error {
+	_, err := bcpFields(ddi)
+	return err
+}
+
+// emitBcpFormat generates a SQL Server (non-XML) bcp format file describing the fixed-width layout of the
+// data file: a fixed-length character field per variable, named after it, in position order, with filler
+// fields over the columns no variable spans, and a last one taking the rest of the line (including a
+// carriage return, if any). The fields are read and converted by the bulk load script (see emitBulkLoad).
+// It's for mssql only (see ParseEmitFlag).
+//
+// returns error if the data file's layout can't be described (see bcpFields)
+func emitBcpFormat(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	fields, err := bcpFields(ddi)
+	if err != nil {
+		return nil, err
+	}
+	var fmtFile strings.Builder
+	fmtFile.WriteString(bcpFormatVersion + "\n")
+	fmtFile.WriteString(fmt.Sprintf("%d\n", len(fields)+1))
+	col := 0
+	for i, f := range fields {
+		order := 0
+		if f.v != nil {
+			col++
+			order = col
+		}
+		fmtFile.WriteString(fmt.Sprintf("%-7d SQLCHAR %-7d %-7d %-8s %-7d %-20s %s\n", i+1, 0, f.length, `""`, order, f.name, `""`))
+	}
+	// the last field ends at the newline; its length allows for a carriage return
+	fmtFile.WriteString(fmt.Sprintf("%-7d SQLCHAR %-7d %-7d %-8s %-7d %-20s %s\n", len(fields)+1, 0, 1, `"\n"`, 0, "EOL", `""`))
+	return []byte(fmtFile.String()), nil
+}
+
+// emitBulkLoad generates a sqlcmd script bulk loading the data file into the main table created by the
+// DDL, in place of replaying the dump's inserts, given the name of its format file (see emitBcpFormat).
+// The data file is read through OPENROWSET(BULK ...), as BULK INSERT does (minimally logged, with TABLOCK),
+// so that the fields are converted on the way in: blank fields are null, and implied decimals are applied,
+// save in fields already holding a decimal point. The files are read by the server; their paths are the
+// DataFile and FormatFile sqlcmd variables.
+//
+// returns error if the main table holds columns that aren't in the data file (a row id), or some of its
+// variables are set apart in other tables, or dropped (see RepWeights, Melts, QFlags, VarGroups)
+func emitBulkLoad(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName, fmtFileName string) ([]byte, error) {
+	switch {
+	case len(dbfmtr.RowID) != 0:
+		return nil, fmt.Errorf("bulk loads can't number rows in file order (-row-id)")
+	case dbfmtr.RepWeights.long() || dbfmtr.Melts != nil:
+		return nil, fmt.Errorf("bulk loads only load the main table, not long-format tables (see -repwts, and -melt)")
+	case dbfmtr.QFlags != nil:
+		return nil, fmt.Errorf("bulk loads load every field of the data file, data quality flags included (see -qflags)")
+	case dbfmtr.VarGroups != nil:
+		return nil, fmt.Errorf("bulk loads only load the main table, not variable group tables (see -split-groups)")
+	}
+	fields, err := bcpFields(ddi)
+	if err != nil {
+		return nil, err
+	}
+	var cols, vals []string
+	for _, f := range fields {
+		if f.v == nil {
+			continue
+		}
+		cols = append(cols, dbfmtr.quoteIdent(dbfmtr.columnName(*f.v)))
+		val := fmt.Sprintf("NULLIF(src.%s, '')", dbfmtr.quoteIdent(f.name))
+		if f.v.DecimalPoint > 0 && dbfmtr.columnType(*f.v) == "float" {
+			val = fmt.Sprintf("CASE WHEN CHARINDEX('.', %s) > 0 THEN CAST(%s AS decimal(38, %d)) ELSE CAST(%s AS decimal(38, 0)) / 1%s END",
+				val, val, f.v.DecimalPoint, val, strings.Repeat("0", f.v.DecimalPoint))
+		}
+		vals = append(vals, val)
+	}
+	// UTF-8 data files can be read from 2016 onward
+	var codePage string
+	if !dbfmtr.releaseBefore(2016, 0) {
+		codePage = ", CODEPAGE = '65001'"
+	}
+
+	var script strings.Builder
+	script.WriteString("-- SQL Server bulk load script generated by ipums2db\n")
+	script.WriteString("-- create the tables with the DDL first, then load with:\n")
+	script.WriteString(fmt.Sprintf("--   sqlcmd -S <server> -d <database> -i <this file> -v DataFile=\"%s\" FormatFile=\"%s\"\n",
+		datFileName, filepath.Base(fmtFileName)))
+	script.WriteString("-- the files are read by the server; give their paths as it sees them\n")
+	script.Write(dbfmtr.UseStatement())
+	script.WriteString(fmt.Sprintf("INSERT INTO %s WITH (TABLOCK) (%s)\nSELECT\n\t%s\n",
+		dbfmtr.ident(dbfmtr.TableName), strings.Join(cols, ", "), strings.Join(vals, ",\n\t")))
+	script.WriteString(fmt.Sprintf("FROM OPENROWSET(BULK N'$(DataFile)', FORMATFILE = N'$(FormatFile)'%s) AS src;\n", codePage))
+	return []byte(script.String()), nil
+}
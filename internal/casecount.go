@@ -0,0 +1,112 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CaseCountError reports the case counts declared by a data dictionary that its data file doesn't match
+// (e.g., a truncated download)
+type CaseCountError struct {
+	File       string
+	Mismatches []string // e.g., "5 rows, but 6 cases declared"
+}
+
+// Error lists the mismatches
+func (e *CaseCountError) Error() string {
+	return fmt.Sprintf("%s doesn't match the case counts of its data dictionary (%s); is it truncated, or from another extract?",
+		e.File, strings.Join(e.Mismatches, "; "))
+}
+
+// CheckCaseCounts checks the rows of a data file against the case counts declared by its data dictionary
+// (caseQnty), if any, given the rows of a fixed-width file (see DetectLineEndings); aggregate extracts'
+// records are counted here, if needed. Hierarchical extracts, declaring a case count per record type (see
+// RecGroup), have their records counted by type, from the record type variable; their total isn't checked.
+//
+// returns *CaseCountError if the file doesn't match; other errors if it can't be read
+func CheckCaseCounts(datFileName string, ddi *DataDict, rows int) error {
+	ccErr := &CaseCountError{File: datFileName}
+	var counted []RecGroup
+	for _, g := range ddi.RecGroups {
+		if g.CaseQnty > 0 {
+			counted = append(counted, g)
+		}
+	}
+	recType, ok := ddi.RecTypeVar()
+	switch {
+	case len(counted) > 1 && ok && ddi.Flavor != AGGREGATE:
+		counts, err := countRecordTypes(datFileName, ddi, recType)
+		if err != nil {
+			return err
+		}
+		for _, g := range counted {
+			if n := counts[strings.TrimSpace(g.RecType)]; n != g.CaseQnty {
+				ccErr.Mismatches = append(ccErr.Mismatches, fmt.Sprintf("%d records of type %s, but %d declared", n, g.RecType, g.CaseQnty))
+			}
+		}
+	case ddi.CaseQnty > 0 || len(counted) == 1:
+		declared := ddi.CaseQnty
+		if declared == 0 {
+			declared = counted[0].CaseQnty
+		}
+		if ddi.Flavor == AGGREGATE {
+			var err error
+			if rows, err = CountCSVRecords(datFileName); err != nil {
+				return err
+			}
+		}
+		if rows != declared {
+			ccErr.Mismatches = append(ccErr.Mismatches, fmt.Sprintf("%d rows, but %d cases declared", rows, declared))
+		}
+	}
+	if len(ccErr.Mismatches) != 0 {
+		return ccErr
+	}
+	return nil
+}
+
+// countRecordTypes reads a fixed-width file line by line, counting its records by the value of the record
+// type variable (trimmed); lines too short to hold it count as blank
+//
+// returns error if the file can't be read
+func countRecordTypes(datFileName string, ddi *DataDict, recType Var) (map[string]int, error) {
+	datFile, err := OpenDat(datFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer datFile.Close()
+	size, err := datFile.Size()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	in := bufio.NewReaderSize(io.NewSectionReader(datFile, 0, size), max(1<<20, BytesPerRow(ddi)+1))
+	for {
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("a line of %s is longer than the %d characters described by the data dictionary", datFileName, BytesPerRow(ddi)-1)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		var val []byte
+		if len(line) >= recType.Location.End {
+			val = bytes.TrimSpace(line[recType.Location.Start-1 : recType.Location.End])
+		}
+		counts[string(val)]++
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return counts, nil
+}
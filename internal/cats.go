@@ -0,0 +1,107 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// catRangeRe matches category codes expressing a range of values (e.g., "1-5", "10..19", "90 thru 99"),
+// and catOpenRangeRe matches those with an open upper bound (e.g., "90+")
+var (
+	catRangeRe     = regexp.MustCompile(`(?i)^(-?\d+(?:\.\d+)?)\s*(?:-|\.\.|thru|through|to)\s*(-?\d+(?:\.\d+)?)$`)
+	catOpenRangeRe = regexp.MustCompile(`^(-?\d+(?:\.\d+)?)\s*\+$`)
+)
+
+// catRange returns the bounds of a numeric variable's category code: both bounds are the code itself for
+// single values, and an open upper bound is "". ok is false for non-numeric (e.g., grouped "BB") codes.
+func catRange(val string) (lo, hi string, ok bool) {
+	val = strings.TrimSpace(val)
+	if _, err := strconv.ParseFloat(val, 64); err == nil {
+		return val, val, true
+	}
+	if m := catRangeRe.FindStringSubmatch(val); m != nil {
+		return m[1], m[2], true
+	}
+	if m := catOpenRangeRe.FindStringSubmatch(val); m != nil {
+		return m[1], "", true
+	}
+	return "", "", false
+}
+
+// hasCatRanges reports whether any category of a numeric variable is a range of values,
+// in which case its ref_table has val_min and val_max columns in place of val
+func hasCatRanges(v Var) bool {
+	if v.VType.VarType == "character" {
+		return false
+	}
+	for _, c := range v.Cats {
+		if lo, hi, ok := catRange(c.Val); ok && lo != hi {
+			return true
+		}
+	}
+	return false
+}
+
+// refTableCols returns the names of a variable's ref_table columns, the last being the label column:
+// (val, label), or (val_min, val_max, label) for variables with range categories
+func (dbf *DatabaseFormatter) refTableCols(v Var) []string {
+	if hasCatRanges(v) {
+		return []string{dbf.ident("val_min"), dbf.ident("val_max"), dbf.ident("label")}
+	}
+	return []string{dbf.ident("val"), dbf.ident("label")}
+}
+
+// refTableColDefs returns the column definitions of a variable's ref_table, as found between the
+// parentheses of a "CREATE TABLE" statement; if pk is true, the first column is the primary key
+func (dbf *DatabaseFormatter) refTableColDefs(v Var, pk bool) string {
+	cols := dbf.refTableCols(v)
+	defs := make([]string, len(cols))
+	for i, col := range cols[:len(cols)-1] {
+		defs[i] = fmt.Sprintf("%s %s%s", col, dbf.columnSQLType(v), dbf.varCollation(v))
+	}
+	if pk {
+		defs[0] += " PRIMARY KEY"
+	}
+	defs[len(cols)-1] = fmt.Sprintf("%s %s%s", cols[len(cols)-1], dbf.sqlType("string", maxCharsInLab), dbf.labelCollation())
+	return "\n\t" + strings.Join(defs, ",\n\t") + "\n"
+}
+
+// refTableRows returns the values of a variable's ref_table rows, as SQL literals in the order of
+// refTableCols. Codes that can't be stored in the variable's column (non-numeric codes of numeric
+// variables) are skipped, and returned as "code (label)" descriptions.
+func (dbf *DatabaseFormatter) refTableRows(v Var) (rows [][]string, skipped []string) {
+	ranges := hasCatRanges(v)
+	for _, c := range v.Cats {
+		label := dbf.sqlString(c.Label)
+		if v.VType.VarType == "character" {
+			rows = append(rows, []string{dbf.sqlString(c.Val), label})
+			continue
+		}
+		lo, hi, ok := catRange(c.Val)
+		switch {
+		case !ok:
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", strings.TrimSpace(c.Val), c.Label))
+		case !ranges:
+			rows = append(rows, []string{lo, label})
+		case len(hi) == 0:
+			rows = append(rows, []string{lo, "null", label})
+		default:
+			rows = append(rows, []string{lo, hi, label})
+		}
+	}
+	return rows, skipped
+}
+
+// skippedCatsComment returns SQL comments listing the category codes skipped from a ref_table
+func skippedCatsComment(tableName string, skipped []string) string {
+	var comment strings.Builder
+	flatten := strings.NewReplacer("\n", " ", "\r", "")
+	for _, s := range skipped {
+		comment.WriteString(fmt.Sprintf("-- %s: skipped non-numeric code %s\n", tableName, flatten.Replace(s)))
+	}
+	return comment.String()
+}
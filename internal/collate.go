@@ -0,0 +1,153 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// COLLATE_BINARY is the portable name of each database system's binary collation (see binaryCollations)
+const COLLATE_BINARY string = "binary"
+
+// COLLATE_LABELS is the -collate key of the label columns of ref_tables (and dimension tables)
+const COLLATE_LABELS string = "labels"
+
+// binaryCollations are the collations comparing characters by code, which -collate binary stands for;
+// comparisons of code-like columns (e.g., geographic codes) needn't be locale-aware, and are far faster
+var binaryCollations = map[string]string{
+	POSTGRES:  "C",
+	MYSQL:     "utf8mb4_bin",
+	MSSQL:     "Latin1_General_100_BIN2",
+	ORACLE:    "BINARY",
+	SNOWFLAKE: "utf8",
+}
+
+// collationRe matches collation names: identifiers, or the ICU locales of postgres (e.g., "en-US-x-icu"),
+// and the collation specifications of snowflake (e.g., "en-ci")
+var collationRe = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// Collations are the collations of character columns (see ParseCollateFlag): by variable, then by default.
+// Label columns of ref_tables have their own, as locale-aware ordering suits text, rather than codes.
+type Collations struct {
+	Default string            // collation of character columns of the main table (and their ref_tables' codes)
+	Labels  string            // collation of the label columns of ref_tables
+	ByVar   map[string]string // lowercased variable name -> collation
+}
+
+// ParseCollateFlag parses the -collate flag argument into Collations. The argument is a comma-delimited
+// list of collations, each either applying to every character column by default (e.g., "C"), to the
+// label columns of ref_tables (e.g., "labels=en-US-x-icu"), or to a variable (e.g., "statefip=binary").
+// Collations are named as in the database system, or "binary" for its binary collation (see binaryCollations).
+//
+// returns nil if the argument is empty; returns error if a collation is malformed, or set twice
+func ParseCollateFlag(collateF string) (*Collations, error) {
+	if len(strings.TrimSpace(collateF)) == 0 {
+		return nil, nil
+	}
+	c := &Collations{ByVar: make(map[string]string)}
+	for _, p := range strings.Split(collateF, ",") {
+		key, collation, found := strings.Cut(p, "=")
+		if !found {
+			key, collation = "", key
+		}
+		key, collation = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(collation)
+		if !collationRe.MatchString(collation) {
+			return nil, fmt.Errorf("'%s' is not a collation name (letters, digits, and _ . @ - only)", collation)
+		}
+		var dup bool
+		switch key {
+		case "":
+			dup, c.Default = len(c.Default) != 0, collation
+			key = "character columns"
+		case COLLATE_LABELS:
+			dup, c.Labels = len(c.Labels) != 0, collation
+		default:
+			_, dup = c.ByVar[key]
+			c.ByVar[key] = collation
+		}
+		if dup {
+			return nil, fmt.Errorf("collation of %s is set more than once", key)
+		}
+	}
+	return c, nil
+}
+
+// checkCollations ensures that every variable with its own collation is a character variable of the data
+// dictionary, and that collations are valid names in the database system, which supports them: oracle
+// from 12.2 onward (with extended string sizes)
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkCollations(ddi *DataDict) error {
+	if dbf.Collations == nil {
+		return nil
+	}
+	if dbf.DbType == ORACLE && dbf.releaseBefore(12, 2) {
+		return fmt.Errorf("column collations aren't supported by oracle before 12.2")
+	}
+	vars := make(map[string]Var, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		vars[strings.ToLower(v.Name)] = v
+	}
+	collations := []string{dbf.Collations.Default, dbf.Collations.Labels}
+	for name, collation := range dbf.Collations.ByVar {
+		v, ok := vars[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("cannot set collation of unrecognized variable %s", name)
+		case dbf.columnType(v) != "string":
+			return fmt.Errorf("cannot set collation of %s, which isn't a character column", v.Name)
+		}
+		collations = append(collations, collation)
+	}
+	for _, collation := range collations {
+		if len(collation) == 0 || strings.EqualFold(collation, COLLATE_BINARY) {
+			continue
+		}
+		// collations are identifiers in mysql, mssql, and oracle; postgres quotes them, and snowflake's are strings
+		if (dbf.DbType == MYSQL || dbf.DbType == MSSQL || dbf.DbType == ORACLE) && !identifierRe.MatchString(collation) {
+			return fmt.Errorf("'%s' is not a valid %s collation name (letters, digits, and underscores only)", collation, dbf.DbType)
+		}
+	}
+	return nil
+}
+
+// collateClause returns the COLLATE clause following the type of a column with a collation (e.g.,
+// ` COLLATE "C"`), or "" if there's no collation
+func (dbf *DatabaseFormatter) collateClause(collation string) string {
+	if len(collation) == 0 {
+		return ""
+	}
+	if strings.EqualFold(collation, COLLATE_BINARY) {
+		collation = binaryCollations[dbf.DbType]
+	}
+	switch dbf.DbType {
+	case POSTGRES:
+		return ` COLLATE "` + collation + `"`
+	case SNOWFLAKE:
+		return " COLLATE '" + collation + "'"
+	default:
+		return " COLLATE " + collation
+	}
+}
+
+// varCollation returns the COLLATE clause of a variable's column (and its ref_table's codes), or "" if it
+// isn't a character column, or has no collation
+func (dbf *DatabaseFormatter) varCollation(v Var) string {
+	if dbf.Collations == nil || dbf.columnType(v) != "string" {
+		return ""
+	}
+	if collation, ok := dbf.Collations.ByVar[strings.ToLower(v.Name)]; ok {
+		return dbf.collateClause(collation)
+	}
+	return dbf.collateClause(dbf.Collations.Default)
+}
+
+// labelCollation returns the COLLATE clause of the label columns of ref_tables, or "" if they have no collation
+func (dbf *DatabaseFormatter) labelCollation() string {
+	if dbf.Collations == nil {
+		return ""
+	}
+	return dbf.collateClause(dbf.Collations.Labels)
+}
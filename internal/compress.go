@@ -0,0 +1,141 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// compressBlocks spawns a pool of workers compressing the blocks of ParsedResults (see gzipMember) between
+// the parsers and the writers, so that compression scales with the number of workers, rather than with the
+// number of writers (each of which would otherwise compress everything it writes). Results are returned in
+// the order they're received, so that order (e.g., see Sequencer) is kept; at most workers results are
+// compressed at a time. The returned channel is closed once parsedStream is closed. The work of the
+// workers is recorded in stats, if set.
+func compressBlocks(workers int, parsedStream <-chan ParsedResult, stats *RunStats) <-chan ParsedResult {
+	type compressJob struct {
+		res  ParsedResult
+		done chan ParsedResult
+	}
+	compressedStream := make(chan ParsedResult, cap(parsedStream))
+	jobs := make(chan compressJob)
+	// queue holds the results being compressed, in order of receipt
+	queue := make(chan chan ParsedResult, workers)
+	go func() {
+		for res := range parsedStream {
+			done := make(chan ParsedResult, 1)
+			queue <- done
+			jobs <- compressJob{res, done}
+		}
+		close(jobs)
+		close(queue)
+	}()
+	stats.setStage(stageCompress, workers)
+	for range workers {
+		go func() {
+			zw := gzip.NewWriter(nil)
+			for job := range jobs {
+				start := time.Now()
+				res := compressResult(zw, job.res)
+				stats.addBusy(stageCompress, time.Since(start))
+				job.done <- res
+			}
+		}()
+	}
+	go func() {
+		defer close(compressedStream)
+		for done := range queue {
+			compressedStream <- <-done
+		}
+	}()
+	return compressedStream
+}
+
+// compressResult compresses the block (or shards) of a ParsedResult with zw; results with errors are
+// returned as they are, and compression errors are returned in the result
+func compressResult(zw *gzip.Writer, res ParsedResult) ParsedResult {
+	if res.AnyError != nil {
+		return res
+	}
+	var err error
+	if res.Block, err = gzipMember(zw, res.Block); err != nil {
+		res.AnyError = fmt.Errorf("compressing block: %w", err)
+		return res
+	}
+	for i := range res.Shards {
+		if res.Shards[i].Block, err = gzipMember(zw, res.Shards[i].Block); err != nil {
+			res.AnyError = fmt.Errorf("compressing block: %w", err)
+			return res
+		}
+	}
+	return res
+}
+
+// gzipMember compresses a block into a self-contained gzip member, using (and resetting) zw; members
+// concatenated together make up a single gzip stream, as read by gzip tools and database loaders.
+// Empty blocks are left empty.
+func gzipMember(zw *gzip.Writer, block []byte) ([]byte, error) {
+	if len(block) == 0 {
+		return block, nil
+	}
+	var compressed bytes.Buffer
+	zw.Reset(&compressed)
+	if _, err := zw.Write(block); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// NumCompressWorkers returns the number of compression workers of the -compress-workers flag: one per
+// CPU if 0 (the default)
+//
+// returns error if workers is negative
+func NumCompressWorkers(workers int) (int, error) {
+	if workers < 0 {
+		return 0, fmt.Errorf("-compress-workers (%d) cannot be negative", workers)
+	}
+	if workers == 0 {
+		return runtime.NumCPU(), nil
+	}
+	return workers, nil
+}
+
+// gzipMembersFile is a DumpFile of blocks compressed ahead of time, each a gzip member (see compressBlocks),
+// written as they are; together, they make up a gzip stream
+type gzipMembersFile struct {
+	*os.File
+	written bool
+}
+
+// newGzipMembersFile wraps a file, to be written blocks compressed ahead of time
+func newGzipMembersFile(f *os.File) (DumpFile, error) {
+	return &gzipMembersFile{File: f}, nil
+}
+
+// Write writes a compressed block (a gzip member) to the file
+func (g *gzipMembersFile) Write(member []byte) (int, error) {
+	g.written = g.written || len(member) != 0
+	return g.File.Write(member)
+}
+
+// Close closes the file; a file with no blocks is written an empty member first, so that it's a valid
+// gzip stream, as those compressed by the writer are (see gzipFile)
+func (g *gzipMembersFile) Close() error {
+	if !g.written {
+		g.written = true
+		empty := gzip.NewWriter(g.File)
+		if err := empty.Close(); err != nil {
+			g.File.Close()
+			return err
+		}
+	}
+	return g.File.Close()
+}
@@ -0,0 +1,51 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"os"
+)
+
+// ANSI escape sequences styling console output (see styled)
+const (
+	styleBold  = "\033[1m"
+	styleRed   = "\033[31m"
+	styleGreen = "\033[32m"
+	styleCyan  = "\033[36m"
+	styleReset = "\033[0m"
+	clearLine  = "\r\033[K" // returns to the start of the line, and clears it
+)
+
+// IsInteractive returns whether f is a terminal, rather than a file or pipe
+func IsInteractive(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor returns whether output to f is styled: f is a terminal, and NO_COLOR (see https://no-color.org)
+// isn't set
+func useColor(f *os.File) bool {
+	return IsInteractive(f) && len(os.Getenv("NO_COLOR")) == 0
+}
+
+// styled returns s in style, if output to f is styled (see useColor); s as is, if not
+func styled(f *os.File, style, s string) string {
+	if !useColor(f) {
+		return s
+	}
+	return style + s + styleReset
+}
+
+// ErrorLabel returns the label of an error message printed to f (e.g., its topic), in bold red if styled
+func ErrorLabel(f *os.File, label string) string {
+	return styled(f, styleBold+styleRed, label)
+}
+
+// ClearLine returns the sequence clearing the current line of f, if it's a terminal, so that a message
+// isn't printed after the loading message (see PrintLoadingMessage); nothing, if not
+func ClearLine(f *os.File) string {
+	if !IsInteractive(f) {
+		return ""
+	}
+	return clearLine
+}
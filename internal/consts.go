@@ -0,0 +1,239 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// constIntRe matches constant values written as integers, without leading zeros (which would be lost)
+var constIntRe = regexp.MustCompile(`^-?(0|[1-9][0-9]{0,17})$`)
+
+// ConstColumn is a column holding the same literal value in every row (e.g., the extract a row came from)
+type ConstColumn struct {
+	Name  string
+	Value string
+}
+
+// ParseConstFlag parses the arguments of -add-const flags, each of the form name=value
+// (e.g., "extract_id=usa_00012"), into constant columns, in order
+//
+// returns error if an argument is malformed, or a column is added more than once
+func ParseConstFlag(constFs []string) ([]ConstColumn, error) {
+	consts := make([]ConstColumn, 0, len(constFs))
+	for _, c := range constFs {
+		name, value, found := strings.Cut(c, "=")
+		name = strings.TrimSpace(name)
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form name=value", c)
+		}
+		if !identifierRe.MatchString(name) {
+			return nil, fmt.Errorf("'%s' is not a valid column name (letters, digits, and underscores only)", name)
+		}
+		if slices.ContainsFunc(consts, func(c ConstColumn) bool { return strings.EqualFold(c.Name, name) }) {
+			return nil, fmt.Errorf("%s is added more than once", name)
+		}
+		consts = append(consts, ConstColumn{Name: name, Value: value})
+	}
+	return consts, nil
+}
+
+// constType returns the type of a constant column: "bigint" for integers, and "string" otherwise
+func constType(c ConstColumn) string {
+	if constIntRe.MatchString(c.Value) {
+		return "bigint"
+	}
+	return "string"
+}
+
+// hasAppended reports whether columns are appended to the main table, after the variables
+func (dbf *DatabaseFormatter) hasAppended() bool {
+	return dbf.Derived != nil || len(dbf.Consts) != 0 || len(dbf.Dates) != 0
+}
+
+// appendedVars returns the columns appended to the main table, after the variables, as variables (for
+// naming, see columnName, and documentation): the derived columns, the constant columns, then the date columns
+func (dbf *DatabaseFormatter) appendedVars() []Var {
+	var vars []Var
+	if dbf.Derived != nil {
+		for _, c := range dbf.Derived.cols {
+			vars = append(vars, Var{Name: c.name, Label: "derived: " + c.src})
+		}
+	}
+	for _, c := range dbf.Consts {
+		vars = append(vars, Var{Name: c.Name, Label: "constant: " + cmp.Or(c.Value, "null"), Location: Loc{Width: len(c.Value)}})
+	}
+	for _, dc := range dbf.Dates {
+		vars = append(vars, Var{Name: dc.Name, Label: dc.label()})
+	}
+	return vars
+}
+
+// appendedTypes returns the types of the appended columns (see appendedVars): "bigint", "double", "string", or "date"
+func (dbf *DatabaseFormatter) appendedTypes() []string {
+	var types []string
+	if dbf.Derived != nil {
+		for _, c := range dbf.Derived.cols {
+			types = append(types, derivedType(c))
+		}
+	}
+	for _, c := range dbf.Consts {
+		types = append(types, constType(c))
+	}
+	for range dbf.Dates {
+		types = append(types, "date")
+	}
+	return types
+}
+
+// appendedSQLTypes returns the database types of the appended columns (see appendedVars)
+func (dbf *DatabaseFormatter) appendedSQLTypes() []string {
+	vars := dbf.appendedVars()
+	types := dbf.appendedTypes()
+	for i, t := range types {
+		if t == "string" {
+			types[i] = dbf.sqlType(t, max(vars[i].Location.Width, 1))
+		} else {
+			types[i] = dbf.sqlType(t)
+		}
+	}
+	return types
+}
+
+// checkAppended ensures that the appended columns can be computed, and that none is named after another column
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkAppended(ddi *DataDict) error {
+	if err := dbf.checkDerived(ddi); err != nil {
+		return err
+	}
+	if err := dbf.checkDates(ddi); err != nil {
+		return err
+	}
+	for _, c := range dbf.Consts {
+		if col, ok := dbf.lookupVarColumn(ddi, c.Name); ok {
+			return fmt.Errorf("constant column %s is named after column %s", c.Name, col)
+		}
+	}
+	for _, dc := range dbf.Dates {
+		if col, ok := dbf.lookupVarColumn(ddi, dc.Name); ok {
+			return fmt.Errorf("date column %s is named after column %s", dc.Name, col)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, v := range dbf.appendedVars() {
+		if seen[strings.ToLower(v.Name)] {
+			return fmt.Errorf("column %s is added more than once (as a derived, constant, or date column)", v.Name)
+		}
+		seen[strings.ToLower(v.Name)] = true
+	}
+	return nil
+}
+
+// appendedFromRow returns the values of the appended columns of a fixed-width row (see derivedFromRow),
+// as they'd be written to CSV files: numbers as is, strings unquoted, and dates as dateLayout; "" is null
+//
+// returns error if a derived column cannot be computed
+func (dbf *DatabaseFormatter) appendedFromRow(ddi *DataDict, row []byte, nullPolicies []string) ([]string, error) {
+	var vals []string
+	if dbf.Derived != nil {
+		var err error
+		if vals, err = dbf.derivedFromRow(ddi, row, nullPolicies); err != nil {
+			return nil, err
+		}
+	}
+	return append(dbf.appendConsts(vals), dbf.datesFromRow(ddi, row, nullPolicies)...), nil
+}
+
+// appendedFromRecord returns the values of the appended columns of a comma-delimited record (see appendedFromRow)
+func (dbf *DatabaseFormatter) appendedFromRecord(rec []string, colIdx []int) ([]string, error) {
+	var vals []string
+	if dbf.Derived != nil {
+		var err error
+		if vals, err = dbf.derivedFromRecord(rec, colIdx); err != nil {
+			return nil, err
+		}
+	}
+	return append(dbf.appendConsts(vals), dbf.datesFromRecord(rec, colIdx)...), nil
+}
+
+// appendConsts appends the values of the constant columns to vals; an empty constant is null
+func (dbf *DatabaseFormatter) appendConsts(vals []string) []string {
+	for _, c := range dbf.Consts {
+		vals = append(vals, c.Value)
+	}
+	return vals
+}
+
+// appendedSQL formats the values of the appended columns (see appendedFromRow) as SQL literals,
+// each preceded by a comma, for insertion tuples
+func (dbf *DatabaseFormatter) appendedSQL(vals []string) string {
+	var sql strings.Builder
+	for i, t := range dbf.appendedTypes() {
+		sql.WriteByte(',')
+		switch {
+		case len(vals[i]) == 0:
+			sql.WriteString("null")
+		case t == "string":
+			sql.WriteString(dbf.sqlString(vals[i]))
+		case t == "date":
+			sql.WriteString(dbf.dateLiteral(vals[i]))
+		default:
+			sql.WriteString(vals[i])
+		}
+	}
+	return sql.String()
+}
+
+// appendedCSV formats the values of the appended columns (see appendedFromRow) as CSV fields,
+// each preceded by a comma, for staged CSV records (see csvRecord)
+func (dbf *DatabaseFormatter) appendedCSV(vals []string) string {
+	var csv strings.Builder
+	for i, t := range dbf.appendedTypes() {
+		csv.WriteByte(',')
+		switch {
+		case len(vals[i]) == 0:
+			csv.WriteString(csvNull)
+		case t == "string":
+			csv.WriteString(csvQuote(vals[i]))
+		default:
+			csv.WriteString(vals[i])
+		}
+	}
+	return csv.String()
+}
+
+// appendedAvroKind returns the Avro type of an appended column type (see appendedTypes)
+func appendedAvroKind(t string) string {
+	switch t {
+	case "bigint":
+		return "long"
+	case "string", "date":
+		return t
+	default:
+		return "double"
+	}
+}
+
+// appendAvroAppended appends the values of the appended columns (see appendedFromRow) to an Avro record
+//
+// returns error if a value doesn't fit its type
+func (dbf *DatabaseFormatter) appendAvroAppended(record []byte, vals []string) ([]byte, error) {
+	vars := dbf.appendedVars()
+	var err error
+	for i, t := range dbf.appendedTypes() {
+		if len(vals[i]) == 0 {
+			record = binary.AppendVarint(record, 0)
+			continue
+		}
+		if record, err = appendAvroValue(record, appendedAvroKind(t), 0, vals[i]); err != nil {
+			return nil, fmt.Errorf("column %s: %w", vars[i].Name, err)
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,159 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// rowsPerCSVBlock determines the number of comma-delimited records parsed into a single
+// bulk insert statement. Unlike fixed-width files, comma-delimited files can't be split into
+// byte ranges up front, so they're read sequentially, one block at a time.
+const rowsPerCSVBlock = 10000
+
+// NewCSVParser returns a CSVParser given a comma-delimited file path,
+// a DataDict to read from, a DatabaseFormatter to parse results with, and the max number
+// of records per insertion statement (rowsPerCSVBlock if not positive, or greater)
+func NewCSVParser(csvFileName string, ddi *DataDict, dbfmtr *DatabaseFormatter, rowsPerBlock int) CSVParser {
+	if rowsPerBlock <= 0 || rowsPerBlock > rowsPerCSVBlock {
+		rowsPerBlock = rowsPerCSVBlock
+	}
+	return CSVParser{
+		csvFileName:  csvFileName,
+		ddi:          ddi,
+		dbfmtr:       dbfmtr,
+		rowsPerBlock: rowsPerBlock,
+	}
+}
+
+// CSVParser converts the comma-delimited data of aggregate extracts (e.g., NHGIS, IHGIS)
+// into SQL insertion statements. The first record of the file must be a header, naming each column.
+type CSVParser struct {
+	csvFileName  string
+	ddi          *DataDict
+	dbfmtr       *DatabaseFormatter
+	rowsPerBlock int
+}
+
+// ParseCSV reads the comma-delimited file sequentially, sending blocks of insertion
+// statements to parsedStream. It does not close parsedStream.
+//
+// In case of read or parsing errors, the error is sent as a ParsedResult, and parsing stops;
+// the errors will be handled by the DumpWriter reading ParsedResults from the output stream.
+func (cp CSVParser) ParseCSV(parsedStream chan<- ParsedResult) {
+	err := cp.parse(parsedStream)
+	if err != nil {
+		parsedStream <- ParsedResult{AnyError: err}
+	}
+}
+
+// parse does the work for ParseCSV, returning the first error encountered
+func (cp CSVParser) parse(parsedStream chan<- ParsedResult) error {
+	csvFile, err := os.Open(cp.csvFileName)
+	if err != nil {
+		return err
+	}
+	defer csvFile.Close()
+
+	r := csv.NewReader(csvFile)
+	r.FieldsPerRecord = -1 // don't fail on ragged rows; missing fields are null
+
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("reading header of %s: %w", cp.csvFileName, err)
+	}
+	colIdx, err := csvColumnIndices(cp.ddi, header)
+	if err != nil {
+		return err
+	}
+
+	records := make([][]string, 0, cp.rowsPerBlock)
+	firstRow, index := 1, 0
+	start := time.Now()
+	for {
+		rec, err := r.Read()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading %s: %w", cp.csvFileName, err)
+		}
+		if rec != nil {
+			records = append(records, rec)
+		}
+		if len(records) == cp.rowsPerBlock || (errors.Is(err, io.EOF) && len(records) > 0) {
+			block, bErr := cp.dbfmtr.BulkInsertRecords(cp.ddi, records, firstRow, colIdx)
+			if bErr != nil {
+				return bErr
+			}
+			parsedStream <- ParsedResult{Block: block, Rows: len(records), Index: index, ParseTime: time.Since(start)}
+			start = time.Now()
+			firstRow += len(records)
+			index++
+			records = make([][]string, 0, cp.rowsPerBlock)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// CountCSVRecords returns the number of records in a comma-delimited file, not counting the header.
+//
+// returns error if the file cannot be read or parsed
+func CountCSVRecords(csvFileName string) (int, error) {
+	csvFile, err := os.Open(csvFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer csvFile.Close()
+
+	r := csv.NewReader(csvFile)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	nRecords := 0
+	for {
+		_, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading %s: %w", csvFileName, err)
+		}
+		nRecords++
+	}
+	if nRecords > 0 {
+		nRecords-- // header
+	}
+	return nRecords, nil
+}
+
+// csvColumnIndices matches each variable in the data dictionary to a column of the header,
+// by case-insensitive name. Variables not found in the header have an index of -1.
+//
+// returns error if none of the variables are found in the header
+func csvColumnIndices(ddi *DataDict, header []string) ([]int, error) {
+	headerIdx := make(map[string]int, len(header))
+	for i, h := range header {
+		h = strings.TrimPrefix(h, "\ufeff") // byte order mark, if any
+		headerIdx[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	colIdx := make([]int, len(ddi.Vars))
+	nFound := 0
+	for i, v := range ddi.Vars {
+		idx, ok := headerIdx[strings.ToLower(v.Name)]
+		if !ok {
+			colIdx[i] = -1
+			continue
+		}
+		colIdx[i] = idx
+		nFound++
+	}
+	if nFound == 0 {
+		return nil, fmt.Errorf("none of the data dictionary's variables were found in the CSV header")
+	}
+	return colIdx, nil
+}
@@ -0,0 +1,172 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayout is the layout of synthesized dates, as written to CSV files and SQL literals
+const dateLayout = "2006-01-02"
+
+// DateColumn is a date column synthesized from component variables (e.g., YEAR and MONTH), so time-series
+// queries don't need to reconstruct dates: a year, and optionally a month and a day, each 1 if absent.
+type DateColumn struct {
+	Name  string
+	Year  string // variable names; Month and Day may be empty
+	Month string
+	Day   string
+
+	auto bool   // if true, components are detected from the data dictionary (see checkDates)
+	idx  [3]int // data dictionary index of the year, month, and day variables (-1 if absent); set by checkDates
+}
+
+// ParseDateFlag parses the arguments of -date flags, each of the form name=YEAR[,MONTH[,DAY]], naming
+// the date column and its component variables (e.g., "interview=INTYEAR,INTMONTH,INTDAY"), or only a
+// name, whose components are detected (see checkDates), into date columns, in order
+//
+// returns error if an argument is malformed, or a column is added more than once
+func ParseDateFlag(dateFs []string) ([]DateColumn, error) {
+	dates := make([]DateColumn, 0, len(dateFs))
+	for _, d := range dateFs {
+		name, comps, found := strings.Cut(d, "=")
+		name = strings.TrimSpace(name)
+		if !identifierRe.MatchString(name) {
+			return nil, fmt.Errorf("'%s' is not a valid column name (letters, digits, and underscores only)", name)
+		}
+		if slices.ContainsFunc(dates, func(dc DateColumn) bool { return strings.EqualFold(dc.Name, name) }) {
+			return nil, fmt.Errorf("%s is added more than once", name)
+		}
+		dc := DateColumn{Name: name, auto: !found}
+		if found {
+			vars := strings.Split(comps, ",")
+			if len(vars) > 3 {
+				return nil, fmt.Errorf("'%s' names more than a year, month, and day", d)
+			}
+			for i, v := range vars {
+				vars[i] = strings.TrimSpace(v)
+				if len(vars[i]) == 0 {
+					return nil, fmt.Errorf("'%s' names an empty variable", d)
+				}
+			}
+			vars = append(vars, "", "")
+			dc.Year, dc.Month, dc.Day = vars[0], vars[1], vars[2]
+		}
+		dates = append(dates, dc)
+	}
+	return dates, nil
+}
+
+// label documents a date column, with its component variables (e.g., "date from YEAR, MONTH")
+func (dc DateColumn) label() string {
+	comps := []string{dc.Year}
+	for _, c := range []string{dc.Month, dc.Day} {
+		if len(c) != 0 {
+			comps = append(comps, c)
+		}
+	}
+	return "date from " + strings.Join(comps, ", ")
+}
+
+// checkDates detects the components of date columns given by name only (YEAR, and MONTH and DAY, if
+// included), and ensures that every component is a numeric variable of the data dictionary
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkDates(ddi *DataDict) error {
+	for i := range dbf.Dates {
+		dc := &dbf.Dates[i]
+		if dc.auto {
+			dc.Year, dc.Month, dc.Day = "YEAR", "", ""
+			if v, ok := findVar(ddi, "MONTH"); ok {
+				dc.Month = v.Name
+				if v, ok := findVar(ddi, "DAY"); ok {
+					dc.Day = v.Name
+				}
+			}
+		}
+		for c, name := range []string{dc.Year, dc.Month, dc.Day} {
+			dc.idx[c] = -1
+			if len(name) == 0 {
+				continue
+			}
+			j := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) })
+			if j < 0 {
+				return fmt.Errorf("date column %s: unrecognized variable %s", dc.Name, name)
+			}
+			if dbf.columnType(ddi.Vars[j]) == "string" {
+				return fmt.Errorf("date column %s: variable %s is not numeric", dc.Name, name)
+			}
+			dc.idx[c] = j
+		}
+	}
+	return nil
+}
+
+// datesFromRow returns the values of the date columns of a fixed-width row, formatted as dateLayout,
+// or "" if null: when a component is null, or the components don't make up a valid date (e.g.,
+// month 99, often a "not in universe" code)
+func (dbf *DatabaseFormatter) datesFromRow(ddi *DataDict, row []byte, nullPolicies []string) []string {
+	return dbf.dateValues(func(i int) (int, bool) {
+		v := ddi.Vars[i]
+		chars, isNull, err := applyNullPolicy(row[v.Location.Start-1:v.Location.End], nullPolicies[i], false)
+		if err != nil || isNull {
+			return 0, false
+		}
+		num, err := fixedWidthNumber(chars, 0)
+		if err != nil {
+			return 0, false
+		}
+		n, err := strconv.Atoi(num)
+		return n, err == nil
+	})
+}
+
+// datesFromRecord returns the values of the date columns of a comma-delimited record (see datesFromRow)
+func (dbf *DatabaseFormatter) datesFromRecord(rec []string, colIdx []int) []string {
+	return dbf.dateValues(func(i int) (int, bool) {
+		if colIdx[i] < 0 || colIdx[i] >= len(rec) {
+			return 0, false
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(rec[colIdx[i]]))
+		return n, err == nil
+	})
+}
+
+// dateValues returns the values of the date columns, reading components (by data dictionary index) with get
+func (dbf *DatabaseFormatter) dateValues(get func(i int) (int, bool)) []string {
+	vals := make([]string, len(dbf.Dates))
+	for i, dc := range dbf.Dates {
+		comps := [3]int{0, 1, 1}
+		valid := true
+		for c, vi := range dc.idx {
+			if vi < 0 {
+				continue
+			}
+			comps[c], valid = get(vi)
+			if !valid {
+				break
+			}
+		}
+		if !valid || comps[0] < 1 || comps[0] > 9999 {
+			continue
+		}
+		t := time.Date(comps[0], time.Month(comps[1]), comps[2], 0, 0, 0, 0, time.UTC)
+		// out-of-range months and days are normalized by time.Date (e.g., April 31 -> May 1); they're invalid
+		if t.Year() == comps[0] && int(t.Month()) == comps[1] && t.Day() == comps[2] {
+			vals[i] = t.Format(dateLayout)
+		}
+	}
+	return vals
+}
+
+// dateLiteral formats a date (see dateLayout) as a database system-specific date literal
+func (dbf *DatabaseFormatter) dateLiteral(date string) string {
+	if dbf.DbType == MSSQL {
+		return "'" + date + "'" // implicitly converted to date
+	}
+	return "DATE '" + date + "'"
+}
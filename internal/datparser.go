@@ -4,8 +4,8 @@ package internal
 
 import (
 	"fmt"
-	"os"
 	"sync"
+	"time"
 )
 
 // NewDatParser returns a DatParser given
@@ -20,7 +20,7 @@ func NewDatParser(datFileName string, nParsers int, ddi *DataDict, dbfmtr *Datab
 	}
 }
 
-// ParseBlocks spawns N := nParsers goroutines, each goroutine generating their own *os.File header; each parser
+// ParseBlocks spawns N := nParsers goroutines, each goroutine opening the file on its own (see OpenDat); each parser
 // reads jobs from a ParsingJob stream, parses results, and sends ParsedResults to an output channel.
 //
 // In case of file open errors, the goroutine returns (may come back to this mechanism). In case of parsing errors, the
@@ -30,15 +30,23 @@ func (dp DatParser) ParseBlocks(wg *sync.WaitGroup, jobStream <-chan ParsingJob,
 	for i := 0; i < dp.nParsers; i++ {
 		go func() {
 			defer wg.Done()
-			datFile, err := os.Open(dp.datFileName)
+			datFile, err := OpenDat(dp.datFileName)
 			if err != nil {
 				fmt.Printf("error: DatParser unable to open %s\n", dp.datFileName)
 				return // one parser unable to open the file != other parsers can't open the file
 			}
 			defer datFile.Close()
 			for job := range jobStream {
+				start := time.Now()
+				if len(dp.dbfmtr.ShardBy) != 0 {
+					shards, err := dp.dbfmtr.BulkInsertShards(dp.ddi, datFile, job.StartAtRow, job.RowsToRead)
+					parsedStream <- ParsedResult{Shards: shards, Rows: job.RowsToRead, Index: job.Index, Part: job.Part,
+						ParseTime: time.Since(start), AnyError: err}
+					continue
+				}
 				parsedBlock, err := dp.dbfmtr.BulkInsert(dp.ddi, datFile, job.StartAtRow, job.RowsToRead)
-				parsedStream <- ParsedResult{Block: parsedBlock, AnyError: err}
+				parsedStream <- ParsedResult{Block: parsedBlock, Rows: job.RowsToRead, Index: job.Index, Part: job.Part,
+					ParseTime: time.Since(start), AnyError: err}
 			}
 		}()
 	}
@@ -53,9 +61,38 @@ type DatParser struct {
 	dbfmtr      *DatabaseFormatter
 }
 
-// A ParsedResult contains a block of fixed-width data parsed to SQL inserts,
-// and an error if applicable.
+// A ParsedResult contains a block of fixed-width data parsed to SQL inserts (or, if sharded, the
+// shards of the block), the number of rows in the block, the index and part of its ParsingJob, the
+// time spent parsing it, and an error if applicable.
 type ParsedResult struct {
-	Block    []byte
-	AnyError error
+	Block     []byte
+	Shards    []Shard
+	Rows      int
+	Index     int
+	Part      int
+	ParseTime time.Duration
+	AnyError  error
+}
+
+// ParseError is an error parsing the rows of the data file (e.g., a malformed field), as received by a
+// DumpWriter in a ParsedResult, or met by commands reading the data file (e.g., freq)
+type ParseError struct {
+	Err error
+}
+
+// Error returns the underlying error's message
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// A Shard is the part of a parsed block holding the rows of one value of the shard variable
+// (see DatabaseFormatter.ShardBy): its key (see shardKey), and its SQL inserts
+type Shard struct {
+	Key   string
+	Block []byte
 }
@@ -6,18 +6,28 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"slices"
+	"strconv"
 	"strings"
 )
 
 // As of this initial version, the four following relational
-// database systems will be supported
+// database systems will be supported, along with snowflake
 const (
-	POSTGRES string = "postgres"
-	ORACLE   string = "oracle"
-	MYSQL    string = "mysql"
-	MSSQL    string = "mssql"
+	POSTGRES  string = "postgres"
+	ORACLE    string = "oracle"
+	MYSQL     string = "mysql"
+	MSSQL     string = "mssql"
+	SNOWFLAKE string = "snowflake"
+)
+
+// DbTypes lists the supported database systems
+var DbTypes = []string{POSTGRES, ORACLE, MYSQL, MSSQL, SNOWFLAKE}
+
+// casing policies of generated identifiers (tables, columns, indices)
+const (
+	CASE_LOWER    string = "lower"
+	CASE_UPPER    string = "upper"
+	CASE_PRESERVE string = "preserve"
 )
 
 // the INT type in these database systems defaults to 32 bits
@@ -26,36 +36,67 @@ const (
 // INT columns to those with widths <= 10.
 const maxPlacesFori32 int = 10
 
+// ref_table labels are limited to 1000 characters, which should be far more than enough
+const maxCharsInLab int = 1000
+
+// aggregate (comma-delimited) data dictionaries don't carry column widths, so
+// these are used in place of the width. 38 is the max numeric precision in
+// both mssql and oracle.
+const (
+	defaultNumericPrecision int = 38
+	defaultStringWidth      int = 1000
+)
+
 // getDataTypes returns a map of traditional types and their
 // database system-specific equivalents
 //
 // returns error if dbType is not one of the supported and recognized types
 func getDataTypes(dbType string) (map[string]string, error) {
 	types2DBtypes := map[string]string{
-		"int":    "int",
-		"float":  "numeric",
-		"string": "varchar",
+		"int":       "int",
+		"float":     "numeric",
+		"string":    "varchar",
+		"bigint":    "bigint",
+		"double":    "double precision",
+		"real":      "real",
+		"timestamp": "timestamp",
+		"date":      "date",
 	}
 
 	switch strings.ToLower(dbType) {
-	case POSTGRES, MSSQL:
+	case POSTGRES:
+	case MSSQL:
+		types2DBtypes["double"] = "float"
+		types2DBtypes["timestamp"] = "datetime2"
 	case MYSQL:
 		types2DBtypes["float"] = "decimal"
+		types2DBtypes["double"] = "double"
+		types2DBtypes["real"] = "float"
+		types2DBtypes["timestamp"] = "datetime"
 	case ORACLE:
 		types2DBtypes["float"] = "number"
 		types2DBtypes["string"] = "varchar2"
+		types2DBtypes["bigint"] = "number(19)"
+		types2DBtypes["double"] = "binary_double"
+		types2DBtypes["real"] = "binary_float"
+	case SNOWFLAKE:
+		types2DBtypes["float"] = "number"
+		types2DBtypes["double"] = "float"
+		types2DBtypes["real"] = "float"
+		types2DBtypes["timestamp"] = "timestamp_ntz"
 	default:
-		return nil, fmt.Errorf("dbType '%s' not in {'postgres', 'oracle', 'mysql', mssql'}", dbType)
+		return nil, fmt.Errorf("dbType '%s' not in {'postgres', 'oracle', 'mysql', mssql', 'snowflake'}", dbType)
 	}
 
 	return types2DBtypes, nil
 }
 
 // NewDBFormatter returns a pointer to a DatabaseFormatter,
-// taking the database system, and main table name, and mkddl as inputs
+// taking the database system, and main table name, and mkddl as inputs.
+// If overrides is non-nil, its types are merged on top of the built-in type map.
 //
-// returns error if unrecognized/unsupported database system
-func NewDBFormatter(dbType, tableName string, mkddl bool) (*DatabaseFormatter, error) {
+// returns error if unrecognized/unsupported database system, or invalid overrides
+func NewDBFormatter(dbType, tableName string, mkddl bool, overrides *TypeOverrides) (*DatabaseFormatter, error) {
 	if len(tableName) == 0 {
 		return nil, fmt.Errorf("tableName can not be empty")
 	}
@@ -64,21 +105,82 @@ func NewDBFormatter(dbType, tableName string, mkddl bool) (*DatabaseFormatter, e
 		return nil, fmt.Errorf("could not get data types: %w", err)
 	}
 
-	return &DatabaseFormatter{
-		DbType:    dbType,
-		TableName: tableName,
-		DataTypes: dataTypes,
-		mkddl:     mkddl,
-	}, nil
+	dbf := &DatabaseFormatter{
+		DbType:          strings.ToLower(dbType),
+		TableName:       tableName,
+		DataTypes:       dataTypes,
+		RefPrefix:       "ref_",
+		overriddenTypes: make(map[string]bool),
+		mkddl:           mkddl,
+	}
+	if overrides != nil {
+		types, columns, err := overrides.merge(dbf.DbType)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply type overrides: %w", err)
+		}
+		for k, t := range types {
+			dbf.DataTypes[k] = t
+			dbf.overriddenTypes[k] = true
+		}
+		dbf.columnTypeOverrides = columns
+	}
+	return dbf, nil
 }
 
 // DatabaseFormatter contains a relational database system identifier and
 // a corresponding map of traditional and database types
 type DatabaseFormatter struct {
-	DbType    string
-	TableName string
-	DataTypes map[string]string
-	mkddl     bool
+	DbType          string
+	DbVersion       *DbVersion // if set, the release of the database system the SQL targets (see ParseDbVersionFlag)
+	TableName       string
+	DataTypes       map[string]string
+	Renames         map[string]string // lowercased variable name -> column name, for renamed columns
+	ReservedSuffix  string            // if non-empty, appended to columns named after reserved words
+	Case            string            // casing policy of identifiers: CASE_LOWER (if empty), CASE_UPPER, or CASE_PRESERVE
+	RefSchema       string            // if non-empty, the schema ref_tables are created in
+	RefPrefix       string            // prefix of ref_table names; "ref_" by default
+	RefSuffix       string            // suffix of ref_table names
+	NoRefTables     bool              // if true, no ref_tables are created
+	RefUpsert       bool              // if true, ref_tables are created if not exists, and only missing categories are inserted
+	Nulls           *NullPolicy       // how blank fields are written; if nil, fields holding any blank are null
+	Meta            *ConversionMeta   // if non-nil, an ipums2db_meta table is created and a row inserted
+	DocTables       bool              // if true, ref_citation, ref_samples, and ref_universe tables are created
+	Format          string            // output format of rows: FORMAT_SQL (if empty), FORMAT_AVRO, FORMAT_DTA, or FORMAT_PGCOPY
+	Hash            *Hasher           // if non-nil, identifier variables to hash (see Hasher)
+	Recodes         *Recodes          // if non-nil, value recoding rules (see Recodes)
+	Derived         *DerivedColumns   // if non-nil, columns computed from the variables, appended to the main table
+	Consts          []ConstColumn     // constant columns, appended to the main table after any derived columns
+	Dates           []DateColumn      // date columns synthesized from component variables, appended after any constant columns
+	Model           string            // MODEL_FLAT (the default, if empty) or MODEL_STAR (see ParseModelFlag)
+	RepWeights      *RepWeights       // if non-nil, replicate weights grouped apart from the other variables
+	Melts           *Melts            // if non-nil, groups of variables melted into long-format tables
+	QFlags          *QFlags           // if non-nil, data quality flags moved to a side table, or dropped
+	VarGroups       *VarGroups        // if non-nil, variable groups split out of the main table, into tables of their own
+	HouseholdKeys   bool              // if true, household-person linkage keys and a households view are created (see CreateLinkage)
+	RowID           string            // if set, name of a surrogate row id column (the row's number in the data file), leading the main table
+	ShardBy         string            // if set, variable whose values shard the insertion files (see BulkInsertShards)
+	NaturalKey      []string          // if set, variables uniquely identifying a row; inserts skip rows already loaded (see insertClauses)
+	UniqueKeys      [][]string        // if set, the variables of each unique constraint of the main table (see createUniqueKeys)
+	IndexNames      string            // if set, the name template of indices (see ParseNameTemplate), DEFAULT_INDEX_NAME otherwise
+	ConstraintNames string            // if set, the name template of unique constraints, DEFAULT_NATURAL_KEY and DEFAULT_UNIQUE_KEY otherwise
+	AppendTo        string            // if set, the fingerprint of the main table appended to (see ReadFingerprint); only inserts are written
+	Truncate        bool              // if true, the tables are emptied ahead of the inserts (see CreateTruncation), ref_tables included, if upserted
+	Owner           string            // if set, the role every object created is handed over to, at the end of the DDL (see CreateOwnership)
+	Grants          []Grant           // privileges granted on every object created, at the end of the DDL (see CreateGrants)
+	UseSchema       string            // if set, the schema (database, in mysql and mssql) each file of the dump is run in (see UseStatement)
+	Prologue        []byte            // if set, SQL written at the top of the DDL (e.g., SET statements, extensions)
+	Epilogue        []byte            // if set, SQL written at the end of the dump (see DumpWriter.WriteDDL)
+	Style           *SQLStyle         // if set, the style of the generated SQL (see SQLStyle); the prologue and epilogue are left as is
+	Compact         bool              // if true, inserts are written without comments, indentation, or line breaks within statements
+	Collations      *Collations       // if non-nil, the collations of character columns (see Collations)
+	Decimals        string            // storage of decimal variables: DECIMALS_NUMERIC (if empty), DECIMALS_DOUBLE, DECIMALS_REAL, or DECIMALS_SCALED
+	NotNull         bool              // if true, columns of variables applying to every record, without missing values, are NOT NULL (see notNull)
+	RangeChecks     bool              // if true, CHECK constraints keep variables' values within their valid ranges (see createRangeChecks)
+
+	overriddenTypes     map[string]bool       // traditional types overridden by the user, used without params
+	columnTypeOverrides map[string]string     // lowercased variable name -> forced column type
+	dims                map[string]*dimension // variable name -> dimension, in the star model; set by buildDimensions
+	mkddl               bool
 }
 
 // CreateMainTable generates a SQL "CREATE TABLE" statement, given a data dictionary and table name,
@@ -86,48 +188,135 @@ type DatabaseFormatter struct {
 //
 // returns error if a variable's interval type is not in {"contin", "discrete"}
 func (dbf *DatabaseFormatter) CreateMainTable(ddi *DataDict) ([]byte, error) {
-	init_statement := fmt.Sprintf("CREATE TABLE %s (", dbf.TableName)
+	if err := dbf.checkRenames(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkTypeOverrides(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkDecimals(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkRefNaming(); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkUseSchema(); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkOwner(); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkNullPolicy(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkHashVars(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkRecodes(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkAppended(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkRowID(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkRepWeights(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkMelts(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkQFlags(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkVarGroups(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkModel(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkShardBy(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkNaturalKey(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkUniqueKeys(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkCollations(ddi); err != nil {
+		return nil, err
+	}
+	if err := dbf.checkRangeChecks(); err != nil {
+		return nil, err
+	}
+	dbf.recodeCats(ddi)
+	dbf.buildDimensions(ddi)
+	if err := dbf.checkCopyTypes(ddi); err != nil {
+		return nil, err
+	}
+	init_statement := fmt.Sprintf("CREATE TABLE %s (", dbf.ident(dbf.TableName))
 	var ddl_table strings.Builder
+	// columns renamed for colliding with reserved words are listed up front, as a mapping comment
+	if renamed := dbf.reservedRenames(ddi); len(renamed) != 0 {
+		ddl_table.WriteString(fmt.Sprintf("-- reserved words renamed: %s\n", strings.Join(renamed, ", ")))
+	}
 	ddl_table.WriteString(init_statement)
 
-	// occasionally, you'll have column names like "where" or "year", which may
-	// conflict with reserved keywords. So we need to "escape" the column names
-	// in out table creation. The accepted characters for escaping are a little
-	// different by system.
-	var colEscChr string
-	switch dbf.DbType {
-	case "postgres", "oracle", "mssql":
-		colEscChr = `"`
-	case "mysql":
-		colEscChr = "`"
-	default:
+	// columns, as name, type, and label: the row id, the variables (replicate weights may be grouped
+	// in array columns, and melted variables, data quality flags, and split variable groups are set apart),
+	// then derived and constant columns
+	var cols [][3]string
+	// collations and NOT NULL constraints of variables' columns, by index into cols; left out of the
+	// fingerprint, as they don't bear on appending
+	constraints := make(map[int]string)
+	if len(dbf.RowID) != 0 {
+		cols = append(cols, [3]string{dbf.quoteIdent(dbf.columnName(dbf.rowIDVar())), dbf.rowIDSQLType(), dbf.rowIDVar().Label})
 	}
-
-	for i, v := range ddi.Vars {
-		var typeToUse, nameAndType strings.Builder
-		// get column type
-		switch colType := dbf.columnType(v); colType {
-		case "float":
-			typeToUse.WriteString(fmt.Sprintf("%s(%d,%d)", dbf.DataTypes["float"], v.Location.Width, v.DecimalPoint))
-		case "string":
-			typeToUse.WriteString(fmt.Sprintf("%s(%d)", dbf.DataTypes["string"], v.Location.Width))
-		case "int":
-			typeToUse.WriteString(dbf.DataTypes["int"]) // the rest of vars are ints
-		default: // in future, maybe add other types
+	for _, v := range ddi.Vars {
+		if dbf.setApart(v) {
+			continue
 		}
-
-		var addComma string
-		if i == (len(ddi.Vars) - 1) {
-			addComma = ""
+		name, sqlType := dbf.factColumn(v)
+		label := v.Label
+		if dbf.isDimension(v) {
+			label += " (key of " + dbf.dimTableName(v) + ")"
 		} else {
+			constraints[len(cols)] = dbf.varCollation(v)
+		}
+		constraints[len(cols)] += dbf.notNullClause(v)
+		cols = append(cols, [3]string{dbf.quoteIdent(name), sqlType, label + dbf.scaleNote(v) + varNotes(v)})
+	}
+	cols = append(cols, dbf.repWeightArrayColumns(ddi)...)
+	appendedTypes := dbf.appendedSQLTypes()
+	for i, v := range dbf.appendedVars() {
+		cols = append(cols, [3]string{dbf.quoteIdent(dbf.columnName(v)), appendedTypes[i], v.Label})
+	}
+	// the table's fingerprint is recorded ahead of it, so that later dumps can be appended to it
+	fingerprint := dbf.schemaFingerprint(cols)
+	if err := dbf.checkAppend(fingerprint); err != nil {
+		return nil, err
+	}
+	for i, col := range cols {
+		var addComma string
+		if i != len(cols)-1 {
 			addComma = ","
 		}
-		nameAndType.WriteString(fmt.Sprintf("\n\t%s%s%s %s%s\t-- %s", colEscChr, strings.ToLower(v.Name), colEscChr, typeToUse.String(), addComma, v.Label))
-		ddl_table.WriteString(nameAndType.String())
+		ddl_table.WriteString(fmt.Sprintf("\n\t%s %s%s%s\t-- %s", col[0], col[1], constraints[i], addComma, col[2]))
 	}
 	ddl_table.WriteString("\n);\n\n")
-
-	return []byte(ddl_table.String()), nil
+	ddl_table.WriteString(dbf.createNaturalKey(ddi))
+	ddl_table.WriteString(dbf.createUniqueKeys(ddi))
+	ddl_table.WriteString(dbf.createRangeChecks(ddi))
+	// long-format replicate weight tables, melted tables, the data quality flag table, and variable group
+	// tables, if any, follow the main table
+	ddl_table.Write(dbf.CreateRepWeightTables(ddi))
+	ddl_table.Write(dbf.CreateMeltTables(ddi))
+	ddl_table.Write(dbf.CreateQFlagTable(ddi))
+	ddl_table.Write(dbf.CreateVarGroupTables(ddi))
+
+	return []byte(fingerprintPrefix + fingerprint + "\n" + ddl_table.String()), nil
 }
 
 // CreateRefTables generates "CREATE TABLE" and "INSERT INTO ref_var" statements for the set of discrete variables in a data-dictionary, returning
@@ -150,64 +339,162 @@ func (dbf *DatabaseFormatter) CreateMainTable(ddi *DataDict) ([]byte, error) {
 //	(2, 'Yes, in the labor force'),
 //	(9, 'Unclassifiable (employment status unknown)');
 //
-// returns empty byte slice if there are no discrete variables
+// Variables with categories expressing ranges of values (e.g., "1-5", "90+") get val_min and val_max
+// columns in place of val; an open upper bound is null. Non-numeric codes of numeric variables can't
+// be stored, so they're skipped, and listed in comments.
+//
+// If dbf.RefUpsert is set, the statements are instead safe to run against ref_tables that already
+// exist (e.g., when appending a second extract); see createRefTableIfNotExists.
+//
+// returns empty byte slice if there are no discrete variables, or if ref_tables are skipped
 func (dbf *DatabaseFormatter) CreateRefTables(ddi *DataDict) []byte {
+	if dbf.Model == MODEL_STAR {
+		return dbf.createDimTables(ddi)
+	}
 	var ddlStatement strings.Builder
 
 	for _, v := range ddi.Vars {
-		if v.Interval == "discrete" {
-			tableName := "ref_" + strings.ToLower(v.Name)
-			var refTable strings.Builder
-			refTable.WriteString(fmt.Sprintf("CREATE TABLE %s (", tableName))
-			// limit labels to 1000 characters, which should be far more than enough
-			maxCharsInLab := 1000
-			colType := dbf.columnType(v)
-			catAndType := fmt.Sprintf("\n\tval %s,\n\tlabel %s(%d)\n);\n\n", colType, dbf.DataTypes["string"], maxCharsInLab)
-			refTable.WriteString(catAndType)
-			ddlStatement.WriteString(refTable.String())
-
-			var insertStatement strings.Builder
-			insertStatement.WriteString(fmt.Sprintf("INSERT INTO %s (val, label)\nVALUES", tableName))
-			for i, cat := range v.Cats {
-				var addComma string
-				if i == (len(v.Cats) - 1) {
-					addComma = "\n"
-				} else {
-					addComma = ","
-				}
-				escapedLabel := strings.ReplaceAll(cat.Label, "'", "''")
-				valAndLab := fmt.Sprintf("\n\t(%s, '%s')%s", cat.Val, escapedLabel, addComma)
-				insertStatement.WriteString(valAndLab)
+		if dbf.hasRefTable(v) {
+			tableName := dbf.refTableName(v)
+			if dbf.RefUpsert {
+				ddlStatement.WriteString(dbf.createRefTableIfNotExists(tableName, v))
+				continue
+			}
+			ddlStatement.WriteString(fmt.Sprintf("CREATE TABLE %s (%s);\n\n", tableName, dbf.refTableColDefs(v, false)))
+
+			rows, skipped := dbf.refTableRows(v)
+			ddlStatement.WriteString(skippedCatsComment(tableName, skipped))
+			if len(rows) == 0 {
+				continue
 			}
-			insertStatement.WriteString(";\n\n")
-			ddlStatement.WriteString(insertStatement.String())
+			tuples := make([]string, len(rows))
+			for i, row := range rows {
+				tuples[i] = fmt.Sprintf("\t(%s)", strings.Join(row, ", "))
+			}
+			head := fmt.Sprintf("INSERT INTO %s (%s)\n", tableName, strings.Join(dbf.refTableCols(v), ", "))
+			ddlStatement.Write(dbf.appendRows([]byte(head), []byte(strings.Join(tuples, ",\n"))))
+			ddlStatement.WriteString("\n;\n\n")
 		}
 	}
 
 	return []byte(ddlStatement.String())
 }
 
-// CreateIndices generates "CREATE INDEX idx_var" statements for a set of columns. As of now, does not
-// support multi-column index creations.
+// hasRefTable reports whether a variable gets a ref_table; all discrete variables do,
+// unless ref_tables are skipped altogether, the variable is hashed (its labels would
+// give away the original values), or it's a grouped replicate weight, or a dropped data quality flag
+func (dbf *DatabaseFormatter) hasRefTable(v Var) bool {
+	return v.Interval == "discrete" && !dbf.NoRefTables && !dbf.Hash.hashes(v) && !dbf.RepWeights.groups(v) && !dbf.QFlags.drops(v)
+}
+
+// refTableName returns the name of a variable's ref_table (e.g., "ref_labforce")
+func (dbf *DatabaseFormatter) refTableName(v Var) string {
+	return dbf.refTable(dbf.columnName(v))
+}
+
+// refTable returns the name of a ref_table given its base name (e.g., "labforce" -> "ref_labforce"),
+// with the ref_table prefix and suffix, qualified by the ref_table schema, if any
+func (dbf *DatabaseFormatter) refTable(base string) string {
+	name := dbf.ident(dbf.RefPrefix + base + dbf.RefSuffix)
+	if len(dbf.RefSchema) != 0 {
+		name = dbf.ident(dbf.RefSchema) + "." + name
+	}
+	return name
+}
+
+// CreateRefSchema generates a "CREATE SCHEMA" statement for the ref_table schema, skipped if
+// the schema already exists (note: statement terminator (e.g., ";") is included). In oracle,
+// a schema is a user, which is left to the database administrator.
+//
+// returns empty byte slice if there is no ref_table schema, or if neither ref_tables nor doc tables are created
+func (dbf *DatabaseFormatter) CreateRefSchema() []byte {
+	if len(dbf.RefSchema) == 0 || (dbf.NoRefTables && !dbf.DocTables) {
+		return []byte{}
+	}
+	schema := dbf.ident(dbf.RefSchema)
+	switch dbf.DbType {
+	case MSSQL:
+		return []byte(fmt.Sprintf("IF SCHEMA_ID(N'%s') IS NULL\n\tEXEC('CREATE SCHEMA %s');\n\n", schema, schema))
+	case ORACLE:
+		return []byte(fmt.Sprintf("-- ref_tables are created in schema %s; the %s user must already exist\n\n", schema, schema))
+	default:
+		return []byte(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;\n\n", schema))
+	}
+}
+
+// checkRefNaming ensures that the ref_table schema, prefix, and suffix make for valid table names
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkRefNaming() error {
+	if len(dbf.RefSchema) != 0 && !identifierRe.MatchString(dbf.RefSchema) {
+		return fmt.Errorf("'%s' is not a valid schema name (letters, digits, and underscores only)", dbf.RefSchema)
+	}
+	if !identifierRe.MatchString("x" + dbf.RefPrefix + dbf.RefSuffix) {
+		return fmt.Errorf("'%s' and '%s' are not a valid ref_table prefix and suffix (letters, digits, and underscores only)", dbf.RefPrefix, dbf.RefSuffix)
+	}
+	if len(dbf.RefSchema) == 0 && len(dbf.RefPrefix) == 0 && len(dbf.RefSuffix) == 0 {
+		return fmt.Errorf("ref_tables need a prefix, a suffix, or a schema, so as not to be named like their columns")
+	}
+	return nil
+}
+
+// CreateIndices generates "CREATE INDEX idx_var" statements for a set of index definitions, of the form
+// column[:method][ WHERE predicate] (see ParseIndexFlag); indices without a method get the database
+// system's default, and those with a predicate are partial (see createIndex). Indices are named after
+// IndexNames, if set (see objectName). As of
+// now, does not support multi-column index creations. In snowflake, the columns make up a clustering key
+// instead (see clusterBy).
 //
-// returns error if a column is not recognized in the data dictionary
+// Columns may be referred to by either their variable name, or their renamed column name.
+//
+// returns error if a column is not recognized in the data dictionary, two indices are named alike, or the
+// database system doesn't support an index method (see indexMethods), or partial indices
 func (dbf *DatabaseFormatter) CreateIndices(ddi *DataDict, cols []string) ([]byte, error) {
+	if dbf.DbType == SNOWFLAKE {
+		return dbf.clusterBy(ddi, cols)
+	}
 	var indexStatements strings.Builder
-	varNames := dbf.VariableNames(ddi)
-	for _, col := range cols {
-		if !slices.Contains(varNames, strings.ToLower(col)) {
+	names := make(map[string]bool)
+	for _, def := range cols {
+		col, method, pred := splitIndex(def)
+		col, ok := dbf.lookupColumn(ddi, col)
+		if !ok {
 			return nil, fmt.Errorf("cannot create idx on unrecognized variable %s", col)
 		}
-		indexStatements.WriteString(fmt.Sprintf("CREATE INDEX idx_%s ON %s (%s);\n\n", col, dbf.TableName, col))
+		name := dbf.objectName(orDefault(dbf.IndexNames, DEFAULT_INDEX_NAME), []string{col})
+		if names[strings.ToLower(name)] {
+			return nil, fmt.Errorf("index name %s is generated more than once; name indices apart (see -index-name-template)", name)
+		}
+		names[strings.ToLower(name)] = true
+		stmt, err := dbf.createIndex(name, dbf.quoteIdent(col), method, pred)
+		if err != nil {
+			return nil, err
+		}
+		indexStatements.WriteString(stmt)
 	}
 	return []byte(indexStatements.String()), nil
 }
 
-// VariableNames returns the included variables from a data dictionary
+// VariableNames returns the column names of the included variables from a data dictionary
 func (dbf *DatabaseFormatter) VariableNames(ddi *DataDict) []string {
-	variableNames := make([]string, len(ddi.Vars))
-	for i, v := range ddi.Vars {
-		variableNames[i] = strings.ToLower(v.Name)
+	variableNames := make([]string, 0, len(ddi.Vars))
+	var vars []Var
+	if len(dbf.RowID) != 0 {
+		vars = append(vars, dbf.rowIDVar())
+	}
+	for _, v := range ddi.Vars {
+		if !dbf.setApart(v) {
+			vars = append(vars, v)
+		}
+	}
+	if dbf.RepWeights.arrays() {
+		for _, g := range dbf.RepWeights.groupList {
+			vars = append(vars, Var{Name: g.name})
+		}
+	}
+	for _, v := range append(vars, dbf.appendedVars()...) {
+		name, _ := dbf.factColumn(v)
+		variableNames = append(variableNames, name)
 	}
 	return variableNames
 }
@@ -217,94 +504,329 @@ func (dbf *DatabaseFormatter) VariableNames(ddi *DataDict) []string {
 // It takes in a DataDict pointer, the fixed width file, the row
 // in the file to start reading at, and the number of rows to parse in total.
 //
+// For database systems loading staged CSV files (see stagesCSV), CSV records are generated instead;
+// for Avro output, an Avro data block (see avroBlock); for Stata output, rows of a .dta file's data (see dtaRecord);
+// for binary COPY output, tuples of a binary COPY file (see copyRecord).
+//
 // Returns error file can't be opened, or if any row cannot be parsed.
-func (dbf *DatabaseFormatter) BulkInsert(ddi *DataDict, datFile *os.File, startAtRow int, numRows int) ([]byte, error) {
-	bytesPerLine := BytesPerRow(ddi)
+func (dbf *DatabaseFormatter) BulkInsert(ddi *DataDict, datFile io.ReaderAt, startAtRow int, numRows int) ([]byte, error) {
+	buffer, err := readRows(ddi, datFile, startAtRow, numRows)
+	if err != nil {
+		return nil, err
+	}
+	rowNums := make([]int, numRows)
+	for r := range rowNums {
+		rowNums[r] = startAtRow + r + 1
+	}
+	return dbf.insertBlock(ddi, buffer, rowNums)
+}
 
-	off := bytesPerLine * startAtRow
-	buffSize := numRows * bytesPerLine
-	buffer := make([]byte, buffSize)
-	_, err := datFile.ReadAt(buffer, int64(off))
+// readRows reads numRows rows of a fixed-width file, starting at row startAtRow (0-based)
+//
+// returns error if the file can't be read
+func readRows(ddi *DataDict, datFile io.ReaderAt, startAtRow int, numRows int) ([]byte, error) {
+	bytesPerLine := BytesPerRow(ddi)
+	buffer := make([]byte, numRows*bytesPerLine)
+	_, err := datFile.ReadAt(buffer, int64(bytesPerLine*startAtRow))
 	if err != nil {
 		if !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("error reading dat file: %v", err)
+			return nil, fmt.Errorf("error reading dat file: %w", err)
 		}
 	}
+	return buffer, nil
+}
+
+// insertBlock generates the inserts of a buffer of fixed-width rows (see BulkInsert), given the (1-based)
+// number of each row in the file
+//
+// returns error if any row cannot be parsed
+func (dbf *DatabaseFormatter) insertBlock(ddi *DataDict, buffer []byte, rowNums []int) ([]byte, error) {
+	bytesPerLine := BytesPerRow(ddi)
 
 	// get the column types once, which should slightly speed up the
 	// tuple-insert-statement processing below
 	colTypes := dbf.columnTypes(ddi)
-	bulkInsertInit := fmt.Sprintf("INSERT INTO %s VALUES\n", dbf.TableName)
+	nullPolicies := dbf.nullPolicies(ddi)
+	bulkInsertInit, bulkInsertEnd := dbf.insertClauses(ddi)
+	tuple := dbf.insertTuple
+	switch {
+	case dbf.Format == FORMAT_AVRO:
+		tuple = dbf.avroRecord
+	case dbf.Format == FORMAT_DTA:
+		tuple = dbf.dtaRecord
+	case dbf.copiesBinary():
+		types, err := dbf.copyColumnTypes(ddi)
+		if err != nil {
+			return nil, err
+		}
+		tuple = func(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+			return dbf.copyRecord(ddi, row, rowNum, colTypes, nullPolicies, types)
+		}
+	case dbf.stagesCSV():
+		tuple = dbf.csvRecord
+	}
 
 	dat := make([]byte, 0, len(buffer))
 	for i := 0; i < len(buffer); i += bytesPerLine {
 		row := buffer[i:(i + bytesPerLine)]
-		inserts, err := dbf.insertTuple(ddi, row, colTypes)
+		inserts, err := tuple(ddi, row, rowNums[i/bytesPerLine], colTypes, nullPolicies)
 		if err != nil {
 			return nil, fmt.Errorf("error row %v: %w", row, err)
 		}
 		dat = append(dat, inserts...)
 	}
-	bulkInsertStatement := append([]byte(bulkInsertInit), dat...)
-	bulkInsertStatement[len(bulkInsertStatement)-2] = ';'
-	return bulkInsertStatement, nil
+	switch {
+	case dbf.Format == FORMAT_AVRO:
+		return avroBlock(dat, len(buffer)/bytesPerLine)
+	case dbf.Format == FORMAT_DTA || dbf.copiesBinary() || dbf.stagesCSV():
+		return dat, nil
+	case len(dat) == 0:
+		return dat, nil
+	}
+	bulkInsertStatement := dbf.appendRows([]byte(bulkInsertInit), dat[:len(dat)-2])
+	bulkInsertStatement = append(append(bulkInsertStatement, bulkInsertEnd...), '\n')
+	if dbf.RepWeights.long() {
+		repWeights, err := dbf.repWeightInserts(ddi, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		bulkInsertStatement = append(bulkInsertStatement, repWeights...)
+	}
+	if dbf.Melts != nil {
+		melted, err := dbf.meltInserts(ddi, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		bulkInsertStatement = append(bulkInsertStatement, melted...)
+	}
+	if dbf.QFlags.side() {
+		qflags, err := dbf.qflagInserts(ddi, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		bulkInsertStatement = append(bulkInsertStatement, qflags...)
+	}
+	if dbf.VarGroups != nil {
+		grouped, err := dbf.varGroupInserts(ddi, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		bulkInsertStatement = append(bulkInsertStatement, grouped...)
+	}
+	return dbf.styledInserts(bulkInsertStatement), nil
+}
+
+// BulkInsertRecords generates multi-tuple database table inserts from comma-delimited records,
+// as found in aggregate (e.g., NHGIS, IHGIS) extracts.
+//
+// It takes in a DataDict pointer, the records to insert, the (1-based) number of the first record in
+// the file, and colIdx, which holds the record index of each variable in the data dictionary
+// (or -1 if the variable is not in the records).
+//
+// For database systems loading staged CSV files (see stagesCSV), CSV records are generated instead;
+// for Avro output, an Avro data block (see avroBlock); for Stata output, rows of a .dta file's data (see dtaRecord);
+// for binary COPY output, tuples of a binary COPY file (see copyRecord).
+//
+// Returns error if any record cannot be parsed.
+func (dbf *DatabaseFormatter) BulkInsertRecords(ddi *DataDict, records [][]string, firstRow int, colIdx []int) ([]byte, error) {
+	switch {
+	case dbf.Format == FORMAT_AVRO:
+		return dbf.avroRecords(ddi, records, firstRow, colIdx)
+	case dbf.Format == FORMAT_DTA:
+		return dbf.dtaRecords(ddi, records, firstRow, colIdx)
+	case dbf.copiesBinary():
+		return dbf.copyRecords(ddi, records, firstRow, colIdx)
+	case dbf.stagesCSV():
+		return dbf.csvRecords(ddi, records, firstRow, colIdx)
+	}
+	colTypes := dbf.columnTypes(ddi)
+	bulkInsertInit, bulkInsertEnd := dbf.insertClauses(ddi)
+	var bulkInsert strings.Builder
+	for r, rec := range records {
+		bulkInsert.WriteString("\t(")
+		if len(dbf.RowID) != 0 {
+			bulkInsert.WriteString(strconv.Itoa(firstRow+r) + ",")
+		}
+		for i, v := range ddi.Vars {
+			var field string
+			if colIdx[i] >= 0 && colIdx[i] < len(rec) {
+				field = strings.TrimSpace(rec[colIdx[i]])
+			}
+			if len(field) != 0 {
+				var err error
+				if field, _, err = dbf.transformField(v, field, 0); err != nil {
+					return nil, fmt.Errorf("record %v: %w", rec, err)
+				}
+			}
+			switch colType := colTypes[v.Name]; {
+			case len(field) == 0:
+				field = "null"
+			case colType == "string":
+				field = dbf.sqlString(field)
+			default:
+				// numeric fields are written as is, so they must be numeric
+				if _, err := strconv.ParseFloat(field, 64); err != nil {
+					return nil, fmt.Errorf("record %v: variable %s: %w", rec, v.Name, err)
+				}
+			}
+			bulkInsert.WriteString(field)
+			if i != (len(ddi.Vars) - 1) {
+				bulkInsert.WriteString(",")
+			}
+		}
+		if dbf.hasAppended() {
+			vals, err := dbf.appendedFromRecord(rec, colIdx)
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", rec, err)
+			}
+			bulkInsert.WriteString(dbf.appendedSQL(vals))
+		}
+		if r != (len(records) - 1) {
+			bulkInsert.WriteString("),\n")
+		} else {
+			bulkInsert.WriteString(")")
+		}
+	}
+	bulkInsertStatement := dbf.appendRows([]byte(bulkInsertInit), []byte(bulkInsert.String()))
+	return dbf.styledInserts(append(append(bulkInsertStatement, bulkInsertEnd...), '\n')), nil
 }
 
-// insertTuple generates a single insertion tuple, given a row byte slice, data dictionary, and column types.
+// insertTuple generates a single insertion tuple, given a row byte slice, data dictionary, the (1-based)
+// number of the row in the file, column types, and the null policy of each variable (see NullPolicy).
 // Note that this statement does not include the insertion statement itself, as the BulkInsert method
 // will be used to create insertion statements.
 //
-// returns error if start and end positions are not valid for row.
-func (dbf *DatabaseFormatter) insertTuple(ddi *DataDict, row []byte, colTypes map[string]string) ([]byte, error) {
+// returns error if start and end positions are not valid for row, or if a field cannot be parsed.
+func (dbf *DatabaseFormatter) insertTuple(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
 	var insertStatement strings.Builder
 	insertStatement.WriteString("\t(")
+	if len(dbf.RowID) != 0 {
+		insertStatement.WriteString(strconv.Itoa(rowNum) + ",")
+	}
+	first := true
 	for i, v := range ddi.Vars {
-
-		start, end := v.Location.Start-1, v.Location.End
-		if (start < 0) || (end > len(row)) {
-			return nil, fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+		// replicate weights, melted variables, data quality flags, and split variable groups are set apart
+		// (see RepWeights, Melts, QFlags, VarGroups)
+		if dbf.setApart(v) {
+			continue
+		}
+		val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[i])
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			insertStatement.WriteString(",")
+		}
+		insertStatement.WriteString(val)
+		first = false
+	}
+	if dbf.RepWeights.arrays() {
+		arrays, err := dbf.repWeightArrays(ddi, row, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		insertStatement.WriteString(arrays)
+	}
+	if dbf.hasAppended() {
+		vals, err := dbf.appendedFromRow(ddi, row, nullPolicies)
+		if err != nil {
+			return nil, err
 		}
+		insertStatement.WriteString(dbf.appendedSQL(vals))
+	}
+	insertStatement.WriteString("),\n")
+	return []byte(insertStatement.String()), nil
+}
 
-		chars := row[start:end]
-		var sChars string
+// sqlValue formats the field of a variable in a fixed-width row as a SQL literal (or null), given
+// the variable's column type and null policy (see NullPolicy)
+//
+// returns error if start and end positions are not valid for row, or if the field cannot be parsed.
+func (dbf *DatabaseFormatter) sqlValue(v Var, row []byte, colType string, nullPolicy string) (string, error) {
+	start, end := v.Location.Start-1, v.Location.End
+	if (start < 0) || (end > len(row)) {
+		return "", fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+	}
 
-		// null values
-		if slices.Contains(chars, byte(' ')) {
-			chars = []byte("null")
-			sChars = string(chars)
-			insertStatement.WriteString(sChars)
-			if i != (len(ddi.Vars) - 1) {
-				insertStatement.WriteString(",")
-			}
-			continue
+	// null values
+	chars, isNull, err := applyNullPolicy(row[start:end], nullPolicy, colType == "string")
+	if err != nil {
+		return "", fmt.Errorf("variable %s: %w", v.Name, err)
+	}
+	if !isNull {
+		if chars, isNull, err = dbf.transformChars(v, chars); err != nil {
+			return "", err
 		}
+	}
+	if isNull {
+		return "null", nil
+	}
+	// in the star model, discrete variables hold the keys of their dimension
+	if dbf.dims[v.Name] != nil {
+		return dbf.dimKey(v, chars)
+	}
 
-		switch colType := colTypes[v.Name]; colType {
-		case "string":
-			sChars = fmt.Sprintf("'%s'", string(chars))
-		case "float":
-			// for true float cases (not float due to width concerns)
-			if v.DecimalPoint != 0 {
-				placeDecimalAt := len(chars) - v.DecimalPoint
-				chars = slices.Insert(chars, placeDecimalAt, byte('.'))
-			}
-			sChars = string(chars)
-		case "int":
-			sChars = string(chars)
-			sChars = strings.TrimLeft(sChars, "0") // trim to reduce outFile sizes
-			if len(sChars) == 0 {
-				sChars = "0"
-			}
-		default:
+	switch colType {
+	case "string":
+		return dbf.sqlString(string(chars)), nil
+	case "float":
+		// for true float cases (not float due to width concerns), the decimal point is implied
+		num, err := fixedWidthNumber(chars, v.DecimalPoint)
+		if err != nil {
+			return "", fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		return num, nil
+	case "int", "bigint":
+		num, err := fixedWidthNumber(chars, 0)
+		if err != nil {
+			return "", fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		return num, nil
+	default:
+		return "", nil
+	}
+}
+
+// fixedWidthNumber formats a fixed-width numeric field as a SQL numeric literal, placing the implied
+// decimal point dcml digits from the right. The field may carry a leading sign (e.g., "-000123");
+// leading zeros are trimmed to reduce outFile sizes, and fields that already hold a decimal point
+// are written as is.
+//
+// returns error if the field is not a number
+func fixedWidthNumber(chars []byte, dcml int) (string, error) {
+	sign, digits := "", string(chars)
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		if digits[0] == '-' {
+			sign = "-"
 		}
+		digits = digits[1:]
+	}
+	if strings.Contains(digits, ".") {
+		if _, err := strconv.ParseFloat(digits, 64); err != nil {
+			return "", fmt.Errorf("'%s' is not a number", chars)
+		}
+		return sign + digits, nil
+	}
+	if len(digits) == 0 || strings.Trim(digits, "0123456789") != "" {
+		return "", fmt.Errorf("'%s' is not a number", chars)
+	}
 
-		insertStatement.WriteString(sChars)
-		if i != (len(ddi.Vars) - 1) {
-			insertStatement.WriteString(",")
+	digits = strings.TrimLeft(digits, "0")
+	if dcml > 0 {
+		// pad, so that there's at least one digit before the decimal point (e.g., "-5" -> "-0.05")
+		if len(digits) <= dcml {
+			digits = strings.Repeat("0", dcml-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-dcml] + "." + digits[len(digits)-dcml:]
+		if strings.Trim(digits, "0.") == "" {
+			sign = "" // no negative zero
 		}
+		return sign + digits, nil
 	}
-	insertStatement.WriteString("),\n")
-	return []byte(insertStatement.String()), nil
+	if len(digits) == 0 {
+		return "0", nil // no negative zero
+	}
+	return sign + digits, nil
 }
 
 // columnTypes returns a map of variable names and their database-equivalent column types
@@ -318,16 +840,62 @@ func (dbf *DatabaseFormatter) columnTypes(ddi *DataDict) map[string]string {
 	return colToType
 }
 
+// columnSQLType returns the database system-specific SQL type of a variable's column,
+// including precision/scale or length (e.g., "numeric(9,2)", "varchar(6)")
+func (dbf *DatabaseFormatter) columnSQLType(v Var) string {
+	if t, ok := dbf.columnOverride(v); ok && !isGenericType(t) {
+		return t // forced to a literal SQL type
+	}
+	width := v.Location.Width
+	switch colType := dbf.columnType(v); colType {
+	case "float":
+		if dbf.floats(v) {
+			return dbf.sqlType(dbf.Decimals)
+		}
+		if width == 0 {
+			width = defaultNumericPrecision
+		}
+		return dbf.sqlType("float", width, v.DecimalPoint)
+	case "string":
+		if dbf.Hash.hashes(v) {
+			width = hashChars
+		} else if width == 0 {
+			width = defaultStringWidth
+		}
+		return dbf.sqlType("string", width)
+	case "bigint":
+		return dbf.sqlType("bigint")
+	default: // the rest of vars are ints
+		return dbf.sqlType("int")
+	}
+}
+
 // columnType is a helper function that returns the type that
-// a database column should have: options include ["int", "float", "string"]
+// a database column should have: options include ["int", "bigint", "float", "string"];
+// "bigint" is only used when forced by the user, or for wide scaled decimals (see scales);
+// hashed variables are always strings
 func (dbf *DatabaseFormatter) columnType(v Var) string {
+	if dbf.Hash.hashes(v) {
+		return "string"
+	}
+	if t, ok := dbf.columnOverride(v); ok && isGenericType(t) {
+		return strings.ToLower(t)
+	}
 	// if the variable type is a character type -> must be string
 	if v.VType.VarType == "character" {
 		return "string"
 	}
+	// scaled decimals are integers, of as many digits as the variable
+	if dbf.scales(v) {
+		if v.Location.Width < maxPlacesFori32 {
+			return "int"
+		}
+		return "bigint"
+	}
 	// if a column has decimal point places > 0 -> must be float
 	// if the variable has width > 10 -> must be float (with 0 decimal places)
-	if (v.DecimalPoint > 0) || (v.Location.Width > maxPlacesFori32) {
+	// if the variable has no width (aggregate extracts) -> must be float, as counts may exceed 32 bits
+	if (v.DecimalPoint > 0) || (v.Location.Width > maxPlacesFori32) || (v.Location.Width == 0) {
 		return "float"
 	}
 	// return int in all other cases
@@ -0,0 +1,51 @@
+package internal
+
+import "testing"
+
+// TestFixedWidthNumber checks the numeric literals written for fixed-width fields: signs, leading zeros,
+// implied decimals, and fields already holding a decimal point, and the fields that aren't numbers
+func TestFixedWidthNumber(t *testing.T) {
+	tests := []struct {
+		field   string
+		dcml    int
+		want    string
+		wantErr bool
+	}{
+		{field: "123", want: "123"},
+		{field: "000123", want: "123"},
+		{field: "0000", want: "0"},
+		{field: "+0042", want: "42"},
+		{field: "-0042", want: "-42"},
+		{field: "-0000", want: "0"},
+		{field: "12345", dcml: 2, want: "123.45"},
+		{field: "00005", dcml: 2, want: "0.05"},
+		{field: "-0005", dcml: 2, want: "-0.05"},
+		{field: "+0005", dcml: 2, want: "0.05"},
+		{field: "5", dcml: 3, want: "0.005"},
+		{field: "000", dcml: 2, want: "0.00"},
+		{field: "-000", dcml: 2, want: "0.00"},
+		{field: "12.5", want: "12.5"},
+		{field: "0012.50", dcml: 2, want: "0012.50"},
+		{field: "-12.5", dcml: 1, want: "-12.5"},
+		{field: "-  12", wantErr: true},
+		{field: "-  12", dcml: 2, wantErr: true},
+		{field: "-", wantErr: true},
+		{field: "+", wantErr: true},
+		{field: "", wantErr: true},
+		{field: "12a", wantErr: true},
+		{field: "--12", wantErr: true},
+		{field: "1.2.3", wantErr: true},
+		{field: " 12", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := fixedWidthNumber([]byte(tt.field), tt.dcml)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("fixedWidthNumber(%q, %d) = %q, want error", tt.field, tt.dcml, got)
+		case !tt.wantErr && err != nil:
+			t.Errorf("fixedWidthNumber(%q, %d) error: %v", tt.field, tt.dcml, err)
+		case got != tt.want:
+			t.Errorf("fixedWidthNumber(%q, %d) = %q, want %q", tt.field, tt.dcml, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DbVersion is a release of a database system targeted by the generated SQL (see ParseDbVersionFlag);
+// mssql releases are numbered by year (e.g., 2016)
+type DbVersion struct {
+	Major, Minor, Patch int
+}
+
+// minDbVersions are the oldest releases of each database system the generated SQL can target: postgres
+// 9.5 (INSERT ... ON CONFLICT, brin indices), mysql 5.7, oracle 11.2, and mssql 2008 (MERGE, row
+// constructors, the date and datetime2 types, and filtered indices). Snowflake, released continuously,
+// has no releases to target.
+var minDbVersions = map[string]DbVersion{
+	POSTGRES: {9, 5, 0},
+	MYSQL:    {5, 7, 0},
+	ORACLE:   {11, 2, 0},
+	MSSQL:    {2008, 0, 0},
+}
+
+// dbVersionRe matches the -db-version flag argument: a release, optionally prefixed by its database system
+var dbVersionRe = regexp.MustCompile(`^(?:([a-z]+):)?(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
+
+// ParseDbVersionFlag parses the -db-version flag argument, the release of the database system (dbType) the
+// generated SQL targets, of the form [system:]major[.minor[.patch]] (e.g., "postgres:12", "mysql:5.7",
+// "mssql:2016", or "12"), so that features missing from older releases are avoided, and those of newer
+// releases are used (see DatabaseFormatter.releaseBefore, and releaseSince)
+//
+// returns nil if the argument is empty; returns error if it's malformed, names another database system
+// than dbType, or a release older than the oldest targeted (see minDbVersions)
+func ParseDbVersionFlag(verF, dbType string) (*DbVersion, error) {
+	verF, dbType = strings.ToLower(strings.TrimSpace(verF)), strings.ToLower(dbType)
+	if len(verF) == 0 {
+		return nil, nil
+	}
+	m := dbVersionRe.FindStringSubmatch(verF)
+	if m == nil {
+		return nil, fmt.Errorf("'%s' is not of the form [database:]major[.minor[.patch]] (e.g., postgres:12, mysql:5.7, mssql:2016)", verF)
+	}
+	if len(m[1]) != 0 && m[1] != dbType {
+		return nil, fmt.Errorf("'%s' targets %s, but the database system is %s", verF, m[1], dbType)
+	}
+	oldest, ok := minDbVersions[dbType]
+	switch {
+	case dbType == SNOWFLAKE:
+		return nil, fmt.Errorf("snowflake is released continuously, and has no releases to target")
+	case !ok:
+		return nil, fmt.Errorf("dbType '%s' not in {'postgres', 'oracle', 'mysql', mssql'}", dbType)
+	}
+	var parts [3]int
+	for i, p := range m[2:] {
+		if len(p) != 0 {
+			parts[i], _ = strconv.Atoi(p)
+		}
+	}
+	v := DbVersion{parts[0], parts[1], parts[2]}
+	switch {
+	case dbType == MSSQL && v.Major < 2000:
+		return nil, fmt.Errorf("mssql releases are numbered by year (e.g., mssql:2016), not %s", verF)
+	case v.less(oldest):
+		return nil, fmt.Errorf("%s %s is older than the oldest release targeted (%s)", dbType, v, oldest)
+	}
+	return &v, nil
+}
+
+// String formats a release as major[.minor[.patch]]
+func (v DbVersion) String() string {
+	s := strconv.Itoa(v.Major)
+	if v.Minor != 0 || v.Patch != 0 {
+		s += "." + strconv.Itoa(v.Minor)
+	}
+	if v.Patch != 0 {
+		s += "." + strconv.Itoa(v.Patch)
+	}
+	return s
+}
+
+// less reports whether a release is older than another
+func (v DbVersion) less(w DbVersion) bool {
+	if v.Major != w.Major {
+		return v.Major < w.Major
+	}
+	if v.Minor != w.Minor {
+		return v.Minor < w.Minor
+	}
+	return v.Patch < w.Patch
+}
+
+// releaseBefore reports whether the SQL targets a release of the database system older than major.minor.
+// Without a targeted release (see DbVersion), neither releaseBefore nor releaseSince holds: the SQL is that
+// of the releases ipums2db has long been written for.
+func (dbf *DatabaseFormatter) releaseBefore(major, minor int) bool {
+	return dbf.DbVersion != nil && dbf.DbVersion.less(DbVersion{major, minor, 0})
+}
+
+// releaseSince reports whether the SQL targets a release of the database system of major.minor onward
+func (dbf *DatabaseFormatter) releaseSince(major, minor int) bool {
+	return dbf.DbVersion != nil && !dbf.DbVersion.less(DbVersion{major, minor, 0})
+}
+
+// selectsRows reports whether the rows of multi-row inserts are selected from dual, and united (see
+// appendRows), rather than listed after VALUES, which oracle only allows from 23 onward
+func (dbf *DatabaseFormatter) selectsRows() bool {
+	return dbf.DbType == ORACLE && dbf.releaseBefore(23, 0)
+}
+
+// appendRows appends the rows of a multi-row insert ("\t(1,2),\n\t(3,4)") to the statement's head (e.g.,
+// "INSERT INTO ipums_tab "): after VALUES, or, for oracle releases before 23, as rows selected from dual,
+// and united ("SELECT 1,2 FROM dual\nUNION ALL SELECT 3,4 FROM dual"). Oracle literals hold no line
+// breaks (see sqlString), so the rows' delimiters can't occur within them.
+func (dbf *DatabaseFormatter) appendRows(head, rows []byte) []byte {
+	if !dbf.selectsRows() {
+		return append(append(head, "VALUES\n"...), rows...)
+	}
+	rows = bytes.TrimSuffix(bytes.TrimPrefix(rows, []byte("\t(")), []byte(")"))
+	head = append(head, "SELECT "...)
+	head = append(head, bytes.ReplaceAll(rows, []byte("),\n\t("), []byte(" FROM dual\nUNION ALL SELECT "))...)
+	return append(head, " FROM dual"...)
+}
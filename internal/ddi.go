@@ -3,31 +3,220 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/xml"
-	"os"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 )
 
-// NewDataDict returns a DataDict, given the file path to the XML file
+// Data dictionary flavors. Microdata extracts (e.g., IPUMS USA, CPS) describe fixed-width
+// files, while aggregate extracts (e.g., NHGIS, IHGIS) describe comma-delimited files,
+// with columns identified by name rather than by position.
+const (
+	MICRODATA string = "microdata"
+	AGGREGATE string = "aggregate"
+)
+
+// NewDataDict returns a DataDict, given the file path to the XML file.
+// The flavor of the data dictionary is detected and stored in DataDict.Flavor
+//
+// SPSS (.sps), SAS (.sas), and Stata (.do) syntax files are accepted in place of the XML file.
+// Errors parsing the file are returned as a *DDIError.
 func NewDataDict(ddiFileName string) (DataDict, error) {
-	file, err := os.Open(ddiFileName)
+	return newDataDict(ddiFileName, false)
+}
+
+// NewDataDictNoCats returns a DataDict as NewDataDict does, without the variables' categories, for
+// commands that don't need them (e.g., previewing rows): categories make up most of a large DDI, so
+// they're dropped as each variable is read, keeping memory flat (see decodeDataDict).
+func NewDataDictNoCats(ddiFileName string) (DataDict, error) {
+	return newDataDict(ddiFileName, true)
+}
+
+// newDataDict returns a DataDict, given the file path to the XML (or syntax) file; if skipCats is set,
+// the variables' categories are left out
+func newDataDict(ddiFileName string, skipCats bool) (DataDict, error) {
+	if isSyntaxFile(ddiFileName) {
+		ddi, err := newDataDictFromSyntax(ddiFileName)
+		if err != nil {
+			return DataDict{}, &DDIError{File: ddiFileName, Err: err}
+		}
+		if skipCats {
+			for i := range ddi.Vars {
+				ddi.Vars[i].Cats = nil
+			}
+		}
+		return ddi, nil
+	}
+	file, err := openInput(ddiFileName)
 	if err != nil {
 		return DataDict{}, err
 	}
 	defer file.Close()
-	var ddi DataDict
-
-	decoder := xml.NewDecoder(file)
-	err = decoder.Decode(&ddi)
 
+	ddi, err := decodeDataDict(file, skipCats)
 	if err != nil {
-		return DataDict{}, err
+		return DataDict{}, &DDIError{File: ddiFileName, Err: err}
+	}
+	if err := checkRecordStructure(&ddi); err != nil {
+		return DataDict{}, &DDIError{File: ddiFileName, Err: err}
+	}
+
+	ddi.Flavor = ddiFlavor(&ddi)
+	if ddi.Flavor == AGGREGATE {
+		describeAggregateVars(&ddi)
 	}
 
 	return ddi, nil
 }
 
+// decodeDataDict decodes a DDI XML document token by token, rather than as a whole, so that DDIs of
+// hundreds of MB (large variable sets, with full category lists) are read in flat memory: sections that
+// aren't used (e.g., docDscr, and otherMat) are skipped unread, and variables are decoded one at a
+// time, dropping their categories if skipCats is set. Only the elements mapped by DataDict are kept.
+//
+// returns error if the XML is malformed
+func decodeDataDict(r io.Reader, skipCats bool) (DataDict, error) {
+	var ddi DataDict
+	decoder := xml.NewDecoder(r)
+	inRoot := false
+	for {
+		tok, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return DataDict{}, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !inRoot {
+			// the root (codeBook) element
+			ddi.ID, inRoot = xmlAttr(se, "ID"), true
+			continue
+		}
+		switch se.Name.Local {
+		case "dataDscr":
+			// descend into the variables
+		case "stdyDscr":
+			err = decoder.DecodeElement(&ddi.Study, &se)
+		case "fileDscr":
+			var fd fileDscr
+			err = decoder.DecodeElement(&fd, &se)
+			ddi.addFileDscr(fd)
+		case "var":
+			var v Var
+			err = decoder.DecodeElement(&v, &se)
+			if skipCats {
+				v.Cats = nil
+			}
+			ddi.Vars = append(ddi.Vars, v)
+		case "varGrp":
+			var g VarGroup
+			err = decoder.DecodeElement(&g, &se)
+			ddi.VarGroups = append(ddi.VarGroups, g)
+		default:
+			err = decoder.Skip()
+		}
+		if err != nil {
+			return DataDict{}, err
+		}
+	}
+	return ddi, nil
+}
+
+// fileDscr represents the file description of a DDI: the data file, and its structure
+type fileDscr struct {
+	FileType string `xml:"fileTxt>fileType"`
+	FileName string `xml:"fileTxt>fileName"`
+	CaseQnty int    `xml:"fileTxt>dimensns>caseQnty"`
+	FileStrc struct {
+		Type      string     `xml:"type,attr"`
+		RecGroups []RecGroup `xml:"recGrp"`
+	} `xml:"fileTxt>fileStrc"`
+}
+
+// addFileDscr records a file description of the DDI; the last declared of each field is kept, and record
+// groups are accumulated, as if the DDI was decoded as a whole
+func (dd *DataDict) addFileDscr(fd fileDscr) {
+	if len(fd.FileType) != 0 {
+		dd.FileType = fd.FileType
+	}
+	if len(fd.FileName) != 0 {
+		dd.FileName = fd.FileName
+	}
+	if fd.CaseQnty != 0 {
+		dd.CaseQnty = fd.CaseQnty
+	}
+	if len(fd.FileStrc.Type) != 0 {
+		dd.FileStrc = strings.ToLower(fd.FileStrc.Type)
+	}
+	dd.RecGroups = append(dd.RecGroups, fd.FileStrc.RecGroups...)
+}
+
+// DDIError is an error parsing a data dictionary (e.g., malformed XML), as opposed to an error
+// reading it, or converting its data
+type DDIError struct {
+	File string
+	Err  error
+}
+
+// Error returns the underlying error's message
+func (e *DDIError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *DDIError) Unwrap() error {
+	return e.Err
+}
+
+// ddiFlavor detects whether a data dictionary describes a microdata (fixed-width) or
+// aggregate (comma-delimited) extract. The file type is used if the DDI declares it;
+// otherwise, a data dictionary without any variable locations is considered aggregate.
+func ddiFlavor(dd *DataDict) string {
+	fileType := strings.ToLower(dd.FileType)
+	if strings.Contains(fileType, "csv") || strings.Contains(fileType, "comma") {
+		return AGGREGATE
+	}
+	for _, v := range dd.Vars {
+		if v.Location.End > 0 {
+			return MICRODATA
+		}
+	}
+	if len(dd.Vars) == 0 {
+		return MICRODATA
+	}
+	return AGGREGATE
+}
+
+// describeAggregateVars fills in column descriptions for aggregate data dictionaries.
+// Aggregate columns (e.g., NHGIS's AJWME001) are labeled relative to the table/concept
+// they belong to ("Total"), so the concept is prepended to the label ("Total Population: Total").
+// Columns without a label fall back to their concept, then to their name.
+func describeAggregateVars(dd *DataDict) {
+	for i, v := range dd.Vars {
+		concept := strings.TrimSpace(v.Concept)
+		label := strings.TrimSpace(v.Label)
+		switch {
+		case len(concept) != 0 && len(label) != 0 && concept != label:
+			dd.Vars[i].Label = concept + ": " + label
+		case len(label) != 0:
+			dd.Vars[i].Label = label
+		case len(concept) != 0:
+			dd.Vars[i].Label = concept
+		default:
+			dd.Vars[i].Label = v.Name
+		}
+	}
+}
+
 // BytesPerRow calculates the line width (# chars + newline)
-// for an IPUMS extract, using the data dictionary
+// for an IPUMS extract, using the data dictionary; see DetectLineEndings
 func BytesPerRow(dd *DataDict) int {
 	// if len(dd.Vars) == 0 {
 	// 	return 0, fmt.Errorf("no variables found, unable to calculate line width")
@@ -38,23 +227,99 @@ func BytesPerRow(dd *DataDict) int {
 			maxEndPos = v.Location.End
 		}
 	}
-	return maxEndPos + 1 // , nil // add newline character
+	eolBytes := dd.EOLBytes
+	if eolBytes == 0 {
+		eolBytes = 1
+	}
+	return maxEndPos + eolBytes // , nil // add newline character
+}
+
+// DetectLineEndings detects the line endings of a fixed-width file ("\n" or "\r\n"), storing the
+// number of bytes ending each line in dd.EOLBytes, and returns the number of rows in the file.
+// A missing final newline is tolerated; the last row is still counted.
+//
+// returns error if the file cannot be read, or if its first line doesn't match the data dictionary's width
+func DetectLineEndings(datFileName string, dd *DataDict) (int, error) {
+	datFile, err := OpenDat(datFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer datFile.Close()
+	size, err := datFile.Size()
+	if err != nil {
+		return 0, err
+	}
+	totBytes := int(size)
+
+	dd.EOLBytes = 1
+	rowChars := BytesPerRow(dd) - 1
+	head := make([]byte, rowChars+2)
+	n, err := datFile.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	head = head[:n]
+	switch {
+	case len(head) == rowChars: // a single row, without a final newline
+	case len(head) > rowChars && head[rowChars] == '\n':
+	case len(head) > rowChars+1 && head[rowChars] == '\r' && head[rowChars+1] == '\n':
+		dd.EOLBytes = 2
+	default:
+		if i := bytes.IndexByte(head, '\n'); i >= 0 {
+			return 0, fmt.Errorf("first line of %s holds %d characters, but the data dictionary describes %d", DatName(datFileName), len(strings.TrimSuffix(string(head[:i]), "\r")), rowChars)
+		}
+		return 0, fmt.Errorf("first line of %s is shorter than the %d characters described by the data dictionary", DatName(datFileName), rowChars)
+	}
+
+	bytesPerRow := BytesPerRow(dd)
+	totRows := totBytes / bytesPerRow
+	if totBytes%bytesPerRow == rowChars {
+		totRows++ // missing final newline
+	}
+	return totRows, nil
 }
 
 // DataDict represents an IPUMS xml-decoded data dictionary
 type DataDict struct {
-	Vars []Var `xml:"dataDscr>var"` // variables included in the extract
+	ID        string     `xml:"ID,attr"`                            // extract identifier (e.g., "usa_00012"), if declared
+	Vars      []Var      `xml:"dataDscr>var"`                       // variables included in the extract
+	FileType  string     `xml:"fileDscr>fileTxt>fileType"`          // data file type, if declared (e.g., "ascii", "csv")
+	FileName  string     `xml:"fileDscr>fileTxt>fileName"`          // data file name, if declared (e.g., "usa_00001.dat")
+	CaseQnty  int        `xml:"fileDscr>fileTxt>dimensns>caseQnty"` // rows of the data file, if declared (see CheckCaseCounts)
+	FileStrc  string     `xml:"-"`                                  // file structure (fileStrc's type), if declared: "rectangular" or "hierarchical"
+	RecGroups []RecGroup `xml:"fileDscr>fileTxt>fileStrc>recGrp"`   // record types, if declared (see RecTypeVar)
+	VarGroups []VarGroup `xml:"dataDscr>varGrp"`                    // variable groups, if declared (see VarGroups)
+	Study     Study      `xml:"stdyDscr"`                           // study citation and sample descriptions
+	Flavor    string     `xml:"-"`                                  // MICRODATA or AGGREGATE; set by NewDataDict
+	EOLBytes  int        `xml:"-"`                                  // bytes ending each line ("\n": 1, "\r\n": 2); 1 if unset
+
+	recoded bool // if true, recoded variables' categories have been replaced (see recodeCats)
+}
+
+// Study represents the study description of a data dictionary: how to cite the data,
+// and notes describing the samples included in the extract
+type Study struct {
+	Title       string   `xml:"citation>titlStmt>titl"`   // study title (e.g., "IPUMS CPS")
+	Citations   []string `xml:"citation>biblCit"`         // bibliographic citations
+	Notes       []string `xml:"stdyInfo>notes"`           // sample notes
+	SampleProcs []string `xml:"method>dataColl>sampProc"` // sampling procedure descriptions
 }
 
 // Var represents a variable included in the IPUMS data extract
 type Var struct {
-	Name         string    `xml:"name,attr"`   // "readable" variable name
-	Label        string    `xml:"labl"`        // actual variable name
-	VType        VarFormat `xml:"varFormat"`   // variable type
-	DecimalPoint int       `xml:"dcml,attr"`   // implied decimal point, if any
-	Interval     string    `xml:"intrvl,attr"` // interval type (discrete v. continuous)
-	Location     Loc       `xml:"location"`    // location within line
-	Cats         []Cat     `xml:"catgry"`      // if discrete, values/labels per category
+	Name         string     `xml:"name,attr"`    // "readable" variable name
+	Label        string     `xml:"labl"`         // actual variable name
+	VType        VarFormat  `xml:"varFormat"`    // variable type
+	DecimalPoint int        `xml:"dcml,attr"`    // implied decimal point, if any
+	Interval     string     `xml:"intrvl,attr"`  // interval type (discrete v. continuous)
+	Location     Loc        `xml:"location"`     // location within line
+	Cats         []Cat      `xml:"catgry"`       // if discrete, values/labels per category
+	Concept      string     `xml:"concept"`      // table/concept the variable belongs to (aggregate extracts)
+	Universe     string     `xml:"universe"`     // population the variable applies to (e.g., "Persons age 15+")
+	Text         string     `xml:"txt"`          // description of the variable, if declared; often several paragraphs long
+	ValidRanges  []ValRange `xml:"valrng>range"` // valid ranges of values, if declared (e.g., 0 to 135)
+	ValidItems   []ValItem  `xml:"valrng>item"`  // valid values outside the valid ranges, if declared
+	RecTypes     string     `xml:"rectype,attr"` // record types the variable belongs to (e.g., "H P"), space-separated; hierarchical extracts only
 }
 
 // Loc represents the location of a variable within the fixed-width line
@@ -64,12 +329,43 @@ type Loc struct {
 	Width int `xml:"width,attr"`    // width of variable in character count
 }
 
+// ValRange represents a range of valid values of a variable; either bound may be left open
+type ValRange struct {
+	Min string `xml:"min,attr"` // lowest valid value, if bounded
+	Max string `xml:"max,attr"` // highest valid value, if bounded
+}
+
+// ValItem represents a single valid value of a variable
+type ValItem struct {
+	Val string `xml:"VALUE,attr"`
+}
+
 // Category represents a discrete category for a variable
 type Cat struct {
 	Val   string `xml:"catValu"` // coded value
 	Label string `xml:"labl"`    // corresponding label for coded value
 }
 
+// VarGroup represents a group of related variables declared by a data dictionary (e.g., demographics, or income)
+type VarGroup struct {
+	ID    string `xml:"ID,attr"`  // group identifier (e.g., "demo")
+	Vars  string `xml:"var,attr"` // names of the group's variables, space-separated
+	Label string `xml:"labl"`     // group label (e.g., "Demographics")
+}
+
+// RecGroup represents a record type of an extract (e.g., households, and persons, of a hierarchical extract)
+type RecGroup struct {
+	ID       string `xml:"ID,attr"`            // record group identifier, if declared (e.g., "person")
+	Parent   string `xml:"recGrp,attr"`        // identifiers of the record groups the records belong to, if declared (see Levels)
+	RecType  string `xml:"rectype,attr"`       // value of the record type variable identifying the records (e.g., "P")
+	RecIDVar string `xml:"recidvar,attr"`      // name of the record type variable (e.g., "RECTYPE")
+	KeyVar   string `xml:"keyvar,attr"`        // variables linking the records to those of other types (e.g., "SERIAL"), space-separated
+	Label    string `xml:"labl"`               // record type label (e.g., "Person")
+	CaseQnty int    `xml:"recDimnsn>caseQnty"` // records of the type, if declared
+	VarQnty  int    `xml:"recDimnsn>varQnty"`  // variables of the type, if declared
+	RecLen   int    `xml:"recDimnsn>logRecL"`  // characters of a record of the type, if declared (see RecordLength)
+}
+
 // VarFormat represents a variables format/type
 type VarFormat struct {
 	VarType string `xml:"type,attr"` // variable type
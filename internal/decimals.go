@@ -0,0 +1,74 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storage of decimal variables (those with implied decimal places, e.g., weights and incomes)
+const (
+	DECIMALS_NUMERIC string = "numeric" // exact decimals, e.g., numeric(10,2)
+	DECIMALS_DOUBLE  string = "double"  // 8-byte floats, e.g., double precision
+	DECIMALS_REAL    string = "real"    // 4-byte floats, e.g., real; about 7 significant digits
+	DECIMALS_SCALED  string = "scaled"  // integers, the values multiplied by 10^decimal places (e.g., 1234.56 -> 123456)
+)
+
+// maxPlacesFori64 is the widest variable held by a bigint column, in digits
+const maxPlacesFori64 int = 18
+
+// ParseDecimalsFlag returns the storage of decimal variables named by the -decimals flag: "numeric" (the
+// default, if empty), exact decimals; "double" or "real", native floats, far faster to aggregate; or
+// "scaled", integers holding the values scaled by their decimal places (see scales)
+//
+// returns error if the storage is not supported
+func ParseDecimalsFlag(decimalsF string) (string, error) {
+	switch d := strings.ToLower(strings.TrimSpace(decimalsF)); d {
+	case "", DECIMALS_NUMERIC:
+		return DECIMALS_NUMERIC, nil
+	case DECIMALS_DOUBLE, DECIMALS_REAL, DECIMALS_SCALED:
+		return d, nil
+	default:
+		return "", fmt.Errorf("decimal storage '%s' not in {'numeric', 'double', 'real', 'scaled'}", decimalsF)
+	}
+}
+
+// checkDecimals ensures that decimal variables can be stored as set: scaled integers are read from the
+// implied decimals of fixed-width fields, so comma-delimited (aggregate) extracts, whose fields hold
+// decimal points, can't be scaled
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkDecimals(ddi *DataDict) error {
+	if dbf.Decimals == DECIMALS_SCALED && ddi.Flavor == AGGREGATE {
+		return fmt.Errorf("decimal variables are scaled in microdata extracts only")
+	}
+	return nil
+}
+
+// floats reports whether a decimal variable's column is a native float (see DECIMALS_DOUBLE, DECIMALS_REAL)
+func (dbf *DatabaseFormatter) floats(v Var) bool {
+	return (dbf.Decimals == DECIMALS_DOUBLE || dbf.Decimals == DECIMALS_REAL) && v.DecimalPoint > 0
+}
+
+// scales reports whether a decimal variable's column holds scaled integers (see DECIMALS_SCALED): those
+// of numeric variables with implied decimal places, no wider than a bigint, that aren't hashed, or forced
+// to a type
+func (dbf *DatabaseFormatter) scales(v Var) bool {
+	if dbf.Decimals != DECIMALS_SCALED || v.DecimalPoint == 0 || v.VType.VarType == "character" || dbf.Hash.hashes(v) {
+		return false
+	}
+	if _, ok := dbf.columnOverride(v); ok {
+		return false
+	}
+	return v.Location.Width > 0 && v.Location.Width <= maxPlacesFori64
+}
+
+// scaleNote returns the note on a scaled variable's scale factor, appended to its label (e.g., " (scaled by
+// 100)"), or "" if it isn't scaled
+func (dbf *DatabaseFormatter) scaleNote(v Var) string {
+	if !dbf.scales(v) {
+		return ""
+	}
+	return fmt.Sprintf(" (scaled by 1%s)", strings.Repeat("0", v.DecimalPoint))
+}
@@ -0,0 +1,567 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DerivedColumns holds columns computed from expressions over the extract's variables, evaluated per
+// row as the data is converted, and appended to the main table (see ParseDeriveFlag)
+type DerivedColumns struct {
+	cols []derivedCol
+}
+
+// derivedCol is a single derived column
+type derivedCol struct {
+	name string
+	src  string // expression, as given
+	expr exprNode
+}
+
+// ParseDeriveFlag parses the -derive flag argument into DerivedColumns; if empty, it returns nil. The
+// argument is either a semicolon-delimited list of name=expression definitions (e.g.,
+// "incwage_real = incwage * cpi99; age_group = case(age, 0-17: 1, 18-64: 2, 65+: 3)"), or the path
+// to a file holding one definition per line; blank lines and lines starting with "#" are ignored.
+//
+// Expressions are made of numbers, numeric variables, +, -, *, /, parentheses, and the functions:
+//
+//	case(x, range: value, ..., else: value)  the value of the first range holding x (ranges are written
+//	                                         as in category codes: 5, 0-17, 10..19, 65+); null if none
+//	                                         does, and there's no else
+//	round(x[, digits])                       x rounded to digits decimal places (0, by default)
+//	abs(x), min(x, y, ...), max(x, y, ...)
+//	coalesce(x, y, ...)                      the first non-null argument
+//
+// Any other null operand makes the result null, as does division by zero.
+//
+// returns error if the file cannot be read, or if a definition or expression is malformed
+func ParseDeriveFlag(deriveF string) (*DerivedColumns, error) {
+	if len(strings.TrimSpace(deriveF)) == 0 {
+		return nil, nil
+	}
+	var defs []string
+	if strings.Contains(deriveF, "=") {
+		defs = strings.Split(deriveF, ";")
+	} else {
+		f, err := os.Open(deriveF)
+		if err != nil {
+			return nil, fmt.Errorf("reading definitions file: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			defs = append(defs, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading definitions file: %w", err)
+		}
+	}
+
+	dc := &DerivedColumns{}
+	for _, def := range defs {
+		if len(strings.TrimSpace(def)) == 0 {
+			continue
+		}
+		name, src, found := strings.Cut(def, "=")
+		name, src = strings.TrimSpace(name), strings.TrimSpace(src)
+		if !found || len(name) == 0 || len(src) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form name=expression", strings.TrimSpace(def))
+		}
+		if !identifierRe.MatchString(name) {
+			return nil, fmt.Errorf("'%s' is not a valid column name (letters, digits, and underscores only)", name)
+		}
+		if slices.ContainsFunc(dc.cols, func(c derivedCol) bool { return strings.EqualFold(c.name, name) }) {
+			return nil, fmt.Errorf("%s is derived more than once", name)
+		}
+		p := &exprParser{src: src}
+		expr, err := p.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		dc.cols = append(dc.cols, derivedCol{name: name, src: src, expr: expr})
+	}
+	return dc, nil
+}
+
+// derivedType returns the type of a derived column: "bigint" if the expression always yields
+// integers (see exprNode.integral), and "double" otherwise
+func derivedType(c derivedCol) string {
+	if c.expr.integral() {
+		return "bigint"
+	}
+	return "double"
+}
+
+// checkDerived resolves the variables of the derived columns' expressions, and ensures that no
+// derived column is named after another column
+//
+// returns error if an expression refers to a variable not in the data dictionary, or to a
+// character variable, or if a derived column's name is taken
+func (dbf *DatabaseFormatter) checkDerived(ddi *DataDict) error {
+	if dbf.Derived == nil {
+		return nil
+	}
+	for _, c := range dbf.Derived.cols {
+		if col, ok := dbf.lookupVarColumn(ddi, c.name); ok {
+			return fmt.Errorf("derived column %s is named after column %s", c.name, col)
+		}
+		if err := c.expr.bind(ddi); err != nil {
+			return fmt.Errorf("derived column %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// derivedFromRow evaluates the derived columns of a fixed-width row, given the null policy of each
+// variable; returns each column's value, formatted as a SQL numeric literal, or "" if null
+//
+// returns error if an operand cannot be parsed
+func (dbf *DatabaseFormatter) derivedFromRow(ddi *DataDict, row []byte, nullPolicies []string) ([]string, error) {
+	return dbf.Derived.values(func(i int) (float64, bool, error) {
+		v := ddi.Vars[i]
+		chars, isNull, err := applyNullPolicy(row[v.Location.Start-1:v.Location.End], nullPolicies[i], false)
+		if err != nil || isNull {
+			return 0, isNull, err
+		}
+		num, err := fixedWidthNumber(chars, v.DecimalPoint)
+		if err != nil {
+			return 0, false, err
+		}
+		f, err := strconv.ParseFloat(num, 64)
+		return f, false, err
+	})
+}
+
+// derivedFromRecord evaluates the derived columns of a comma-delimited record (see derivedFromRow)
+func (dbf *DatabaseFormatter) derivedFromRecord(rec []string, colIdx []int) ([]string, error) {
+	return dbf.Derived.values(func(i int) (float64, bool, error) {
+		if colIdx[i] < 0 || colIdx[i] >= len(rec) || len(strings.TrimSpace(rec[colIdx[i]])) == 0 {
+			return 0, true, nil
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(rec[colIdx[i]]), 64)
+		return x, false, err
+	})
+}
+
+// values evaluates the derived columns, reading variables (by data dictionary index) with get
+func (dc *DerivedColumns) values(get func(i int) (float64, bool, error)) ([]string, error) {
+	vals := make([]string, len(dc.cols))
+	for i, c := range dc.cols {
+		x, isNull, err := c.expr.eval(get)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("derived column %s: %w", c.name, err)
+		case isNull || math.IsNaN(x) || math.IsInf(x, 0):
+		case c.expr.integral():
+			if math.Abs(x) < math.MaxInt64 {
+				vals[i] = strconv.FormatFloat(x, 'f', 0, 64)
+			}
+		default:
+			vals[i] = strconv.FormatFloat(x, 'g', -1, 64)
+		}
+	}
+	return vals, nil
+}
+
+// exprNode is a node of a derived column's expression
+type exprNode interface {
+	// eval evaluates the node, reading variables with get; isNull is true for null results
+	eval(get func(i int) (float64, bool, error)) (x float64, isNull bool, err error)
+	// integral reports whether the node always yields integers
+	integral() bool
+	// bind resolves the node's variables in a data dictionary
+	bind(ddi *DataDict) error
+}
+
+type (
+	numLit struct {
+		x float64
+	}
+	varRef struct {
+		name  string
+		idx   int
+		isInt bool
+	}
+	negExpr struct {
+		x exprNode
+	}
+	binExpr struct {
+		op   byte
+		l, r exprNode
+	}
+	callExpr struct {
+		fn   string
+		args []exprNode
+	}
+	caseExpr struct {
+		x    exprNode
+		arms []caseArm
+		els  exprNode // nil if no else
+	}
+	caseArm struct {
+		lo, hi float64
+		val    exprNode
+	}
+)
+
+func (n *numLit) eval(func(int) (float64, bool, error)) (float64, bool, error) {
+	return n.x, false, nil
+}
+func (n *numLit) integral() bool       { return n.x == math.Trunc(n.x) }
+func (n *numLit) bind(*DataDict) error { return nil }
+
+func (n *varRef) eval(get func(int) (float64, bool, error)) (float64, bool, error) {
+	x, isNull, err := get(n.idx)
+	if err != nil {
+		return 0, false, fmt.Errorf("variable %s: %w", n.name, err)
+	}
+	return x, isNull, nil
+}
+func (n *varRef) integral() bool { return n.isInt }
+func (n *varRef) bind(ddi *DataDict) error {
+	n.idx = slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, n.name) })
+	if n.idx < 0 {
+		return fmt.Errorf("unrecognized variable %s", n.name)
+	}
+	v := ddi.Vars[n.idx]
+	if v.VType.VarType == "character" {
+		return fmt.Errorf("character variable %s can't be computed on", v.Name)
+	}
+	n.isInt = v.DecimalPoint == 0 && ddi.Flavor != AGGREGATE
+	return nil
+}
+
+func (n *negExpr) eval(get func(int) (float64, bool, error)) (float64, bool, error) {
+	x, isNull, err := n.x.eval(get)
+	return -x, isNull, err
+}
+func (n *negExpr) integral() bool           { return n.x.integral() }
+func (n *negExpr) bind(ddi *DataDict) error { return n.x.bind(ddi) }
+
+func (n *binExpr) eval(get func(int) (float64, bool, error)) (float64, bool, error) {
+	l, lNull, err := n.l.eval(get)
+	if err != nil {
+		return 0, false, err
+	}
+	r, rNull, err := n.r.eval(get)
+	if err != nil || lNull || rNull {
+		return 0, lNull || rNull, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, false, nil
+	case '-':
+		return l - r, false, nil
+	case '*':
+		return l * r, false, nil
+	default:
+		if r == 0 {
+			return 0, true, nil
+		}
+		return l / r, false, nil
+	}
+}
+func (n *binExpr) integral() bool { return n.op != '/' && n.l.integral() && n.r.integral() }
+func (n *binExpr) bind(ddi *DataDict) error {
+	if err := n.l.bind(ddi); err != nil {
+		return err
+	}
+	return n.r.bind(ddi)
+}
+
+func (n *callExpr) eval(get func(int) (float64, bool, error)) (float64, bool, error) {
+	args := make([]float64, 0, len(n.args))
+	for _, a := range n.args {
+		x, isNull, err := a.eval(get)
+		if err != nil {
+			return 0, false, err
+		}
+		if n.fn == "coalesce" && !isNull {
+			return x, false, nil
+		}
+		if isNull && n.fn != "coalesce" {
+			return 0, true, nil
+		}
+		args = append(args, x)
+	}
+	switch n.fn {
+	case "round":
+		scale := 1.0
+		if len(args) == 2 {
+			scale = math.Pow(10, math.Round(args[1]))
+		}
+		return math.Round(args[0]*scale) / scale, false, nil
+	case "abs":
+		return math.Abs(args[0]), false, nil
+	case "min":
+		return slices.Min(args), false, nil
+	case "max":
+		return slices.Max(args), false, nil
+	default: // coalesce, of null arguments only
+		return 0, true, nil
+	}
+}
+func (n *callExpr) integral() bool {
+	if n.fn == "round" {
+		return len(n.args) == 1
+	}
+	for _, a := range n.args {
+		if !a.integral() {
+			return false
+		}
+	}
+	return true
+}
+func (n *callExpr) bind(ddi *DataDict) error {
+	for _, a := range n.args {
+		if err := a.bind(ddi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *caseExpr) eval(get func(int) (float64, bool, error)) (float64, bool, error) {
+	x, isNull, err := n.x.eval(get)
+	if err != nil || isNull {
+		return 0, isNull, err
+	}
+	for _, arm := range n.arms {
+		if arm.lo <= x && x <= arm.hi {
+			return arm.val.eval(get)
+		}
+	}
+	if n.els == nil {
+		return 0, true, nil
+	}
+	return n.els.eval(get)
+}
+func (n *caseExpr) integral() bool {
+	for _, arm := range n.arms {
+		if !arm.val.integral() {
+			return false
+		}
+	}
+	return n.els == nil || n.els.integral()
+}
+func (n *caseExpr) bind(ddi *DataDict) error {
+	nodes := []exprNode{n.x}
+	for _, arm := range n.arms {
+		nodes = append(nodes, arm.val)
+	}
+	if n.els != nil {
+		nodes = append(nodes, n.els)
+	}
+	for _, node := range nodes {
+		if err := node.bind(ddi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exprParser is a recursive descent parser of derived column expressions
+type exprParser struct {
+	src string
+	pos int
+}
+
+// parse parses the whole expression
+//
+// returns error if the expression is malformed
+func (p *exprParser) parse() (exprNode, error) {
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected '%c'", p.src[p.pos])
+	}
+	return n, nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("expression '%s', at %d: %s", p.src, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-blank character, or 0 at the end of the expression
+func (p *exprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// expect consumes the next non-blank character, if it's c
+func (p *exprParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected '%c'", c)
+	}
+	p.pos++
+	return nil
+}
+
+// expr: term {("+" | "-") term}
+func (p *exprParser) expr() (exprNode, error) {
+	l, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.src[p.pos]
+		p.pos++
+		var r exprNode
+		if r, err = p.term(); err == nil {
+			l = &binExpr{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+// term: unary {("*" | "/") unary}
+func (p *exprParser) term() (exprNode, error) {
+	l, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.src[p.pos]
+		p.pos++
+		var r exprNode
+		if r, err = p.unary(); err == nil {
+			l = &binExpr{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+// unary: "-" unary | primary
+func (p *exprParser) unary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		return &negExpr{x: x}, err
+	}
+	return p.primary()
+}
+
+// primary: number | "(" expr ")" | variable | function "(" args ")"
+func (p *exprParser) primary() (exprNode, error) {
+	c := p.peek()
+	start := p.pos
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(')')
+	case c == '.' || (c >= '0' && c <= '9'):
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		x, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("'%s' is not a number", p.src[start:p.pos])
+		}
+		return &numLit{x: x}, nil
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || (p.src[p.pos]|0x20 >= 'a' && p.src[p.pos]|0x20 <= 'z') || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() != '(' {
+			return &varRef{name: name}, nil
+		}
+		p.pos++
+		return p.call(strings.ToLower(name))
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	default:
+		return nil, p.errorf("unexpected '%c'", c)
+	}
+}
+
+// call parses the arguments of a function call, following its "("
+func (p *exprParser) call(fn string) (exprNode, error) {
+	if fn == "case" {
+		return p.caseArgs()
+	}
+	var args []exprNode
+	for {
+		a, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	switch {
+	case fn == "round" && (len(args) == 1 || len(args) == 2):
+	case fn == "abs" && len(args) == 1:
+	case fn == "min" || fn == "max" || fn == "coalesce":
+	case fn == "round" || fn == "abs":
+		return nil, p.errorf("wrong number of arguments to %s", fn)
+	default:
+		return nil, p.errorf("unknown function %s (case, round, abs, min, max, or coalesce)", fn)
+	}
+	return &callExpr{fn: fn, args: args}, nil
+}
+
+// caseArgs parses the arguments of case, following its "(": an expression, then "range: value" arms
+func (p *exprParser) caseArgs() (exprNode, error) {
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	n := &caseExpr{x: x}
+	for p.peek() == ',' {
+		p.pos++
+		colon := strings.IndexByte(p.src[p.pos:], ':')
+		if colon < 0 {
+			return nil, p.errorf("expected 'range: value'")
+		}
+		key := strings.TrimSpace(p.src[p.pos : p.pos+colon])
+		p.pos += colon + 1
+		val, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(key, "else") {
+			n.els = val
+			continue
+		}
+		lo, hi, ok := catRange(key)
+		if !ok {
+			return nil, p.errorf("'%s' is not a value or range of values", key)
+		}
+		arm := caseArm{val: val, hi: math.Inf(1)}
+		arm.lo, _ = strconv.ParseFloat(lo, 64)
+		if len(hi) != 0 {
+			arm.hi, _ = strconv.ParseFloat(hi, 64)
+		}
+		n.arms = append(n.arms, arm)
+	}
+	if len(n.arms) == 0 && n.els == nil {
+		return nil, p.errorf("case needs at least one 'range: value' arm")
+	}
+	return n, p.expect(')')
+}
@@ -0,0 +1,85 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SearchVars returns the variables of a data dictionary matching a term (case-insensitive): the variable
+// named term, if any, or else every variable whose name or label contains it, in data dictionary order
+func SearchVars(ddi *DataDict, term string) []Var {
+	term = strings.TrimSpace(term)
+	if v, ok := findVar(ddi, term); ok {
+		return []Var{v}
+	}
+	lower := strings.ToLower(term)
+	var matches []Var
+	for _, v := range ddi.Vars {
+		if strings.Contains(strings.ToLower(v.Name), lower) || strings.Contains(strings.ToLower(v.Label), lower) {
+			matches = append(matches, v)
+		}
+	}
+	return matches
+}
+
+// Describe returns the codebook entry of a variable: its label, type, position, width, implied decimals,
+// interval, record types, concept, and universe (if declared), and every category, one per line. For example:
+//
+//	INCWAGE: Wage and salary income
+//	  type:      numeric (continuous)
+//	  position:  16-24 (width 9, 2 implied decimals)
+//	  universe:  Persons age 15+
+//	  categories (1):
+//	    9999999  N/A
+func Describe(v Var) string {
+	var desc strings.Builder
+	varType := v.VType.VarType
+	if len(varType) == 0 {
+		varType = "numeric"
+	}
+	interval := v.Interval
+	if interval == "contin" {
+		interval = "continuous"
+	}
+	desc.WriteString(fmt.Sprintf("%s: %s\n", v.Name, v.Label))
+	if len(interval) != 0 {
+		desc.WriteString(fmt.Sprintf("  type:      %s (%s)\n", varType, interval))
+	} else {
+		desc.WriteString(fmt.Sprintf("  type:      %s\n", varType))
+	}
+	desc.WriteString(fmt.Sprintf("  position:  %d-%d (width %d", v.Location.Start, v.Location.End, v.Location.Width))
+	switch v.DecimalPoint {
+	case 0:
+		desc.WriteString(")\n")
+	case 1:
+		desc.WriteString(", 1 implied decimal)\n")
+	default:
+		desc.WriteString(fmt.Sprintf(", %d implied decimals)\n", v.DecimalPoint))
+	}
+	if types := v.RecordTypes(); len(types) != 0 {
+		desc.WriteString(fmt.Sprintf("  records:   %s\n", strings.Join(types, ", ")))
+	}
+	if concept := strings.TrimSpace(v.Concept); len(concept) != 0 {
+		desc.WriteString(fmt.Sprintf("  concept:   %s\n", concept))
+	}
+	if universe := strings.Join(strings.Fields(v.Universe), " "); len(universe) != 0 {
+		desc.WriteString(fmt.Sprintf("  universe:  %s\n", universe))
+	}
+	if text := strings.Join(strings.Fields(v.Text), " "); len(text) != 0 {
+		desc.WriteString(fmt.Sprintf("  about:     %s\n", text))
+	}
+	if len(v.Cats) == 0 {
+		return desc.String()
+	}
+	width := 0
+	for _, c := range v.Cats {
+		width = max(width, len(strings.TrimSpace(c.Val)))
+	}
+	desc.WriteString(fmt.Sprintf("  categories (%d):\n", len(v.Cats)))
+	for _, c := range v.Cats {
+		desc.WriteString(fmt.Sprintf("    %-*s  %s\n", width, strings.TrimSpace(c.Val), c.Label))
+	}
+	return desc.String()
+}
@@ -0,0 +1,119 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dictHeader is the header of the exported data dictionary
+var dictHeader = []string{"name", "label", "type", "start", "end", "width", "decimals", "interval", "n_categories", "universe", "description"}
+
+// labelsHeader is the header of the exported value labels
+var labelsHeader = []string{"name", "value", "label"}
+
+// ExportDict writes the data dictionary to outFileName, one row per variable, and all value labels
+// to a second file named after the first (e.g., "dict.csv" -> "dict_labels.csv"). The format is
+// chosen by outFileName's extension: ".md" for Markdown tables, and CSV otherwise.
+// Returns the path of the value labels file.
+//
+// returns error if either file cannot be written
+func ExportDict(ddi *DataDict, outFileName string) (string, error) {
+	ext := filepath.Ext(outFileName)
+	labelsFileName := strings.TrimSuffix(outFileName, ext) + "_labels" + ext
+	if len(ext) == 0 {
+		labelsFileName = outFileName + "_labels"
+	}
+	markdown := strings.EqualFold(ext, ".md")
+
+	dictRows, labelRows := dictRecords(ddi)
+	if err := writeTable(outFileName, dictHeader, dictRows, markdown); err != nil {
+		return "", err
+	}
+	if err := writeTable(labelsFileName, labelsHeader, labelRows, markdown); err != nil {
+		_ = os.Remove(outFileName)
+		return "", err
+	}
+	return labelsFileName, nil
+}
+
+// dictRecords returns the rows of the exported data dictionary and of the value labels
+func dictRecords(ddi *DataDict) ([][]string, [][]string) {
+	dictRows := make([][]string, 0, len(ddi.Vars))
+	var labelRows [][]string
+	for _, v := range ddi.Vars {
+		varType := v.VType.VarType
+		if len(varType) == 0 {
+			varType = "numeric"
+		}
+		dictRows = append(dictRows, []string{
+			strings.ToLower(v.Name),
+			v.Label,
+			varType,
+			strconv.Itoa(v.Location.Start),
+			strconv.Itoa(v.Location.End),
+			strconv.Itoa(v.Location.Width),
+			strconv.Itoa(v.DecimalPoint),
+			v.Interval,
+			strconv.Itoa(len(v.Cats)),
+			docText(v.Universe),
+			docText(v.Text),
+		})
+		for _, c := range v.Cats {
+			labelRows = append(labelRows, []string{strings.ToLower(v.Name), strings.TrimSpace(c.Val), c.Label})
+		}
+	}
+	return dictRows, labelRows
+}
+
+// writeTable writes a header and rows to a file, either as CSV or a Markdown table
+func writeTable(fileName string, header []string, rows [][]string, markdown bool) error {
+	f, err := createTemp(fileName)
+	if err != nil {
+		return err
+	}
+	if markdown {
+		err = writeMarkdownTable(f, header, rows)
+	} else {
+		w := csv.NewWriter(f)
+		_ = w.Write(header)
+		_ = w.WriteAll(rows) // WriteAll flushes, and returns any write error
+		err = w.Error()
+	}
+	return finishTemp(f, fileName, err)
+}
+
+// writeMarkdownTable writes a header and rows as a Markdown (GitHub-flavored) table
+func writeMarkdownTable(w io.Writer, header []string, rows [][]string) error {
+	cell := strings.NewReplacer("|", `\|`, "\n", " ", "\r", "")
+	writeRow := func(row []string) error {
+		escaped := make([]string, len(row))
+		for i, c := range row {
+			escaped[i] = cell.Replace(c)
+		}
+		_, err := fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+		return err
+	}
+	if err := writeRow(header); err != nil {
+		return err
+	}
+	sep := make([]string, len(header))
+	for i := range sep {
+		sep[i] = "---"
+	}
+	if err := writeRow(sep); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := writeRow(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxCharsInDoc limits the length of citation, sample, and universe text in the doc tables;
+// 4000 is the max varchar2 length in oracle (without extended string sizes)
+const maxCharsInDoc int = 4000
+
+// maxCharsInNote limits the length of the description in a column comment (see varNotes); the full
+// description is in the emitted docs, and the exported data dictionary
+const maxCharsInNote int = 200
+
+// CreateDocTables generates "CREATE TABLE" and "INSERT INTO" statements for three tables capturing the
+// DDI's documentation, so that it travels with the data:
+//
+//   - ref_citation (title, citation): the study title and each bibliographic citation
+//   - ref_samples (note): sample notes and sampling procedure descriptions
+//   - ref_universe (variable, universe): the population each variable applies to
+//
+// Tables that would be empty are not created. Returns a byte slice of all the statements
+// (note: statement terminator (e.g., ";") is included).
+func (dbf *DatabaseFormatter) CreateDocTables(ddi *DataDict) []byte {
+	var docs strings.Builder
+	for _, t := range dbf.docTables(ddi) {
+		docs.WriteString(dbf.docTable(t.name, t.colDefs, t.rows))
+	}
+	return []byte(docs.String())
+}
+
+// docTableDef is a doc table: its name, column definitions, and rows of string values
+type docTableDef struct {
+	name    string
+	colDefs []string
+	rows    [][]string
+}
+
+// docTables returns the doc tables of a data dictionary (see CreateDocTables), empty ones included
+func (dbf *DatabaseFormatter) docTables(ddi *DataDict) []docTableDef {
+	var citations [][]string
+	for _, c := range ddi.Study.Citations {
+		if c = docText(c); len(c) != 0 {
+			citations = append(citations, []string{docText(ddi.Study.Title), c})
+		}
+	}
+	if len(citations) == 0 && len(docText(ddi.Study.Title)) != 0 {
+		citations = append(citations, []string{docText(ddi.Study.Title), ""})
+	}
+	tables := []docTableDef{{dbf.refTable("citation"),
+		[]string{dbf.ident("title ") + dbf.sqlType("string", 1000), dbf.ident("citation ") + dbf.sqlType("string", maxCharsInDoc)},
+		citations}}
+
+	var samples [][]string
+	for _, n := range append(append([]string{}, ddi.Study.Notes...), ddi.Study.SampleProcs...) {
+		if n = docText(n); len(n) != 0 {
+			samples = append(samples, []string{n})
+		}
+	}
+	tables = append(tables, docTableDef{dbf.refTable("samples"),
+		[]string{dbf.ident("note ") + dbf.sqlType("string", maxCharsInDoc)},
+		samples})
+
+	var universes [][]string
+	for _, v := range ddi.Vars {
+		if u := docText(v.Universe); len(u) != 0 {
+			universes = append(universes, []string{dbf.columnName(v), u})
+		}
+	}
+	tables = append(tables, docTableDef{dbf.refTable("universe"),
+		[]string{dbf.ident("variable ") + dbf.sqlType("string", 128), dbf.ident("universe ") + dbf.sqlType("string", maxCharsInDoc)},
+		universes})
+	return tables
+}
+
+// docTable generates the "CREATE TABLE" and "INSERT INTO" statements for a single doc table,
+// given its column definitions and rows of string values; returns "" if there are no rows
+func (dbf *DatabaseFormatter) docTable(tableName string, colDefs []string, rows [][]string) string {
+	if len(rows) == 0 {
+		return ""
+	}
+	colNames := make([]string, len(colDefs))
+	for i, def := range colDefs {
+		colNames[i], _, _ = strings.Cut(def, " ")
+	}
+	var t strings.Builder
+	t.WriteString(fmt.Sprintf("CREATE TABLE %s (\n\t%s\n);\n\n", tableName, strings.Join(colDefs, ",\n\t")))
+	tuples := make([]string, len(rows))
+	for i, row := range rows {
+		vals := make([]string, len(row))
+		for j, v := range row {
+			vals[j] = dbf.sqlNullableString(v)
+		}
+		tuples[i] = fmt.Sprintf("\t(%s)", strings.Join(vals, ", "))
+	}
+	head := fmt.Sprintf("INSERT INTO %s (%s)\n", tableName, strings.Join(colNames, ", "))
+	t.Write(dbf.appendRows([]byte(head), []byte(strings.Join(tuples, ",\n"))))
+	t.WriteString("\n;\n\n")
+	return t.String()
+}
+
+// docText collapses the whitespace of DDI documentation text (which is often wrapped
+// and indented within the XML), truncating it to maxCharsInDoc characters
+func docText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > maxCharsInDoc {
+		s = string(r[:maxCharsInDoc])
+	}
+	return s
+}
+
+// varNotes returns the notes following a variable's label in its column comment: the first sentence of
+// its description, and its universe, if declared (e.g., ". Age in years. Universe: All persons")
+func varNotes(v Var) string {
+	var notes []string
+	if text := docText(v.Text); len(text) != 0 {
+		if end := strings.Index(text, ". "); end >= 0 {
+			text = text[:end+1]
+		}
+		if r := []rune(text); len(r) > maxCharsInNote {
+			text = string(r[:maxCharsInNote]) + "..."
+		}
+		notes = append(notes, strings.TrimSuffix(text, "."))
+	}
+	if u := docText(v.Universe); len(u) != 0 {
+		notes = append(notes, "Universe: "+strings.TrimSuffix(u, "."))
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return ". " + strings.Join(notes, ". ")
+}
+
+// emitDocs generates a Markdown document of the DDI's documentation: the study citation,
+// sample notes, and each variable's label, universe, and description
+func emitDocs(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	var md strings.Builder
+	title := docText(ddi.Study.Title)
+	if len(title) == 0 {
+		title = dbfmtr.TableName
+	}
+	md.WriteString(fmt.Sprintf("# %s\n\n", title))
+	if len(ddi.ID) != 0 {
+		md.WriteString(fmt.Sprintf("Extract: `%s`\n\n", ddi.ID))
+	}
+
+	if len(ddi.Study.Citations) != 0 {
+		md.WriteString("## citation\n\n")
+		for _, c := range ddi.Study.Citations {
+			if c = docText(c); len(c) != 0 {
+				md.WriteString(c + "\n\n")
+			}
+		}
+	}
+
+	if len(ddi.Study.Notes)+len(ddi.Study.SampleProcs) != 0 {
+		md.WriteString("## samples\n\n")
+		for _, n := range append(append([]string{}, ddi.Study.Notes...), ddi.Study.SampleProcs...) {
+			if n = docText(n); len(n) != 0 {
+				md.WriteString("- " + n + "\n")
+			}
+		}
+		md.WriteString("\n")
+	}
+
+	md.WriteString("## variables\n\n")
+	rows := make([][]string, len(ddi.Vars))
+	for i, v := range ddi.Vars {
+		rows[i] = []string{dbfmtr.columnName(v), docText(v.Label), docText(v.Universe), docText(v.Text)}
+	}
+	if err := writeMarkdownTable(&md, []string{"name", "label", "universe", "description"}, rows); err != nil {
+		return nil, err
+	}
+	return []byte(md.String()), nil
+}
@@ -0,0 +1,651 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Stata storage types of .dta files (format 118); strN columns are typed by their width, N
+const (
+	dtaDouble uint16 = 65526
+	dtaLong   uint16 = 65528
+	dtaInt    uint16 = 65529
+	dtaByte   uint16 = 65530
+)
+
+// limits of Stata .dta files
+const (
+	maxDtaVars      = 32767 // variables of a file, as in Stata/SE
+	maxDtaStrWidth  = 2045  // characters of strN columns
+	maxDtaLabel     = 80    // characters of variable and data labels
+	maxDtaValLabel  = 32000 // bytes of a value label
+	dtaNameBytes    = 129   // bytes of a variable or value label name field
+	dtaFormatBytes  = 57    // bytes of a display format field
+	dtaVarLabelSize = 321   // bytes of a variable label field
+)
+
+// dtaMissing are the bytes of Stata's system missing value (.) of each numeric storage type
+var dtaMissing = map[uint16][]byte{
+	dtaByte:   {101},
+	dtaInt:    binary.LittleEndian.AppendUint16(nil, 32741),
+	dtaLong:   binary.LittleEndian.AppendUint32(nil, 2147483621),
+	dtaDouble: binary.LittleEndian.AppendUint64(nil, 0x7fe0000000000000),
+}
+
+// dtaRanges are the nonmissing values of Stata's integer storage types
+var dtaRanges = map[uint16][2]int64{
+	dtaByte: {-127, 100},
+	dtaInt:  {-32767, 32740},
+	dtaLong: {-2147483647, 2147483620},
+}
+
+// dtaNameRe matches valid Stata variable names
+var dtaNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,31}$`)
+
+// dtaReserved are the names Stata reserves, which variables can't be named
+var dtaReserved = map[string]bool{
+	"_all": true, "_b": true, "byte": true, "_coef": true, "_cons": true, "double": true, "float": true,
+	"if": true, "in": true, "int": true, "long": true, "_n": true, "_N": true, "_pi": true, "_pred": true,
+	"_rc": true, "_skip": true, "strL": true, "using": true, "with": true,
+}
+
+// dtaEpoch is the origin of Stata dates (%td), which count the days since
+var dtaEpoch = time.Date(1960, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DtaSchema is the layout of the Stata .dta file (format 118, read by Stata 14 and later) of the main
+// table: the file's header and metadata, up to its data, and its value labels, which follow the data.
+// The header's row count and section offsets are patched once the data is written (see dtaFile).
+type DtaSchema struct {
+	header      []byte
+	valueLabels []byte
+	rowBytes    int // bytes of each row of the data
+	nAt, mapAt  int // offsets of the row count, and of the section offsets, in header
+}
+
+// dtaType returns the Stata storage type of a variable's column, given the column's type (see columnType):
+//
+//   - "string" columns are strN, N being the width of the variable (of the hash, if hashed); N is
+//     past Stata's widest strN if the variable is wider
+//   - "int" columns are bytes (up to 2 digits), ints (up to 4), or longs (up to 9), as their values fit;
+//     wider ones are doubles
+//   - "bigint" and "float" columns are doubles
+func (dbf *DatabaseFormatter) dtaType(colType string, v Var) uint16 {
+	width := v.Location.Width
+	switch colType {
+	case "string":
+		if dbf.Hash.hashes(v) {
+			width = hashChars
+		} else if width == 0 {
+			width = defaultStringWidth
+		}
+		return uint16(min(width, maxDtaStrWidth+1))
+	case "int":
+		switch {
+		case width == 0:
+			return dtaDouble
+		case width <= 2:
+			return dtaByte
+		case width <= 4:
+			return dtaInt
+		case width < maxPlacesFori32:
+			return dtaLong
+		}
+	}
+	return dtaDouble
+}
+
+// appendedDtaType returns the Stata storage type of an appended column (see appendedTypes): strings are
+// strN, N being the width of the value, dates are longs (days since 1960-01-01, Stata's %td), and the
+// rest are doubles
+func appendedDtaType(t string, v Var) uint16 {
+	switch t {
+	case "string":
+		return uint16(min(max(v.Location.Width, 1), maxDtaStrWidth+1))
+	case "date":
+		return dtaLong
+	default:
+		return dtaDouble
+	}
+}
+
+// dtaSize returns the bytes of a value of a Stata storage type
+func dtaSize(t uint16) int {
+	switch t {
+	case dtaByte:
+		return 1
+	case dtaInt:
+		return 2
+	case dtaLong:
+		return 4
+	case dtaDouble:
+		return 8
+	default:
+		return int(t)
+	}
+}
+
+// dtaFormat returns the display format of a column of a Stata storage type
+func dtaFormat(t uint16, v Var, appendedType string) string {
+	switch {
+	case t <= maxDtaStrWidth:
+		return fmt.Sprintf("%%%ds", t)
+	case appendedType == "date":
+		return "%td"
+	case t == dtaDouble && v.DecimalPoint > 0 && v.Location.Width == 0:
+		return fmt.Sprintf("%%10.%df", v.DecimalPoint)
+	case t == dtaDouble && v.DecimalPoint > 0:
+		return fmt.Sprintf("%%%d.%df", max(v.Location.Width, v.DecimalPoint)+1, v.DecimalPoint)
+	case t == dtaLong:
+		return "%12.0g"
+	case t == dtaDouble:
+		return "%10.0g"
+	default:
+		return "%8.0g"
+	}
+}
+
+// dtaColumn is a column of a Stata .dta file
+type dtaColumn struct {
+	name, label, format string
+	typ                 uint16
+	labels              []Cat // value labels, of integer values, if any
+}
+
+// DtaSchema generates the layout of the Stata .dta file of the main table (see DtaSchema): a variable for
+// each column, labeled with the variable's label (up to 80 characters), and the categories of integer
+// variables as value labels, named after their variables. The file is labeled with the extract's ID.
+//
+// returns error if a column is not a valid Stata name, a string column is wider than Stata's strN
+// columns, the file would hold too many variables, or on the same checks as CreateMainTable (see checkColumns)
+func (dbf *DatabaseFormatter) DtaSchema(ddi *DataDict) (DtaSchema, error) {
+	if err := dbf.checkColumns(ddi); err != nil {
+		return DtaSchema{}, err
+	}
+	dbf.recodeCats(ddi)
+	var cols []dtaColumn
+	if len(dbf.RowID) != 0 {
+		v := dbf.rowIDVar()
+		cols = append(cols, dtaColumn{name: dbf.columnName(v), label: v.Label, typ: dtaLong, format: dtaFormat(dtaLong, v, "")})
+	}
+	for _, v := range ddi.Vars {
+		col := dtaColumn{name: dbf.columnName(v), label: v.Label + dbf.scaleNote(v), typ: dbf.dtaType(dbf.columnType(v), v)}
+		if valRange, ok := dtaRanges[col.typ]; ok {
+			col.labels = dtaValueLabels(v, valRange)
+		}
+		// scaled decimals are integers, and displayed as such
+		fv := v
+		if dbf.scales(v) {
+			fv.DecimalPoint = 0
+		}
+		col.format = dtaFormat(col.typ, fv, "")
+		cols = append(cols, col)
+	}
+	types := dbf.appendedTypes()
+	for i, v := range dbf.appendedVars() {
+		t := appendedDtaType(types[i], v)
+		cols = append(cols, dtaColumn{name: dbf.columnName(v), label: v.Label, typ: t, format: dtaFormat(t, v, types[i])})
+	}
+	if len(cols) > maxDtaVars {
+		return DtaSchema{}, fmt.Errorf("%d columns exceed the %d variables of a Stata file", len(cols), maxDtaVars)
+	}
+	names := make(map[string]bool)
+	for _, col := range cols {
+		switch {
+		case !dtaNameRe.MatchString(col.name):
+			return DtaSchema{}, fmt.Errorf("column name '%s' is not a valid Stata name (up to 32 letters, digits, and underscores)", col.name)
+		case dtaReserved[col.name]:
+			return DtaSchema{}, fmt.Errorf("column name '%s' is reserved by Stata; rename it (see -rename)", col.name)
+		case names[col.name]:
+			return DtaSchema{}, fmt.Errorf("column name '%s' is repeated", col.name)
+		case col.typ == maxDtaStrWidth+1:
+			return DtaSchema{}, fmt.Errorf("column %s is wider than Stata's strings (%d characters)", col.name, maxDtaStrWidth)
+		}
+		names[col.name] = true
+	}
+	var label string
+	if len(ddi.ID) != 0 {
+		label = fmt.Sprintf("IPUMS extract %s", ddi.ID)
+	}
+	return dtaLayout(cols, label, time.Now()), nil
+}
+
+// dtaValueLabels returns the categories of a variable with integer values, within the nonmissing values of
+// the variable's storage type, in order of value; the first label of a value is kept
+func dtaValueLabels(v Var, valRange [2]int64) []Cat {
+	seen := make(map[int64]bool)
+	var cats []Cat
+	for _, c := range v.Cats {
+		val := strings.TrimSpace(c.Val)
+		n, err := strconv.ParseInt(val, 10, 32)
+		if err != nil || n < valRange[0] || n > valRange[1] || seen[n] {
+			continue
+		}
+		seen[n] = true
+		cats = append(cats, Cat{Val: strconv.FormatInt(n, 10), Label: c.Label})
+	}
+	slices.SortFunc(cats, func(a, b Cat) int {
+		x, _ := strconv.Atoi(a.Val)
+		y, _ := strconv.Atoi(b.Val)
+		return x - y
+	})
+	return cats
+}
+
+// dtaLayout lays out the sections of a .dta file of columns (see DtaSchema), in the order of the file's map
+func dtaLayout(cols []dtaColumn, label string, stamp time.Time) DtaSchema {
+	var s DtaSchema
+	var h bytes.Buffer
+	h.WriteString("<stata_dta><header><release>118</release><byteorder>LSF</byteorder><K>")
+	h.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(cols))))
+	h.WriteString("</K><N>")
+	s.nAt = h.Len()
+	h.Write(make([]byte, 8)) // patched once the rows are written
+	h.WriteString("</N><label>")
+	label = dtaTruncate(label, maxDtaLabel, math.MaxUint16)
+	h.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(label))))
+	h.WriteString(label)
+	h.WriteString("</label><timestamp>")
+	ts := stamp.Format("02 Jan 2006 15:04")
+	h.WriteByte(byte(len(ts)))
+	h.WriteString(ts)
+	h.WriteString("</timestamp></header>")
+
+	offsets := make([]uint64, 14)
+	offsets[1] = uint64(h.Len())
+	h.WriteString("<map>")
+	s.mapAt = h.Len()
+	h.Write(make([]byte, 8*len(offsets))) // patched once the rows are written
+	h.WriteString("</map>")
+
+	section := func(i int, tag string, field func(col dtaColumn) []byte) {
+		offsets[i] = uint64(h.Len())
+		h.WriteString("<" + tag + ">")
+		for _, col := range cols {
+			h.Write(field(col))
+		}
+		h.WriteString("</" + tag + ">")
+	}
+	section(2, "variable_types", func(col dtaColumn) []byte {
+		s.rowBytes += dtaSize(col.typ)
+		return binary.LittleEndian.AppendUint16(nil, col.typ)
+	})
+	section(3, "varnames", func(col dtaColumn) []byte { return dtaField(col.name, dtaNameBytes) })
+	offsets[4] = uint64(h.Len())
+	h.WriteString("<sortlist>")
+	h.Write(make([]byte, 2*(len(cols)+1))) // unsorted
+	h.WriteString("</sortlist>")
+	section(5, "formats", func(col dtaColumn) []byte { return dtaField(col.format, dtaFormatBytes) })
+	section(6, "value_label_names", func(col dtaColumn) []byte {
+		if len(col.labels) == 0 {
+			return make([]byte, dtaNameBytes)
+		}
+		return dtaField(col.name, dtaNameBytes)
+	})
+	section(7, "variable_labels", func(col dtaColumn) []byte {
+		return dtaField(dtaTruncate(col.label, maxDtaLabel, dtaVarLabelSize-1), dtaVarLabelSize)
+	})
+	offsets[8] = uint64(h.Len())
+	h.WriteString("<characteristics></characteristics>")
+	offsets[9] = uint64(h.Len())
+	h.WriteString("<data>")
+	for i := 1; i < 10; i++ { // the file itself starts at 0
+		binary.LittleEndian.PutUint64(h.Bytes()[s.mapAt+8*i:], offsets[i])
+	}
+	s.header = h.Bytes()
+
+	for _, col := range cols {
+		if len(col.labels) != 0 {
+			s.valueLabels = append(s.valueLabels, dtaLabelTable(col.name, col.labels)...)
+		}
+	}
+	return s
+}
+
+// dtaLabelTable returns a value label table, of categories with integer values (see dtaValueLabels)
+func dtaLabelTable(name string, cats []Cat) []byte {
+	var offs, vals, txt []byte
+	for _, c := range cats {
+		n, _ := strconv.ParseInt(c.Val, 10, 32)
+		offs = binary.LittleEndian.AppendUint32(offs, uint32(len(txt)))
+		vals = binary.LittleEndian.AppendUint32(vals, uint32(int32(n)))
+		txt = append(append(txt, dtaTruncate(c.Label, maxDtaValLabel, maxDtaValLabel-1)...), 0)
+	}
+	table := binary.LittleEndian.AppendUint32(nil, uint32(len(cats)))
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(txt)))
+	table = append(append(append(table, offs...), vals...), txt...)
+
+	lbl := append([]byte("<lbl>"), binary.LittleEndian.AppendUint32(nil, uint32(len(table)))...)
+	lbl = append(lbl, dtaField(name, dtaNameBytes)...)
+	lbl = append(lbl, 0, 0, 0) // padding
+	return append(append(lbl, table...), "</lbl>"...)
+}
+
+// dtaField returns a string as a fixed-size, null-padded field
+func dtaField(s string, size int) []byte {
+	field := make([]byte, size)
+	copy(field, s[:min(len(s), size-1)])
+	return field
+}
+
+// dtaTruncate truncates a string to at most chars characters, and maxBytes bytes, without splitting any
+func dtaTruncate(s string, chars, maxBytes int) string {
+	n := 0
+	for i, r := range s {
+		if n == chars || i+utf8.RuneLen(r) > maxBytes {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// dtaRecord generates a row of a Stata .dta file's data from a fixed-width row, in place of an insertion
+// tuple (see insertTuple): its columns' values, in their storage types (see DtaSchema). Numbers are
+// parsed as they'd be inserted; null values are Stata's system missing value (.), and empty strings.
+//
+// returns error if start and end positions are not valid for row, or if a field cannot be parsed, or
+// doesn't fit its storage type
+func (dbf *DatabaseFormatter) dtaRecord(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	record := make([]byte, 0, len(row)+4*len(ddi.Vars))
+	var err error
+	if len(dbf.RowID) != 0 {
+		if record, err = appendDtaValue(record, dtaLong, strconv.Itoa(rowNum)); err != nil {
+			return nil, fmt.Errorf("column %s: %w", dbf.RowID, err)
+		}
+	}
+	for i, v := range ddi.Vars {
+		start, end := v.Location.Start-1, v.Location.End
+		if (start < 0) || (end > len(row)) {
+			return nil, fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+		}
+		colType := colTypes[v.Name]
+		chars, isNull, err := applyNullPolicy(row[start:end], nullPolicies[i], colType == "string")
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		if !isNull {
+			if chars, isNull, err = dbf.transformChars(v, chars); err != nil {
+				return nil, err
+			}
+		}
+		t := dbf.dtaType(colType, v)
+		if isNull {
+			record = appendDtaMissing(record, t)
+			continue
+		}
+		val := string(chars)
+		if colType != "string" {
+			dcml := 0
+			if colType == "float" {
+				dcml = v.DecimalPoint
+			}
+			if val, err = fixedWidthNumber(chars, dcml); err != nil {
+				return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+			}
+		}
+		if record, err = appendDtaValue(record, t, val); err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+	}
+	if dbf.hasAppended() {
+		vals, err := dbf.appendedFromRow(ddi, row, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		return dbf.appendDtaAppended(record, vals)
+	}
+	return record, nil
+}
+
+// dtaRecords generates rows of a Stata .dta file's data (see dtaRecord) from comma-delimited records, in
+// place of insertion statements (see BulkInsertRecords); fields are in the order of the data dictionary.
+//
+// returns error if any record cannot be parsed.
+func (dbf *DatabaseFormatter) dtaRecords(ddi *DataDict, records [][]string, firstRow int, colIdx []int) ([]byte, error) {
+	colTypes := dbf.columnTypes(ddi)
+	var out []byte
+	for r, rec := range records {
+		var err error
+		if len(dbf.RowID) != 0 {
+			if out, err = appendDtaValue(out, dtaLong, strconv.Itoa(firstRow+r)); err != nil {
+				return nil, fmt.Errorf("record %v: column %s: %w", rec, dbf.RowID, err)
+			}
+		}
+		for i, v := range ddi.Vars {
+			var field string
+			if colIdx[i] >= 0 && colIdx[i] < len(rec) {
+				field = strings.TrimSpace(rec[colIdx[i]])
+			}
+			if len(field) != 0 {
+				if field, _, err = dbf.transformField(v, field, 0); err != nil {
+					return nil, fmt.Errorf("record %v: %w", rec, err)
+				}
+			}
+			t := dbf.dtaType(colTypes[v.Name], v)
+			if len(field) == 0 {
+				out = appendDtaMissing(out, t)
+				continue
+			}
+			if out, err = appendDtaValue(out, t, field); err != nil {
+				return nil, fmt.Errorf("record %v: variable %s: %w", rec, v.Name, err)
+			}
+		}
+		if dbf.hasAppended() {
+			vals, err := dbf.appendedFromRecord(rec, colIdx)
+			if err == nil {
+				out, err = dbf.appendDtaAppended(out, vals)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", rec, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// appendDtaAppended appends the values of the appended columns (see appendedFromRow) to a row of a .dta
+// file's data
+//
+// returns error if a value doesn't fit its type
+func (dbf *DatabaseFormatter) appendDtaAppended(record []byte, vals []string) ([]byte, error) {
+	vars := dbf.appendedVars()
+	for i, t := range dbf.appendedTypes() {
+		dt := appendedDtaType(t, vars[i])
+		val := vals[i]
+		if len(val) == 0 {
+			record = appendDtaMissing(record, dt)
+			continue
+		}
+		if t == "date" {
+			d, err := time.Parse(dateLayout, val)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: '%s' is not a date", vars[i].Name, val)
+			}
+			val = strconv.FormatInt((d.Unix()-dtaEpoch.Unix())/(24*60*60), 10)
+		}
+		var err error
+		if record, err = appendDtaValue(record, dt, val); err != nil {
+			return nil, fmt.Errorf("column %s: %w", vars[i].Name, err)
+		}
+	}
+	return record, nil
+}
+
+// appendDtaMissing appends a null value of a Stata storage type to a row: the system missing value (.),
+// or an empty string
+func appendDtaMissing(record []byte, t uint16) []byte {
+	if missing, ok := dtaMissing[t]; ok {
+		return append(record, missing...)
+	}
+	return append(record, make([]byte, t)...)
+}
+
+// appendDtaValue appends a value (a number, as formatted by fixedWidthNumber, or a string) to a row of a
+// .dta file's data, in a Stata storage type (see dtaType); strings are null-padded to their column's width
+//
+// returns error if the value doesn't fit the type
+func appendDtaValue(record []byte, t uint16, val string) ([]byte, error) {
+	switch t {
+	case dtaByte, dtaInt, dtaLong:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if r := dtaRanges[t]; err != nil || n < r[0] || n > r[1] {
+			return nil, fmt.Errorf("'%s' is not a Stata %s", val, map[uint16]string{dtaByte: "byte", dtaInt: "int", dtaLong: "long"}[t])
+		}
+		switch t {
+		case dtaByte:
+			return append(record, byte(int8(n))), nil
+		case dtaInt:
+			return binary.LittleEndian.AppendUint16(record, uint16(int16(n))), nil
+		default:
+			return binary.LittleEndian.AppendUint32(record, uint32(int32(n))), nil
+		}
+	case dtaDouble:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", val)
+		}
+		return binary.LittleEndian.AppendUint64(record, math.Float64bits(f)), nil
+	default:
+		if len(val) > int(t) {
+			return nil, fmt.Errorf("'%s' is longer than its Stata column (str%d)", val, t)
+		}
+		record = append(record, val...)
+		return append(record, make([]byte, int(t)-len(val))...), nil
+	}
+}
+
+// dtaParts are the files of Stata dumps: a single .dta file
+func dtaParts(schema DtaSchema) dumpParts {
+	return dumpParts{ext: ".dta", wrap: func(f *os.File) (DumpFile, error) {
+		return newDtaFile(f, schema)
+	}}
+}
+
+// NewDtaDumpWriter returns a DumpWriter of a single Stata .dta file (see NewDumpWriter); as the file's
+// header is patched once its rows are written (see dtaFile), there's no directory format.
+//
+// returns error if writerName is an object storage URL, or a special file (see newDtaFile)
+func NewDtaDumpWriter(totBytes int, writerName string, schema DtaSchema) (DumpWriter, error) {
+	if IsObjectURL(writerName) {
+		return DumpWriter{}, fmt.Errorf("Stata dumps can't be written to object storage; write to a local file")
+	}
+	return newDumpWriter(totBytes, writerName, false, OutputSplit{}, dtaParts(schema))
+}
+
+// dtaFile is a DumpFile written as a Stata .dta file: the header and metadata (see DtaSchema) are written
+// up front, each write, which must be whole rows (see dtaRecord), is appended to the data, and closing
+// writes the value labels, then patches the row count, and the section offsets, into the header
+type dtaFile struct {
+	f         *os.File
+	schema    DtaSchema
+	dataBytes int64
+}
+
+// newDtaFile writes the header of a Stata .dta file to f, returning it as a dtaFile
+//
+// returns error if f is a special file (e.g., a pipe), whose header can't be patched, or if the header
+// cannot be written
+func newDtaFile(f *os.File, schema DtaSchema) (DumpFile, error) {
+	if isSpecialFile(f.Name()) {
+		return nil, fmt.Errorf("Stata dumps can't be written to %s; write to a regular file", f.Name())
+	}
+	if _, err := f.Write(schema.header); err != nil {
+		return nil, err
+	}
+	return &dtaFile{f: f, schema: schema}, nil
+}
+
+// Write appends rows to the data
+func (df *dtaFile) Write(p []byte) (int, error) {
+	n, err := df.f.Write(p)
+	df.dataBytes += int64(n)
+	return n, err
+}
+
+// Close writes the end of the file, patches its header, and closes it
+//
+// returns error if the data isn't whole rows, or if the file can't be written
+func (df *dtaFile) Close() error {
+	err := df.finish()
+	if closeErr := df.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// finish writes the sections following the data, and patches the row count and section offsets
+func (df *dtaFile) finish() error {
+	s := df.schema
+	if s.rowBytes == 0 || df.dataBytes%int64(s.rowBytes) != 0 {
+		return fmt.Errorf("Stata data of %d bytes isn't made of rows of %d bytes", df.dataBytes, s.rowBytes)
+	}
+	offsets := make([]uint64, 4) // strls, value_labels, </stata_dta>, and the end of the file
+	offsets[0] = uint64(int64(len(s.header)) + df.dataBytes + int64(len("</data>")))
+	offsets[1] = offsets[0] + uint64(len("<strls></strls>"))
+	offsets[2] = offsets[1] + uint64(len("<value_labels>")+len(s.valueLabels)+len("</value_labels>"))
+	offsets[3] = offsets[2] + uint64(len("</stata_dta>"))
+
+	tail := []byte("</data><strls></strls><value_labels>")
+	tail = append(append(tail, s.valueLabels...), "</value_labels></stata_dta>"...)
+	if _, err := df.f.Write(tail); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.AppendUint64(nil, uint64(df.dataBytes/int64(s.rowBytes)))
+	if _, err := df.f.WriteAt(n, int64(s.nAt)); err != nil {
+		return err
+	}
+	var patch []byte
+	for _, off := range offsets {
+		patch = binary.LittleEndian.AppendUint64(patch, off)
+	}
+	_, err := df.f.WriteAt(patch, int64(s.mapAt+8*10))
+	return err
+}
+
+// Name returns the file name
+func (df *dtaFile) Name() string {
+	return df.f.Name()
+}
+
+// DtaFileName returns the name of the Stata file written for schema file-only generation
+// (e.g., "acs.sql" -> "acs.dta")
+func DtaFileName(outFileName string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(outFileName, ".sql"), ".dta") + ".dta"
+}
+
+// MkDtaSchema writes a Stata .dta file without rows, holding the variables, and their labels and value
+// labels, only; used for when only -x flag is passed, and not dat file arg (see MkDDL)
+func MkDtaSchema(dbfmtr *DatabaseFormatter, ddi *DataDict, outFileName string, silence bool) error {
+	schema, err := dbfmtr.DtaSchema(ddi)
+	if err != nil {
+		return err
+	}
+	outFileName = DtaFileName(outFileName)
+	dw, err := NewDtaDumpWriter(0, outFileName, schema)
+	if err != nil {
+		return err
+	}
+	err = dw.SchemaFile.Close()
+	if err == nil {
+		err = dw.Commit()
+	}
+	if err != nil {
+		dw.FileCleanup()
+		return err
+	}
+	if !silence {
+		fmt.Printf("Stata file (no rows) written to %s\n", outFileName)
+	}
+	return nil
+}
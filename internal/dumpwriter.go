@@ -4,10 +4,12 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // maxBytesPerFile determines the maximum bytes (pre-processed fixed-width, not SQL statements)
@@ -21,43 +23,115 @@ const maxBytesPerFile = (1 << 30) * 10
 // in that directory. If makeItDir is fale, only one outFile will be created, and the outFile will necessarily
 // be the same file as the schema file. Performs directory and file cleanup in case of errors in the process of
 // creating outFiles.
-func NewDumpWriter(totBytes int, writerName string, makeItDir bool) (DumpWriter, error) {
+//
+// All files are written under temporary names (see createTemp and createTempDir): the dump file
+// (or directory) only takes its real name once Commit is called, after all writes succeed.
+//
+// If split limits are set (directory format only), further outFiles are created as needed, whenever
+// an outFile would grow past a limit. If the dump is sharded (split.ShardBy), no outFiles are created up
+// front; each shard's is created as it's first written (see outShards).
+//
+// If writerName is an object storage URL (e.g., "s3://bucket/prefix/"), the files are streamed to
+// object storage instead; see newObjectDumpWriter.
+func NewDumpWriter(totBytes int, writerName string, makeItDir bool, split OutputSplit) (DumpWriter, error) {
+	if IsObjectURL(writerName) {
+		return newObjectDumpWriter(totBytes, writerName, makeItDir, split)
+	}
+	return newDumpWriter(totBytes, writerName, makeItDir, split, sqlParts)
+}
+
+// dumpParts describes the files of a dump: the insertion files of directory format dumps, the
+// schema file alongside them, and the extension of single file dumps
+type dumpParts struct {
+	nameFmt    string                             // name of the i-th insertion file (e.g., "inserts_%d.sql")
+	schemaName string                             // name of the schema file in directory format (e.g., "ddl.sql")
+	ext        string                             // extension of single file dumps (e.g., ".sql")
+	wrap       func(f *os.File) (DumpFile, error) // wraps each insertion file as it's created (e.g., for compression), if non-nil
+}
+
+// sqlParts are the files of SQL dumps: ddl.sql, and insertion files of the form inserts_{i}.sql
+var sqlParts = dumpParts{nameFmt: "inserts_%d.sql", schemaName: "ddl.sql", ext: ".sql"}
+
+// create creates the insertion file fName; the file mustn't exist, so that a file isn't overwritten by
+// another of the dump named alike (e.g., shards differing in case, on case-insensitive filesystems)
+func (dp dumpParts) create(fName string) (DumpFile, error) {
+	f, err := os.OpenFile(fName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return dp.wrapFile(f)
+}
+
+// wrapFile wraps a created insertion file, if needed; the file is closed and removed (unless it's
+// a special file, e.g., /dev/stdout) if that fails
+func (dp dumpParts) wrapFile(f *os.File) (DumpFile, error) {
+	if dp.wrap == nil {
+		return f, nil
+	}
+	wrapped, err := dp.wrap(f)
+	if err != nil {
+		f.Close()
+		if !isSpecialFile(f.Name()) {
+			_ = os.Remove(f.Name())
+		}
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// newDumpWriter generates a new local DumpWriter (see NewDumpWriter), with insertion files described by parts
+func newDumpWriter(totBytes int, writerName string, makeItDir bool, split OutputSplit, parts dumpParts) (DumpWriter, error) {
 	// if either the default option is used, or makeItDir == false AND -o is provided:
-	// need to trim the ".sql" for the rest of the function logic to work
-	// note: this doesn't protect agains non-".sql" extensions.
-	writerName = strings.TrimSuffix(writerName, ".sql")
+	// need to trim the ".sql" (or the dump's own extension) for the rest of the function logic to work
+	// note: this doesn't protect agains other extensions.
+	writerName = strings.TrimSuffix(strings.TrimSuffix(writerName, parts.ext), ".sql")
 	// calc num outfiles
 	nOutFiles := 1
 	if makeItDir {
 		nOutFiles = numOutFiles(totBytes)
 	}
-	// make new dir
+	// sharded dumps have an outFile per shard, created as needed
+	sharded := makeItDir && len(split.ShardBy) != 0
+	nWriters := nOutFiles
+	if sharded {
+		nOutFiles = 0
+	}
+	// make new (temporary) dir
+	// the directory can't already exist, as an existing dump would otherwise be mixed into the new one
+	var tmpDir string
 	if makeItDir {
-		// make new dir
-		var perms os.FileMode = 0755
-		err := os.Mkdir(writerName, perms)
+		if _, err := os.Stat(writerName); err == nil {
+			return DumpWriter{}, &os.PathError{Op: "mkdir", Path: writerName, Err: os.ErrExist}
+		}
+		var err error
+		tmpDir, err = createTempDir(writerName)
 		if err != nil {
 			return DumpWriter{}, err
 		}
 	}
 	// make schema file
-	schemaFName := fmt.Sprintf("%s.sql", writerName)
+	// if not dir format, it's also the outFile, so it's wrapped like one
+	var schemaF DumpFile
+	var err error
 	if makeItDir {
-		schemaFName = filepath.Join(writerName, "ddl.sql")
-
+		schemaF, err = os.Create(filepath.Join(tmpDir, parts.schemaName))
+	} else {
+		var f *os.File
+		if f, err = createTemp(writerName + parts.ext); err == nil {
+			schemaF, err = parts.wrapFile(f)
+		}
 	}
-	schemaF, err := os.Create(schemaFName)
 	if err != nil {
 		// clean up directory made
 		if makeItDir {
-			_ = os.Remove(writerName)
+			_ = os.Remove(tmpDir)
 		}
 		return DumpWriter{}, err
 	}
 	// make outFiles
 	// note that if there's only one outfile, then the schemaFile and
 	// the outFile will point to the same underlying file.
-	outFiles := make([]*os.File, nOutFiles)
+	outFiles := make([]DumpFile, nOutFiles)
 	for i := 0; i < nOutFiles; i++ {
 		// if not dir format, then there's only one outFile
 		// and it'll be the same as the schema file
@@ -68,9 +142,9 @@ func NewDumpWriter(totBytes int, writerName string, makeItDir bool) (DumpWriter,
 			break
 		}
 
-		iName := fmt.Sprintf("inserts_%d.sql", i)
-		fName := filepath.Join(writerName, iName)
-		f, err := os.Create(fName)
+		iName := fmt.Sprintf(parts.nameFmt, i)
+		fName := filepath.Join(tmpDir, iName)
+		f, err := parts.create(fName)
 		if err != nil {
 			// delete all files in case of errors
 			for j := 0; j < i; j++ {
@@ -81,39 +155,155 @@ func NewDumpWriter(totBytes int, writerName string, makeItDir bool) (DumpWriter,
 				}
 			}
 			// remove directory created
-			_ = os.Remove(writerName)
+			_ = os.Remove(schemaF.Name())
+			_ = os.Remove(tmpDir)
 			return DumpWriter{}, err
 		}
 		outFiles[i] = f
 	}
 	// make it now
-	dw := DumpWriter{SchemaFile: schemaF, OutFiles: outFiles}
+	dw := DumpWriter{SchemaFile: schemaF, OutFiles: outFiles, makeItDir: makeItDir}
+	dw.staging, dw.final = schemaF.Name(), writerName+parts.ext
+	if makeItDir {
+		dw.staging, dw.final = tmpDir, writerName
+	} else if dw.staging != dw.final {
+		dw.emitted = &[]stagedFile{}
+	}
+	newFile := func(name string) (DumpFile, error) {
+		return parts.create(filepath.Join(tmpDir, name))
+	}
+	if makeItDir && split.IsSet() {
+		dw.split = split
+		dw.parts = &outParts{newFile: newFile, nameFmt: parts.nameFmt, next: nOutFiles}
+	}
+	if sharded {
+		dw.shards = newOutShards(split.ShardBy, nWriters, newFile)
+	}
 	return dw, nil
 }
 
 // NewDumpWriterDDLOnly returns a new DumpWriter, meant only for DDL creation.
 // As the logic is much simpler here, it warrants a seperate function.
+// The file is written under a temporary name (or, for object storage URLs, uploaded),
+// until Commit is called.
 func NewDumpWriterDDLOnly(fileName string) (DumpWriter, error) {
-	f, err := os.Create(fileName)
+	if IsObjectURL(fileName) {
+		od, err := newObjectDump(fileName)
+		if err != nil {
+			return DumpWriter{}, err
+		}
+		u, err := od.create(od.prefix)
+		if err != nil {
+			return DumpWriter{}, err
+		}
+		return DumpWriter{SchemaFile: u, OutFiles: []DumpFile{}, remote: od}, nil
+	}
+	f, err := createTemp(fileName)
 	if err != nil {
 		return DumpWriter{}, err
 	}
-	dw := DumpWriter{SchemaFile: f, OutFiles: []*os.File{}}
+	dw := DumpWriter{SchemaFile: f, OutFiles: []DumpFile{}, staging: f.Name(), final: fileName}
 	return dw, nil
 }
 
+// StagingName returns the temporary name that the dump file (or directory) is written under
+// until Commit is called
+func (dw DumpWriter) StagingName() string {
+	return dw.staging
+}
+
+// Commit gives the dump file (or directory) its real name, once all writes have succeeded
+// and all files are closed, flushing its files to disk before the rename, and the rename after it;
+// artifacts written alongside a single file dump (see WriteEmitted) are renamed first. For object
+// storage, the uploads are completed, making the objects visible. returns error if flushing, a
+// rename (or an upload) fails
+func (dw DumpWriter) Commit() error {
+	if dw.remote != nil {
+		return dw.remote.commit()
+	}
+	if dw.staging == dw.final {
+		return nil // special file (e.g., /dev/stdout), written to directly
+	}
+	if err := syncTree(dw.staging); err != nil {
+		return err
+	}
+	if dw.emitted != nil {
+		for _, sf := range *dw.emitted {
+			if err := renameSynced(sf.staging, sf.final); err != nil {
+				return err
+			}
+		}
+	}
+	return renameSynced(dw.staging, dw.final)
+}
+
+// NumWriters returns the number of outFile writers spawned by WriteParsedResults
+func (dw DumpWriter) NumWriters() int {
+	if dw.shards != nil {
+		if dw.Ordered {
+			return 1
+		}
+		return dw.shards.writers
+	}
+	return len(dw.OutFiles)
+}
+
+// PlanWriters returns the insertion files created up front, and the writers spawned by WriteParsedResults,
+// of a dump of a data file of totBytes bytes (see NewDumpWriter, and NumWriters), without creating it;
+// sharded dumps create no files up front, and split dumps create more files as their limits are reached
+func PlanWriters(totBytes int, makeItDir bool, split OutputSplit, ordered bool) (files, writers int) {
+	if !makeItDir {
+		return 1, 1
+	}
+	n := numOutFiles(totBytes)
+	if len(split.ShardBy) != 0 {
+		if ordered {
+			return 0, 1
+		}
+		return 0, n
+	}
+	return n, n
+}
+
 // WriteParsedResults spawns N := len(DumpWriter.OutFiles) outFile writers to write SQL insertion
 // statements to outFiles. It reads from a channel of ParsedResults, and writes successful results
-// to an outFile.
+// to an outFile. Sharded dumps spawn NumWriters writers, sharing the outFiles of the shards instead;
+// when rows are assigned to outFiles (see AssignRows), each result is written by the writer of its outFile.
+// If the outFiles are compressed by a pool of workers (see NewStagedDumpWriter), results pass through
+// the pool first, in order. If Stats is set, the rows parsed, and the work of each stage, are recorded;
+// if JobLog is set, each job is logged as it's received.
 //
 // In case of any write errors, all created files and directories should be deleted, and the program
 // should exit.
 func (dw DumpWriter) WriteParsedResults(wg *sync.WaitGroup, parsedStream <-chan ParsedResult, exitFunc func(err error, topic string)) {
+	if dw.JobLog != nil {
+		parsedStream = logJobs(dw.JobLog, parsedStream)
+	}
+	if dw.Stats != nil {
+		parsedStream = dw.Stats.tap(parsedStream)
+		dw.Stats.setStage(stageWrite, dw.NumWriters())
+	}
+	if dw.compressWorkers > 0 {
+		parsedStream = compressBlocks(dw.compressWorkers, parsedStream, dw.Stats)
+	}
+	if dw.shards != nil {
+		dw.writeShardedResults(wg, parsedStream, exitFunc)
+		return
+	}
+	if dw.partRows > 0 {
+		dw.writeAssignedResults(wg, parsedStream, exitFunc)
+		return
+	}
 	wg.Add(len(dw.OutFiles))
 	for _, f := range dw.OutFiles {
-		go func(f *os.File) {
+		go func(f DumpFile) {
 			defer wg.Done()
-			err := writeToDump(f, parsedStream)
+			var err error
+			if dw.parts != nil {
+				err = dw.writeToParts(f, parsedStream)
+			} else {
+				err = dw.writeToDump(f, parsedStream)
+			}
 			// if you can't commit a write, you need to stop all actions
 			// close all files, and delete them, and also exit in some way
 			if err != nil {
@@ -124,13 +314,43 @@ func (dw DumpWriter) WriteParsedResults(wg *sync.WaitGroup, parsedStream <-chan
 	}
 }
 
+// writeShardedResults spawns the writers of a sharded dump (see WriteParsedResults), closing the
+// outFiles of the shards once they're all done
+func (dw DumpWriter) writeShardedResults(wg *sync.WaitGroup, parsedStream <-chan ParsedResult, exitFunc func(err error, topic string)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var writerWG sync.WaitGroup
+		writerWG.Add(dw.NumWriters())
+		for range dw.NumWriters() {
+			go func() {
+				defer writerWG.Done()
+				if err := dw.writeToShards(parsedStream); err != nil {
+					dw.FileCleanup()
+					exitFunc(err, "DumpWriter")
+				}
+			}()
+		}
+		writerWG.Wait()
+		// closing flushes any buffered output, so it may fail as well
+		if err := dw.shards.close(); err != nil {
+			dw.FileCleanup()
+			exitFunc(fmt.Errorf("encountered error closing: %w", err), "DumpWriter")
+		}
+	}()
+}
+
 // WriteDDL writes main table creation, index creation, and ref_table creation and inserts to
-// the DumpWriter.SchemaFile. If at any step, a write cannot be completed, a non-nil error is returned.
-func (dw DumpWriter) WriteDDL(dbfmtr *DatabaseFormatter, ddi *DataDict, indices []string) error {
+// the DumpWriter.SchemaFile, after the formatter's UseStatement and Prologue, if any; when appending to
+// existing tables (see DatabaseFormatter.AppendTo), nothing is created. The formatter's Epilogue, if any, ends
+// the dump: it's written at the end of the DDL if the DDL is all there is (or loads the staged files), as
+// post.sql in directory format, and after the insertions in a single file. Binary COPY dumps also get the script
+// loading them (see copyLoader). If at any step, a write cannot be completed, a non-nil error is returned.
+func (dw *DumpWriter) WriteDDL(dbfmtr *DatabaseFormatter, ddi *DataDict, indices []string) error {
 	// IF DIR FORMAT: once we write the DDL, we can close this file
 	// IF SINGLE FILE FORMAT: we cannot close the file yet. We still have inserts to make
 	// IF LEN(outFiles) == 0: we can close, as we are only generating DDL
-	if len(dw.OutFiles) > 1 || len(dw.OutFiles) == 0 {
+	if len(dw.OutFiles) == 0 || dw.OutFiles[0] != dw.SchemaFile {
 		defer dw.SchemaFile.Close()
 	}
 	// main table creation
@@ -138,30 +358,156 @@ func (dw DumpWriter) WriteDDL(dbfmtr *DatabaseFormatter, ddi *DataDict, indices
 	if err != nil {
 		return fmt.Errorf("ipums2db: table creation: %w", err)
 	}
-	// ref tables
-	refTablesSQL := dbfmtr.CreateRefTables(ddi)
+	// provenance table, if requested
+	metaSQL := dbfmtr.CreateMetaTable(ddi)
+	// ref tables, and their schema, if any
+	refTablesSQL := append(dbfmtr.CreateRefSchema(), dbfmtr.CreateRefTables(ddi)...)
+	// documentation tables, if requested
+	if dbfmtr.DocTables {
+		refTablesSQL = append(refTablesSQL, dbfmtr.CreateDocTables(ddi)...)
+	}
 	// indices
 	indicesSQL, err := dbfmtr.CreateIndices(ddi, indices)
 	if err != nil {
 		return fmt.Errorf("ipums2db: index creation: %w", err)
 	}
+	// household-person linkage, if requested
+	linkageSQL, err := dbfmtr.CreateLinkage(ddi)
+	if err != nil {
+		return fmt.Errorf("ipums2db: linkage: %w", err)
+	}
+	indicesSQL = append(indicesSQL, linkageSQL...)
+	// when appending, the tables already exist, so none are created (the provenance table is created if
+	// it doesn't exist); the DDL is left with the truncation and loads, if any
+	appending := len(dbfmtr.AppendTo) != 0
+	if appending {
+		tableSQL, refTablesSQL, indicesSQL = nil, nil, nil
+	}
+	// tables emptied ahead of the inserts (or loads), if requested
+	indicesSQL = append(indicesSQL, dbfmtr.CreateTruncation(ddi)...)
+	// staged CSV files, loaded once everything's created
+	if dw.staged {
+		loadSQL, err := dbfmtr.stagedLoad(dw.final)
+		if err != nil {
+			return fmt.Errorf("ipums2db: load statements: %w", err)
+		}
+		indicesSQL = append(indicesSQL, loadSQL...)
+	}
+	// binary COPY files, loaded by a script of their own
+	if dw.copied {
+		if err := dw.writeCopyLoader(dbfmtr); err != nil {
+			return fmt.Errorf("ipums2db: loader script write: %w", err)
+		}
+	}
+	// ownership and privileges, once everything's created
+	if !appending {
+		indicesSQL = append(indicesSQL, dbfmtr.CreateOwnership(ddi)...)
+		indicesSQL = append(indicesSQL, dbfmtr.CreateGrants(ddi)...)
+	}
 
-	lenDDL := len(tableSQL) + len(refTablesSQL) + len(indicesSQL)
+	// the epilogue ends the dump: the DDL, if nothing follows it; otherwise, the insertions
+	var epilogueSQL []byte
+	switch {
+	case len(dbfmtr.Epilogue) == 0:
+	case len(dw.OutFiles) == 0 || dw.staged:
+		epilogueSQL = dbfmtr.Epilogue
+	case dw.makeItDir:
+		if err := dw.writeDirFile("post.sql", append(dbfmtr.UseStatement(), dbfmtr.Epilogue...)); err != nil {
+			return fmt.Errorf("ipums2db: epilogue write: %w", err)
+		}
+	default:
+		dw.epilogue = dbfmtr.Epilogue
+	}
+
+	useSQL := dbfmtr.UseStatement()
+	// the generated DDL is restyled, if a style is set; the prologue and epilogue are the user's own
+	ddlSQL := make([]byte, 0, len(tableSQL)+len(metaSQL)+len(refTablesSQL)+len(indicesSQL))
+	ddlSQL = append(ddlSQL, tableSQL...)
+	ddlSQL = append(ddlSQL, metaSQL...)
+	ddlSQL = append(ddlSQL, refTablesSQL...)
+	ddlSQL = append(ddlSQL, indicesSQL...)
+	ddlSQL = dbfmtr.styled(ddlSQL)
+	lenDDL := len(useSQL) + len(dbfmtr.Prologue) + len(ddlSQL) + len(epilogueSQL)
 	buffer := make([]byte, 0, lenDDL)
 	// append DDL
-	buffer = append(buffer, tableSQL...)
-	buffer = append(buffer, refTablesSQL...)
-	buffer = append(buffer, indicesSQL...)
+	buffer = append(buffer, useSQL...)
+	buffer = append(buffer, dbfmtr.Prologue...)
+	buffer = append(buffer, ddlSQL...)
+	buffer = append(buffer, epilogueSQL...)
 
 	_, err = dw.SchemaFile.Write(buffer)
 	if err != nil {
-		return fmt.Errorf("ipums2db: DDL write: %v", err)
+		return fmt.Errorf("ipums2db: DDL write: %w", err)
+	}
+	return nil
+}
+
+// SetFileHeader starts every insertion file of a directory format dump with header (e.g., the formatter's
+// UseStatement), including the files created as split limits are reached, or as shards are first written;
+// the schema file is left to WriteDDL, and staged CSV and binary COPY files have no header. returns error if the
+// header can't be written
+func (dw DumpWriter) SetFileHeader(header []byte) error {
+	if !dw.makeItDir || dw.staged || dw.copied || len(header) == 0 {
+		return nil
+	}
+	for _, f := range dw.OutFiles {
+		if _, err := f.Write(header); err != nil {
+			return err
+		}
+	}
+	withHeader := func(newFile func(name string) (DumpFile, error)) func(name string) (DumpFile, error) {
+		return func(name string) (DumpFile, error) {
+			f, err := newFile(name)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := f.Write(header); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			return f, nil
+		}
+	}
+	if dw.parts != nil {
+		dw.parts.newFile = withHeader(dw.parts.newFile)
+	}
+	if dw.shards != nil {
+		dw.shards.newFile = withHeader(dw.shards.newFile)
 	}
 	return nil
 }
 
-// FileCleanup deletes all files created, schema and/our output files
+// writeDirFile writes a file of content to the directory of a directory format dump (e.g., post.sql)
+func (dw DumpWriter) writeDirFile(name string, content []byte) error {
+	var f DumpFile
+	var err error
+	if dw.remote != nil {
+		f, err = dw.remote.createInDir(name)
+	} else {
+		f, err = os.Create(filepath.Join(dw.staging, name))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// FileCleanup deletes all files created, schema and/our output files; for object storage,
+// uploads not yet completed are aborted
 func (dw DumpWriter) FileCleanup() {
+	if dw.remote != nil {
+		dw.remote.abort()
+		return
+	}
+	// special files (e.g., /dev/stdout) are written to directly, and are not ours to delete
+	if dw.staging == dw.final {
+		_ = dw.SchemaFile.Close()
+		return
+	}
 	// if single-file dump writer, close schema file first
 	if len(dw.OutFiles) == 1 {
 		dw.SchemaFile.Close()
@@ -174,36 +520,100 @@ func (dw DumpWriter) FileCleanup() {
 		_ = f.Close()
 		_ = os.Remove(f.Name())
 	}
+	// delete any outFiles created for split limits
+	if dw.parts != nil {
+		dw.parts.cleanup()
+	}
+	if dw.shards != nil {
+		dw.shards.cleanup()
+	}
+	// delete the directory, along with anything else written to it (e.g., artifacts)
+	if dw.makeItDir {
+		_ = os.RemoveAll(dw.staging)
+	}
+	// delete artifacts written alongside a single file dump
+	if dw.emitted != nil {
+		for _, sf := range *dw.emitted {
+			_ = os.Remove(sf.staging)
+		}
+	}
 }
 
 // DumpWriter writes the database SQL representation of a fixed-width file. The SchemaFile
 // will represent the file where table creation, index creation, and ref_table creation and insertions
 // will take place. OutFiles hold where insertion statements will take place.
 type DumpWriter struct {
-	SchemaFile *os.File
-	OutFiles   []*os.File
+	SchemaFile DumpFile
+	OutFiles   []DumpFile
+	Ordered    bool          // if true, results are received in file order (see Sequencer), and sharded dumps keep it with a single writer
+	Stats      *RunStats     // metrics of the run, if collected
+	JobLog     io.Writer     // if set, each parsed job is logged to it (see logJobs)
+	split      OutputSplit   // insertion file limits, if any
+	parts      *outParts     // outFiles created for split limits, if any
+	shards     *outShards    // outFiles of the shards, if sharded
+	partRows   int           // rows per outFile, if rows are assigned to outFiles (see AssignRows)
+	totRows    int           // rows of the dump, if rows are assigned to outFiles
+	makeItDir  bool          // whether the dump is in directory format
+	staging    string        // temporary file (or directory) name, until Commit
+	final      string        // real file (or directory) name
+	remote     *objectDump   // object storage uploads, if writing to object storage
+	staged     bool          // whether the dump stages CSV files, loaded by the DDL (see NewStagedDumpWriter)
+	copied     bool          // whether the dump holds binary COPY files, loaded by its loader script (see NewCopyDumpWriter)
+	epilogue   []byte        // SQL written after the insertions of a single file dump, if any (see WriteDDL)
+	emitted    *[]stagedFile // artifacts written alongside a single file dump, under temporary names until Commit
+
+	compressWorkers int // workers compressing blocks ahead of the writers, if any (see compressBlocks)
+}
+
+// DumpFile is a file of the dump: either a local file, or an object being uploaded to object storage
+type DumpFile interface {
+	io.Writer
+	Close() error
+	Name() string
 }
 
 // writeToDump reads ParsedResults from a channel, and writes the results to an output
 // file. In the case of errors in the ParsedResult, the function returns with a non-nil
 // error. If a parsed block of insertion statements cannot be written, the file will be closed
 // and deleted, and a non-nil error is returned.
-func writeToDump(outFile *os.File, parsedStream <-chan ParsedResult) error {
+func (dw DumpWriter) writeToDump(outFile DumpFile, parsedStream <-chan ParsedResult) error {
 	for res := range parsedStream {
 		if res.AnyError != nil {
-			return fmt.Errorf("encountered error parsing: %w", res.AnyError)
+			return &ParseError{Err: fmt.Errorf("encountered error parsing: %w", res.AnyError)}
 		}
-		_, err := outFile.Write(res.Block)
+		err := dw.writeBlock(outFile, res.Block)
 		if err != nil {
 			outFile.Close()
 			_ = os.Remove(outFile.Name())
-			return fmt.Errorf("encountered error writing: %v; deleting in-progress dump file", err)
+			return fmt.Errorf("encountered error writing: %w; deleting in-progress dump file", err)
+		}
+	}
+	// a single file dump ends with the epilogue, if any
+	if len(dw.epilogue) != 0 {
+		if _, err := outFile.Write(dw.epilogue); err != nil {
+			outFile.Close()
+			_ = os.Remove(outFile.Name())
+			return fmt.Errorf("encountered error writing epilogue: %w; deleting in-progress dump file", err)
 		}
 	}
-	outFile.Close()
+	// closing flushes any buffered (e.g., compressed) output, so it may fail as well
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("encountered error closing: %w", err)
+	}
 	return nil
 }
 
+// writeBlock writes a block to an output file, recording the time spent, and the bytes written, if Stats is set
+func (dw DumpWriter) writeBlock(outFile DumpFile, block []byte) error {
+	start := time.Now()
+	_, err := outFile.Write(block)
+	dw.Stats.addBusy(stageWrite, time.Since(start))
+	if err == nil {
+		dw.Stats.addWritten(len(block))
+	}
+	return err
+}
+
 // numOutFiles determines, based on the size of a fixed-width file, the
 // number of output files to create.
 func numOutFiles(totBytes int) int {
@@ -0,0 +1,592 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An Emitter generates an auxiliary artifact (e.g., an import script for another tool)
+// from the same data dictionary used to generate the dump.
+type Emitter struct {
+	Ext      string // file extension of the artifact, including the "."
+	Emit     func(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error)
+	ReadsDat bool   // if true, the artifact reads the data file itself, rather than the dump
+	DbType   string // if set, the only database type the artifact is for (e.g., "oracle", for SQL*Loader)
+
+	// if set, checks that the artifact can describe the data file's layout (see CheckEmitLayout)
+	Layout func(ddi *DataDict) error
+
+	// if set, a script loading the data file with the artifact (e.g., a format file), given the artifact's
+	// name, written next to it with extension LoaderExt
+	Loader    func(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName, artifactName string) ([]byte, error)
+	LoaderExt string
+}
+
+// emitters maps each supported -emit option to its Emitter
+var emitters = map[string]Emitter{
+	"stata":      {Ext: ".do", Emit: emitStata, ReadsDat: true},
+	"r":          {Ext: ".R", Emit: emitR, ReadsDat: true},
+	"python":     {Ext: ".py", Emit: emitPython, ReadsDat: true},
+	"erd":        {Ext: ".mmd", Emit: emitMermaidERD},
+	"erd-dot":    {Ext: ".dot", Emit: emitDotERD},
+	"docs":       {Ext: ".md", Emit: emitDocs},
+	"sqlldr":     {Ext: ".ctl", Emit: emitSQLLoader, ReadsDat: true, DbType: ORACLE},
+	"bcp":        {Ext: ".fmt", Emit: emitBcpFormat, ReadsDat: true, DbType: MSSQL, Layout: checkBcpLayout, Loader: emitBulkLoad, LoaderExt: "_bulk.sql"},
+	"sqlalchemy": {Ext: "_sqlalchemy.py", Emit: emitSQLAlchemy},
+	"django":     {Ext: "_django.py", Emit: emitDjango},
+	"go":         {Ext: "_row.go", Emit: emitGoStruct},
+}
+
+// ParseEmitFlag returns the comma-delimited emit flag argument as a string slice
+//
+// returns error if any of the artifacts are not supported, or not for the database type
+func ParseEmitFlag(emitF, dbType string) ([]string, error) {
+	if len(emitF) == 0 {
+		return []string{}, nil
+	}
+	kinds := strings.Split(strings.ToLower(emitF), ",")
+	for _, k := range kinds {
+		if _, ok := emitters[k]; !ok {
+			return nil, fmt.Errorf("emit '%s' not in {'%s'}", k, strings.Join(EmitKinds(), "', '"))
+		}
+		if e := emitters[k]; len(e.DbType) != 0 && !strings.EqualFold(e.DbType, dbType) {
+			return nil, fmt.Errorf("emit '%s' is for %s (-b %s), not %s", k, e.DbType, e.DbType, strings.ToLower(dbType))
+		}
+	}
+	return kinds, nil
+}
+
+// CheckEmitLayout ensures that each of the requested artifacts can describe the layout of the data file
+// (e.g., bcp format files describe fixed-width files of a single record type), before anything is written
+//
+// returns error if not the case
+func CheckEmitLayout(kinds []string, ddi *DataDict) error {
+	for _, k := range kinds {
+		if layout := emitters[k].Layout; layout != nil {
+			if err := layout(ddi); err != nil {
+				return fmt.Errorf("emit '%s': %w", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// EmitKinds returns the supported -emit options, sorted
+func EmitKinds() []string {
+	kinds := make([]string, 0, len(emitters))
+	for k := range emitters {
+		kinds = append(kinds, k)
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+// EmitPath returns the path an artifact is written to. For single-file dumps, the artifact
+// sits next to the dump, sharing its name (e.g., "ipums_dump.sql" -> "ipums_dump.do"); for
+// directory dumps, the artifact is placed in the directory (e.g., "ipums_dump/import.do").
+// Object storage URLs are treated alike (e.g., "s3://bucket/prefix/import.do").
+func EmitPath(outFileName string, makeItDir bool, ext string) string {
+	for _, dumpExt := range []string{".sql", ".avro", ".dta"} {
+		outFileName = strings.TrimSuffix(outFileName, dumpExt)
+	}
+	if makeItDir && IsObjectURL(outFileName) {
+		return strings.TrimSuffix(outFileName, "/") + "/import" + ext
+	}
+	if makeItDir {
+		return filepath.Join(outFileName, "import"+ext)
+	}
+	return outFileName + ext
+}
+
+// WriteEmitted generates and writes each of the requested artifacts, returning the paths written.
+// datFileName is the data file that the artifacts should read from; if empty, the data
+// file named in the data dictionary is used.
+//
+// returns error if an artifact cannot be generated or written
+func WriteEmitted(kinds []string, ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName, outFileName string, makeItDir bool) ([]string, error) {
+	return writeEmitted(kinds, ddi, dbfmtr, datFileName, outFileName, makeItDir, writeEmittedFile)
+}
+
+// WriteEmitted writes the requested artifacts alongside a dump (see WriteEmitted), committed along with it:
+// artifacts uploaded to object storage are part of the dump's uploads, and artifacts of a single file dump
+// are written under temporary names (see createTemp), alike completed by Commit, or removed by FileCleanup,
+// along with the dump; in directory format, they're written to the dump's directory
+//
+// returns error if an artifact cannot be generated or written
+func (dw DumpWriter) WriteEmitted(kinds []string, ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName, outFileName string, makeItDir bool) ([]string, error) {
+	write := writeEmittedFile
+	switch {
+	case dw.remote != nil:
+		write = dw.remote.writeObject
+	case dw.emitted != nil:
+		write = dw.stageEmitted
+	}
+	return writeEmitted(kinds, ddi, dbfmtr, datFileName, outFileName, makeItDir, write)
+}
+
+// stagedFile is a file written under a temporary name, and the real name it's renamed to by Commit
+type stagedFile struct {
+	staging, final string
+}
+
+// stageEmitted writes an artifact of a single file dump under a temporary name, flushed to disk, to be
+// renamed by Commit
+func (dw DumpWriter) stageEmitted(path string, b []byte) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	*dw.emitted = append(*dw.emitted, stagedFile{staging: f.Name(), final: path})
+	return nil
+}
+
+// writeEmitted generates each of the requested artifacts (see WriteEmitted), writing them with write
+func writeEmitted(kinds []string, ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName, outFileName string, makeItDir bool, write func(path string, b []byte) error) ([]string, error) {
+	if len(datFileName) == 0 {
+		datFileName = ddi.FileName
+	}
+	// the artifacts read the data as it was provided (compressed or not), but
+	// most tools can't read gzip compressed fixed-width files directly
+	datFileName = strings.TrimSuffix(datFileName, ".gz")
+
+	// artifacts listing categories list the recoded ones
+	dbfmtr.recodeCats(ddi)
+
+	written := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		em := emitters[k]
+		b, err := em.Emit(ddi, dbfmtr, datFileName)
+		if err != nil {
+			return written, fmt.Errorf("emit %s: %w", k, err)
+		}
+		path := EmitPath(outFileName, makeItDir, em.Ext)
+		// the loader is generated first, so that neither file is written if it can't be
+		var loader []byte
+		if em.Loader != nil {
+			if loader, err = em.Loader(ddi, dbfmtr, datFileName, path); err != nil {
+				return written, fmt.Errorf("emit %s: %w", k, err)
+			}
+		}
+		if err = write(path, b); err != nil {
+			return written, fmt.Errorf("emit %s: %w", k, err)
+		}
+		written = append(written, path)
+		if em.Loader == nil {
+			continue
+		}
+		loaderPath := EmitPath(outFileName, makeItDir, em.LoaderExt)
+		if err = write(loaderPath, loader); err != nil {
+			return written, fmt.Errorf("emit %s: %w", k, err)
+		}
+		written = append(written, loaderPath)
+	}
+	return written, nil
+}
+
+// writeEmittedFile writes an artifact, locally or to object storage
+func writeEmittedFile(path string, b []byte) error {
+	if IsObjectURL(path) {
+		return putObject(path, b)
+	}
+	return writeFileAtomic(path, b)
+}
+
+// stataType returns the smallest Stata storage type that holds a variable's values
+func stataType(v Var) string {
+	if v.VType.VarType == "character" {
+		return "str"
+	}
+	width := v.Location.Width
+	switch {
+	case v.DecimalPoint > 0 || width == 0 || width > 9:
+		return "double"
+	case width <= 2:
+		return "byte"
+	case width <= 4:
+		return "int"
+	default:
+		return "long"
+	}
+}
+
+// stataQuote quotes a string with Stata's compound double quotes
+func stataQuote(s string) string {
+	return "`\"" + s + "\"'"
+}
+
+// emitStata generates a Stata do file that imports the data file, applying implied
+// decimals, variable labels, and value labels. Fixed-width files are read with infix,
+// and comma-delimited (aggregate) files with import delimited.
+func emitStata(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	var do strings.Builder
+	do.WriteString("* Stata import script generated by ipums2db\n")
+	do.WriteString("* the data file is read from the path after \"using\"; edit it if the file moves\n\n")
+	do.WriteString("set more off\n\nclear\n")
+
+	if ddi.Flavor == AGGREGATE {
+		do.WriteString(fmt.Sprintf("import delimited using %s, clear case(lower) varnames(1)\n", stataQuote(datFileName)))
+		for _, rn := range renamedColumns(ddi, dbfmtr) {
+			do.WriteString(fmt.Sprintf("rename %s %s\n", rn[0], rn[1]))
+		}
+		do.WriteString("\n")
+	} else {
+		do.WriteString("quietly infix ///\n")
+		for _, v := range ddi.Vars {
+			name := dbfmtr.columnName(v)
+			pos := fmt.Sprintf("%d-%d", v.Location.Start, v.Location.End)
+			do.WriteString(fmt.Sprintf("  %-7s %-12s %-10s ///\n", stataType(v), name, pos))
+		}
+		do.WriteString(fmt.Sprintf("  using %s\n\n", stataQuote(datFileName)))
+
+		// implied decimals
+		for _, v := range ddi.Vars {
+			if v.DecimalPoint > 0 && v.VType.VarType != "character" {
+				name := dbfmtr.columnName(v)
+				do.WriteString(fmt.Sprintf("replace %-12s = %-12s / 1%s\n", name, name, strings.Repeat("0", v.DecimalPoint)))
+			}
+		}
+		do.WriteString("\n")
+		for _, v := range ddi.Vars {
+			if v.DecimalPoint > 0 && v.VType.VarType != "character" {
+				do.WriteString(fmt.Sprintf("format %-12s %%%d.%df\n", dbfmtr.columnName(v), v.Location.Width+1, v.DecimalPoint))
+			}
+		}
+		do.WriteString("\n")
+	}
+
+	// variable labels
+	for _, v := range ddi.Vars {
+		// Stata variable labels are limited to 80 characters
+		label := v.Label
+		if r := []rune(label); len(r) > 80 {
+			label = string(r[:80])
+		}
+		do.WriteString(fmt.Sprintf("label var %-12s %s\n", dbfmtr.columnName(v), stataQuote(label)))
+	}
+	do.WriteString("\n")
+
+	// value labels; Stata only allows value labels on integer codes
+	for _, v := range ddi.Vars {
+		if v.Interval != "discrete" || len(v.Cats) == 0 || v.VType.VarType == "character" {
+			continue
+		}
+		name := dbfmtr.columnName(v)
+		lblName := name + "_lbl"
+		nDefined := 0
+		for _, c := range v.Cats {
+			if !isIntegerCode(c.Val) {
+				continue
+			}
+			add := ""
+			if nDefined > 0 {
+				add = ", add"
+			}
+			do.WriteString(fmt.Sprintf("label define %s %s %s%s\n", lblName, strings.TrimSpace(c.Val), stataQuote(c.Label), add))
+			nDefined++
+		}
+		if nDefined > 0 {
+			do.WriteString(fmt.Sprintf("label values %s %s\n\n", name, lblName))
+		}
+	}
+
+	return []byte(do.String()), nil
+}
+
+// rColType returns the readr column type of a variable; R integers are 32 bits,
+// so wide integer variables are read as doubles
+func rColType(dbfmtr *DatabaseFormatter, v Var) string {
+	switch dbfmtr.columnType(v) {
+	case "string":
+		return "col_character()"
+	case "int":
+		return "col_integer()"
+	default:
+		return "col_double()"
+	}
+}
+
+// rDBIDriver returns the DBI driver expression for a database system
+func rDBIDriver(dbType string) string {
+	switch dbType {
+	case MYSQL:
+		return "RMariaDB::MariaDB()"
+	case ORACLE:
+		return "ROracle::Oracle()"
+	case MSSQL, SNOWFLAKE:
+		return "odbc::odbc()"
+	default:
+		return "RPostgres::Postgres()"
+	}
+}
+
+// rVector formats a slice of already-formatted R values as a c(...) vector
+func rVector(vals []string) string {
+	return "c(" + strings.Join(vals, ", ") + ")"
+}
+
+// emitR generates an R script that imports the data file with readr, applying implied decimals,
+// variable labels, and value labels (as factors). The script ends with a (commented) DBI snippet
+// for reading the same data back out of the database once the dump is loaded.
+func emitR(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	var r strings.Builder
+	r.WriteString("# R import script generated by ipums2db\n")
+	r.WriteString("# the data file is read from the path below; edit it if the file moves\n\n")
+	r.WriteString("library(readr)\n\n")
+
+	colTypes := make([]string, len(ddi.Vars))
+	for i, v := range ddi.Vars {
+		// comma-delimited columns are named by the file's header, so renames are applied after reading
+		name := dbfmtr.columnName(v)
+		if ddi.Flavor == AGGREGATE {
+			name = strings.ToLower(v.Name)
+		}
+		colTypes[i] = fmt.Sprintf("    %s = %s", name, rColType(dbfmtr, v))
+	}
+
+	if ddi.Flavor == AGGREGATE {
+		r.WriteString(fmt.Sprintf("data <- read_csv(\n  %s,\n", strconv.Quote(datFileName)))
+		r.WriteString("  name_repair = tolower,\n")
+	} else {
+		starts := make([]string, len(ddi.Vars))
+		ends := make([]string, len(ddi.Vars))
+		names := make([]string, len(ddi.Vars))
+		for i, v := range ddi.Vars {
+			starts[i] = strconv.Itoa(v.Location.Start)
+			ends[i] = strconv.Itoa(v.Location.End)
+			names[i] = strconv.Quote(dbfmtr.columnName(v))
+		}
+		r.WriteString(fmt.Sprintf("data <- read_fwf(\n  %s,\n", strconv.Quote(datFileName)))
+		r.WriteString("  col_positions = fwf_positions(\n")
+		r.WriteString(fmt.Sprintf("    start = %s,\n", rVector(starts)))
+		r.WriteString(fmt.Sprintf("    end = %s,\n", rVector(ends)))
+		r.WriteString(fmt.Sprintf("    col_names = %s\n", rVector(names)))
+		r.WriteString("  ),\n")
+	}
+	r.WriteString("  col_types = cols(\n")
+	r.WriteString(strings.Join(colTypes, ",\n"))
+	r.WriteString("\n  ),\n")
+	r.WriteString("  na = c(\"\", \"NA\")\n)\n\n")
+	if ddi.Flavor == AGGREGATE {
+		for _, rn := range renamedColumns(ddi, dbfmtr) {
+			r.WriteString(fmt.Sprintf("names(data)[names(data) == %s] <- %s\n", strconv.Quote(rn[0]), strconv.Quote(rn[1])))
+		}
+		r.WriteString("\n")
+	}
+
+	// implied decimals
+	if ddi.Flavor != AGGREGATE {
+		r.WriteString("# implied decimals\n")
+		for _, v := range ddi.Vars {
+			if v.DecimalPoint > 0 && v.VType.VarType != "character" {
+				name := dbfmtr.columnName(v)
+				r.WriteString(fmt.Sprintf("data$%s <- data$%s / 1%s\n", name, name, strings.Repeat("0", v.DecimalPoint)))
+			}
+		}
+		r.WriteString("\n")
+	}
+
+	// value labels; these come first, as factor() drops attributes
+	r.WriteString("# value labels; codes without a label become NA\n")
+	for _, v := range ddi.Vars {
+		if v.Interval != "discrete" || len(v.Cats) == 0 {
+			continue
+		}
+		name := dbfmtr.columnName(v)
+		var levels, labels []string
+		for _, c := range v.Cats {
+			if v.VType.VarType == "character" {
+				levels = append(levels, strconv.Quote(c.Val))
+			} else if lo, hi, ok := catRange(c.Val); ok && lo == hi {
+				levels = append(levels, lo)
+			} else {
+				continue // ranges and non-numeric codes can't be factor levels of a numeric column
+			}
+			labels = append(labels, strconv.Quote(c.Label))
+		}
+		if len(levels) == 0 {
+			continue
+		}
+		r.WriteString(fmt.Sprintf("data$%s <- factor(data$%s,\n  levels = %s,\n  labels = %s\n)\n", name, name, rVector(levels), rVector(labels)))
+	}
+	r.WriteString("\n")
+
+	// variable labels
+	r.WriteString("# variable labels\n")
+	for _, v := range ddi.Vars {
+		r.WriteString(fmt.Sprintf("attr(data$%s, \"label\") <- %s\n", dbfmtr.columnName(v), strconv.Quote(v.Label)))
+	}
+	r.WriteString("\n")
+
+	// DBI
+	r.WriteString("# once the dump is loaded, the same data can be read from the database with DBI:\n")
+	r.WriteString(fmt.Sprintf("# con <- DBI::dbConnect(%s, ...)\n", rDBIDriver(dbfmtr.DbType)))
+	r.WriteString(fmt.Sprintf("# data <- DBI::dbGetQuery(con, \"SELECT * FROM %s\")\n", dbfmtr.ident(dbfmtr.TableName)))
+	for _, v := range ddi.Vars {
+		if dbfmtr.hasRefTable(v) && len(v.Cats) > 0 {
+			r.WriteString(fmt.Sprintf("# %s_labels <- DBI::dbGetQuery(con, \"SELECT %s FROM %s\")\n", dbfmtr.columnName(v), strings.Join(dbfmtr.refTableCols(v), ", "), dbfmtr.refTableName(v)))
+		}
+	}
+
+	return []byte(r.String()), nil
+}
+
+// pythonDtype returns the pandas dtype of a variable; integers use the nullable
+// Int64 type, so that blank (missing) values don't force a float column
+func pythonDtype(dbfmtr *DatabaseFormatter, v Var) string {
+	switch dbfmtr.columnType(v) {
+	case "string":
+		return "string"
+	case "int":
+		return "Int64"
+	default:
+		// int64 holds up to 18 digits
+		if v.DecimalPoint == 0 && v.Location.Width > 0 && v.Location.Width <= 18 {
+			return "Int64"
+		}
+		return "float64"
+	}
+}
+
+// pythonCode formats a category's coded value as a Python literal
+func pythonCode(v Var, val string) string {
+	val = strings.TrimSpace(val)
+	if v.VType.VarType == "character" {
+		return strconv.Quote(val)
+	}
+	if i, err := strconv.Atoi(val); err == nil {
+		return strconv.Itoa(i) // Python doesn't allow leading zeros in integer literals
+	}
+	if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.Quote(val)
+}
+
+// emitPython generates a Python module that loads the data file into a pandas DataFrame. The colspecs,
+// dtypes, implied decimals, and category labels (mirroring the ref_tables) are module-level constants,
+// so they can be reused on their own.
+func emitPython(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	var py strings.Builder
+	py.WriteString("# pandas import script generated by ipums2db\n")
+	py.WriteString("# the data file is read from the path below; edit it if the file moves\n")
+	py.WriteString("import pandas as pd\n\n")
+	py.WriteString(fmt.Sprintf("DAT_FILE = %s\n\n", strconv.Quote(datFileName)))
+
+	if ddi.Flavor != AGGREGATE {
+		py.WriteString("# (start, end) column positions; zero-based, end exclusive\n")
+		py.WriteString("COLSPECS = [\n")
+		for _, v := range ddi.Vars {
+			py.WriteString(fmt.Sprintf("    (%d, %d),  # %s\n", v.Location.Start-1, v.Location.End, dbfmtr.columnName(v)))
+		}
+		py.WriteString("]\n\n")
+	}
+
+	py.WriteString("DTYPES = {\n")
+	for _, v := range ddi.Vars {
+		py.WriteString(fmt.Sprintf("    %s: %s,\n", strconv.Quote(dbfmtr.columnName(v)), strconv.Quote(pythonDtype(dbfmtr, v))))
+	}
+	py.WriteString("}\n\n")
+
+	py.WriteString("IMPLIED_DECIMALS = {\n")
+	if ddi.Flavor != AGGREGATE {
+		for _, v := range ddi.Vars {
+			if v.DecimalPoint > 0 && v.VType.VarType != "character" {
+				py.WriteString(fmt.Sprintf("    %s: %d,\n", strconv.Quote(dbfmtr.columnName(v)), v.DecimalPoint))
+			}
+		}
+	}
+	py.WriteString("}\n\n")
+
+	py.WriteString("VARIABLE_LABELS = {\n")
+	for _, v := range ddi.Vars {
+		py.WriteString(fmt.Sprintf("    %s: %s,\n", strconv.Quote(dbfmtr.columnName(v)), strconv.Quote(v.Label)))
+	}
+	py.WriteString("}\n\n")
+
+	py.WriteString("# category labels; these mirror the ref_<var> tables of the dump\n")
+	py.WriteString("VALUE_LABELS = {\n")
+	for _, v := range ddi.Vars {
+		if v.Interval != "discrete" || len(v.Cats) == 0 {
+			continue
+		}
+		py.WriteString(fmt.Sprintf("    %s: {\n", strconv.Quote(dbfmtr.columnName(v))))
+		for _, c := range v.Cats {
+			py.WriteString(fmt.Sprintf("        %s: %s,\n", pythonCode(v, c.Val), strconv.Quote(c.Label)))
+		}
+		py.WriteString("    },\n")
+	}
+	py.WriteString("}\n\n\n")
+
+	py.WriteString("def load(path=DAT_FILE, labels=False):\n")
+	py.WriteString("    \"\"\"Load the extract into a DataFrame; if labels, coded values are replaced\n")
+	py.WriteString("    by their category labels (as pandas categoricals).\"\"\"\n")
+	if ddi.Flavor == AGGREGATE {
+		py.WriteString("    data = pd.read_csv(path)\n")
+		py.WriteString("    data.columns = data.columns.str.lower()\n")
+		if renames := renamedColumns(ddi, dbfmtr); len(renames) != 0 {
+			pairs := make([]string, len(renames))
+			for i, rn := range renames {
+				pairs[i] = fmt.Sprintf("%s: %s", strconv.Quote(rn[0]), strconv.Quote(rn[1]))
+			}
+			py.WriteString(fmt.Sprintf("    data = data.rename(columns={%s})\n", strings.Join(pairs, ", ")))
+		}
+		py.WriteString("    data = data.astype({k: v for k, v in DTYPES.items() if k in data.columns})\n")
+	} else {
+		py.WriteString("    data = pd.read_fwf(\n")
+		py.WriteString("        path, colspecs=COLSPECS, names=list(DTYPES), dtype=DTYPES, header=None\n")
+		py.WriteString("    )\n")
+	}
+	py.WriteString("    for name, places in IMPLIED_DECIMALS.items():\n")
+	py.WriteString("        data[name] = data[name] / 10**places\n")
+	py.WriteString("    if labels:\n")
+	py.WriteString("        for name, codes in VALUE_LABELS.items():\n")
+	py.WriteString("            if name in data.columns:\n")
+	py.WriteString("                data[name] = data[name].map(codes).astype(\"category\")\n")
+	py.WriteString("    return data\n\n\n")
+	py.WriteString("if __name__ == \"__main__\":\n")
+	py.WriteString("    print(load().head())\n")
+
+	return []byte(py.String()), nil
+}
+
+// renamedColumns returns the (lowercased variable name, column name) pairs of renamed variables
+func renamedColumns(ddi *DataDict, dbfmtr *DatabaseFormatter) [][2]string {
+	var renames [][2]string
+	for _, v := range ddi.Vars {
+		if name := strings.ToLower(v.Name); name != dbfmtr.columnName(v) {
+			renames = append(renames, [2]string{name, dbfmtr.columnName(v)})
+		}
+	}
+	return renames
+}
+
+// isIntegerCode reports whether a category's coded value is an integer
+func isIntegerCode(val string) bool {
+	val = strings.TrimPrefix(strings.TrimSpace(val), "-")
+	if len(val) == 0 {
+		return false
+	}
+	for _, c := range val {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
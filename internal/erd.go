@@ -0,0 +1,132 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// erdModel describes the tables of a generated schema, and the relationships between them
+type erdModel struct {
+	tables []erdTable
+	links  []erdLink
+}
+
+// erdTable is a single table of the schema
+type erdTable struct {
+	name string
+	cols []erdCol
+}
+
+// erdCol is a single column of a table
+type erdCol struct {
+	name    string
+	sqlType string
+	comment string
+}
+
+// erdLink relates a column of one table to a column of another (e.g., ipums_tab.sex -> ref_sex.val)
+type erdLink struct {
+	fromTable, fromCol string
+	toTable, toCol     string
+}
+
+// newERDModel builds the erdModel of the schema generated for a data dictionary:
+// the main table, and a ref_table for each discrete variable (or a dimension table, in the star model)
+func newERDModel(ddi *DataDict, dbfmtr *DatabaseFormatter) erdModel {
+	var m erdModel
+	main := erdTable{name: dbfmtr.ident(dbfmtr.TableName)}
+	for _, v := range ddi.Vars {
+		col, sqlType := dbfmtr.factColumn(v)
+		main.cols = append(main.cols, erdCol{name: col, sqlType: sqlType, comment: v.Label})
+		// in the star model, discrete variables without categories get no dimension table
+		if !dbfmtr.hasRefTable(v) || (dbfmtr.Model == MODEL_STAR && !dbfmtr.isDimension(v)) {
+			continue
+		}
+		if dbfmtr.isDimension(v) {
+			m.links = append(m.links, erdLink{fromTable: main.name, fromCol: col, toTable: dbfmtr.dimTableName(v), toCol: col})
+			continue
+		}
+		refName := dbfmtr.refTableName(v)
+		m.links = append(m.links, erdLink{fromTable: main.name, fromCol: col, toTable: refName, toCol: dbfmtr.refTableCols(v)[0]})
+	}
+	m.tables = append(m.tables, main)
+	for _, v := range ddi.Vars {
+		// in the star model, discrete variables without categories get no dimension table
+		if !dbfmtr.hasRefTable(v) || (dbfmtr.Model == MODEL_STAR && !dbfmtr.isDimension(v)) {
+			continue
+		}
+		ref := erdTable{name: dbfmtr.refTableName(v)}
+		if dbfmtr.isDimension(v) {
+			ref.name = dbfmtr.dimTableName(v)
+			ref.cols = append(ref.cols, erdCol{name: dbfmtr.dimKeyColumn(v), sqlType: dbfmtr.sqlType("int"), comment: "surrogate key"})
+		}
+		cols := dbfmtr.refTableCols(v)
+		if len(cols) == 3 {
+			ref.cols = append(ref.cols,
+				erdCol{name: cols[0], sqlType: dbfmtr.columnSQLType(v), comment: "lowest coded value"},
+				erdCol{name: cols[1], sqlType: dbfmtr.columnSQLType(v), comment: "highest coded value"})
+		} else {
+			ref.cols = append(ref.cols, erdCol{name: cols[0], sqlType: dbfmtr.columnSQLType(v), comment: "coded value"})
+		}
+		ref.cols = append(ref.cols, erdCol{name: cols[len(cols)-1], sqlType: dbfmtr.sqlType("string", maxCharsInLab), comment: "category label"})
+		m.tables = append(m.tables, ref)
+	}
+	return m
+}
+
+// emitMermaidERD generates a Mermaid entity-relationship diagram of the generated schema
+func emitMermaidERD(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	m := newERDModel(ddi, dbfmtr)
+	// mermaid attribute types can't hold precision/scale (e.g., "numeric(9,2)"), and
+	// comments can't hold double quotes
+	baseType := func(t string) string {
+		base, _, _ := strings.Cut(t, "(")
+		return base
+	}
+	comment := strings.NewReplacer(`"`, "'", "\n", " ")
+	// nor can entity names hold a schema qualifier's dot
+	entity := strings.NewReplacer(".", "__")
+
+	var erd strings.Builder
+	erd.WriteString("%% entity-relationship diagram generated by ipums2db\n")
+	erd.WriteString("erDiagram\n")
+	for _, t := range m.tables {
+		erd.WriteString(fmt.Sprintf("    %s {\n", entity.Replace(t.name)))
+		for _, c := range t.cols {
+			erd.WriteString(fmt.Sprintf("        %s %s \"%s\"\n", baseType(c.sqlType), c.name, comment.Replace(c.comment)))
+		}
+		erd.WriteString("    }\n")
+	}
+	for _, l := range m.links {
+		erd.WriteString(fmt.Sprintf("    %s }o--o| %s : \"%s = %s\"\n", entity.Replace(l.fromTable), entity.Replace(l.toTable), l.fromCol, l.toCol))
+	}
+	return []byte(erd.String()), nil
+}
+
+// emitDotERD generates a Graphviz DOT entity-relationship diagram of the generated schema
+func emitDotERD(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	m := newERDModel(ddi, dbfmtr)
+	var dot strings.Builder
+	dot.WriteString("// entity-relationship diagram generated by ipums2db\n")
+	dot.WriteString("digraph ipums2db {\n")
+	dot.WriteString("    rankdir=LR;\n")
+	dot.WriteString("    node [shape=plaintext, fontname=\"Helvetica\"];\n\n")
+	for _, t := range m.tables {
+		dot.WriteString(fmt.Sprintf("    %q [label=<<table border=\"0\" cellborder=\"1\" cellspacing=\"0\">\n", t.name))
+		dot.WriteString(fmt.Sprintf("        <tr><td bgcolor=\"lightgrey\"><b>%s</b></td></tr>\n", html.EscapeString(t.name)))
+		for _, c := range t.cols {
+			dot.WriteString(fmt.Sprintf("        <tr><td port=%q align=\"left\">%s <i>%s</i></td></tr>\n",
+				c.name, html.EscapeString(c.name), html.EscapeString(c.sqlType)))
+		}
+		dot.WriteString("    </table>>];\n")
+	}
+	dot.WriteString("\n")
+	for _, l := range m.links {
+		dot.WriteString(fmt.Sprintf("    %q:%q -> %q:%q;\n", l.fromTable, l.fromCol, l.toTable, l.toCol))
+	}
+	dot.WriteString("}\n")
+	return []byte(dot.String()), nil
+}
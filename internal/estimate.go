@@ -0,0 +1,209 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// estimateSampleRows is the number of rows parsed by EstimateDump, at most
+const estimateSampleRows = 20000
+
+// estimateSampleSpans is the number of evenly spaced spans of rows that the sample of EstimateDump is
+// drawn from, so that it isn't biased by the order of the file (e.g., extracts sorted by sample year)
+const estimateSampleSpans = 20
+
+// DumpEstimate is the plan of a conversion, extrapolated from a sample of its rows (see EstimateDump)
+type DumpEstimate struct {
+	Rows       int           // rows of the data file
+	SampleRows int           // rows parsed
+	DatBytes   int           // bytes of the (decompressed) data file
+	DumpBytes  int64         // bytes of the insertion files (compressed, for compressed dumps); the DDL isn't counted
+	Files      int           // insertion files, in directory format; 0 if one per shard
+	Parsers    int           // parsers the sample was parsed with
+	RowsPerSec float64       // rows parsed per second, in the sample
+	Duration   time.Duration // time to parse all rows, at the sample's throughput, and decompress the file, if gzip compressed
+}
+
+// EstimateDump parses a sample of the rows of a data file, as a conversion would (with nParsers parsers),
+// extrapolating the size of the dump, its number of insertion files (in directory format, given split), and
+// the conversion's duration from it; nothing is written. The sample is drawn from evenly spaced spans of
+// rows across the file; gzip compressed files are read once through (to count their rows), and sampled from
+// their first rows. Aggregate (comma-delimited) extracts, usually small, are parsed whole. If compress is
+// set, the sample's blocks are compressed as they would be in the dump (see gzipMember).
+//
+// returns error if the data file can't be read, or the sample can't be parsed
+func EstimateDump(datFileName string, ddi *DataDict, dbfmtr *DatabaseFormatter, nParsers int, makeItDir bool, split OutputSplit, compress bool) (DumpEstimate, error) {
+	est := DumpEstimate{Parsers: nParsers}
+	var decompressTime time.Duration
+	if strings.HasSuffix(datFileName, ".gz") {
+		start := time.Now()
+		sampleFile, datBytes, err := sampleGzipDat(datFileName, ddi)
+		if err != nil {
+			return DumpEstimate{}, err
+		}
+		defer os.Remove(sampleFile)
+		decompressTime = time.Since(start)
+		datFileName, est.DatBytes = sampleFile, datBytes
+	} else {
+		datBytes, err := TotalBytes(datFileName)
+		if err != nil {
+			return DumpEstimate{}, err
+		}
+		est.DatBytes = datBytes
+	}
+
+	parsedStream := make(chan ParsedResult, nParsers)
+	var parserWG sync.WaitGroup
+	if ddi.Flavor == AGGREGATE {
+		est.Parsers = 1
+		cp := NewCSVParser(datFileName, ddi, dbfmtr, 0)
+		parserWG.Add(1)
+		go func() {
+			defer parserWG.Done()
+			cp.ParseCSV(parsedStream)
+		}()
+	} else {
+		sampledRows, err := DetectLineEndings(datFileName, ddi)
+		if err != nil {
+			return DumpEstimate{}, err
+		}
+		est.Rows = rowsOfBytes(est.DatBytes, ddi)
+		jobs := make(chan ParsingJob)
+		go func() {
+			defer close(jobs)
+			for i, job := range sampleJobs(sampledRows) {
+				job.Index = i
+				jobs <- job
+			}
+		}()
+		NewDatParser(datFileName, nParsers, ddi, dbfmtr).ParseBlocks(&parserWG, jobs, parsedStream)
+	}
+	go func() {
+		parserWG.Wait()
+		close(parsedStream)
+	}()
+
+	start := time.Now()
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(nil)
+	}
+	var sampleBytes int64
+	var err error
+	for res := range parsedStream {
+		if res.AnyError != nil {
+			if err == nil {
+				err = &ParseError{Err: fmt.Errorf("encountered error parsing: %w", res.AnyError)}
+			}
+			continue
+		}
+		if zw != nil {
+			res = compressResult(zw, res)
+		}
+		est.SampleRows += res.Rows
+		sampleBytes += int64(len(res.Block))
+		for _, s := range res.Shards {
+			sampleBytes += int64(len(s.Block))
+		}
+	}
+	if err != nil {
+		return DumpEstimate{}, err
+	}
+	elapsed := time.Since(start)
+	if ddi.Flavor == AGGREGATE {
+		est.Rows = est.SampleRows
+	}
+	if est.SampleRows == 0 {
+		return est, nil
+	}
+
+	est.DumpBytes = sampleBytes * int64(est.Rows) / int64(est.SampleRows)
+	if elapsed > 0 {
+		est.RowsPerSec = float64(est.SampleRows) / elapsed.Seconds()
+	}
+	if est.RowsPerSec > 0 {
+		est.Duration = time.Duration(float64(est.Rows)/est.RowsPerSec*float64(time.Second)) + decompressTime
+	}
+	if makeItDir && len(split.ShardBy) == 0 {
+		est.Files = numOutFiles(est.DatBytes)
+		if split.Rows > 0 {
+			est.Files = max(est.Files, (est.Rows+split.Rows-1)/split.Rows)
+		}
+		if split.Bytes > 0 {
+			est.Files = max(est.Files, int((est.DumpBytes+int64(split.Bytes)-1)/int64(split.Bytes)))
+		}
+	}
+	return est, nil
+}
+
+// sampleJobs returns the jobs parsing the sample of a file of totRows rows: estimateSampleRows rows at most,
+// in estimateSampleSpans evenly spaced spans
+func sampleJobs(totRows int) []ParsingJob {
+	if totRows <= estimateSampleRows {
+		if totRows == 0 {
+			return nil
+		}
+		return []ParsingJob{{StartAtRow: 0, RowsToRead: totRows}}
+	}
+	spanRows := estimateSampleRows / estimateSampleSpans
+	stride := totRows / estimateSampleSpans
+	jobs := make([]ParsingJob, estimateSampleSpans)
+	for i := range jobs {
+		jobs[i] = ParsingJob{StartAtRow: i * stride, RowsToRead: spanRows}
+	}
+	return jobs
+}
+
+// rowsOfBytes returns the rows of a fixed-width file of datBytes bytes, once its line endings are known
+// (see DetectLineEndings); a final row without a newline is counted
+func rowsOfBytes(datBytes int, ddi *DataDict) int {
+	bytesPerRow := BytesPerRow(ddi)
+	rows := datBytes / bytesPerRow
+	if datBytes%bytesPerRow == bytesPerRow-ddi.EOLBytes {
+		rows++
+	}
+	return rows
+}
+
+// sampleGzipDat reads a gzip compressed fixed-width file through, writing its first estimateSampleRows rows
+// (or so) to a temporary file, to be sampled and removed by the caller; returns the temporary file's name,
+// and the file's decompressed bytes
+func sampleGzipDat(gzPath string, ddi *DataDict) (string, int, error) {
+	src, err := os.Open(gzPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer zr.Close()
+
+	dst, err := os.CreateTemp("", "ipums2db-sample-*.dat")
+	if err != nil {
+		return "", 0, err
+	}
+	// rows are counted at their longest ("\r\n"), so the sample holds at least estimateSampleRows rows
+	sampled, err := io.CopyN(dst, zr, int64(estimateSampleRows*(BytesPerRow(ddi)+1)))
+	if closeErr := dst.Close(); err == nil || err == io.EOF {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", 0, fmt.Errorf("sampling %s: %w", gzPath, err)
+	}
+	rest, err := io.Copy(io.Discard, zr)
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", 0, fmt.Errorf("reading %s: %w", gzPath, err)
+	}
+	return dst.Name(), int(sampled + rest), nil
+}
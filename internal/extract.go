@@ -0,0 +1,424 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// conditionRe matches a row condition of the form "VAR<op>VALUE" (e.g., "age>=18", "statefip=6,36")
+var conditionRe = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(!=|<=|>=|=|<|>)\s*(.*?)\s*$`)
+
+// locationAttrRe matches the position attributes of a DDI <location> tag
+var locationAttrRe = regexp.MustCompile(`\b(StartPos|EndPos|width)="[^"]*"`)
+
+// varGrpAttrRe matches the variable list attribute of a DDI <varGrp> tag
+var varGrpAttrRe = regexp.MustCompile(`\bvar="([^"]*)"`)
+
+// RowCondition is a condition that rows of a subset extract must meet, comparing a variable's
+// value to one or more values (see ParseRowCondition)
+type RowCondition struct {
+	v       Var
+	op      string
+	vals    []string
+	numVals []float64 // vals, parsed, for numeric variables
+}
+
+// ParseRowCondition parses a row condition of the form "VAR<op>VALUE", where op is one of
+// =, !=, <, <=, >, or >=; with = and !=, VALUE may list several values, separated by commas
+// (e.g., "statefip=6,36" keeps rows from either state). Numeric variables are compared as
+// numbers (with implied decimals applied), and character variables as (trimmed) strings.
+//
+// returns error if the condition is malformed, or names a variable that's not in the data dictionary
+func ParseRowCondition(ddi *DataDict, cond string) (RowCondition, error) {
+	m := conditionRe.FindStringSubmatch(cond)
+	if m == nil {
+		return RowCondition{}, fmt.Errorf("condition '%s' is not of the form VAR<op>VALUE (e.g., age>=18)", cond)
+	}
+	i := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, m[1]) })
+	if i < 0 {
+		return RowCondition{}, fmt.Errorf("condition '%s': unrecognized variable %s", cond, m[1])
+	}
+	rc := RowCondition{v: ddi.Vars[i], op: m[2], vals: []string{m[3]}}
+	if rc.op == "=" || rc.op == "!=" {
+		rc.vals = strings.Split(m[3], ",")
+	}
+	for j, val := range rc.vals {
+		rc.vals[j] = strings.TrimSpace(val)
+		if rc.v.VType.VarType == "character" {
+			continue
+		}
+		n, err := strconv.ParseFloat(rc.vals[j], 64)
+		if err != nil {
+			return RowCondition{}, fmt.Errorf("condition '%s': '%s' is not a number", cond, rc.vals[j])
+		}
+		rc.numVals = append(rc.numVals, n)
+	}
+	return rc, nil
+}
+
+// matches reports whether a row meets the condition; blank fields only meet != conditions
+func (rc RowCondition) matches(row []byte) (bool, error) {
+	field := bytes.TrimSpace(row[rc.v.Location.Start-1 : rc.v.Location.End])
+	if len(field) == 0 {
+		return rc.op == "!=", nil
+	}
+	var cmps []int
+	if rc.v.VType.VarType == "character" {
+		for _, val := range rc.vals {
+			cmps = append(cmps, strings.Compare(string(field), val))
+		}
+	} else {
+		num, err := fixedWidthNumber(field, rc.v.DecimalPoint)
+		if err != nil {
+			return false, fmt.Errorf("variable %s: %w", rc.v.Name, err)
+		}
+		n, _ := strconv.ParseFloat(num, 64)
+		for _, val := range rc.numVals {
+			switch {
+			case n < val:
+				cmps = append(cmps, -1)
+			case n > val:
+				cmps = append(cmps, 1)
+			default:
+				cmps = append(cmps, 0)
+			}
+		}
+	}
+	switch rc.op {
+	case "=":
+		return slices.Contains(cmps, 0), nil
+	case "!=":
+		return !slices.Contains(cmps, 0), nil
+	case "<":
+		return cmps[0] < 0, nil
+	case "<=":
+		return cmps[0] <= 0, nil
+	case ">":
+		return cmps[0] > 0, nil
+	default:
+		return cmps[0] >= 0, nil
+	}
+}
+
+// ExtractResult summarizes a subset extract
+type ExtractResult struct {
+	DDIFile string // rewritten data dictionary path
+	RowsIn  int    // rows read
+	RowsOut int    // rows written
+	VarsOut int    // variables written
+}
+
+// ExtractDDIName returns the name of the data dictionary written alongside a subset extract
+// (e.g., "usa_small.dat" -> "usa_small.xml")
+func ExtractDDIName(outFileName string) string {
+	base := strings.TrimSuffix(outFileName, ".gz")
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".xml"
+}
+
+// WriteExtract writes a subset of a fixed-width file: only the variables named in keep (all, if
+// empty), in the data dictionary's order, and only the rows meeting all conditions. The data
+// dictionary is rewritten alongside it (see ExtractDDIName), with the dropped variables removed
+// and the kept variables' positions updated; the rest of the DDI is kept as is. Either file is
+// gzip compressed if its name ends with ".gz", and written under a temporary name until complete.
+//
+// returns error if the data dictionary isn't a fixed-width DDI XML file, a variable is not
+// recognized, or either file cannot be read or written
+func WriteExtract(ddiFileName, datFileName, outFileName string, keep []string, conds []RowCondition) (ExtractResult, error) {
+	if isSyntaxFile(ddiFileName) {
+		return ExtractResult{}, fmt.Errorf("extracts rewrite the DDI, so -x must be the DDI XML file, not %s", ddiFileName)
+	}
+	ddi, err := NewDataDict(ddiFileName)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	if ddi.Flavor == AGGREGATE {
+		return ExtractResult{}, fmt.Errorf("extracts are of fixed-width (microdata) files; %s describes a comma-delimited file", ddiFileName)
+	}
+	kept, err := keptVars(&ddi, keep)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+
+	res := ExtractResult{DDIFile: ExtractDDIName(outFileName), VarsOut: len(kept)}
+	f, err := createTemp(outFileName)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	res.RowsIn, res.RowsOut, err = writeExtractRows(f, &ddi, datFileName, kept, conds, strings.HasSuffix(outFileName, ".gz"))
+	if err = finishTemp(f, outFileName, err); err != nil {
+		return ExtractResult{}, err
+	}
+
+	src, err := os.ReadFile(ddiFileName)
+	if err == nil {
+		src, err = rewriteDDI(src, kept, filepath.Base(outFileName), res.RowsOut)
+	}
+	if err == nil {
+		err = writeFileAtomic(res.DDIFile, src)
+	}
+	if err != nil {
+		_ = os.Remove(outFileName)
+		return ExtractResult{}, err
+	}
+	return res, nil
+}
+
+// keptVars returns the variables of a subset extract, by lowercased name, with their new locations
+//
+// returns error if a variable is not in the data dictionary
+func keptVars(ddi *DataDict, keep []string) (map[string]Loc, error) {
+	want := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.ContainsFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) }) {
+			return nil, fmt.Errorf("cannot keep unrecognized variable %s", name)
+		}
+		want[name] = true
+	}
+	kept := make(map[string]Loc)
+	pos := 1
+	for _, v := range ddi.Vars {
+		name := strings.ToLower(v.Name)
+		if len(want) != 0 && !want[name] {
+			continue
+		}
+		width := v.Location.End - v.Location.Start + 1
+		kept[name] = Loc{Start: pos, End: pos + width - 1, Width: width}
+		pos += width
+	}
+	return kept, nil
+}
+
+// writeExtractRows reads a fixed-width file (gzip compressed, if it ends with ".gz") row by row,
+// writing the kept variables of rows meeting all conditions to w, with the file's line endings.
+// returns the number of rows read and written
+//
+// returns error if a line doesn't match the data dictionary's width, or cannot be read or written
+func writeExtractRows(w io.Writer, ddi *DataDict, datFileName string, kept map[string]Loc, conds []RowCondition, compress bool) (int, int, error) {
+	datFile, err := os.Open(datFileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer datFile.Close()
+	var r io.Reader = datFile
+	if strings.HasSuffix(datFileName, ".gz") {
+		zr, err := gzip.NewReader(datFile)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	// the gzip footer is written on close, after the last row, so its error is returned too
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	out := bufio.NewWriterSize(w, 1<<20)
+
+	// spans of the kept variables in each input row
+	var spans [][2]int
+	for _, v := range ddi.Vars {
+		if _, ok := kept[strings.ToLower(v.Name)]; ok {
+			spans = append(spans, [2]int{v.Location.Start - 1, v.Location.End})
+		}
+	}
+	rowChars := BytesPerRow(ddi) - 1
+	in := bufio.NewReaderSize(r, max(1<<20, rowChars+2))
+	var eol []byte
+	rowsIn, rowsOut := 0, 0
+	for {
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return rowsIn, rowsOut, fmt.Errorf("line %d is longer than the %d characters described by the data dictionary", rowsIn+1, rowChars)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return rowsIn, rowsOut, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		row := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if eol == nil {
+			eol = append([]byte{}, line[len(row):]...)
+			if len(eol) == 0 {
+				eol = []byte("\n") // a single row, without a final newline
+			}
+		}
+		rowsIn++
+		if len(row) != rowChars {
+			return rowsIn, rowsOut, fmt.Errorf("line %d holds %d characters, but the data dictionary describes %d", rowsIn, len(row), rowChars)
+		}
+		keepRow := true
+		for _, c := range conds {
+			if keepRow, err = c.matches(row); err != nil {
+				return rowsIn, rowsOut, fmt.Errorf("line %d: %w", rowsIn, err)
+			} else if !keepRow {
+				break
+			}
+		}
+		if keepRow {
+			for _, s := range spans {
+				out.Write(row[s[0]:s[1]])
+			}
+			if _, err := out.Write(eol); err != nil {
+				return rowsIn, rowsOut, err
+			}
+			rowsOut++
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return rowsIn, rowsOut, err
+	}
+	if zw != nil {
+		return rowsIn, rowsOut, zw.Close()
+	}
+	return rowsIn, rowsOut, nil
+}
+
+// ddiEdit replaces the bytes of src[start:end] of a DDI with repl
+type ddiEdit struct {
+	start, end int
+	repl       []byte
+}
+
+// rewriteDDI rewrites a DDI XML file for a subset extract, editing the original bytes in place, so
+// that everything else (formatting, namespaces, documentation) is kept as is:
+//
+//   - dropped <var> elements are removed, and the kept ones' <location> positions are updated
+//   - dropped variables are removed from <varGrp> variable lists
+//   - the data file name (<fileName>), case count (<caseQnty>), and variable count (<varQnty>) are updated
+func rewriteDDI(src []byte, kept map[string]Loc, datName string, rows int) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	var edits []ddiEdit
+	var path []string
+	varStart, varName := -1, ""
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rewriting DDI: %w", err)
+		}
+		end := int(dec.InputOffset())
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			switch t.Name.Local {
+			case "var":
+				varStart, varName = start, strings.ToLower(xmlAttr(t, "name"))
+			case "location":
+				if loc, ok := kept[varName]; ok && varStart >= 0 {
+					tag := locationAttrRe.ReplaceAllStringFunc(string(src[start:end]), func(attr string) string {
+						name, _, _ := strings.Cut(attr, "=")
+						n := map[string]int{"StartPos": loc.Start, "EndPos": loc.End, "width": loc.Width}[name]
+						return fmt.Sprintf(`%s="%d"`, name, n)
+					})
+					edits = append(edits, ddiEdit{start, end, []byte(tag)})
+				}
+			case "varGrp":
+				tag := varGrpAttrRe.ReplaceAllStringFunc(string(src[start:end]), func(attr string) string {
+					var names []string
+					for _, name := range strings.Fields(varGrpAttrRe.FindStringSubmatch(attr)[1]) {
+						if _, ok := kept[strings.ToLower(name)]; ok {
+							names = append(names, name)
+						}
+					}
+					return fmt.Sprintf(`var="%s"`, strings.Join(names, " "))
+				})
+				edits = append(edits, ddiEdit{start, end, []byte(tag)})
+			}
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+			if t.Name.Local == "var" && varStart >= 0 {
+				if _, ok := kept[varName]; !ok {
+					s, e := wholeLines(src, varStart, end)
+					// edits within the element (e.g., its location) are dropped with it
+					for len(edits) > 0 && edits[len(edits)-1].start >= s {
+						edits = edits[:len(edits)-1]
+					}
+					edits = append(edits, ddiEdit{s, e, nil})
+				}
+				varStart = -1
+			}
+		case xml.CharData:
+			if len(path) == 0 {
+				continue
+			}
+			var repl string
+			switch path[len(path)-1] {
+			case "fileName":
+				var esc bytes.Buffer
+				_ = xml.EscapeText(&esc, []byte(datName))
+				repl = esc.String()
+			case "caseQnty":
+				repl = strconv.Itoa(rows)
+			case "varQnty":
+				repl = strconv.Itoa(len(kept))
+			default:
+				continue
+			}
+			edits = append(edits, ddiEdit{start, end, []byte(repl)})
+		}
+	}
+	var out bytes.Buffer
+	pos := 0
+	for _, e := range edits {
+		out.Write(src[pos:e.start])
+		out.Write(e.repl)
+		pos = e.end
+	}
+	out.Write(src[pos:])
+	return out.Bytes(), nil
+}
+
+// wholeLines widens src[start:end] to the whole lines it spans, if nothing else is on them
+// (so that removing an element doesn't leave blank lines behind)
+func wholeLines(src []byte, start, end int) (int, int) {
+	s := start
+	for s > 0 && (src[s-1] == ' ' || src[s-1] == '\t') {
+		s--
+	}
+	e := end
+	for e < len(src) && (src[e] == ' ' || src[e] == '\t' || src[e] == '\r') {
+		e++
+	}
+	if (s == 0 || src[s-1] == '\n') && (e == len(src) || src[e] == '\n') {
+		if e < len(src) {
+			e++
+		}
+		return s, e
+	}
+	return start, end
+}
+
+// xmlAttr returns the value of an attribute of an XML element, by local name
+func xmlAttr(t xml.StartElement, name string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
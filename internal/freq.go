@@ -0,0 +1,259 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rowScanner accumulates results from rows of a fixed-width file (see scanRows)
+type rowScanner interface {
+	// scan reads a row, given its (1-based) number in the file
+	scan(row []byte, rowNum int) error
+}
+
+// scanRows reads every row of a fixed-width file, in parallel, as a conversion parses them: jobs are made by
+// MakeParsingJobsStream, sized as decided by NewJobConfig, and read by the parsers, each passing its rows to
+// its own scanner, made by newScanner. The scanners are returned once the file is read, for their results
+// to be merged, along with the number of rows read.
+//
+// returns error if the data file can't be read, or a row can't be scanned (the first error, in file order,
+// as a ParseError)
+func scanRows[S rowScanner](datFileName string, ddi *DataDict, newScanner func() S) ([]S, int, error) {
+	if ddi.Flavor == AGGREGATE {
+		return nil, 0, fmt.Errorf("aggregate extracts are comma-delimited; only fixed-width (microdata) files are scanned")
+	}
+	totRows, err := DetectLineEndings(datFileName, ddi)
+	if err != nil {
+		return nil, 0, err
+	}
+	bytesPerRow := BytesPerRow(ddi)
+	rowBytes := totRows * bytesPerRow
+	if totRows == 0 {
+		return nil, 0, nil
+	}
+	jc := NewJobConfig(rowBytes, 0)
+	maxBytesPerJob := jc.BytesPerJob(bytesPerRow, len(ddi.Vars), totRows, OutputSplit{})
+
+	jobs := make(chan ParsingJob)
+	jobsErr := make(chan error, 1)
+	go func() {
+		// the stream is only closed by the job maker once its arguments are checked
+		err := MakeParsingJobsStream(bytesPerRow, rowBytes, maxBytesPerJob, 0, jobs)
+		if err != nil {
+			close(jobs)
+		}
+		jobsErr <- err
+	}()
+
+	scanners := make([]S, jc.NumParsers)
+	errs := make([]*scanError, jc.NumParsers)
+	var wg sync.WaitGroup
+	for i := range scanners {
+		scanners[i] = newScanner()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			datFile, err := os.Open(datFileName)
+			if err != nil {
+				errs[i] = &scanError{err: err}
+				for range jobs { // let the job maker finish
+				}
+				return
+			}
+			defer datFile.Close()
+			for job := range jobs {
+				if errs[i] != nil {
+					continue
+				}
+				buffer, err := readRows(ddi, datFile, job.StartAtRow, job.RowsToRead)
+				if err != nil {
+					errs[i] = &scanError{row: job.StartAtRow + 1, err: err}
+					continue
+				}
+				for r := 0; r < job.RowsToRead; r++ {
+					row := buffer[r*bytesPerRow : (r+1)*bytesPerRow]
+					if err := scanners[i].scan(row, job.StartAtRow+r+1); err != nil {
+						errs[i] = &scanError{row: job.StartAtRow + r + 1, err: &ParseError{Err: err}}
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := <-jobsErr; err != nil {
+		return nil, 0, err
+	}
+
+	var first *scanError
+	for _, e := range errs {
+		if e != nil && (first == nil || e.row < first.row) {
+			first = e
+		}
+	}
+	if first != nil {
+		return nil, 0, first.err
+	}
+	return scanners, totRows, nil
+}
+
+// scanError is an error scanning a row of a fixed-width file, and the (1-based) number of the row
+type scanError struct {
+	row int
+	err error
+}
+
+// FreqTable is the frequency table of a variable of an extract: the count of rows holding each of its values
+// (see Frequencies)
+type FreqTable struct {
+	Var    Var
+	Counts []FreqCount // in value order (numerically, for numeric variables)
+	Rows   int         // rows counted
+}
+
+// FreqCount is the count of rows holding a value of a variable, and the value's category label, if any;
+// blank fields have an empty value
+type FreqCount struct {
+	Value string
+	Label string
+	Count int
+}
+
+// freqScanner counts the values of variables, keyed by their formatted value (see policyValue)
+type freqScanner struct {
+	vars     []Var
+	policies []string // null policy of each variable
+	counts   []map[string]int
+}
+
+// scan counts the values of a row
+func (fs *freqScanner) scan(row []byte, rowNum int) error {
+	for i, v := range fs.vars {
+		val, err := policyValue(v, row[v.Location.Start-1:v.Location.End], fs.policies[i])
+		if err != nil {
+			return fmt.Errorf("row %d: variable %s: %w", rowNum, v.Name, err)
+		}
+		fs.counts[i][val]++
+	}
+	return nil
+}
+
+// freqValue returns the value of a field, as counted by Frequencies: trimmed, and, for numeric variables,
+// with implied decimals applied and leading zeros trimmed (e.g., "009" -> "9"), so that values match their
+// categories; blank fields are ""
+//
+// returns error if a numeric field is not a number
+func freqValue(v Var, field []byte) (string, error) {
+	field = bytes.TrimSpace(field)
+	if len(field) == 0 || v.VType.VarType == "character" {
+		return string(field), nil
+	}
+	return fixedWidthNumber(field, v.DecimalPoint)
+}
+
+// policyValue returns the value of a field as freqValue does, once a null policy is applied to it, as a
+// conversion applies it: fields loaded as null are "", as blank fields are
+//
+// returns error if the policy rejects the field (e.g., a partially blank one, under "strict"), or a numeric
+// field is not a number
+func policyValue(v Var, field []byte, policy string) (string, error) {
+	chars, isNull, err := applyNullPolicy(field, policy, v.VType.VarType == "character")
+	if err != nil || isNull {
+		return "", err
+	}
+	return freqValue(v, chars)
+}
+
+// Frequencies counts the values of the named variables (case-insensitive) in every row of a fixed-width
+// file, read in parallel (see scanRows), returning a frequency table per variable, in the order named.
+// Values are joined with their category labels; values with no category (e.g., of continuous variables)
+// have no label. Fields are counted as they'd be loaded under a null policy (the default, if nil): fields
+// loaded as null are counted as blank.
+//
+// returns error if a variable isn't in the data dictionary, or the data file can't be read or parsed
+func Frequencies(datFileName string, ddi *DataDict, names []string, np *NullPolicy) ([]FreqTable, error) {
+	if err := np.check(ddi); err != nil {
+		return nil, err
+	}
+	vars := make([]Var, len(names))
+	for i, name := range names {
+		v, ok := findVar(ddi, strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unrecognized variable %s", name)
+		}
+		vars[i] = v
+	}
+	scanners, totRows, err := scanRows(datFileName, ddi, func() *freqScanner {
+		fs := &freqScanner{vars: vars, policies: np.varPolicies(vars), counts: make([]map[string]int, len(vars))}
+		for i := range fs.counts {
+			fs.counts[i] = make(map[string]int)
+		}
+		return fs
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]FreqTable, len(vars))
+	for i, v := range vars {
+		counts := make(map[string]int)
+		for _, fs := range scanners {
+			for val, n := range fs.counts[i] {
+				counts[val] += n
+			}
+		}
+		labels := catLabels(v)
+		t := FreqTable{Var: v, Rows: totRows}
+		for val, n := range counts {
+			t.Counts = append(t.Counts, FreqCount{Value: val, Label: labels[val], Count: n})
+		}
+		slices.SortFunc(t.Counts, func(a, b FreqCount) int { return compareValues(v, a.Value, b.Value) })
+		tables[i] = t
+	}
+	return tables, nil
+}
+
+// catLabels returns the category labels of a variable, keyed by their values, formatted as field values
+// are (see freqValue)
+func catLabels(v Var) map[string]string {
+	labels := make(map[string]string)
+	for _, c := range v.Cats {
+		val, err := freqValue(Var{VType: v.VType}, []byte(c.Val))
+		if err != nil {
+			val = strings.TrimSpace(c.Val)
+		}
+		labels[val] = c.Label
+	}
+	return labels
+}
+
+// compareValues orders two values of a variable: numerically, for numeric variables, and as strings
+// otherwise; blank values ("") come last
+func compareValues(v Var, a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	}
+	if v.VType.VarType != "character" {
+		x, errX := strconv.ParseFloat(a, 64)
+		y, errY := strconv.ParseFloat(b, 64)
+		if errX == nil && errY == nil && x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,59 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+)
+
+// goField returns the Go field name of a variable: its name, in CamelCase (e.g., "INCWAGE" -> "Incwage",
+// "US2019A_AGE" -> "Us2019aAge"), prefixed by "V" if it doesn't start with a letter
+func goField(name string) string {
+	field := ormClass(name)
+	if len(field) == 0 || field[0] < 'A' || field[0] > 'Z' {
+		field = "V" + field
+	}
+	return field
+}
+
+// emitGoStruct generates the Go source of a struct type holding a row of the extract, as scanned by
+// RowReader.Scan: a field per variable, tagged with its name; numeric fields are pointers, nil for blank
+// fields, of float64s for variables of implied decimals, or else int64s, and character fields are strings
+// ("" for blank fields). The struct is of package ipums, named Row.
+//
+// returns error for aggregate extracts, whose comma-delimited rows aren't read by RowReader
+func emitGoStruct(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	if ddi.Flavor == AGGREGATE {
+		return nil, fmt.Errorf("rows of aggregate extracts aren't read by RowReader; only fixed-width (microdata) files are")
+	}
+	var src strings.Builder
+	src.WriteString("// Code generated by ipums2db; DO NOT EDIT.\n\n")
+	src.WriteString("package ipums\n\n")
+	dat := "the extract"
+	if len(datFileName) != 0 {
+		dat = InputName(datFileName)
+	}
+	src.WriteString(fmt.Sprintf("// Row is a row of %s, as scanned by ipums2db's RowReader.Scan\n", dat))
+	src.WriteString("type Row struct {\n")
+	taken := make(map[string]bool, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		field := goField(v.Name)
+		for n := 2; taken[field]; n++ {
+			field = goField(v.Name) + strconv.Itoa(n)
+		}
+		taken[field] = true
+		goType := "*int64"
+		switch {
+		case v.VType.VarType == "character":
+			goType = "string"
+		case v.DecimalPoint > 0:
+			goType = "*float64"
+		}
+		src.WriteString(fmt.Sprintf("\t%s %s `ipums:%s` // %s\n", field, goType, strconv.Quote(v.Name), strings.Join(strings.Fields(v.Label), " ")))
+	}
+	src.WriteString("}\n")
+	return format.Source([]byte(src.String()))
+}
@@ -0,0 +1,228 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// grantPrivileges are the privileges accepted by the -grant flag; "all" grants every privilege on a table
+var grantPrivileges = []string{"select", "insert", "update", "delete", "all"}
+
+// Grant is a set of privileges granted to a role (or user) on every object created by the DDL (see CreateGrants)
+type Grant struct {
+	Privileges []string // lowercased privileges, in grantPrivileges
+	Role       string
+}
+
+// dbObject is a table, or view, created by the DDL
+type dbObject struct {
+	name string
+	view bool
+}
+
+// ParseGrantFlag parses the -grant flag argument, a comma-delimited list of privilege:role pairs (e.g.,
+// "select:analytics_ro,all:etl_rw"), into a Grant per role, in order of first appearance; the privileges
+// of a role named more than once are merged.
+//
+// returns error if a pair is malformed, a privilege isn't in grantPrivileges, or a role isn't a valid name
+func ParseGrantFlag(grantF string) ([]Grant, error) {
+	if len(strings.TrimSpace(grantF)) == 0 {
+		return nil, nil
+	}
+	var grants []Grant
+	for _, pair := range strings.Split(grantF, ",") {
+		priv, role, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		priv, role = strings.ToLower(strings.TrimSpace(priv)), strings.TrimSpace(role)
+		if !ok || len(priv) == 0 || len(role) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form privilege:role", pair)
+		}
+		if !slices.Contains(grantPrivileges, priv) {
+			return nil, fmt.Errorf("privilege '%s' not in {'%s'}", priv, strings.Join(grantPrivileges, "', '"))
+		}
+		if !identifierRe.MatchString(role) {
+			return nil, fmt.Errorf("'%s' is not a valid role name (letters, digits, and underscores only)", role)
+		}
+		i := slices.IndexFunc(grants, func(g Grant) bool { return g.Role == role })
+		if i < 0 {
+			grants = append(grants, Grant{Role: role})
+			i = len(grants) - 1
+		}
+		if !slices.Contains(grants[i].Privileges, priv) {
+			grants[i].Privileges = append(grants[i].Privileges, priv)
+		}
+	}
+	return grants, nil
+}
+
+// createdObjects returns the tables and views created by the DDL of a data dictionary, in order of creation:
+// the main table, long-format tables, ref_tables (or dimension tables, in the star model), doc tables, the
+// ipums2db_meta table, and the households view
+func (dbf *DatabaseFormatter) createdObjects(ddi *DataDict) []dbObject {
+	objects := []dbObject{{name: dbf.ident(dbf.TableName)}}
+	if dbf.RepWeights.long() {
+		for _, g := range dbf.RepWeights.groupList {
+			objects = append(objects, dbObject{name: dbf.repWeightTable(g)})
+		}
+	}
+	if dbf.Melts != nil {
+		for _, g := range dbf.Melts.groups {
+			objects = append(objects, dbObject{name: dbf.meltTable(g)})
+		}
+	}
+	if dbf.QFlags.side() {
+		objects = append(objects, dbObject{name: dbf.qflagTable()})
+	}
+	if dbf.VarGroups != nil {
+		for _, g := range dbf.VarGroups.groupList {
+			objects = append(objects, dbObject{name: dbf.varGroupTable(g)})
+		}
+	}
+	for _, v := range ddi.Vars {
+		switch {
+		case dbf.isDimension(v):
+			objects = append(objects, dbObject{name: dbf.dimTableName(v)})
+		case dbf.Model != MODEL_STAR && dbf.hasRefTable(v):
+			objects = append(objects, dbObject{name: dbf.refTableName(v)})
+		}
+	}
+	if dbf.DocTables {
+		for _, t := range dbf.docTables(ddi) {
+			if len(t.rows) != 0 {
+				objects = append(objects, dbObject{name: t.name})
+			}
+		}
+	}
+	if dbf.Meta != nil {
+		objects = append(objects, dbObject{name: dbf.ident(metaTableName)})
+	}
+	if dbf.HouseholdKeys {
+		objects = append(objects, dbObject{name: dbf.ident(dbf.derivedName("households")), view: true})
+	}
+	return objects
+}
+
+// CreateGrants generates the "GRANT" statements of dbf.Grants, on every table and view created by the DDL
+// (see createdObjects), in the syntax of the database system (note: statement terminator (e.g., ";") is
+// included). Views aggregate the main table, so they can't be written to; only their SELECT privilege is
+// granted. For example, -grant select:analytics_ro,all:etl_rw would generate, in postgres:
+//
+// GRANT SELECT ON ipums_tab TO analytics_ro;
+// GRANT ALL PRIVILEGES ON ipums_tab TO etl_rw;
+//
+// returns empty byte slice if there are no grants
+func (dbf *DatabaseFormatter) CreateGrants(ddi *DataDict) []byte {
+	if len(dbf.Grants) == 0 {
+		return []byte{}
+	}
+	var grants strings.Builder
+	grants.WriteString("-- privileges\n")
+	for _, g := range dbf.Grants {
+		for _, obj := range dbf.createdObjects(ddi) {
+			privs := dbf.grantPrivilegeList(g.Privileges)
+			if obj.view {
+				privs = "SELECT"
+			}
+			grants.WriteString(fmt.Sprintf("GRANT %s ON %s TO %s;\n", privs, dbf.grantTarget(obj), dbf.grantee(g.Role)))
+		}
+	}
+	grants.WriteString("\n")
+	return []byte(grants.String())
+}
+
+// grantPrivilegeList returns the privileges of a grant, as listed in a "GRANT" statement (e.g., "SELECT, INSERT");
+// "all" stands for every privilege. In SQL Server, ALL is deprecated, so the table privileges are listed instead.
+func (dbf *DatabaseFormatter) grantPrivilegeList(privileges []string) string {
+	if slices.Contains(privileges, "all") {
+		if dbf.DbType == MSSQL {
+			return "SELECT, INSERT, UPDATE, DELETE, REFERENCES"
+		}
+		return "ALL PRIVILEGES"
+	}
+	upper := make([]string, len(privileges))
+	for i, p := range privileges {
+		upper[i] = strings.ToUpper(p)
+	}
+	return strings.Join(upper, ", ")
+}
+
+// grantTarget returns the object of a "GRANT" statement; snowflake names the kind of object
+func (dbf *DatabaseFormatter) grantTarget(obj dbObject) string {
+	if dbf.DbType != SNOWFLAKE {
+		return obj.name
+	}
+	if obj.view {
+		return "VIEW " + obj.name
+	}
+	return "TABLE " + obj.name
+}
+
+// grantee returns the grantee of a "GRANT" statement; in snowflake, privileges are granted to roles
+func (dbf *DatabaseFormatter) grantee(role string) string {
+	if dbf.DbType == SNOWFLAKE {
+		return "ROLE " + role
+	}
+	return role
+}
+
+// CreateOwnership generates the statements handing every object created by the DDL (see createdObjects), and
+// the ref_table schema, if created, over to dbf.Owner, in the syntax of the database system (note: statement
+// terminator (e.g., ";") is included); dumps are typically run by an administrator, but owned by an
+// application role. For example, -owner census_app would generate, in postgres:
+//
+// ALTER TABLE ipums_tab OWNER TO census_app;
+//
+// returns empty byte slice if there is no owner
+func (dbf *DatabaseFormatter) CreateOwnership(ddi *DataDict) []byte {
+	if len(dbf.Owner) == 0 {
+		return []byte{}
+	}
+	var owner strings.Builder
+	owner.WriteString("-- ownership\n")
+	if len(dbf.CreateRefSchema()) != 0 {
+		owner.WriteString(dbf.ownershipStatement("SCHEMA", dbf.ident(dbf.RefSchema)))
+	}
+	for _, obj := range dbf.createdObjects(ddi) {
+		kind := "TABLE"
+		if obj.view {
+			kind = "VIEW"
+		}
+		owner.WriteString(dbf.ownershipStatement(kind, obj.name))
+	}
+	owner.WriteString("\n")
+	return []byte(owner.String())
+}
+
+// ownershipStatement returns the statement handing an object of a kind (TABLE, VIEW, or SCHEMA) over to dbf.Owner
+func (dbf *DatabaseFormatter) ownershipStatement(kind, name string) string {
+	switch dbf.DbType {
+	case MSSQL:
+		if kind == "SCHEMA" {
+			return fmt.Sprintf("ALTER AUTHORIZATION ON SCHEMA::%s TO %s;\n", name, dbf.Owner)
+		}
+		return fmt.Sprintf("ALTER AUTHORIZATION ON OBJECT::%s TO %s;\n", name, dbf.Owner)
+	case SNOWFLAKE:
+		return fmt.Sprintf("GRANT OWNERSHIP ON %s %s TO ROLE %s COPY CURRENT GRANTS;\n", kind, name, dbf.Owner)
+	default:
+		return fmt.Sprintf("ALTER %s %s OWNER TO %s;\n", kind, name, dbf.Owner)
+	}
+}
+
+// checkOwner ensures that dbf.Owner, if set, is a valid role name, and that objects can change hands in the
+// database system: in oracle, objects belong to the schema (user) they're created in, and mysql has no owners
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkOwner() error {
+	if len(dbf.Owner) == 0 {
+		return nil
+	}
+	if !identifierRe.MatchString(dbf.Owner) {
+		return fmt.Errorf("'%s' is not a valid role name (letters, digits, and underscores only)", dbf.Owner)
+	}
+	if dbf.DbType == ORACLE || dbf.DbType == MYSQL {
+		return fmt.Errorf("objects have no owner to assign in %s; grant privileges instead (see -grant)", dbf.DbType)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// hashChars is the number of hex digits of hashed identifiers (80 bits); collisions are
+// vanishingly unlikely, even among billions of distinct values
+const hashChars = 20
+
+// Hasher pseudonymizes identifier variables (e.g., SERIAL, CBSERIAL), replacing each value with its
+// salted hash: the same value always hashes alike (given the same salt), so hashed identifiers can
+// still be joined on, across record types and extracts, but can't be traced back to the originals
+// without the salt.
+type Hasher struct {
+	salt []byte
+	vars map[string]bool // lowercased variable names
+}
+
+// NewHasher returns a Hasher of the comma-delimited variables of the -hash-vars flag argument,
+// salted with salt; if no variables are given, it returns nil (nothing is hashed).
+//
+// returns error if variables are given without a salt; unsalted hashes of identifiers (often
+// small, sequential numbers) are reversed by hashing every possible value
+func NewHasher(hashVarsF, salt string) (*Hasher, error) {
+	if len(strings.TrimSpace(hashVarsF)) == 0 {
+		return nil, nil
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("hashing identifiers requires a salt (-salt, or the IPUMS2DB_SALT environment variable)")
+	}
+	h := &Hasher{salt: []byte(salt), vars: make(map[string]bool)}
+	for _, name := range strings.Split(hashVarsF, ",") {
+		h.vars[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return h, nil
+}
+
+// hashes reports whether a variable is hashed
+func (h *Hasher) hashes(v Var) bool {
+	return h != nil && h.vars[strings.ToLower(v.Name)]
+}
+
+// sum returns the hash of a (non-null) value of a variable. Values are hashed in a canonical form,
+// so that they hash alike whatever their width: numbers as formatted by fixedWidthNumber (e.g.,
+// "0001234" -> "1234"), and strings with surrounding blanks trimmed.
+//
+// returns error if a numeric variable's value is not a number
+func (h *Hasher) sum(v Var, field string, dcml int) (string, error) {
+	val := strings.TrimSpace(field)
+	if v.VType.VarType != "character" {
+		num, err := fixedWidthNumber([]byte(val), dcml)
+		if err != nil {
+			return "", fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		val = num
+	}
+	mac := hmac.New(sha256.New, h.salt)
+	mac.Write([]byte(val))
+	return hex.EncodeToString(mac.Sum(nil))[:hashChars], nil
+}
+
+// checkHashVars ensures that every hashed variable is in the data dictionary
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkHashVars(ddi *DataDict) error {
+	if dbf.Hash == nil {
+		return nil
+	}
+	for name := range dbf.Hash.vars {
+		if !slices.ContainsFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) }) {
+			return fmt.Errorf("cannot hash unrecognized variable %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Formats of a preview of rows (see Head.Write)
+const (
+	HEAD_TABLE string = "table" // aligned columns, headed by the variable names; the default
+	HEAD_CSV   string = "csv"   // comma-delimited, with a header row
+	HEAD_JSON  string = "json"  // an array of objects, keyed by variable name
+)
+
+// HeadFormats are the formats of a preview of rows
+var HeadFormats = []string{HEAD_TABLE, HEAD_CSV, HEAD_JSON}
+
+// Head holds the first rows of a fixed-width file, decoded (see ReadHead)
+type Head struct {
+	Vars []Var
+	Rows [][]string // a value per variable, in the order of Vars; blank fields are ""
+}
+
+// ReadHead decodes the first n rows of a fixed-width file (gzip compressed, if it ends with ".gz"), reading
+// no further: fields are decoded as they'd be loaded under a null policy (the default, if nil), null fields
+// being blank, and values are trimmed, and numeric ones have their implied decimals applied, and leading
+// zeros trimmed. If labels is set, values are replaced by their category labels, if any. Only the named
+// variables (case-insensitive) are decoded, in the order named; every variable, if none are named.
+//
+// returns error if a variable isn't in the data dictionary, or if a row can't be read or decoded (as a ParseError)
+func ReadHead(datFileName string, ddi *DataDict, names []string, n int, labels bool, np *NullPolicy) (Head, error) {
+	if ddi.Flavor == AGGREGATE {
+		return Head{}, fmt.Errorf("aggregate extracts are comma-delimited; only fixed-width (microdata) files are previewed")
+	}
+	head := Head{Vars: ddi.Vars}
+	if len(names) != 0 {
+		head.Vars = make([]Var, len(names))
+		for i, name := range names {
+			v, ok := findVar(ddi, strings.TrimSpace(name))
+			if !ok {
+				return Head{}, fmt.Errorf("unrecognized variable %s", name)
+			}
+			head.Vars[i] = v
+		}
+	}
+	if err := np.check(ddi); err != nil {
+		return Head{}, err
+	}
+	policies := np.varPolicies(head.Vars)
+	// a nil map per variable, unless values are replaced by labels
+	catLabelsOf := make([]map[string]string, len(head.Vars))
+	for i, v := range head.Vars {
+		if labels {
+			catLabelsOf[i] = catLabels(v)
+		}
+	}
+
+	datFile, err := os.Open(datFileName)
+	if err != nil {
+		return Head{}, err
+	}
+	defer datFile.Close()
+	var r io.Reader = datFile
+	if strings.HasSuffix(datFileName, ".gz") {
+		zr, err := gzip.NewReader(datFile)
+		if err != nil {
+			return Head{}, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	rowChars := BytesPerRow(ddi) - 1
+	in := bufio.NewReaderSize(r, max(1<<16, rowChars+2))
+	for len(head.Rows) < n {
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return Head{}, &ParseError{Err: fmt.Errorf("line %d is longer than the %d characters described by the data dictionary", len(head.Rows)+1, rowChars)}
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Head{}, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		row := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(row) != rowChars {
+			return Head{}, &ParseError{Err: fmt.Errorf("line %d holds %d characters, but the data dictionary describes %d", len(head.Rows)+1, len(row), rowChars)}
+		}
+		vals := make([]string, len(head.Vars))
+		for i, v := range head.Vars {
+			val, err := policyValue(v, row[v.Location.Start-1:v.Location.End], policies[i])
+			if err != nil {
+				return Head{}, &ParseError{Err: fmt.Errorf("line %d: variable %s: %w", len(head.Rows)+1, v.Name, err)}
+			}
+			if label, ok := catLabelsOf[i][val]; ok {
+				val = label
+			}
+			vals[i] = val
+		}
+		head.Rows = append(head.Rows, vals)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return head, nil
+}
+
+// Write writes the rows of the preview to w, in a format (see HeadFormats). In JSON, blank fields are null,
+// and numeric values are numbers, unless replaced by category labels.
+//
+// returns error if the format isn't recognized, or w can't be written to
+func (h Head) Write(w io.Writer, format string) error {
+	names := make([]string, len(h.Vars))
+	for i, v := range h.Vars {
+		names[i] = v.Name
+	}
+	switch format {
+	case HEAD_CSV:
+		cw := csv.NewWriter(w)
+		cw.Write(names)
+		cw.WriteAll(h.Rows)
+		return cw.Error()
+	case HEAD_JSON:
+		// objects are written by hand, so that their keys follow the order of the variables
+		bw := bufio.NewWriter(w)
+		bw.WriteString("[")
+		for r, row := range h.Rows {
+			pairs := make([]string, len(row))
+			for i, val := range row {
+				jv := []byte("null")
+				switch {
+				case len(val) == 0:
+				case h.Vars[i].VType.VarType != "character" && json.Valid([]byte(val)):
+					jv = []byte(val)
+				default:
+					jv, _ = json.Marshal(val)
+				}
+				key, _ := json.Marshal(names[i])
+				pairs[i] = fmt.Sprintf("%s: %s", key, jv)
+			}
+			if r > 0 {
+				bw.WriteString(",")
+			}
+			bw.WriteString("\n  {" + strings.Join(pairs, ", ") + "}")
+		}
+		bw.WriteString("\n]\n")
+		return bw.Flush()
+	case HEAD_TABLE, "":
+		widths := make([]int, len(names))
+		for i, name := range names {
+			widths[i] = len(name)
+			for _, row := range h.Rows {
+				widths[i] = max(widths[i], len(row[i]))
+			}
+		}
+		bw := bufio.NewWriter(w)
+		writeLine := func(vals []string) {
+			cells := make([]string, len(vals))
+			for i, val := range vals {
+				// numeric columns are right-aligned, so that their decimal points line up
+				if h.Vars[i].VType.VarType != "character" {
+					cells[i] = fmt.Sprintf("%*s", widths[i], val)
+				} else {
+					cells[i] = fmt.Sprintf("%-*s", widths[i], val)
+				}
+			}
+			bw.WriteString(strings.TrimRight(strings.Join(cells, "  "), " ") + "\n")
+		}
+		writeLine(names)
+		for _, row := range h.Rows {
+			writeLine(row)
+		}
+		return bw.Flush()
+	default:
+		return fmt.Errorf("format '%s' not in {'%s'}", format, strings.Join(HeadFormats, "', '"))
+	}
+}
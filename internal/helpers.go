@@ -4,6 +4,7 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"slices"
@@ -20,14 +21,37 @@ const maxBytesofDatFileInMemory = (1 << 20) * 100
 // per parsing job, the size of the parsed results buffered channel, and the number of
 // parsers. A number of arbitrary decisions are made, but they should work for a number of
 // different users. Hopefully :)
+//
+// To set any of them instead, see NewUserJobConfig.
 func NewJobConfig(totBytes int, nWriters int) JobConfig {
+	jc, _ := NewUserJobConfig(JobConfig{}, totBytes, nWriters)
+	return jc
+}
+
+// NewUserJobConfig returns a JobConfig honoring the fields set (non-zero) in user, and deciding on the
+// rest as NewJobConfig does; the max bytes per job are decided given the number of parsers, whether set
+// or not. Set fields are used as they are: they're not adapted to the file (see BytesPerJob), but checked
+// against it by Validate.
+//
+// returns error if any field of user is negative
+func NewUserJobConfig(user JobConfig, totBytes int, nWriters int) (JobConfig, error) {
+	switch {
+	case user.NumParsers < 0:
+		return JobConfig{}, fmt.Errorf("number of parsers (%d) cannot be negative", user.NumParsers)
+	case user.MaxBytesPerJob < 0:
+		return JobConfig{}, fmt.Errorf("bytes per job (%d) cannot be negative", user.MaxBytesPerJob)
+	case user.ParsedResChanSize < 0:
+		return JobConfig{}, fmt.Errorf("parsed result buffer size (%d) cannot be negative", user.ParsedResChanSize)
+	}
 	// decide on NumParsers
 	// there should be 5 parsers at max and 2 parsers at minimum; writes will be the bottleneck.
 	// note that this is an arbitrary selection, but 5 performs pretty well.
 	MINPARSERS, MAXPARSERS := 2, 5
 	nCPU := runtime.NumCPU()
 	nParsers := 1
-	if nCPU > nParsers {
+	if user.NumParsers > 0 {
+		nParsers = user.NumParsers
+	} else if nCPU > nParsers {
 		nCPUsSaveParseWrite := nCPU - nWriters - nParsers
 		if nCPUsSaveParseWrite > 0 {
 			chooseFrom := []int{nCPUsSaveParseWrite, MAXPARSERS}
@@ -38,6 +62,9 @@ func NewJobConfig(totBytes int, nWriters int) JobConfig {
 	}
 	// ParsedResChanrSize will just be the size of nParsers
 	parsedResChanSize := nParsers
+	if user.ParsedResChanSize > 0 {
+		parsedResChanSize = user.ParsedResChanSize
+	}
 	// decide on MaxBytesPerJob
 	// at any given moment, at most I'd like there to be at most maxBytesofDatFileInMemory bytes
 	// of the dat file in memory. This means that, the max number of bytes
@@ -50,12 +77,56 @@ func NewJobConfig(totBytes int, nWriters int) JobConfig {
 	if maxBPerJ > totBytes {
 		maxBPerJ = totBytes
 	}
+	if user.MaxBytesPerJob > 0 {
+		maxBPerJ = user.MaxBytesPerJob
+	}
 
 	return JobConfig{
 		ParsedResChanSize: parsedResChanSize,
 		NumParsers:        nParsers,
 		MaxBytesPerJob:    maxBPerJ,
+		userParsers:       user.NumParsers > 0,
+		userBytesPerJob:   user.MaxBytesPerJob > 0,
+	}, nil
+}
+
+// bytesPerVarCost is the estimated cost of formatting a single field, in bytes of fixed-width data taking as
+// long to process; each field makes a value, a delimiter, and possibly quotes and escapes in the SQL, apart
+// from being parsed and checked, so rows of many narrow variables cost much more than their width.
+const bytesPerVarCost = 24
+
+// minJobsPerParser and minRowsPerJob balance jobs among parsers: files are split into at least minJobsPerParser
+// jobs per parser, so that no parser is left with a large share of the file while others idle, but jobs are
+// kept to at least minRowsPerJob rows (if the file holds that many), so that they're worth sending.
+const (
+	minJobsPerParser = 4
+	minRowsPerJob    = 1000
+)
+
+// BytesPerJob adapts the size of parsing jobs to the cost of the rows of a fixed-width file of totRows rows,
+// each bytesPerRow bytes (chars + newline) of nVars variables, returning the max bytes per job (a multiple
+// of bytesPerRow). Each row costs its bytes, plus bytesPerVarCost per variable; jobs hold as many rows as
+// cost MaxBytesPerJob (see bytesPerVarCost), so that narrow-but-deep and wide-but-shallow files alike make
+// jobs of similar cost, and similar generated SQL size. Jobs are further split for balance among parsers
+// (see minJobsPerParser), but kept to at least minRowsPerJob rows, up to totRows: the MaxBytesPerJob of a
+// small file is its size (see NewUserJobConfig), which its rows' cost would otherwise split into jobs of a row
+// or so, each making an insert of its own. Lastly, jobs are capped by the split limits of insertion files (see
+// OutputSplit.MaxBytesPerJob).
+//
+// If MaxBytesPerJob was set by the user (see NewUserJobConfig), it's used as is (see Validate), in whole
+// rows, up to the size of the file.
+func (jc JobConfig) BytesPerJob(bytesPerRow, nVars, totRows int, split OutputSplit) int {
+	if jc.userBytesPerJob {
+		return min(jc.MaxBytesPerJob/bytesPerRow, totRows) * bytesPerRow
 	}
+	rowCost := bytesPerRow + bytesPerVarCost*nVars
+	rowsPerJob := max(jc.MaxBytesPerJob/rowCost, 1)
+	// balance among parsers, without making jobs too small to be worth it
+	balanced := (totRows + minJobsPerParser*jc.NumParsers - 1) / (minJobsPerParser * jc.NumParsers)
+	rowsPerJob = min(rowsPerJob, max(balanced, minRowsPerJob))
+	rowsPerJob = max(rowsPerJob, minRowsPerJob)
+	rowsPerJob = max(min(rowsPerJob, totRows), 1)
+	return split.MaxBytesPerJob(rowsPerJob*bytesPerRow, bytesPerRow)
 }
 
 // A JobConfig determines the size of the parsed results buffered channel, the
@@ -65,26 +136,59 @@ type JobConfig struct {
 	ParsedResChanSize int
 	NumParsers        int
 	MaxBytesPerJob    int
+
+	// whether NumParsers and MaxBytesPerJob were set by the user, rather than decided (see NewUserJobConfig)
+	userParsers, userBytesPerJob bool
 }
 
-// TotalBytes returns the total bytes in the fixed width file.
+// Validate checks that the JobConfig works for an extract: jobs set by the user must hold at least a row (see
+// BytesPerRow; decided jobs always hold one, see BytesPerJob), and, if -split-rows is set, no more rows than
+// an insertion file (a job's rows are inserted by a single statement). Aggregate extracts are read
+// sequentially, by a single parser, in blocks of records (see rowsPerCSVBlock), so neither can be set for
+// them. Jobs larger than the file simply hold all of it.
+//
+// returns error if not the case
+func (jc JobConfig) Validate(ddi *DataDict, split OutputSplit) error {
+	if ddi.Flavor == AGGREGATE {
+		switch {
+		case jc.userParsers && jc.NumParsers > 1:
+			return fmt.Errorf("aggregate extracts are read by a single parser, not %d", jc.NumParsers)
+		case jc.userBytesPerJob:
+			return fmt.Errorf("aggregate extracts are read in blocks of records, not by bytes per job")
+		}
+		return nil
+	}
+	bytesPerRow := BytesPerRow(ddi)
+	switch {
+	case jc.NumParsers < 1:
+		return fmt.Errorf("number of parsers (%d) must be at least 1", jc.NumParsers)
+	case jc.userBytesPerJob && jc.MaxBytesPerJob < bytesPerRow:
+		return fmt.Errorf("bytes per job (%d) cannot hold a single row (%d bytes)", jc.MaxBytesPerJob, bytesPerRow)
+	case jc.userBytesPerJob && split.Rows > 0 && jc.MaxBytesPerJob/bytesPerRow > split.Rows:
+		return fmt.Errorf("bytes per job (%d) hold %d rows, more than the %d rows per insertion file (-split-rows)",
+			jc.MaxBytesPerJob, jc.MaxBytesPerJob/bytesPerRow, split.Rows)
+	}
+	return nil
+}
+
+// TotalBytes returns the total bytes in the fixed width file (local, or at an HTTP(S) URL; see OpenDat).
 // Returns err if file cannot be opened.
 func TotalBytes(datFileName string) (int, error) {
-	datFile, err := os.Open(datFileName)
+	datFile, err := OpenDat(datFileName)
 	if err != nil {
 		return 0, err
 	}
 	defer datFile.Close()
 
-	stats, err := datFile.Stat()
+	totBytes, err := datFile.Size()
 	if err != nil {
 		return 0, err
 	}
-	totBytes := stats.Size()
 	return int(totBytes), nil
 }
 
-// PrintFinalSummary prints the time elapsed for a parsing job, as well as the MiB parsed per second
+// PrintFinalSummary prints the time elapsed for a parsing job, as well as the MiB parsed per second;
+// on a terminal, it replaces the loading message, in green
 func PrintFinalSummary(silent bool, start, end time.Time, totBytes int) {
 	if silent {
 		return
@@ -92,27 +196,30 @@ func PrintFinalSummary(silent bool, start, end time.Time, totBytes int) {
 	timeElapsed := end.Sub(start).Round(time.Millisecond)
 	bytesInMiB := 1 << 20
 	MiBPerSec := float64(totBytes) / timeElapsed.Seconds() / float64(bytesInMiB)
-	fmt.Printf("\rTime elapsed: %v (%.2f MiB/s)\n", timeElapsed, MiBPerSec)
+	summary := fmt.Sprintf("Time elapsed: %v (%.2f MiB/s)", timeElapsed, MiBPerSec)
+	fmt.Printf("%s%s\n", ClearLine(os.Stdout), styled(os.Stdout, styleGreen, summary))
 }
 
-// PrintJobSummary prints the summary for a program run.
+// PrintJobSummary prints the summary for a program run, with its keys in cyan on a terminal.
 // if silent, then the summary is not printed.
 func PrintJobSummary(silent bool, delim, dbT, tabN, idx, ddi, datFN string) {
 	if silent {
 		return
 	}
 	delimLong := strings.Repeat(delim, len(datFN)+5) // includes the "dat: " chars, so add 5
+	key := func(k string) string { return styled(os.Stdout, styleCyan, k) }
 	fmt.Printf(
-		"%s\ndbT: %s\ntab: %s\nidx: %s\nxml: %s\ndat: %s\n%s\n",
-		delimLong, dbT, tabN, idx, ddi, datFN, delimLong,
+		"%s\n%s %s\n%s %s\n%s %s\n%s %s\n%s %s\n%s\n",
+		delimLong, key("dbT:"), dbT, key("tab:"), tabN, key("idx:"), idx, key("xml:"), ddi, key("dat:"), datFN, delimLong,
 	)
 }
 
-// PrintLoadingMessage prints a loading message while the program runs.
-// Prints nothng if silent.
+// PrintLoadingMessage prints a loading message while the program runs, updating it in place.
+// Prints nothng if silent, or if stdout isn't a terminal (e.g., piped to a log file), where the
+// updates would pile up.
 // Should be ran as a goroutine.
 func PrintLoadingMessage(silent bool) {
-	if silent {
+	if silent || !IsInteractive(os.Stdout) {
 		return
 	}
 	printStatement := []byte("I-P-U-M-S-!")
@@ -127,33 +234,54 @@ func PrintLoadingMessage(silent bool) {
 	}
 }
 
-// MkDDL writes the DDL statement only; used for when only -x flag is passed, and not dat file arg
-func MkDDL(dbType, tabName, ddiFileName, outFileName string, idx []string, silence bool) error {
-	// DatabaseFormatter
-	dbfmtr, err := NewDBFormatter(dbType, tabName, true)
-	if err != nil {
-		return err
-	}
-	// DataDict
-	ddi, err := NewDataDict(ddiFileName)
-	if err != nil {
-		return err
-	}
-	// DDL writer
-	// change dat conversion default schema gen default
+// logJobs logs each ParsedResult to w (its job, rows, parsing time, and bytes), as it
+// passes from parsedStream to the returned channel, which is closed once parsedStream is closed. Results
+// with errors are passed on unlogged, to be reported by the writers.
+func logJobs(w io.Writer, parsedStream <-chan ParsedResult) <-chan ParsedResult {
+	logged := make(chan ParsedResult, cap(parsedStream))
+	go func() {
+		defer close(logged)
+		for res := range parsedStream {
+			if res.AnyError == nil {
+				nBytes := len(res.Block)
+				for _, s := range res.Shards {
+					nBytes += len(s.Block)
+				}
+				fmt.Fprintf(w, "job %d: %d rows parsed in %v, %d bytes\n", res.Index, res.Rows, res.ParseTime.Round(time.Microsecond), nBytes)
+			}
+			logged <- res
+		}
+	}()
+	return logged
+}
+
+// DDLFileName returns the output file name for schema-only generation;
+// the dat conversion default ("ipums_dump.sql") is swapped for the schema default ("ipums_DDL.sql")
+func DDLFileName(outFileName string) string {
 	if outFileName == "ipums_dump.sql" {
-		outFileName = "ipums_DDL.sql"
+		return "ipums_DDL.sql"
 	}
+	return outFileName
+}
+
+// MkDDL writes the DDL statement only; used for when only -x flag is passed, and not dat file arg
+func MkDDL(dbfmtr *DatabaseFormatter, ddi *DataDict, outFileName string, idx []string, silence bool) error {
+	// DDL writer
+	outFileName = DDLFileName(outFileName)
 	dw, err := NewDumpWriterDDLOnly(outFileName)
 	if err != nil {
 		return err
 	}
 	// write it all
-	err = dw.WriteDDL(dbfmtr, &ddi, idx)
+	err = dw.WriteDDL(dbfmtr, ddi, idx)
 	if err != nil {
 		dw.FileCleanup() // delete file if unable to write DDL
 		return err
 	}
+	if err = dw.Commit(); err != nil {
+		dw.FileCleanup()
+		return err
+	}
 	if !silence {
 		fmt.Printf("DDL file written to %s\n", outFileName)
 	}
@@ -0,0 +1,355 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpRetries determines the number of attempts of each request for a remote input file, retrying on
+// network errors (including responses cut short) and transient (throttling or server-side) failures,
+// with exponential backoff; each attempt resumes where the last one left off, if ranges are served
+const httpRetries = 5
+
+// httpClient requests remote input files; requests have no overall timeout, as large bodies take a while,
+// but stalled connections are given up on (and retried)
+var httpClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: time.Minute,
+	IdleConnTimeout:       90 * time.Second,
+}}
+
+// IsHTTPURL reports whether an input name is an HTTP(S) URL (e.g., "https://example.org/usa_00012.dat")
+func IsHTTPURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// InputName returns the file name of an input: the base name of its path, or of its URL's path, without
+// the query or fragment (e.g., "usa_00012.dat.gz" of "https://example.org/usa_00012.dat.gz?token=abc")
+func InputName(name string) string {
+	if IsHTTPURL(name) {
+		name, _, _ = strings.Cut(name, "#")
+		name, _, _ = strings.Cut(name, "?")
+		return path.Base(name)
+	}
+	return filepath.Base(name)
+}
+
+// transientStatus reports whether a response status is worth retrying: throttling, or a server-side failure
+func transientStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// validator returns the validator of the file of a response, so that later ranges are known to be of the
+// same file (see getRange): its ETag, if strong, or else its Last-Modified date; "" if neither is set
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// getRange requests the bytes of a URL from offset start through end (inclusive), or to the end of the
+// file, if end is negative; a start of 0 and negative end request the whole file, without a Range header.
+// Ranges are requested with If-Range set to ifRange (see validator), if set, so that the server sends the
+// whole file (status 200), rather than a range, if the file changed. Returns the response, with its body
+// unread, if its status is 200, or 206, its Content-Range starting at start.
+//
+// returns error if the request fails, or its status is otherwise (e.g., 412, if the file changed)
+func getRange(url string, start, end int64, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case end >= 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	case start > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if len(ifRange) != 0 && len(req.Header.Get("Range")) != 0 {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		// e.g., "bytes 100-199/123456"
+		var first int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &first); err != nil || first != start {
+			resp.Body.Close()
+			return nil, &httpStatusError{url: url, status: fmt.Sprintf("range starting at %d requested, but got Content-Range: %s", start, resp.Header.Get("Content-Range"))}
+		}
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, &httpStatusError{url: url, status: resp.Status + "; the file changed since it was first read"}
+	default:
+		resp.Body.Close()
+		return nil, &httpStatusError{url: url, status: resp.Status, transient: transientStatus(resp.StatusCode)}
+	}
+	return resp, nil
+}
+
+// httpStatusError is an unexpected response status; transient ones are retried
+type httpStatusError struct {
+	url       string
+	status    string
+	transient bool
+}
+
+// Error returns the URL, and the response's status
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.url, e.status)
+}
+
+// retryable reports whether a failed attempt is worth retrying: network errors are, and so are transient
+// statuses (see transientStatus); errors of local files (e.g., writing a download to a full disk) aren't
+func retryable(err error) bool {
+	var se *httpStatusError
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.As(err, &se) || se.transient
+}
+
+// withRetries runs attempt up to httpRetries times, backing off exponentially, until it succeeds, or fails
+// for good (see retryable)
+//
+// returns error if all attempts fail
+func withRetries(attempt func() error) error {
+	backoff := time.Second
+	var err error
+	for i := 1; i <= httpRetries; i++ {
+		if i > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = attempt(); err == nil || !retryable(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", httpRetries, err)
+}
+
+// httpFile is a data file served over HTTP(S), read at arbitrary offsets by range requests, as parsers
+// read local files, so that it's never stored locally (see OpenDat)
+type httpFile struct {
+	url       string
+	size      int64
+	validator string // validator of the file, as first read (see validator); ranges are of that file only
+}
+
+// httpValidators holds the validator of each URL opened (see openHTTPFile), by URL, so that a data file opened
+// several times in a run (e.g., to count its rows, then to parse it) is the same file each time
+var httpValidators sync.Map
+
+// openHTTPFile probes a URL for the size of the file it serves, whether it serves ranges of it, and its
+// validator, by requesting its first byte
+//
+// returns error if the request fails, if ranges aren't served (e.g., the response is the whole file), or if
+// the file changed since the URL was last opened
+func openHTTPFile(url string) (*httpFile, error) {
+	f := &httpFile{url: url}
+	err := withRetries(func() error {
+		resp, err := getRange(url, 0, 0, "")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return &httpStatusError{url: url, status: "ranges aren't served (" + resp.Status + ")"}
+		}
+		f.validator = validator(resp)
+		if prev, ok := httpValidators.LoadOrStore(url, f.validator); ok && prev != f.validator {
+			return &httpStatusError{url: url, status: "the file changed since it was first read"}
+		}
+		// e.g., "bytes 0-0/123456"
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if f.size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return &httpStatusError{url: url, status: "the file's size is unknown (Content-Range: " + resp.Header.Get("Content-Range") + ")"}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ServesRanges reports whether a URL serves ranges of its file, so that it can be read in place (see OpenDat)
+func ServesRanges(url string) bool {
+	_, err := openHTTPFile(url)
+	return err == nil
+}
+
+// ReadAt reads len(p) bytes of the file from offset off, by a range request; a response cut short is
+// resumed from where it left off. Ranges are only read of the file as first read (see openHTTPFile), so
+// that a file replaced on the server isn't read in pieces of either.
+//
+// returns io.EOF if fewer bytes remain in the file, or error if all attempts fail, or the file changed
+func (f *httpFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), f.size-off)
+	var n int64
+	err := withRetries(func() error {
+		resp, err := getRange(f.url, off+n, off+want-1, f.validator)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return &httpStatusError{url: f.url, status: "the file changed since it was first read, or ranges are no longer served (" + resp.Status + ")"}
+		}
+		read, err := io.ReadFull(resp.Body, p[n:want])
+		n += int64(read)
+		return err
+	})
+	if err != nil {
+		return int(n), err
+	}
+	if want < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// Size returns the size of the file, in bytes
+func (f *httpFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+// Close releases nothing; requests are made, and their connections released, by each read
+func (f *httpFile) Close() error {
+	return nil
+}
+
+// datSource is a data file read at arbitrary offsets: a local file, or one served over HTTP(S)
+type datSource interface {
+	io.ReaderAt
+	io.Closer
+	Size() (int64, error)
+}
+
+// localFile is a local data file
+type localFile struct {
+	*os.File
+}
+
+// Size returns the size of the file, in bytes
+func (f localFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// OpenDat opens a data file for reading at arbitrary offsets: a local file, an HTTP(S) URL serving ranges
+// (see ServesRanges), read in place by range requests, or the parts of a multi-part data file (see
+// JoinDatParts), read as one
+//
+// returns error if the file can't be opened
+func OpenDat(name string) (datSource, error) {
+	if IsMultiPart(name) {
+		return openMultiDat(name)
+	}
+	if IsHTTPURL(name) {
+		return openHTTPFile(name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return localFile{f}, nil
+}
+
+// openInput opens a file for reading through: a local file, or an HTTP(S) URL, streamed (e.g., a DDI)
+//
+// returns error if the file can't be opened, or all requests fail
+func openInput(name string) (io.ReadCloser, error) {
+	if !IsHTTPURL(name) {
+		return os.Open(name)
+	}
+	var resp *http.Response
+	err := withRetries(func() error {
+		var err error
+		resp, err = getRange(name, 0, -1, "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// FetchURL downloads the file served at an HTTP(S) URL into a temporary file, keeping the extension of the
+// URL's path (e.g., ".dat.gz"), for files read whole, rather than at offsets (e.g., compressed files);
+// a download cut short is resumed where it left off, if ranges are served, and the file is unchanged
+// (see validator), or else started over, so that the download is never of pieces of two files. The
+// temporary file is created in os.TempDir(); it's up to the caller to remove it.
+//
+// returns error if all attempts fail, or the file can't be written (which isn't retried)
+func FetchURL(url string) (string, error) {
+	base := InputName(url)
+	var ext string
+	if i := strings.Index(base, "."); i > 0 {
+		ext = base[i:]
+	}
+	dst, err := os.CreateTemp("", "ipums2db-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	var written int64
+	var ifRange string
+	err = withRetries(func() error {
+		resp, err := getRange(url, written, -1, ifRange)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			ifRange = validator(resp)
+		}
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			// ranges aren't served, or the file changed, so the whole file is sent again
+			if _, err := dst.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := dst.Truncate(0); err != nil {
+				return err
+			}
+			written = 0
+		}
+		n, err := io.Copy(dst, resp.Body)
+		written += n
+		return err
+	})
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
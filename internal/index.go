@@ -0,0 +1,162 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// indexMethods are the index methods (structures) of each database system, as set per index by the -i
+// flag (e.g., "year:brin"); indices without one get the database system's default (usually a b-tree)
+var indexMethods = map[string][]string{
+	POSTGRES: {"btree", "hash", "brin"},
+	MYSQL:    {"btree", "hash"},
+	ORACLE:   {"btree", "bitmap"},
+	MSSQL:    {"btree", "columnstore"},
+}
+
+// indexMethodReleases are the releases index methods need, if older ones are targeted (see DbVersion):
+// postgres hash indices aren't crash-safe (WAL-logged) before 10, and mssql columnstore indices, which
+// 2008 lacks, make their table read-only, and its inserts fail, before 2016
+var indexMethodReleases = map[string]map[string]DbVersion{
+	POSTGRES: {"hash": {10, 0, 0}},
+	MSSQL:    {"columnstore": {2016, 0, 0}},
+}
+
+// allIndexMethods lists the index methods of any database system, in order of first appearance
+var allIndexMethods = []string{"btree", "hash", "brin", "bitmap", "columnstore"}
+
+// partialIndexes are the database systems supporting partial (filtered) indices, of the rows matching a
+// predicate (see ParseIndexFlag)
+var partialIndexes = map[string]bool{POSTGRES: true, MSSQL: true}
+
+// indexWhereRe matches the WHERE keyword of a partial index's definition
+var indexWhereRe = regexp.MustCompile(`(?i)\s+WHERE\s+`)
+
+// ParseIndexFlag parses the -i flag argument, a comma-delimited list of variables (or columns) to index,
+// each optionally followed by an index method (e.g., "year:brin,serial:brin,age"), and by a predicate
+// making it a partial index, of the rows matching it (e.g., "incwage WHERE incwage < 99999998"), into a
+// slice of index definitions of the form column[:method][ WHERE predicate], methods lowercased. Commas
+// within a predicate's parentheses or quotes don't delimit definitions (e.g., "sex WHERE age IN (1, 2)").
+// Whether the database system supports a method, or partial indices, is checked as the indices are
+// created (see CreateIndices).
+//
+// returns error if a definition is malformed, a method isn't in allIndexMethods, or a predicate is empty,
+// or holds a statement terminator (;)
+func ParseIndexFlag(indF string) ([]string, error) {
+	if len(strings.TrimSpace(indF)) == 0 {
+		return []string{}, nil
+	}
+	var indices []string
+	for _, def := range splitIndexDefs(indF) {
+		col, method, pred := splitIndex(def)
+		head, _, hasPred := cutIndexWhere(def)
+		switch {
+		case len(col) == 0 || strings.ContainsAny(col, " \t"):
+			return nil, fmt.Errorf("'%s' is not of the form column[:method][ WHERE predicate]", strings.TrimSpace(def))
+		case hasPred && len(pred) == 0:
+			return nil, fmt.Errorf("index on %s: empty WHERE predicate", col)
+		case len(splitStatements(pred, ';')) > 1 || strings.HasSuffix(strings.TrimSpace(pred), ";"):
+			return nil, fmt.Errorf("index on %s: the WHERE predicate can't hold statement terminators (;)", col)
+		}
+		if strings.Contains(head, ":") {
+			if !slices.Contains(allIndexMethods, method) {
+				return nil, fmt.Errorf("index method '%s' not in {'%s'}", method, strings.Join(allIndexMethods, "', '"))
+			}
+			col += ":" + method
+		}
+		if hasPred {
+			col += " WHERE " + pred
+		}
+		indices = append(indices, col)
+	}
+	return indices, nil
+}
+
+// splitIndexDefs splits the -i flag argument into index definitions, at commas outside of parentheses
+// and quotes
+func splitIndexDefs(indF string) []string {
+	var (
+		defs    []string
+		depth   int
+		inQuote byte
+		start   int
+	)
+	for i := 0; i < len(indF); i++ {
+		switch c := indF[i]; {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth = max(depth-1, 0)
+		case c == ',' && depth == 0:
+			defs = append(defs, indF[start:i])
+			start = i + 1
+		}
+	}
+	return append(defs, indF[start:])
+}
+
+// cutIndexWhere cuts an index definition around its WHERE keyword, if any
+func cutIndexWhere(def string) (head, pred string, found bool) {
+	loc := indexWhereRe.FindStringIndex(def)
+	if loc == nil {
+		return def, "", false
+	}
+	return def[:loc[0]], def[loc[1]:], true
+}
+
+// splitIndex splits an index definition (see ParseIndexFlag) into its column, its method, lowercased, if
+// any, and its predicate, if any
+func splitIndex(def string) (string, string, string) {
+	head, pred, _ := cutIndexWhere(def)
+	col, method, _ := strings.Cut(head, ":")
+	return strings.TrimSpace(col), strings.ToLower(strings.TrimSpace(method)), strings.TrimSpace(pred)
+}
+
+// createIndex generates the "CREATE INDEX" statement of an index on a column, quoted, using a method (see
+// indexMethods): postgres' "USING method", mysql's trailing "USING METHOD", oracle's "CREATE BITMAP INDEX",
+// and mssql's "CREATE NONCLUSTERED COLUMNSTORE INDEX"; b-trees are the default elsewhere. An index with a
+// predicate is partial, ending with "WHERE predicate", written as is.
+//
+// returns error if the database system (or the release targeted, see indexMethodReleases) doesn't support
+// the method, or partial indices
+func (dbf *DatabaseFormatter) createIndex(name, col, method, pred string) (string, error) {
+	table := dbf.ident(dbf.TableName)
+	if len(method) != 0 && !slices.Contains(indexMethods[dbf.DbType], method) {
+		return "", fmt.Errorf("%s indices aren't supported by %s (index methods: {'%s'})", method, dbf.DbType, strings.Join(indexMethods[dbf.DbType], "', '"))
+	}
+	if v, ok := indexMethodReleases[dbf.DbType][method]; ok && dbf.releaseBefore(v.Major, v.Minor) {
+		return "", fmt.Errorf("%s indices need %s %s or newer (%s targeted)", method, dbf.DbType, v, dbf.DbVersion)
+	}
+	if len(pred) != 0 && !partialIndexes[dbf.DbType] {
+		return "", fmt.Errorf("partial indices (%s WHERE %s) aren't supported by %s", col, pred, dbf.DbType)
+	}
+	var stmt string
+	switch {
+	case len(method) == 0:
+		stmt = fmt.Sprintf("CREATE INDEX %s ON %s (%s)", name, table, col)
+	case dbf.DbType == POSTGRES:
+		stmt = fmt.Sprintf("CREATE INDEX %s ON %s USING %s (%s)", name, table, method, col)
+	case dbf.DbType == MYSQL:
+		stmt = fmt.Sprintf("CREATE INDEX %s ON %s (%s) USING %s", name, table, col, strings.ToUpper(method))
+	case method == "bitmap":
+		stmt = fmt.Sprintf("CREATE BITMAP INDEX %s ON %s (%s)", name, table, col)
+	case method == "columnstore":
+		stmt = fmt.Sprintf("CREATE NONCLUSTERED COLUMNSTORE INDEX %s ON %s (%s)", name, table, col)
+	default: // b-trees, the default of oracle and mssql
+		stmt = fmt.Sprintf("CREATE INDEX %s ON %s (%s)", name, table, col)
+	}
+	if len(pred) != 0 {
+		stmt += " WHERE " + pred
+	}
+	return stmt + ";\n\n", nil
+}
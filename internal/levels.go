@@ -0,0 +1,224 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A Level is a record type of a multi-level hierarchical extract (e.g., ATUS's households, persons, and
+// activities), converted into a table of its own, with the keys of its parent records (see Levels)
+type Level struct {
+	Group  RecGroup
+	Name   string   // name of the level, from its record type's label (e.g., "activity"); suffixes its table's name
+	Parent int      // index of the level of its records' parents; -1, for the top level (e.g., households)
+	Keys   []Var    // key variables of its ancestors' records, propagated down; appended past its own record
+	Dict   DataDict // data dictionary of its rows (see SplitLevels): its record type's variables, then Keys
+
+	keyFrom []int // index of the ancestor level each key is read from
+	shared  []Var // key variables of its own records, also held by its parent's records, checked alike
+	chars   int   // characters of its records, up to their type's last variable
+}
+
+// levelNameRe matches the characters of record type labels left out of level names
+var levelNameRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Levels returns the levels of a hierarchical extract, one per declared record type, in declaration order.
+// A record type's parent is the record group its recGrp attribute refers to, if any, or else the one
+// declared ahead of it (e.g., H, then P, then activities). Each level's rows are its records, followed by
+// the key variables of its ancestors' record groups (recGrp's keyvar, e.g., CASEID, or LINENO) that its
+// own record type lacks, read from the nearest ancestor holding them; linking each row to its parents'.
+//
+// returns error if the extract isn't hierarchical, declares fewer than two record types, or refers to
+// undeclared record groups
+func (dd *DataDict) Levels() ([]Level, error) {
+	switch {
+	case !dd.Hierarchical():
+		return nil, fmt.Errorf("levels apply to hierarchical extracts; the data dictionary describes a rectangular one")
+	case len(dd.RecGroups) < 2:
+		return nil, fmt.Errorf("levels need the record types declared (recGrp)")
+	}
+	levels := make([]Level, len(dd.RecGroups))
+	names := make(map[string]bool)
+	for i, g := range dd.RecGroups {
+		lvl := Level{Group: g, Parent: i - 1}
+		if parents := strings.Fields(g.Parent); len(parents) != 0 {
+			lvl.Parent = -1
+			for j, p := range dd.RecGroups {
+				if len(p.ID) != 0 && p.ID == parents[0] {
+					lvl.Parent = j
+				}
+			}
+			if lvl.Parent < 0 || lvl.Parent == i {
+				return nil, fmt.Errorf("record type %s belongs to undeclared record group %s", g.RecType, parents[0])
+			}
+		}
+		lvl.Name = strings.Trim(levelNameRe.ReplaceAllString(strings.ToLower(g.Label), "_"), "_")
+		if len(lvl.Name) == 0 || names[lvl.Name] {
+			lvl.Name = strings.ToLower(strings.TrimSpace(g.RecType))
+		}
+		names[lvl.Name] = true
+		levels[i] = lvl
+	}
+
+	for i := range levels {
+		lvl := &levels[i]
+		sub, err := dd.OfRecType(lvl.Group.RecType)
+		if err != nil {
+			return nil, err
+		}
+		lvl.chars = BytesPerRow(&sub) - max(sub.EOLBytes, 1)
+		// the ancestors of the level, nearest first, and their key variables
+		var ancestors []int
+		for p, seen := lvl.Parent, 0; p >= 0; p, seen = levels[p].Parent, seen+1 {
+			if seen == len(levels) {
+				return nil, fmt.Errorf("record type %s belongs to a cycle of record groups", lvl.Group.RecType)
+			}
+			ancestors = append(ancestors, p)
+		}
+		keyed := make(map[string]bool)
+		for _, g := range append([]int{i}, ancestors...) {
+			for _, name := range levels[g].Group.KeyVars() {
+				v, ok := findVar(dd, name)
+				if !ok || keyed[v.Name] {
+					continue
+				}
+				keyed[v.Name] = true
+				if v.inRecType(lvl.Group.RecType) {
+					if lvl.Parent >= 0 && v.inRecType(levels[lvl.Parent].Group.RecType) {
+						lvl.shared = append(lvl.shared, v)
+					}
+					continue
+				}
+				for _, a := range ancestors {
+					if v.inRecType(levels[a].Group.RecType) {
+						lvl.Keys, lvl.keyFrom = append(lvl.Keys, v), append(lvl.keyFrom, a)
+						break
+					}
+				}
+			}
+		}
+		// keys are appended past the record, in the order found
+		at := lvl.chars
+		for _, k := range lvl.Keys {
+			width := k.Location.End - k.Location.Start + 1
+			k.Location.Start, k.Location.End = at+1, at+width
+			sub.Vars = append(sub.Vars, k)
+			at += width
+		}
+		lvl.Dict = sub
+	}
+	return levels, nil
+}
+
+// SplitLevels copies the records of each level of a hierarchical fixed-width file (gzip compressed, if it
+// ends with ".gz") into a temporary file of its own (see Levels), returning the temporary files' paths, in
+// the order of the levels, and the rows of each. Records follow their parent's record; the latest record of
+// each level is held until the next one, so that its key variables are appended to its descendants'
+// records. Records of undeclared types are skipped.
+// The temporary files are created in os.TempDir(); it's up to the caller to remove them.
+//
+// returns error if the file can't be read or written, or if a line is malformed, a record precedes any
+// record of its parent's type, or its key variables don't match its parent's (as a ParseError)
+func SplitLevels(datFileName string, dd *DataDict, levels []Level) ([]string, []int, error) {
+	files := make([]*os.File, len(levels))
+	outs := make([]*bufio.Writer, len(levels))
+	rows := make([]int, len(levels))
+	fail := func(err error) ([]string, []int, error) {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				_ = os.Remove(f.Name())
+			}
+		}
+		return nil, nil, err
+	}
+	for i := range levels {
+		f, err := os.CreateTemp("", "ipums2db-*.dat")
+		if err != nil {
+			return fail(err)
+		}
+		files[i], outs[i] = f, bufio.NewWriterSize(f, 1<<20)
+	}
+
+	latest := make([][]byte, len(levels)) // the latest record of each level; nil, if none since its parent's
+	lines := make([]int, len(levels))
+	err := eachRecord(datFileName, dd, func(lineNum int, t string, row []byte) error {
+		i := -1
+		for j, lvl := range levels {
+			if strings.EqualFold(t, strings.TrimSpace(lvl.Group.RecType)) {
+				i = j
+			}
+		}
+		if i < 0 {
+			return nil
+		}
+		lvl := levels[i]
+		rec, err := cutRecord(row, lvl.chars, t, lineNum)
+		if err != nil {
+			return err
+		}
+		if lvl.Parent >= 0 {
+			parent := latest[lvl.Parent]
+			if parent == nil {
+				return &ParseError{Err: fmt.Errorf("line %d: record of type %s precedes any record of its parent type (%s)", lineNum, t, levels[lvl.Parent].Group.RecType)}
+			}
+			for _, k := range lvl.shared {
+				parentKey, key := parent[k.Location.Start-1:k.Location.End], rec[k.Location.Start-1:k.Location.End]
+				if !bytes.Equal(bytes.TrimSpace(parentKey), bytes.TrimSpace(key)) {
+					return &ParseError{Err: fmt.Errorf("line %d: %s %s doesn't match that of its parent record (line %d: %s)",
+						lineNum, k.Name, bytes.TrimSpace(key), lines[lvl.Parent], bytes.TrimSpace(parentKey))}
+				}
+			}
+		}
+		outs[i].Write(rec)
+		for k, key := range lvl.Keys {
+			outs[i].Write(latest[lvl.keyFrom[k]][key.Location.Start-1 : key.Location.End])
+		}
+		outs[i].WriteByte('\n')
+		rows[i]++
+		// the level's descendants belong to this record from now on
+		latest[i], lines[i] = append(latest[i][:0], rec...), lineNum
+		for j := range levels {
+			if isDescendant(levels, j, i) {
+				latest[j] = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	names := make([]string, len(levels))
+	for i, f := range files {
+		if flushErr := outs[i].Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		names[i] = f.Name()
+	}
+	if err != nil {
+		for _, name := range names {
+			_ = os.Remove(name)
+		}
+		return nil, nil, err
+	}
+	return names, rows, nil
+}
+
+// isDescendant reports whether the records of level j descend from those of level i
+func isDescendant(levels []Level, j, i int) bool {
+	for p, seen := levels[j].Parent, 0; p >= 0 && seen < len(levels); p, seen = levels[p].Parent, seen+1 {
+		if p == i {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// findVar returns the variable of a data dictionary with the given name (case-insensitive), if any
+func findVar(ddi *DataDict, name string) (Var, bool) {
+	i := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) })
+	if i < 0 {
+		return Var{}, false
+	}
+	return ddi.Vars[i], true
+}
+
+// householdKeyVars returns the variables identifying a household in a microdata extract: SERIAL
+// numbers households within a sample, so it's qualified by SAMPLE if included (e.g., IPUMS USA),
+// or else by YEAR and MONTH, if included (e.g., IPUMS CPS).
+//
+// returns error if the extract lacks SERIAL, or is aggregate
+func householdKeyVars(ddi *DataDict) ([]Var, error) {
+	if ddi.Flavor == AGGREGATE {
+		return nil, fmt.Errorf("household keys are for microdata extracts, not aggregate ones")
+	}
+	serial, ok := findVar(ddi, "SERIAL")
+	if !ok {
+		return nil, fmt.Errorf("household keys require the SERIAL variable")
+	}
+	var household []Var
+	if sample, ok := findVar(ddi, "SAMPLE"); ok {
+		household = append(household, sample)
+	} else {
+		for _, name := range []string{"YEAR", "MONTH"} {
+			if v, ok := findVar(ddi, name); ok {
+				household = append(household, v)
+			}
+		}
+	}
+	return append(household, serial), nil
+}
+
+// CreateLinkage generates the household-person linkage of a person-level extract, whose persons are
+// identified by their household (see householdKeyVars) and PERNUM, numbering persons within it:
+// a unique key on the person identifiers, an index on the household identifiers (but in snowflake, which
+// has no indices), and a view of households, counting their persons, with a comment documenting how to
+// join it back to the persons.
+//
+// For example, an IPUMS USA extract would generate (among others):
+//
+// ALTER TABLE ipums_tab ADD CONSTRAINT uk_ipums_tab_person UNIQUE ("sample", "serial", "pernum");
+//
+// CREATE VIEW ipums_tab_households AS
+// SELECT "sample", "serial", count(*) AS persons
+// FROM ipums_tab
+// GROUP BY "sample", "serial";
+//
+// returns empty byte slice if linkage isn't requested; error if the extract isn't person-level
+func (dbf *DatabaseFormatter) CreateLinkage(ddi *DataDict) ([]byte, error) {
+	if !dbf.HouseholdKeys {
+		return []byte{}, nil
+	}
+	household, err := householdKeyVars(ddi)
+	if err != nil {
+		return nil, err
+	}
+	person, ok := findVar(ddi, "PERNUM")
+	if !ok {
+		return nil, fmt.Errorf("household keys require the PERNUM variable of person-level extracts")
+	}
+	hhCols := make([]string, len(household))
+	for i, v := range household {
+		col, _ := dbf.factColumn(v)
+		hhCols[i] = dbf.quoteIdent(col)
+	}
+	hhKey := strings.Join(hhCols, ", ")
+	personCol, _ := dbf.factColumn(person)
+	personCol = dbf.quoteIdent(personCol)
+	table := dbf.ident(dbf.TableName)
+	view := dbf.ident(dbf.derivedName("households"))
+
+	var linkage strings.Builder
+	linkage.WriteString(fmt.Sprintf("-- household-person linkage: persons are identified by (%s, %s), and the persons of a household\n", hhKey, personCol))
+	linkage.WriteString(fmt.Sprintf("-- share (%s); %s holds one row per household. For household-level aggregation, join on the household key, e.g.:\n", hhKey, view))
+	joinOn := make([]string, len(hhCols))
+	for i, col := range hhCols {
+		joinOn[i] = fmt.Sprintf("p.%s = h.%s", col, col)
+	}
+	linkage.WriteString(fmt.Sprintf("--   SELECT h.persons, p.* FROM %s h JOIN %s p ON %s;\n", view, table, strings.Join(joinOn, " AND ")))
+	linkage.WriteString(fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s UNIQUE (%s, %s);\n\n", table, dbf.objectName(DEFAULT_PERSON_KEY, nil), hhKey, personCol))
+	if dbf.DbType != SNOWFLAKE {
+		linkage.WriteString(fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n\n", dbf.objectName(DEFAULT_HOUSEHOLD_IDX, nil), table, hhKey))
+	}
+	// in SQL Server, a view must be created in a batch of its own
+	if dbf.DbType == MSSQL {
+		linkage.WriteString("GO\n")
+	}
+	linkage.WriteString(fmt.Sprintf("CREATE VIEW %s AS\nSELECT %s, count(*) AS persons\nFROM %s\nGROUP BY %s;\n", view, hhKey, table, hhKey))
+	if dbf.DbType == MSSQL {
+		linkage.WriteString("GO\n")
+	}
+	linkage.WriteString("\n")
+	return []byte(linkage.String()), nil
+}
+
+// longTableKey returns the data dictionary indices of the variables linking the rows of a long-format
+// table (e.g., of replicate weights) to the row of the main table they belong to: the household key (see
+// householdKeyVars) and PERNUM, if included; none if the row id links them instead (see DatabaseFormatter.RowID)
+//
+// returns error if the extract can't be keyed by household
+func (dbf *DatabaseFormatter) longTableKey(ddi *DataDict) ([]int, error) {
+	if len(dbf.RowID) != 0 {
+		return nil, nil
+	}
+	household, err := householdKeyVars(ddi)
+	if err != nil {
+		return nil, err
+	}
+	if pernum, ok := findVar(ddi, "PERNUM"); ok {
+		household = append(household, pernum)
+	}
+	key := make([]int, len(household))
+	for i, v := range household {
+		key[i] = slices.IndexFunc(ddi.Vars, func(kv Var) bool { return kv.Name == v.Name })
+	}
+	return key, nil
+}
+
+// longKeyCols returns the quoted key columns of a long-format table, and their SQL types, given the
+// indices of its key variables (see longTableKey)
+func (dbf *DatabaseFormatter) longKeyCols(ddi *DataDict, key []int) ([]string, []string) {
+	if len(dbf.RowID) != 0 {
+		return []string{dbf.quoteIdent(dbf.columnName(dbf.rowIDVar()))}, []string{dbf.sqlType("bigint")}
+	}
+	cols, types := make([]string, len(key)), make([]string, len(key))
+	for i, ki := range key {
+		var col string
+		col, types[i] = dbf.factColumn(ddi.Vars[ki])
+		cols[i] = dbf.quoteIdent(col)
+	}
+	return cols, types
+}
+
+// longKeyValues formats the key of a fixed-width row, the rowNum-th of the file, as comma-separated
+// SQL literals, for the tuples of long-format tables (see longTableKey)
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) longKeyValues(ddi *DataDict, row []byte, rowNum int, key []int, colTypes map[string]string, nullPolicies []string) (string, error) {
+	if len(dbf.RowID) != 0 {
+		return strconv.Itoa(rowNum), nil
+	}
+	vals := make([]string, len(key))
+	for i, ki := range key {
+		v := ddi.Vars[ki]
+		val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[ki])
+		if err != nil {
+			return "", err
+		}
+		vals[i] = val
+	}
+	return strings.Join(vals, ","), nil
+}
+
+// createSideTable generates the "CREATE TABLE" and "CREATE INDEX" statements of a side table of the main
+// table (e.g., of data quality flags): its key (see longTableKey), then a column per variable, given the
+// indices of its key variables and variables; unlike long-format tables, it has a row per row of the main table
+func (dbf *DatabaseFormatter) createSideTable(ddi *DataDict, table, indexName string, key, idx []int) string {
+	keyCols, keyTypes := dbf.longKeyCols(ddi, key)
+	var ddl strings.Builder
+	ddl.WriteString(fmt.Sprintf("CREATE TABLE %s (", table))
+	for i, col := range keyCols {
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s,", col, keyTypes[i]))
+	}
+	for i, vi := range idx {
+		v := ddi.Vars[vi]
+		var addComma string
+		if i != len(idx)-1 {
+			addComma = ","
+		}
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s%s\t-- %s", dbf.quoteIdent(dbf.columnName(v)), dbf.columnSQLType(v), addComma, v.Label))
+	}
+	ddl.WriteString("\n);\n\n")
+	ddl.WriteString(fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n\n", indexName, table, strings.Join(keyCols, ", ")))
+	return ddl.String()
+}
+
+// sideTableInserts generates the insert statement of a side table (see createSideTable) for a buffer of
+// fixed-width rows, given the (1-based) number of each row in the file
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) sideTableInserts(ddi *DataDict, table string, key, idx []int, buffer []byte, bytesPerLine int, rowNums []int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	var tuples strings.Builder
+	for i := 0; i < len(buffer); i += bytesPerLine {
+		row := buffer[i:(i + bytesPerLine)]
+		keyVals, err := dbf.longKeyValues(ddi, row, rowNums[i/bytesPerLine], key, colTypes, nullPolicies)
+		if err != nil {
+			return nil, fmt.Errorf("error row %v: %w", row, err)
+		}
+		tuples.WriteString("\t(" + keyVals)
+		for _, vi := range idx {
+			v := ddi.Vars[vi]
+			val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[vi])
+			if err != nil {
+				return nil, fmt.Errorf("error row %v: %w", row, err)
+			}
+			tuples.WriteString("," + val)
+		}
+		tuples.WriteString("),\n")
+	}
+	if tuples.Len() == 0 {
+		return []byte{}, nil
+	}
+	stmt := tuples.String()
+	inserts := dbf.appendRows([]byte("INSERT INTO "+table+" "), []byte(stmt[:len(stmt)-2]))
+	return append(inserts, ";\n"...), nil
+}
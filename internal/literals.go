@@ -0,0 +1,140 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// mysqlEscaper escapes string literal contents for mysql, which (unless the NO_BACKSLASH_ESCAPES
+// mode is set) reads backslashes in literals as escape characters
+var mysqlEscaper = strings.NewReplacer(`\`, `\\`, "'", "''", "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// sqlString formats a string as a SQL string literal, escaping quotes and control characters
+// by database system:
+//
+//   - postgres: control characters are written in an escape string (E'...'); NUL characters,
+//     which postgres can't store in text, are dropped
+//   - mysql and snowflake: backslashes and control characters are backslash-escaped
+//   - mssql and oracle: control characters are concatenated in (e.g., 'a' + CHAR(9) + 'b')
+//
+// Strings holding non-ASCII text (e.g., accented labels) are marked as Unicode where the database
+// system needs it: N'...' in mssql, whose plain literals are converted to the database's code page,
+// and a utf8mb4 charset introducer in mysql, whose plain literals are read in the connection's
+// character set.
+func (dbf *DatabaseFormatter) sqlString(s string) string {
+	switch {
+	case dbf.DbType == MYSQL:
+		return dbf.unicodePrefix(s) + "'" + mysqlEscaper.Replace(s) + "'"
+	case dbf.DbType == SNOWFLAKE:
+		return "'" + snowflakeEscaper.Replace(s) + "'"
+	case !hasControlChars(s):
+		return dbf.unicodePrefix(s) + "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	case dbf.DbType == POSTGRES:
+		return "E'" + postgresEscape(s) + "'"
+	default:
+		return dbf.concatControlChars(s)
+	}
+}
+
+// unicodePrefix returns the prefix marking a string literal as Unicode, if the string holds
+// non-ASCII text and the database system needs it
+func (dbf *DatabaseFormatter) unicodePrefix(s string) string {
+	if isASCII(s) {
+		return ""
+	}
+	switch dbf.DbType {
+	case MSSQL:
+		return "N"
+	case MYSQL:
+		return "_utf8mb4"
+	default:
+		return ""
+	}
+}
+
+// postgresEscape escapes string contents for a postgres escape string (E'...')
+func postgresEscape(s string) string {
+	var esc strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == 0:
+			// postgres text can't hold NUL characters
+		case c == '\\':
+			esc.WriteString(`\\`)
+		case c == '\'':
+			esc.WriteString("''")
+		case c == '\n':
+			esc.WriteString(`\n`)
+		case c == '\r':
+			esc.WriteString(`\r`)
+		case c == '\t':
+			esc.WriteString(`\t`)
+		case isControlChar(c):
+			esc.WriteString(fmt.Sprintf(`\x%02x`, c))
+		default:
+			esc.WriteByte(c)
+		}
+	}
+	return esc.String()
+}
+
+// concatControlChars formats a string holding control characters as a concatenation of
+// string literals and character functions (CHAR() in mssql, CHR() in oracle)
+func (dbf *DatabaseFormatter) concatControlChars(s string) string {
+	charFunc, concat := "CHR", " || "
+	if dbf.DbType == MSSQL {
+		charFunc, concat = "CHAR", " + "
+	}
+	var parts []string
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && !isControlChar(s[i]) {
+			continue
+		}
+		if i > start {
+			run := s[start:i]
+			parts = append(parts, dbf.unicodePrefix(run)+"'"+strings.ReplaceAll(run, "'", "''")+"'")
+		}
+		if i < len(s) {
+			parts = append(parts, fmt.Sprintf("%s(%d)", charFunc, s[i]))
+		}
+		start = i + 1
+	}
+	return strings.Join(parts, concat)
+}
+
+// hasControlChars reports whether a string holds any ASCII control characters
+func hasControlChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isControlChar(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isControlChar reports whether a byte is an ASCII control character
+func isControlChar(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// sqlNullableString formats a string as a SQL string literal, or null if the string is empty
+func (dbf *DatabaseFormatter) sqlNullableString(s string) string {
+	if len(s) == 0 {
+		return "null"
+	}
+	return dbf.sqlString(s)
+}
+
+// isASCII reports whether a string holds ASCII characters only
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockFileName returns the name of the lock file of an output target: "<target>.lock", next to it
+func LockFileName(target string) string {
+	return filepath.Clean(target) + ".lock"
+}
+
+// LockOutput takes the lock of an output target (a file, or a directory in directory format), by creating
+// its lock file (see LockFileName), which must not already exist; so that two simultaneous runs writing to
+// the same target fail fast, rather than writing into the same files. The lock file records the run
+// holding it (its process id, and start time), for the message of the run turned away.
+//
+// It returns the function releasing the lock (removing the lock file), which may be called more than once.
+// Object storage URLs and special files (e.g., /dev/stdout) aren't locked; their release does nothing.
+// returns error if the target is locked by another run, or the lock file can't be created
+func LockOutput(target string) (func(), error) {
+	if IsObjectURL(target) || isSpecialFile(target) {
+		return func() {}, nil
+	}
+	lockName := LockFileName(target)
+	f, err := os.OpenFile(lockName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		holder := "another run"
+		if info, readErr := os.ReadFile(lockName); readErr == nil && len(info) != 0 {
+			holder = "another run (" + strings.TrimSpace(string(info)) + ")"
+		}
+		return nil, fmt.Errorf("%s is writing to %s; if no run is, the lock was left by one that was killed, and %s can be removed",
+			holder, target, lockName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, "pid %d, started %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(lockName)
+		return nil, err
+	}
+	var once sync.Once
+	return func() { once.Do(func() { _ = os.Remove(lockName) }) }, nil
+}
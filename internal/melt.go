@@ -0,0 +1,262 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Melts melts groups of related variables (e.g., OCC1990 and IND1990, or the activity variables of time
+// use data) out of the main table, each group into a long-format table of its own, with a row per
+// (non-null) value: the key of its row, the variable's (column) name, and its value.
+type Melts struct {
+	groups []meltGroup
+
+	// set by checkMelts
+	melted map[string]bool // names of melted variables
+	key    []int           // indices of the variables linking values to their row (see longTableKey)
+}
+
+// meltGroup is a group of variables melted into a long-format table
+type meltGroup struct {
+	name    string   // base name of the group's table (e.g., "occs" -> "ipums_tab_occs")
+	vars    []string // variable names, as given
+	idx     []int    // index of each variable in the data dictionary; set by checkMelts
+	valType string   // SQL type of the value column; set by checkMelts
+}
+
+// ParseMeltFlag parses the arguments of -melt flags, each of the form name=VAR1,VAR2[,...], naming a group's
+// table and its variables (e.g., "occs=OCC1990,IND1990"), into a Melts; if no groups are given, it returns
+// nil (nothing is melted).
+//
+// returns error if an argument is malformed, or a group or variable is named more than once
+func ParseMeltFlag(meltFs []string) (*Melts, error) {
+	if len(meltFs) == 0 {
+		return nil, nil
+	}
+	m := &Melts{}
+	seen := make(map[string]bool)
+	for _, mf := range meltFs {
+		name, vars, found := strings.Cut(mf, "=")
+		name = strings.TrimSpace(name)
+		if !found || len(strings.TrimSpace(vars)) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form name=VAR1,VAR2[,...]", mf)
+		}
+		if !identifierRe.MatchString(name) {
+			return nil, fmt.Errorf("'%s' is not a valid table name (letters, digits, and underscores only)", name)
+		}
+		if slices.ContainsFunc(m.groups, func(g meltGroup) bool { return strings.EqualFold(g.name, name) }) {
+			return nil, fmt.Errorf("group %s is named more than once", name)
+		}
+		g := meltGroup{name: strings.ToLower(name)}
+		for _, v := range strings.Split(vars, ",") {
+			v = strings.TrimSpace(v)
+			if len(v) == 0 {
+				return nil, fmt.Errorf("'%s' names an empty variable", mf)
+			}
+			if seen[strings.ToLower(v)] {
+				return nil, fmt.Errorf("variable %s is melted more than once", v)
+			}
+			seen[strings.ToLower(v)] = true
+			g.vars = append(g.vars, v)
+		}
+		m.groups = append(m.groups, g)
+	}
+	return m, nil
+}
+
+// melts reports whether a variable is melted
+func (m *Melts) melts(v Var) bool {
+	return m != nil && m.melted[v.Name]
+}
+
+// setApart reports whether a variable is stored apart from the main table (or not at all): a grouped
+// replicate weight (see RepWeights), a melted variable (see Melts), a data quality flag (see QFlags), or
+// a variable of a split variable group (see VarGroups)
+func (dbf *DatabaseFormatter) setApart(v Var) bool {
+	return dbf.RepWeights.groups(v) || dbf.Melts.melts(v) || dbf.QFlags.flags(v) || dbf.VarGroups.groups(v)
+}
+
+// checkMelts ensures that every melted variable is in the data dictionary, and that melting can be written:
+// it's for SQL insert dumps of microdata extracts only, a group's values must share a column (all character,
+// or all numeric), and long-format tables need a key linking values to their row (see longTableKey), which
+// can't be melted itself. The value column of each group is typed to hold every one of its variables.
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkMelts(ddi *DataDict) error {
+	m := dbf.Melts
+	if m == nil {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("variables are melted in microdata extracts only")
+	case !dbf.writesInserts():
+		return fmt.Errorf("variables are melted in SQL insert dumps only")
+	}
+	m.melted = make(map[string]bool)
+	for gi := range m.groups {
+		g := &m.groups[gi]
+		g.idx = g.idx[:0]
+		for _, name := range g.vars {
+			i := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) })
+			if i < 0 {
+				return fmt.Errorf("melt group %s: unrecognized variable %s", g.name, name)
+			}
+			if dbf.RepWeights.groups(ddi.Vars[i]) {
+				return fmt.Errorf("melt group %s: variable %s is a grouped replicate weight", g.name, name)
+			}
+			g.idx = append(g.idx, i)
+			m.melted[ddi.Vars[i].Name] = true
+		}
+		valType, err := dbf.meltValueType(ddi, *g)
+		if err != nil {
+			return fmt.Errorf("melt group %s: %w", g.name, err)
+		}
+		g.valType = valType
+	}
+	key, err := dbf.longTableKey(ddi)
+	if err != nil {
+		return fmt.Errorf("melted tables are keyed by the row id (-row-id), or the household: %w", err)
+	}
+	for _, ki := range key {
+		if m.melted[ddi.Vars[ki].Name] {
+			return fmt.Errorf("variable %s keys the melted tables, so it can't be melted", ddi.Vars[ki].Name)
+		}
+	}
+	m.key = key
+	return nil
+}
+
+// meltValueType returns the SQL type of a group's value column: the variables' shared type, if any; or
+// else a string wide enough for the widest, a bigint, a native float (if decimals are stored as such),
+// or a numeric holding the most integer and decimal places of any of them
+//
+// returns error if character and numeric variables are mixed, or if scaled decimals (see scales) are
+// mixed with variables of other decimal places
+func (dbf *DatabaseFormatter) meltValueType(ddi *DataDict, g meltGroup) (string, error) {
+	first := ddi.Vars[g.idx[0]]
+	shared, strs, floats, natives := true, 0, false, false
+	scaled, unscaled := make(map[int]bool), false
+	width, intPlaces, decimals := 0, 0, 0
+	for _, i := range g.idx {
+		v := ddi.Vars[i]
+		shared = shared && dbf.columnSQLType(v) == dbf.columnSQLType(first)
+		switch dbf.columnType(v) {
+		case "string":
+			strs++
+		case "float":
+			floats, natives = true, natives || dbf.floats(v)
+		}
+		switch {
+		case dbf.scales(v):
+			scaled[v.DecimalPoint] = true
+		case dbf.columnType(v) != "string":
+			unscaled = true
+		}
+		width = max(width, v.Location.Width)
+		intPlaces = max(intPlaces, v.Location.Width-v.DecimalPoint)
+		decimals = max(decimals, v.DecimalPoint)
+	}
+	switch {
+	case shared:
+		return dbf.columnSQLType(first), nil
+	case strs == len(g.idx):
+		return dbf.sqlType("string", width), nil
+	case strs != 0:
+		return "", fmt.Errorf("character and numeric variables can't share a value column")
+	case len(scaled) > 1 || (len(scaled) != 0 && unscaled):
+		return "", fmt.Errorf("scaled decimals can't share a value column with variables of other decimal places")
+	case natives:
+		return dbf.sqlType(dbf.Decimals), nil
+	case floats:
+		return dbf.sqlType("float", intPlaces+decimals, decimals), nil
+	default:
+		return dbf.sqlType("bigint"), nil
+	}
+}
+
+// meltTable returns the name of a group's long-format table (e.g., "ipums_tab_occs")
+func (dbf *DatabaseFormatter) meltTable(g meltGroup) string {
+	return dbf.ident(dbf.derivedName(g.name))
+}
+
+// CreateMeltTables generates the "CREATE TABLE" and "CREATE INDEX" statements of melted tables: a table per
+// group, with a row per (non-null) value, keyed like the row it belongs to.
+//
+// For example, -melt occs=OCC1990,IND1990 on an IPUMS USA extract would generate:
+//
+// CREATE TABLE ipums_tab_occs (
+//
+//	"sample" int,
+//	"serial" int,
+//	"pernum" int,
+//	"variable" varchar(7),
+//	"value" int	-- OCC1990, IND1990
+//
+// );
+//
+// CREATE INDEX idx_ipums_tab_occs ON ipums_tab_occs ("sample", "serial", "pernum");
+//
+// returns empty byte slice if no variables are melted
+func (dbf *DatabaseFormatter) CreateMeltTables(ddi *DataDict) []byte {
+	if dbf.Melts == nil {
+		return []byte{}
+	}
+	keyCols, keyTypes := dbf.longKeyCols(ddi, dbf.Melts.key)
+	var ddl strings.Builder
+	for _, g := range dbf.Melts.groups {
+		table := dbf.meltTable(g)
+		ddl.WriteString(fmt.Sprintf("CREATE TABLE %s (", table))
+		for i, col := range keyCols {
+			ddl.WriteString(fmt.Sprintf("\n\t%s %s,", col, keyTypes[i]))
+		}
+		names, nameWidth := make([]string, len(g.idx)), 0
+		for i, vi := range g.idx {
+			names[i] = ddi.Vars[vi].Name
+			nameWidth = max(nameWidth, len(dbf.columnName(ddi.Vars[vi])))
+		}
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s,", dbf.quoteIdent(dbf.columnName(Var{Name: "variable"})), dbf.sqlType("string", nameWidth)))
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s\t-- %s\n);\n\n", dbf.quoteIdent(dbf.columnName(Var{Name: "value"})), g.valType, strings.Join(names, ", ")))
+		ddl.WriteString(fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n\n", dbf.tableObjectName(DEFAULT_DERIVED_INDEX, dbf.derivedName(g.name), nil), table, strings.Join(keyCols, ", ")))
+	}
+	return []byte(ddl.String())
+}
+
+// meltInserts generates the insert statements of melted tables (see CreateMeltTables) for a buffer of
+// fixed-width rows, given the (1-based) number of each row in the file; null values are skipped.
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) meltInserts(ddi *DataDict, buffer []byte, bytesPerLine int, rowNums []int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	var inserts strings.Builder
+	for _, g := range dbf.Melts.groups {
+		var tuples strings.Builder
+		for i := 0; i < len(buffer); i += bytesPerLine {
+			row := buffer[i:(i + bytesPerLine)]
+			key, err := dbf.longKeyValues(ddi, row, rowNums[i/bytesPerLine], dbf.Melts.key, colTypes, nullPolicies)
+			if err != nil {
+				return nil, fmt.Errorf("error row %v: %w", row, err)
+			}
+			for _, vi := range g.idx {
+				v := ddi.Vars[vi]
+				val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[vi])
+				if err != nil {
+					return nil, fmt.Errorf("error row %v: %w", row, err)
+				}
+				if val == "null" {
+					continue
+				}
+				tuples.WriteString(fmt.Sprintf("\t(%s,%s,%s),\n", key, dbf.sqlString(dbf.columnName(v)), val))
+			}
+		}
+		if tuples.Len() == 0 {
+			continue
+		}
+		stmt := tuples.String()
+		inserts.Write(dbf.appendRows([]byte("INSERT INTO "+dbf.meltTable(g)+" "), []byte(stmt[:len(stmt)-2])))
+		inserts.WriteString(";\n")
+	}
+	return []byte(inserts.String()), nil
+}
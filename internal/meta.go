@@ -0,0 +1,100 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// metaTableName is the name of the provenance table; it's shared by every dump, so that
+// a single table records every extract loaded into a database
+const metaTableName = "ipums2db_meta"
+
+// ConversionMeta holds the provenance of a dump: where it came from, when, and how it was made
+type ConversionMeta struct {
+	TableName   string    // main table the rows were inserted into
+	DDIFile     string    // data dictionary path
+	DatFile     string    // data file path; empty for schema-only generation
+	DDIID       string    // extract identifier (e.g., "usa_00012"); taken from the DDI if empty
+	ConvertedAt time.Time // conversion start time
+	ToolVersion string    // ipums2db version
+	RowCount    int       // rows in the data file; negative if unknown
+	Options     string    // command line options used
+}
+
+// CreateMetaTable generates the statements creating the ipums2db_meta table (if it doesn't exist yet)
+// and inserting the dump's provenance row, returning a byte slice of the statements
+// (note: statement terminator (e.g., ";") is included).
+//
+// returns empty byte slice if dbf.Meta is nil
+func (dbf *DatabaseFormatter) CreateMetaTable(ddi *DataDict) []byte {
+	if dbf.Meta == nil {
+		return []byte{}
+	}
+	m := *dbf.Meta
+	if len(m.DDIID) == 0 {
+		m.DDIID = ddi.ID
+	}
+	cols := []string{
+		fmt.Sprintf("%s %s", dbf.ident("table_name"), dbf.sqlType("string", 128)),
+		fmt.Sprintf("%s %s", dbf.ident("ddi_file"), dbf.sqlType("string", 1000)),
+		fmt.Sprintf("%s %s", dbf.ident("dat_file"), dbf.sqlType("string", 1000)),
+		fmt.Sprintf("%s %s", dbf.ident("ddi_id"), dbf.sqlType("string", 128)),
+		fmt.Sprintf("%s %s", dbf.ident("converted_at"), dbf.sqlType("timestamp")),
+		fmt.Sprintf("%s %s", dbf.ident("tool_version"), dbf.sqlType("string", 64)),
+		fmt.Sprintf("%s %s", dbf.ident("row_count"), dbf.sqlType("bigint")),
+		fmt.Sprintf("%s %s", dbf.ident("options"), dbf.sqlType("string", 4000)),
+	}
+	var meta strings.Builder
+	meta.WriteString(dbf.createTableIfNotExists(dbf.ident(metaTableName), "\n\t"+strings.Join(cols, ",\n\t")+"\n"))
+
+	rowCount := "null"
+	if m.RowCount >= 0 {
+		rowCount = fmt.Sprintf("%d", m.RowCount)
+	}
+	vals := []string{
+		dbf.sqlString(dbf.ident(m.TableName)),
+		dbf.sqlString(m.DDIFile),
+		dbf.sqlNullableString(m.DatFile),
+		dbf.sqlNullableString(m.DDIID),
+		dbf.timestampLiteral(m.ConvertedAt),
+		dbf.sqlString(m.ToolVersion),
+		rowCount,
+		dbf.sqlString(m.Options),
+	}
+	colNames := make([]string, len(cols))
+	for i, c := range cols {
+		colNames[i], _, _ = strings.Cut(c, " ")
+	}
+	meta.WriteString(fmt.Sprintf(
+		"INSERT INTO %s (%s)\nVALUES\n\t(%s);\n\n",
+		dbf.ident(metaTableName), strings.Join(colNames, ", "), strings.Join(vals, ", "),
+	))
+	return []byte(meta.String())
+}
+
+// createTableIfNotExists generates a "CREATE TABLE" statement that's skipped if the table already exists.
+// cols holds the column definitions, as found between the parentheses of a "CREATE TABLE" statement.
+func (dbf *DatabaseFormatter) createTableIfNotExists(tableName, cols string) string {
+	switch {
+	case dbf.DbType == MSSQL:
+		return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL\nCREATE TABLE %s (%s);\n\n", tableName, tableName, cols)
+	case dbf.DbType == ORACLE && !dbf.releaseSince(23, 0):
+		// oracle releases before 23 (assumed, unless a newer one is targeted) have no "IF NOT EXISTS"; ORA-00955 is raised if the name is already used
+		create := strings.ReplaceAll(fmt.Sprintf("CREATE TABLE %s (%s)", tableName, cols), "'", "''")
+		return fmt.Sprintf("BEGIN\n\tEXECUTE IMMEDIATE '%s';\nEXCEPTION\n\tWHEN OTHERS THEN\n\t\tIF SQLCODE != -955 THEN RAISE; END IF;\nEND;\n/\n\n", create)
+	default:
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);\n\n", tableName, cols)
+	}
+}
+
+// timestampLiteral formats a time as a database system-specific timestamp literal
+func (dbf *DatabaseFormatter) timestampLiteral(t time.Time) string {
+	ts := t.UTC().Format("2006-01-02 15:04:05")
+	if dbf.DbType == MSSQL {
+		return "'" + ts + "'" // implicitly converted to datetime2
+	}
+	return "TIMESTAMP '" + ts + "'"
+}
@@ -0,0 +1,146 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// datPartSep separates the parts of a multi-part data file's name (see JoinDatParts); NUL can't appear in
+// paths or URLs, so names are never ambiguous
+const datPartSep = "\x00"
+
+// JoinDatParts names a data file split into several parts (e.g., "usa_00012_1.dat", "usa_00012_2.dat"), read
+// as one logical file, the parts concatenated in order (see OpenDat); a single part is named as it is
+func JoinDatParts(parts []string) string {
+	return strings.Join(parts, datPartSep)
+}
+
+// IsMultiPart reports whether a data file name names several parts (see JoinDatParts)
+func IsMultiPart(name string) bool {
+	return strings.Contains(name, datPartSep)
+}
+
+// DatName returns a data file name fit for printing: the parts of a multi-part data file, comma-delimited
+func DatName(name string) string {
+	return strings.ReplaceAll(name, datPartSep, ", ")
+}
+
+// multiDat is a data file split into several parts, read at arbitrary offsets as one logical file; rows are
+// numbered continuously across parts
+type multiDat struct {
+	parts  []datSource
+	names  []string
+	starts []int64 // offset of each part in the logical file
+	size   int64
+}
+
+// openMultiDat opens each part of a multi-part data file (see OpenDat), ensuring that each part but the last
+// ends with a newline, so that rows aren't split across parts
+//
+// returns error if a part can't be opened, or is empty, or cuts a row short
+func openMultiDat(name string) (*multiDat, error) {
+	md := &multiDat{names: strings.Split(name, datPartSep)}
+	for i, partName := range md.names {
+		part, err := OpenDat(partName)
+		if err != nil {
+			md.Close()
+			return nil, err
+		}
+		md.parts = append(md.parts, part)
+		size, err := part.Size()
+		if err != nil {
+			md.Close()
+			return nil, err
+		}
+		if size == 0 {
+			md.Close()
+			return nil, fmt.Errorf("data file part %s is empty", partName)
+		}
+		if i < len(md.names)-1 {
+			last := make([]byte, 1)
+			if _, err := part.ReadAt(last, size-1); err != nil && !errors.Is(err, io.EOF) {
+				md.Close()
+				return nil, err
+			}
+			if last[0] != '\n' {
+				md.Close()
+				return nil, fmt.Errorf("data file part %s doesn't end with a newline, so its last row would run into the next part's first", partName)
+			}
+		}
+		md.starts = append(md.starts, md.size)
+		md.size += size
+	}
+	return md, nil
+}
+
+// ReadAt reads len(p) bytes of the logical file from offset off, across parts as need be
+//
+// returns io.EOF if fewer bytes remain in the file, or error if a part can't be read
+func (md *multiDat) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for i, part := range md.parts {
+		end := md.size
+		if i < len(md.parts)-1 {
+			end = md.starts[i+1]
+		}
+		if off+int64(n) >= end || n == len(p) {
+			continue
+		}
+		want := min(int64(len(p)-n), end-(off+int64(n)))
+		read, err := part.ReadAt(p[n:n+int(want)], off+int64(n)-md.starts[i])
+		n += read
+		if err != nil && !(errors.Is(err, io.EOF) && int64(read) == want) {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the size of the logical file, in bytes: the sum of its parts'
+func (md *multiDat) Size() (int64, error) {
+	return md.size, nil
+}
+
+// Close closes each part
+func (md *multiDat) Close() error {
+	var errs []error
+	for _, part := range md.parts {
+		errs = append(errs, part.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ConcatDat copies the parts of a multi-part data file into a single temporary file, for readers reading the
+// data file through whole, rather than at offsets (e.g., -rectype). The temporary file is created in
+// os.TempDir(); it's up to the caller to remove it.
+//
+// returns error if a part can't be read (see openMultiDat), or the file can't be written
+func ConcatDat(name string) (string, error) {
+	md, err := openMultiDat(name)
+	if err != nil {
+		return "", err
+	}
+	defer md.Close()
+	dst, err := os.CreateTemp("", "ipums2db-*.dat")
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, io.NewSectionReader(md, 0, md.size)); err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
@@ -0,0 +1,105 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_INDEX_NAME     = "idx_{cols}"            // name template of -i indices (see IndexNameTemplate)
+	DEFAULT_NATURAL_KEY    = "uk_{table}"            // name of the natural key's unique constraint (see createNaturalKey)
+	DEFAULT_UNIQUE_KEY     = "uq_{table}_{cols}"     // name template of -unique constraints (see createUniqueKeys)
+	DEFAULT_RANGE_CHECK    = "ck_{table}_{cols}"     // name template of -range-checks constraints (see createRangeChecks)
+	DEFAULT_PERSON_KEY     = "uk_{table}_person"     // name of the linkage's unique key on the person identifiers (see CreateLinkage)
+	DEFAULT_HOUSEHOLD_IDX  = "idx_{table}_household" // name of the linkage's index on the household identifiers
+	DEFAULT_DERIVED_INDEX  = "idx_{table}"           // name of the index on the key of a derived table, {table} being its name (see derivedName)
+	nameHashLen            = 8                       // hex digits of the hash ending shortened names (see limitName)
+	nameTemplateTable      = "{table}"
+	nameTemplateCols       = "{cols}"
+	nameTemplateCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_$"
+)
+
+// identLimits are the maximum identifier lengths (in bytes) of each database system; generated index
+// and constraint names longer than that are shortened (see limitName), rather than truncated by the
+// database system (postgres), possibly into the name of another object, or rejected (the others).
+// Oracle's limit is of 12.2 onward, 30 bytes before (see oracleLegacyIdentLimit).
+var identLimits = map[string]int{
+	POSTGRES:  63,
+	MYSQL:     64,
+	ORACLE:    128,
+	MSSQL:     128,
+	SNOWFLAKE: 255,
+}
+
+// oracleLegacyIdentLimit is the identifier limit of oracle releases before 12.2, applied if one is targeted
+// (see DbVersion)
+const oracleLegacyIdentLimit = 30
+
+// ParseNameTemplate parses the -index-name-template, or -constraint-name-template flag argument, a name
+// made of letters, digits, underscores, and dollar signs, and of the placeholders {table}, the main table's
+// name, and {cols}, the columns indexed (or constrained), joined by underscores (e.g., "ix_{table}_{cols}")
+//
+// returns error if the template holds other characters, or placeholders
+func ParseNameTemplate(tmpl string) (string, error) {
+	tmpl = strings.TrimSpace(tmpl)
+	rest := strings.NewReplacer(nameTemplateTable, "", nameTemplateCols, "").Replace(tmpl)
+	if i := strings.IndexFunc(rest, func(r rune) bool { return !strings.ContainsRune(nameTemplateCharacters, r) }); i != -1 {
+		if rest[i] == '{' {
+			return "", fmt.Errorf("name template '%s': unknown placeholder (placeholders: %s, %s)", tmpl, nameTemplateTable, nameTemplateCols)
+		}
+		return "", fmt.Errorf("name template '%s': names can only hold letters, digits, '_', and '$'", tmpl)
+	}
+	return tmpl, nil
+}
+
+// objectName generates the name of an index, or constraint, on columns of the main table from a name
+// template (see ParseNameTemplate), cased (see ident), and shortened to the database system's limit
+func (dbf *DatabaseFormatter) objectName(tmpl string, cols []string) string {
+	return dbf.tableObjectName(tmpl, dbf.TableName, cols)
+}
+
+// tableObjectName generates the name of an index, or constraint, on columns of a table, as objectName does
+// for the main table (e.g., of the index on a derived table's key, see derivedName)
+func (dbf *DatabaseFormatter) tableObjectName(tmpl, table string, cols []string) string {
+	name := strings.NewReplacer(nameTemplateTable, table, nameTemplateCols, strings.Join(cols, "_")).Replace(tmpl)
+	return dbf.ident(dbf.limitName(name))
+}
+
+// derivedName returns the name of a table, or view, derived from the main table (e.g., "ipums_tab_repwtps",
+// of replicate weights): the main table's name, then a suffix, shortened to the database system's limit. It's
+// left uncased (see ident). Ref tables aren't derived: they're named after their variables (see refTableName).
+func (dbf *DatabaseFormatter) derivedName(suffix string) string {
+	return dbf.limitName(dbf.TableName + "_" + suffix)
+}
+
+// limitName shortens a name longer than the database system's identifier limit (see identLimits): it's cut,
+// and ends with a hash of the whole name (e.g., "idx_..._1f0e3dad"), so that names sharing a long prefix
+// remain distinct. Names within the limit are returned as is.
+func (dbf *DatabaseFormatter) limitName(name string) string {
+	limit, ok := identLimits[dbf.DbType]
+	if dbf.DbType == ORACLE && dbf.releaseBefore(12, 2) {
+		limit = oracleLegacyIdentLimit
+	}
+	if !ok || len(name) <= limit {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	cut := limit - nameHashLen - 1
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + "_" + hex.EncodeToString(sum[:])[:nameHashLen]
+}
+
+// orDefault returns a name template, or a default template if unset
+func orDefault(tmpl, def string) string {
+	if len(tmpl) == 0 {
+		return def
+	}
+	return tmpl
+}
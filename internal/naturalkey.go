@@ -0,0 +1,149 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// naturalKeyCols returns the quoted columns of the natural key, in the order declared; the row id column
+// (see RowID) may be one of them
+func (dbf *DatabaseFormatter) naturalKeyCols(ddi *DataDict) []string {
+	return dbf.keyColumns(ddi, dbf.NaturalKey)
+}
+
+// keyColumns returns the quoted columns of a key's variables (e.g., the natural key's), in the order
+// declared; the row id column (see RowID) may be one of them
+func (dbf *DatabaseFormatter) keyColumns(ddi *DataDict, names []string) []string {
+	cols := dbf.keyColumnNames(ddi, names)
+	for i, col := range cols {
+		cols[i] = dbf.quoteIdent(col)
+	}
+	return cols
+}
+
+// keyColumnNames returns the (unquoted) columns of a key's variables, in the order declared
+func (dbf *DatabaseFormatter) keyColumnNames(ddi *DataDict, names []string) []string {
+	cols := make([]string, len(names))
+	for i, name := range names {
+		if len(dbf.RowID) != 0 && strings.EqualFold(strings.TrimSpace(name), dbf.RowID) {
+			cols[i] = dbf.columnName(dbf.rowIDVar())
+			continue
+		}
+		cols[i], _ = dbf.lookupColumn(ddi, name)
+	}
+	return cols
+}
+
+// checkNaturalKey ensures that the natural key, if declared, is made of distinct columns of the main table,
+// and that its inserts can skip rows already loaded: conflicts are handled by the database, so dumps loading
+// files (see writesInserts) are out, long-format tables, keyed by their own columns, would still take
+// duplicates, and oracle releases before 23 can't merge rows listed after VALUES (see selectsRows)
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkNaturalKey(ddi *DataDict) error {
+	if len(dbf.NaturalKey) == 0 {
+		return nil
+	}
+	switch {
+	case !dbf.writesInserts():
+		return fmt.Errorf("natural keys apply to SQL insert dumps only")
+	case dbf.RepWeights.long() || dbf.Melts != nil:
+		return fmt.Errorf("natural keys can't be combined with long-format tables (see -repwts, and -melt)")
+	case dbf.QFlags.side():
+		return fmt.Errorf("natural keys can't be combined with the data quality flag table (see -qflags)")
+	case dbf.VarGroups != nil:
+		return fmt.Errorf("natural keys can't be combined with variable group tables (see -split-groups)")
+	case dbf.selectsRows():
+		return fmt.Errorf("natural keys need oracle 23 or newer, whose MERGE statements can list rows after VALUES (%s targeted)", dbf.DbVersion)
+	}
+	return dbf.checkKeyColumns(ddi, dbf.NaturalKey, "natural key")
+}
+
+// checkKeyColumns ensures that the variables of a key (e.g., "natural key") are distinct columns of the main
+// table, or its row id column
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkKeyColumns(ddi *DataDict, names []string, key string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		isRowID := len(dbf.RowID) != 0 && strings.EqualFold(strings.TrimSpace(name), dbf.RowID)
+		col, ok := dbf.lookupColumn(ddi, name)
+		if !ok && !isRowID {
+			return fmt.Errorf("unrecognized %s variable %s", key, name)
+		}
+		if isRowID {
+			col = dbf.RowID
+		}
+		if seen[strings.ToLower(col)] {
+			return fmt.Errorf("%s variable %s is listed more than once", key, name)
+		}
+		seen[strings.ToLower(col)] = true
+	}
+	return nil
+}
+
+// createNaturalKey generates the unique constraint of the natural key on the main table, which the conflict
+// handling of its inserts relies on (see insertClauses); "" if there is no natural key. From postgres 15
+// onward, the constraint treats nulls as equal (NULLS NOT DISTINCT), so that rows whose key holds nulls
+// are skipped too.
+func (dbf *DatabaseFormatter) createNaturalKey(ddi *DataDict) string {
+	if len(dbf.NaturalKey) == 0 {
+		return ""
+	}
+	unique := "UNIQUE"
+	if dbf.DbType == POSTGRES && dbf.releaseSince(15, 0) {
+		unique = "UNIQUE NULLS NOT DISTINCT"
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s (%s);\n\n",
+		dbf.ident(dbf.TableName), dbf.naturalKeyName(ddi), unique, strings.Join(dbf.naturalKeyCols(ddi), ", "))
+}
+
+// naturalKeyName returns the name of the natural key's unique constraint (see ConstraintNames)
+func (dbf *DatabaseFormatter) naturalKeyName(ddi *DataDict) string {
+	return dbf.objectName(orDefault(dbf.ConstraintNames, DEFAULT_NATURAL_KEY), dbf.keyColumnNames(ddi, dbf.NaturalKey))
+}
+
+// insertClauses returns the text surrounding the rows of a main table insert statement (see appendRows): by
+// default, "INSERT INTO <table> " and ";". If a natural key is declared, rows whose key is already in the
+// table are skipped, so that re-running a partially loaded dump doesn't duplicate them:
+//
+//   - postgres: INSERT INTO ... VALUES ... ON CONFLICT DO NOTHING
+//   - mysql: INSERT IGNORE INTO ... VALUES ...
+//   - mssql and oracle: MERGE INTO ... USING (VALUES ...) ... WHEN NOT MATCHED THEN INSERT
+//
+// The tail ends with the statement terminator, without a newline.
+func (dbf *DatabaseFormatter) insertClauses(ddi *DataDict) (head, tail string) {
+	table := dbf.ident(dbf.TableName)
+	if len(dbf.NaturalKey) == 0 {
+		return fmt.Sprintf("INSERT INTO %s ", table), ";"
+	}
+	switch dbf.DbType {
+	case MYSQL:
+		return fmt.Sprintf("INSERT IGNORE INTO %s ", table), ";"
+	case MSSQL, ORACLE:
+		names := dbf.VariableNames(ddi)
+		cols, srcCols := make([]string, len(names)), make([]string, len(names))
+		for i, name := range names {
+			cols[i] = dbf.quoteIdent(name)
+			srcCols[i] = "src." + cols[i]
+		}
+		keyCols := dbf.naturalKeyCols(ddi)
+		on := make([]string, len(keyCols))
+		for i, col := range keyCols {
+			on[i] = fmt.Sprintf("tgt.%s = src.%s", col, col)
+		}
+		// oracle takes no AS before table aliases
+		as := "AS "
+		if dbf.DbType == ORACLE {
+			as = ""
+		}
+		head = fmt.Sprintf("MERGE INTO %s %stgt\nUSING (", table, as)
+		tail = fmt.Sprintf("\n) %ssrc (%s)\nON (%s)\nWHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);",
+			as, strings.Join(cols, ", "), strings.Join(on, " AND "), strings.Join(cols, ", "), strings.Join(srcCols, ", "))
+		return head, tail
+	default:
+		return fmt.Sprintf("INSERT INTO %s ", table), "\nON CONFLICT DO NOTHING;"
+	}
+}
@@ -0,0 +1,42 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"regexp"
+	"slices"
+)
+
+// fullUniverseRe matches the universes of variables that apply to every record of an extract (e.g., "All
+// records", "All persons.", "All households and group quarters"), as opposed to a subpopulation (e.g.,
+// "Persons age 15+", or "All persons age 15+")
+var fullUniverseRe = regexp.MustCompile(`(?i)^all (records|persons|people|households)( and (group quarters|persons|people|households))?\.?$`)
+
+// notNull reports whether a variable's column is declared NOT NULL (see DatabaseFormatter.NotNull): those
+// of variables applying to every record (see fullUniverseRe) that have no missing value categories (see
+// missingLabelRe), and aren't recoded to null. Blank fields of such variables are errors in the data,
+// which the database rejects.
+func (dbf *DatabaseFormatter) notNull(v Var) bool {
+	if !dbf.NotNull || !fullUniverseRe.MatchString(docText(v.Universe)) {
+		return false
+	}
+	for _, c := range v.Cats {
+		if missingLabelRe.MatchString(c.Label) {
+			return false
+		}
+	}
+	if vr := dbf.Recodes.recodes(v); vr != nil {
+		recodesNull := vr.els == recodeNull || slices.ContainsFunc(vr.rules, func(r recodeRule) bool { return r.to == recodeNull })
+		return !recodesNull
+	}
+	return true
+}
+
+// notNullClause returns the NOT NULL constraint following the type of a variable's column (see notNull),
+// or "" if it's nullable
+func (dbf *DatabaseFormatter) notNullClause(v Var) string {
+	if !dbf.notNull(v) {
+		return ""
+	}
+	return " NOT NULL"
+}
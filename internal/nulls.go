@@ -0,0 +1,154 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Policies for detecting null (blank) fixed-width fields
+const (
+	NULL_ANY    string = "any"    // null if the field holds any blank; the default
+	NULL_BLANK  string = "blank"  // null only if the field is entirely blank; other strings are written as is, and other numbers are an error
+	NULL_TRIM   string = "trim"   // blanks are trimmed, then the value is parsed; null if nothing is left
+	NULL_STRICT string = "strict" // null if the field is entirely blank; a partially blank field is an error
+)
+
+// NullPolicy determines how blank fixed-width fields are written: by variable, then by
+// type ("string" or "numeric"), then by default.
+type NullPolicy struct {
+	Default string
+	ByType  map[string]string // "string" or "numeric" -> policy
+	ByVar   map[string]string // lowercased variable name -> policy
+}
+
+// ParseNullsFlag parses the -nulls flag argument into a NullPolicy. The argument is a comma-delimited
+// list of policies, each either applying by default (e.g., "trim"), to a type (e.g., "string=trim"),
+// or to a variable (e.g., "incwage=strict"). Policies include "any", "blank", "trim", and "strict".
+//
+// returns error if a policy is not recognized
+func ParseNullsFlag(nullsF string) (*NullPolicy, error) {
+	np := &NullPolicy{Default: NULL_ANY, ByType: make(map[string]string), ByVar: make(map[string]string)}
+	if len(strings.TrimSpace(nullsF)) == 0 {
+		return np, nil
+	}
+	for _, p := range strings.Split(nullsF, ",") {
+		key, policy, found := strings.Cut(p, "=")
+		if !found {
+			key, policy = "", key
+		}
+		key, policy = strings.ToLower(strings.TrimSpace(key)), strings.ToLower(strings.TrimSpace(policy))
+		switch policy {
+		case NULL_ANY, NULL_BLANK, NULL_TRIM, NULL_STRICT:
+		default:
+			return nil, fmt.Errorf("'%s' not in {'any', 'blank', 'trim', 'strict'}", policy)
+		}
+		switch key {
+		case "":
+			np.Default = policy
+		case "string", "numeric":
+			np.ByType[key] = policy
+		default:
+			np.ByVar[key] = policy
+		}
+	}
+	return np, nil
+}
+
+// policy returns the null policy of a variable
+func (np *NullPolicy) policy(v Var, isString bool) string {
+	if np == nil {
+		return NULL_ANY
+	}
+	if p, ok := np.ByVar[strings.ToLower(v.Name)]; ok {
+		return p
+	}
+	varType := "numeric"
+	if isString {
+		varType = "string"
+	}
+	if p, ok := np.ByType[varType]; ok {
+		return p
+	}
+	return np.Default
+}
+
+// varPolicies returns the null policy of each variable, by its type in the data dictionary (for commands
+// reading the data file without converting it, e.g., freq)
+func (np *NullPolicy) varPolicies(vars []Var) []string {
+	policies := make([]string, len(vars))
+	for i, v := range vars {
+		policies[i] = np.policy(v, v.VType.VarType == "character")
+	}
+	return policies
+}
+
+// check ensures that every variable with its own null policy is in the data dictionary
+//
+// returns error if not the case
+func (np *NullPolicy) check(ddi *DataDict) error {
+	if np == nil {
+		return nil
+	}
+	varNames := make(map[string]bool, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		varNames[strings.ToLower(v.Name)] = true
+	}
+	for name := range np.ByVar {
+		if !varNames[name] {
+			return fmt.Errorf("cannot set null policy of unrecognized variable %s", name)
+		}
+	}
+	return nil
+}
+
+// nullPolicies returns the null policy of each variable of a data dictionary, in order
+func (dbf *DatabaseFormatter) nullPolicies(ddi *DataDict) []string {
+	policies := make([]string, len(ddi.Vars))
+	for i, v := range ddi.Vars {
+		policies[i] = dbf.Nulls.policy(v, dbf.columnType(v) == "string")
+	}
+	return policies
+}
+
+// checkNullPolicy ensures that every variable with its own null policy is in the data dictionary
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkNullPolicy(ddi *DataDict) error {
+	return dbf.Nulls.check(ddi)
+}
+
+// applyNullPolicy applies a null policy to a fixed-width field, returning the field's value
+// (trimmed, for the "trim" policy), or isNull if the field is null
+//
+// returns error if the field is partially blank, under the "strict" policy, or if a numeric field is, under
+// the "blank" policy (as it's not a number)
+func applyNullPolicy(chars []byte, policy string, isString bool) (field []byte, isNull bool, err error) {
+	if bytes.IndexByte(chars, ' ') < 0 {
+		return chars, false, nil
+	}
+	allBlank := len(bytes.Trim(chars, " ")) == 0
+	switch policy {
+	case NULL_BLANK:
+		if !isString && !allBlank {
+			return nil, false, fmt.Errorf("'%s' is partially blank, so not a number (see -nulls trim)", chars)
+		}
+		return chars, allBlank, nil
+	case NULL_TRIM:
+		if isString {
+			field = bytes.TrimRight(chars, " ")
+		} else {
+			field = bytes.Trim(chars, " ")
+		}
+		return field, len(field) == 0, nil
+	case NULL_STRICT:
+		if !allBlank {
+			return nil, false, fmt.Errorf("'%s' is partially blank", chars)
+		}
+		return chars, true, nil
+	default:
+		return chars, true, nil
+	}
+}
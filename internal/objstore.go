@@ -0,0 +1,364 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectPartSize determines the size of each part of a multipart upload to object storage, and so
+// the memory held by each writer; with S3's limit of 10,000 parts, objects can be up to ~312 GiB.
+const objectPartSize = (1 << 20) * 32
+
+// maxObjectParts is the max number of parts in a multipart upload (S3's limit; Azure allows more)
+const maxObjectParts = 10000
+
+// objectRetries determines the number of attempts of each object storage request, retrying
+// on network errors and transient (throttling or server-side) failures, with exponential backoff
+const objectRetries = 5
+
+// objectSchemes are the URL schemes of supported object storage services
+var objectSchemes = []string{"s3://", "gs://", "az://"}
+
+// IsObjectURL reports whether an output name is an object storage URL
+// (e.g., "s3://bucket/prefix/", "gs://bucket/dump.sql", "az://container/prefix/")
+func IsObjectURL(name string) bool {
+	for _, s := range objectSchemes {
+		if strings.HasPrefix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseObjectURL splits an object storage URL into its scheme (e.g., "s3"), bucket (or container), and key
+//
+// returns error if the URL has no bucket
+func parseObjectURL(objURL string) (scheme, bucket, key string, err error) {
+	scheme, rest, _ := strings.Cut(objURL, "://")
+	bucket, key, _ = strings.Cut(rest, "/")
+	if len(bucket) == 0 {
+		return "", "", "", fmt.Errorf("object storage URL '%s' has no bucket", objURL)
+	}
+	return scheme, bucket, key, nil
+}
+
+// objectStore is a bucket (or container) of an object storage service, written to by multipart uploads.
+// Uploaded parts are only made visible as an object once the upload is completed.
+type objectStore interface {
+	startUpload(key string) (uploadID string, err error)
+	uploadPart(key, uploadID string, partNum int, data []byte) (etag string, err error)
+	completeUpload(key, uploadID string, etags []string) error
+	abortUpload(key, uploadID string) error
+	url(key string) string
+}
+
+// newObjectStore returns the objectStore of a bucket, by URL scheme; credentials are read
+// from the environment (see newS3Store, newGCSStore, and newAzureStore)
+//
+// returns error if the scheme is not supported, or credentials are missing
+func newObjectStore(scheme, bucket string) (objectStore, error) {
+	switch scheme {
+	case "s3":
+		return newS3Store(bucket)
+	case "gs":
+		return newGCSStore(bucket)
+	case "az":
+		return newAzureStore(bucket)
+	default:
+		return nil, fmt.Errorf("object storage scheme '%s' not in {'s3', 'gs', 'az'}", scheme)
+	}
+}
+
+// objectUpload is a DumpFile streamed to object storage: writes are buffered, and uploaded one part
+// at a time. Close uploads the last part, but the object only appears once complete is called.
+type objectUpload struct {
+	store     objectStore
+	key       string
+	uploadID  string
+	buf       []byte
+	etags     []string
+	closed    bool
+	completed bool
+	aborted   bool
+}
+
+// Write buffers p, uploading a part each time the buffer fills up
+func (u *objectUpload) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), objectPartSize-len(u.buf))
+		u.buf = append(u.buf, p[:take]...)
+		p = p[take:]
+		if len(u.buf) == objectPartSize {
+			if err := u.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffer as the next part
+func (u *objectUpload) flush() error {
+	if len(u.etags) == maxObjectParts {
+		return fmt.Errorf("%s: object exceeds %d parts of %d bytes", u.Name(), maxObjectParts, objectPartSize)
+	}
+	etag, err := u.store.uploadPart(u.key, u.uploadID, len(u.etags)+1, u.buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.Name(), err)
+	}
+	u.etags = append(u.etags, etag)
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Close uploads the last part, if any
+func (u *objectUpload) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	var err error
+	if len(u.buf) > 0 {
+		err = u.flush()
+	}
+	u.buf = nil
+	return err
+}
+
+// Name returns the object's URL
+func (u *objectUpload) Name() string {
+	return u.store.url(u.key)
+}
+
+// complete makes the uploaded parts visible as the object
+func (u *objectUpload) complete() error {
+	if err := u.Close(); err != nil {
+		return err
+	}
+	if err := u.store.completeUpload(u.key, u.uploadID, u.etags); err != nil {
+		return fmt.Errorf("%s: %w", u.Name(), err)
+	}
+	u.completed = true
+	return nil
+}
+
+// abort discards the uploaded parts, unless the upload was completed
+func (u *objectUpload) abort() {
+	if u.completed || u.aborted {
+		return
+	}
+	u.closed, u.aborted = true, true
+	u.buf = nil
+	_ = u.store.abortUpload(u.key, u.uploadID)
+}
+
+// objectDump holds the uploads of a dump written to object storage, so that they can all be
+// completed once the dump is written, or all aborted in case of errors
+type objectDump struct {
+	store   objectStore
+	prefix  string // key prefix of directory format dumps; the object key of single object dumps
+	mu      sync.Mutex
+	uploads []*objectUpload
+}
+
+// newObjectDump returns an objectDump writing to an object storage URL
+func newObjectDump(objURL string) (*objectDump, error) {
+	scheme, bucket, key, err := parseObjectURL(objURL)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newObjectStore(scheme, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &objectDump{store: store, prefix: key}, nil
+}
+
+// create starts the upload of an object, by key
+func (od *objectDump) create(key string) (*objectUpload, error) {
+	uploadID, err := od.store.startUpload(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", od.store.url(key), err)
+	}
+	u := &objectUpload{store: od.store, key: key, uploadID: uploadID, buf: make([]byte, 0, objectPartSize)}
+	od.mu.Lock()
+	od.uploads = append(od.uploads, u)
+	od.mu.Unlock()
+	return u, nil
+}
+
+// createInDir starts the upload of an object named name under the dump's prefix
+func (od *objectDump) createInDir(name string) (DumpFile, error) {
+	return od.create(path.Join(od.prefix, name))
+}
+
+// commit completes every upload; returns the first error
+func (od *objectDump) commit() error {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	for _, u := range od.uploads {
+		if err := u.complete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort aborts every upload not yet completed
+func (od *objectDump) abort() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	for _, u := range od.uploads {
+		u.abort()
+	}
+}
+
+// writeObject writes a small object (e.g., an artifact) of the dump, by URL, in the dump's bucket; like
+// the dump's other objects, it only appears once the dump is committed
+//
+// returns error if the URL isn't in the dump's bucket, or the upload fails
+func (od *objectDump) writeObject(objURL string, data []byte) error {
+	_, _, key, err := parseObjectURL(objURL)
+	if err != nil {
+		return err
+	}
+	if od.store.url(key) != objURL {
+		return fmt.Errorf("%s is not in the bucket of the dump, %s", objURL, od.store.url(od.prefix))
+	}
+	u, err := od.create(key)
+	if err != nil {
+		return err
+	}
+	if _, err = u.Write(data); err == nil {
+		err = u.Close()
+	}
+	return err
+}
+
+// newObjectDumpWriter returns a DumpWriter streaming to object storage (see NewDumpWriter).
+// In directory format, objects are written under the URL's key prefix (e.g., "prefix/ddl.sql",
+// "prefix/inserts_0.sql"); otherwise, the URL names the single object.
+func newObjectDumpWriter(totBytes int, objURL string, makeItDir bool, split OutputSplit) (DumpWriter, error) {
+	od, err := newObjectDump(objURL)
+	if err != nil {
+		return DumpWriter{}, err
+	}
+	if !makeItDir && (len(od.prefix) == 0 || strings.HasSuffix(od.prefix, "/")) {
+		return DumpWriter{}, fmt.Errorf("%s names a prefix, not an object; use -d to write a directory of objects", objURL)
+	}
+	dw := DumpWriter{makeItDir: makeItDir, remote: od}
+	if !makeItDir {
+		schemaF, err := od.create(od.prefix)
+		if err != nil {
+			return DumpWriter{}, err
+		}
+		dw.SchemaFile, dw.OutFiles = schemaF, []DumpFile{schemaF}
+		return dw, nil
+	}
+	if dw.SchemaFile, err = od.createInDir("ddl.sql"); err != nil {
+		od.abort()
+		return DumpWriter{}, err
+	}
+	nOutFiles := numOutFiles(totBytes)
+	if len(split.ShardBy) != 0 {
+		dw.shards = newOutShards(split.ShardBy, nOutFiles, od.createInDir)
+		nOutFiles = 0
+	}
+	dw.OutFiles = make([]DumpFile, nOutFiles)
+	for i := range nOutFiles {
+		if dw.OutFiles[i], err = od.createInDir(fmt.Sprintf("inserts_%d.sql", i)); err != nil {
+			od.abort()
+			return DumpWriter{}, err
+		}
+	}
+	if split.IsSet() {
+		dw.split = split
+		dw.parts = &outParts{newFile: od.createInDir, nameFmt: sqlParts.nameFmt, next: nOutFiles}
+	}
+	return dw, nil
+}
+
+// putObject uploads a small object (e.g., an artifact) to an object storage URL
+func putObject(objURL string, data []byte) error {
+	od, err := newObjectDump(objURL)
+	if err != nil {
+		return err
+	}
+	u, err := od.create(od.prefix)
+	if err != nil {
+		return err
+	}
+	if _, err = u.Write(data); err == nil {
+		err = u.complete()
+	}
+	if err != nil {
+		u.abort()
+	}
+	return err
+}
+
+// sendWithRetry sends the request made by newReq (made anew for each attempt, so that it can be signed
+// and given a fresh body), retrying on network errors, and on throttling or server-side failures.
+// Returns the response, with its body read.
+//
+// returns error if all attempts fail, or the response has a non-2xx status
+func sendWithRetry(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, []byte, error) {
+	backoff := time.Second
+	var lastErr error
+	for attempt := 1; attempt <= objectRetries; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		req, err := newReq()
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return resp, body, nil
+		case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+		default:
+			return nil, nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+		}
+	}
+	return nil, nil, fmt.Errorf("giving up after %d attempts: %w", objectRetries, lastErr)
+}
+
+// uriEncode percent-encodes a string as RFC 3986 (as S3 request signing expects): all
+// but unreserved characters are encoded, and slashes are kept if keepSlash is true
+func uriEncode(s string, keepSlash bool) string {
+	var enc strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			enc.WriteByte(c)
+		default:
+			fmt.Fprintf(&enc, "%%%02X", c)
+		}
+	}
+	return enc.String()
+}
@@ -0,0 +1,376 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ormModel describes the tables of a generated schema, as mapped by ORM models (see emitSQLAlchemy, and
+// emitDjango): the main table, and its ref_tables (or dimension tables, in the star model)
+type ormModel struct {
+	tables []ormTable
+}
+
+// ormTable is a single table of the schema
+type ormTable struct {
+	name   string // unqualified
+	schema string // if qualified (e.g., by the ref_table schema)
+	class  string // name of the model (e.g., "RefSex")
+	cols   []ormCol
+}
+
+// ormCol is a single column of a table
+type ormCol struct {
+	name    string
+	sqlType string
+	comment string
+	pk      bool    // part of the model's primary key (not necessarily declared in the DDL)
+	ref     *ormRef // if set, the column refers to a column of another table
+	note    string  // if set, a note on the column (e.g., codes in ranges, which can't be referred to)
+}
+
+// ormRef relates a column to the column of a ref_table (or dimension table) that its codes (or keys) refer to
+type ormRef struct {
+	table *ormTable
+	col   string
+	attr  string // name of the relationship attribute (e.g., "sex_ref")
+}
+
+// qualified returns the name of a table, qualified by its schema, if any
+func (t *ormTable) qualified() string {
+	if len(t.schema) == 0 {
+		return t.name
+	}
+	return t.schema + "." + t.name
+}
+
+// ormClass returns the model name of a table: its name, in CamelCase (e.g., "ref_sex" -> "RefSex")
+func ormClass(table string) string {
+	var class strings.Builder
+	for _, part := range strings.Split(strings.ToLower(table), "_") {
+		if len(part) != 0 {
+			class.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return class.String()
+}
+
+// pythonKeywords are Python's reserved words, which can't name an attribute
+var pythonKeywords = []string{"False", "None", "True", "and", "as", "assert", "async", "await", "break", "class",
+	"continue", "def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import", "in",
+	"is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield"}
+
+// ormAttr returns the attribute mapping a column: its name, suffixed by "_col" if a Python keyword, or
+// otherwise reserved by the ORM (e.g., "metadata", in SQLAlchemy); the column keeps its name
+func ormAttr(col string, reserved []string) string {
+	if slices.Contains(pythonKeywords, col) || slices.Contains(reserved, strings.ToLower(col)) {
+		return col + "_col"
+	}
+	return col
+}
+
+// splitQualified splits a table name qualified by a schema (e.g., "refs.ref_sex") into the schema and the table
+func splitQualified(name string) (string, string) {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return schema, table
+	}
+	return "", name
+}
+
+// newORMModel builds the ormModel of the schema generated for a data dictionary: the main table's columns
+// are those of its DDL (see CreateMainTable), and its primary key is the row id column, if any, or else the
+// natural key, or else the household key and PERNUM (see longTableKey), declared or not; ref_tables are keyed
+// by their codes (the lowest, for ranges of codes), and dimension tables by their key. Long-format tables, the
+// data quality flag table, and variable group tables aren't mapped.
+//
+// returns error if the dump isn't SQL, or the main table can't be keyed
+func newORMModel(ddi *DataDict, dbfmtr *DatabaseFormatter) (ormModel, error) {
+	if !dbfmtr.writesSQL() {
+		return ormModel{}, fmt.Errorf("models map the tables of SQL dumps, not %s files", dbfmtr.Format)
+	}
+	var key []string
+	switch {
+	case len(dbfmtr.RowID) != 0:
+		key = []string{dbfmtr.columnName(dbfmtr.rowIDVar())}
+	case len(dbfmtr.NaturalKey) != 0:
+		key = dbfmtr.keyColumnNames(ddi, dbfmtr.NaturalKey)
+	default:
+		idx, err := dbfmtr.longTableKey(ddi)
+		if err != nil {
+			return ormModel{}, fmt.Errorf("models need a primary key: the row id (-row-id), the natural key (-natural-key), or the household: %w", err)
+		}
+		for _, ki := range idx {
+			col, _ := dbfmtr.factColumn(ddi.Vars[ki])
+			key = append(key, col)
+		}
+	}
+
+	var m ormModel
+	main := ormTable{name: dbfmtr.ident(dbfmtr.TableName), class: ormClass(dbfmtr.TableName)}
+	if len(dbfmtr.RowID) != 0 {
+		main.cols = append(main.cols, ormCol{name: dbfmtr.columnName(dbfmtr.rowIDVar()), sqlType: dbfmtr.sqlType("bigint"), comment: dbfmtr.rowIDVar().Label})
+	}
+	// ref_tables (or dimension tables) are added once the main table's columns refer to them
+	var refs []*ormTable
+	for _, v := range ddi.Vars {
+		if dbfmtr.setApart(v) {
+			continue
+		}
+		name, sqlType := dbfmtr.factColumn(v)
+		col := ormCol{name: name, sqlType: sqlType, comment: v.Label}
+		// in the star model, discrete variables without categories get no dimension table
+		if dbfmtr.hasRefTable(v) && (dbfmtr.Model != MODEL_STAR || dbfmtr.isDimension(v)) {
+			ref := newORMRefTable(dbfmtr, v)
+			switch {
+			case dbfmtr.isDimension(v):
+				col.comment += " (key of " + dbfmtr.dimTableName(v) + ")"
+				col.ref = &ormRef{table: ref, col: name, attr: dbfmtr.columnName(v) + "_dim"}
+			case hasCatRanges(v):
+				col.note = fmt.Sprintf("codes fall in ranges of %s (%s); no relationship", ref.class, strings.Join(dbfmtr.refTableCols(v)[:2], ", "))
+			default:
+				col.ref = &ormRef{table: ref, col: dbfmtr.refTableCols(v)[0], attr: dbfmtr.columnName(v) + "_ref"}
+			}
+			refs = append(refs, ref)
+		}
+		main.cols = append(main.cols, col)
+	}
+	for _, col := range dbfmtr.repWeightArrayColumns(ddi) {
+		main.cols = append(main.cols, ormCol{name: strings.Trim(col[0], "\"`"), sqlType: col[1], comment: col[2]})
+	}
+	appendedTypes := dbfmtr.appendedSQLTypes()
+	for i, v := range dbfmtr.appendedVars() {
+		main.cols = append(main.cols, ormCol{name: dbfmtr.columnName(v), sqlType: appendedTypes[i], comment: v.Label})
+	}
+	for i, col := range main.cols {
+		main.cols[i].pk = slices.Contains(key, col.name)
+	}
+	m.tables = append(m.tables, main)
+	for _, ref := range refs {
+		m.tables = append(m.tables, *ref)
+	}
+	return m, nil
+}
+
+// newORMRefTable returns the ormTable of a variable's ref_table (or dimension table, in the star model)
+func newORMRefTable(dbfmtr *DatabaseFormatter, v Var) *ormTable {
+	qualified := dbfmtr.refTableName(v)
+	if dbfmtr.isDimension(v) {
+		qualified = dbfmtr.dimTableName(v)
+	}
+	ref := &ormTable{}
+	ref.schema, ref.name = splitQualified(qualified)
+	ref.class = ormClass(ref.name)
+	if dbfmtr.isDimension(v) {
+		ref.cols = append(ref.cols, ormCol{name: dbfmtr.dimKeyColumn(v), sqlType: dbfmtr.sqlType("int"), comment: "surrogate key", pk: true})
+	}
+	cols := dbfmtr.refTableCols(v)
+	if len(cols) == 3 {
+		ref.cols = append(ref.cols,
+			ormCol{name: cols[0], sqlType: dbfmtr.columnSQLType(v), comment: "lowest coded value"},
+			ormCol{name: cols[1], sqlType: dbfmtr.columnSQLType(v), comment: "highest coded value"})
+	} else {
+		ref.cols = append(ref.cols, ormCol{name: cols[0], sqlType: dbfmtr.columnSQLType(v), comment: "coded value"})
+	}
+	if !dbfmtr.isDimension(v) {
+		ref.cols[0].pk = true
+	}
+	ref.cols = append(ref.cols, ormCol{name: cols[len(cols)-1], sqlType: dbfmtr.sqlType("string", maxCharsInLab), comment: "category label"})
+	return ref
+}
+
+// ormColType is the ORM equivalent of a SQL type
+type ormColType struct {
+	sqlAlchemy string // SQLAlchemy type (e.g., "sa.Numeric(9, 2)")
+	python     string // Python type of its values (e.g., "Decimal")
+	django     string // Django field, without its closing parenthesis (e.g., "models.DecimalField(max_digits=9, decimal_places=2")
+}
+
+// ormType returns the ORM equivalent of a SQL type, as named in the DDL (e.g., "numeric(9,2)", or "varchar2(6)");
+// types without one (e.g., of a literal type override) are mapped as strings
+func ormType(sqlType string) ormColType {
+	sqlType = strings.ToLower(strings.TrimSpace(sqlType))
+	if elem, ok := strings.CutSuffix(sqlType, "[]"); ok {
+		t := ormType(elem)
+		return ormColType{sqlAlchemy: "sa.ARRAY(" + t.sqlAlchemy + ")", python: "list[" + t.python + "]",
+			django: "ArrayField(" + t.django + "), null=True"}
+	}
+	base, params, _ := strings.Cut(sqlType, "(")
+	base = strings.TrimSpace(base)
+	var ps []int
+	for _, p := range strings.Split(strings.TrimSuffix(params, ")"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(p)); err == nil {
+			ps = append(ps, n)
+		}
+	}
+	switch base {
+	case "smallint", "int2", "tinyint":
+		return ormColType{"sa.SmallInteger()", "int", "models.SmallIntegerField("}
+	case "int", "integer", "int4", "mediumint":
+		return ormColType{"sa.Integer()", "int", "models.IntegerField("}
+	case "bigint", "int8":
+		return ormColType{"sa.BigInteger()", "int", "models.BigIntegerField("}
+	case "numeric", "decimal", "number":
+		switch {
+		case len(ps) == 0:
+			return ormColType{"sa.Numeric()", "Decimal", "models.FloatField("}
+		case len(ps) == 2 && ps[1] > 0:
+			return ormColType{fmt.Sprintf("sa.Numeric(%d, %d)", ps[0], ps[1]), "Decimal",
+				fmt.Sprintf("models.DecimalField(max_digits=%d, decimal_places=%d", ps[0], ps[1])}
+		case ps[0] <= 9:
+			return ormColType{"sa.Integer()", "int", "models.IntegerField("}
+		case ps[0] <= 19: // e.g., oracle's number(19)
+			return ormColType{"sa.BigInteger()", "int", "models.BigIntegerField("}
+		default:
+			return ormColType{fmt.Sprintf("sa.Numeric(%d, 0)", ps[0]), "Decimal",
+				fmt.Sprintf("models.DecimalField(max_digits=%d, decimal_places=0", ps[0])}
+		}
+	case "real", "float4", "binary_float", "float", "float8", "double", "double precision", "binary_double":
+		return ormColType{"sa.Float()", "float", "models.FloatField("}
+	case "date":
+		return ormColType{"sa.Date()", "datetime.date", "models.DateField("}
+	case "timestamp", "timestamp_ntz", "datetime", "datetime2":
+		return ormColType{"sa.DateTime()", "datetime.datetime", "models.DateTimeField("}
+	}
+	if len(ps) != 0 {
+		return ormColType{fmt.Sprintf("sa.String(%d)", ps[0]), "str", fmt.Sprintf("models.CharField(max_length=%d", ps[0])}
+	}
+	return ormColType{"sa.Text()", "str", "models.TextField("}
+}
+
+// emitSQLAlchemy generates a Python module of SQLAlchemy (2.0) declarative models of the generated schema
+// (see newORMModel): a model per table, a mapped column per column, with its type, and a relationship from
+// each column of the main table to the ref_table (or dimension table) its codes refer to. The models map the
+// tables the dump creates; the foreign keys relating them are declared in the models only.
+func emitSQLAlchemy(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	m, err := newORMModel(ddi, dbfmtr)
+	if err != nil {
+		return nil, err
+	}
+	reserved := []string{"metadata", "registry"}
+	var py strings.Builder
+	py.WriteString("# SQLAlchemy models generated by ipums2db\n")
+	py.WriteString("# the tables are created and loaded by the dump; foreign keys are declared here only, so\n")
+	py.WriteString("# don't create the tables from these models (e.g., with Base.metadata.create_all)\n")
+	py.WriteString("from __future__ import annotations\n\n")
+	py.WriteString("import datetime\nfrom decimal import Decimal\nfrom typing import Optional\n\n")
+	py.WriteString("import sqlalchemy as sa\n")
+	py.WriteString("from sqlalchemy.orm import DeclarativeBase, Mapped, mapped_column, relationship\n\n\n")
+	py.WriteString("class Base(DeclarativeBase):\n    pass\n")
+	for _, t := range m.tables {
+		py.WriteString(fmt.Sprintf("\n\nclass %s(Base):\n", t.class))
+		py.WriteString(fmt.Sprintf("    __tablename__ = %s\n", strconv.Quote(t.name)))
+		if len(t.schema) != 0 {
+			py.WriteString(fmt.Sprintf("    __table_args__ = {\"schema\": %s}\n", strconv.Quote(t.schema)))
+		}
+		py.WriteString("\n")
+		var rels []string
+		for _, c := range t.cols {
+			ct := ormType(c.sqlType)
+			args := []string{strconv.Quote(c.name), ct.sqlAlchemy}
+			if c.ref != nil {
+				args = append(args, fmt.Sprintf("sa.ForeignKey(%s)", strconv.Quote(c.ref.table.qualified()+"."+c.ref.col)))
+				rels = append(rels, fmt.Sprintf("    %s: Mapped[Optional[%s]] = relationship()\n", ormAttr(c.ref.attr, reserved), c.ref.table.class))
+			}
+			pyType := fmt.Sprintf("Optional[%s]", ct.python)
+			if c.pk {
+				args = append(args, "primary_key=True")
+				pyType = ct.python
+			}
+			if len(c.comment) != 0 {
+				args = append(args, "comment="+strconv.Quote(c.comment))
+			}
+			if len(c.note) != 0 {
+				py.WriteString(fmt.Sprintf("    # %s\n", c.note))
+			}
+			py.WriteString(fmt.Sprintf("    %s: Mapped[%s] = mapped_column(%s)\n", ormAttr(c.name, reserved), pyType, strings.Join(args, ", ")))
+		}
+		if len(rels) != 0 {
+			py.WriteString("\n" + strings.Join(rels, ""))
+		}
+	}
+	return []byte(py.String()), nil
+}
+
+// emitDjango generates a Python module of Django models of the generated schema (see newORMModel): unmanaged
+// models, mapping the tables the dump creates, with a field per column, and a foreign key (without a database
+// constraint) from each column of the main table to the ref_table (or dimension table) its codes refer to.
+// Main tables keyed by several columns get a composite primary key (Django 5.2 or newer).
+func emitDjango(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	m, err := newORMModel(ddi, dbfmtr)
+	if err != nil {
+		return nil, err
+	}
+	// Django's own names; "id" names the implicit primary key, unless it's the primary key itself
+	reserved := []string{"pk", "objects", "id"}
+	var models strings.Builder
+	var usesArrays bool
+	for _, t := range m.tables {
+		models.WriteString(fmt.Sprintf("\n\nclass %s(models.Model):\n", t.class))
+		var pks []string
+		for _, c := range t.cols {
+			if c.pk {
+				pks = append(pks, ormAttr(c.name, reserved))
+			}
+		}
+		if len(pks) > 1 {
+			quoted := make([]string, len(pks))
+			for i, pk := range pks {
+				quoted[i] = strconv.Quote(pk)
+			}
+			models.WriteString(fmt.Sprintf("    pk = models.CompositePrimaryKey(%s)\n", strings.Join(quoted, ", ")))
+		}
+		for _, c := range t.cols {
+			ct := ormType(c.sqlType)
+			usesArrays = usesArrays || strings.HasPrefix(ct.django, "ArrayField")
+			attr := ormAttr(c.name, reserved)
+			var args []string
+			field := ct.django
+			if c.ref != nil {
+				// the foreign key's attribute is the referred row; its value is the attribute suffixed by "_id"
+				field = "models.ForeignKey(" + strconv.Quote(c.ref.table.class)
+				args = append(args, "models.DO_NOTHING", "to_field="+strconv.Quote(ormAttr(c.ref.col, reserved)), "db_constraint=False", `related_name="+"`)
+			}
+			if attr != c.name || c.ref != nil {
+				args = append(args, "db_column="+strconv.Quote(c.name))
+			}
+			switch {
+			case c.pk && len(pks) == 1:
+				args = append(args, "primary_key=True")
+			case !c.pk && !strings.HasPrefix(ct.django, "ArrayField"):
+				args = append(args, "null=True")
+			}
+			if len(c.comment) != 0 {
+				args = append(args, "db_comment="+strconv.Quote(c.comment))
+			}
+			if len(c.note) != 0 {
+				models.WriteString(fmt.Sprintf("    # %s\n", c.note))
+			}
+			sep := ""
+			if !strings.HasSuffix(field, "(") && len(args) != 0 {
+				sep = ", "
+			}
+			models.WriteString(fmt.Sprintf("    %s = %s%s%s)\n", attr, field, sep, strings.Join(args, ", ")))
+		}
+		models.WriteString("\n    class Meta:\n        managed = False\n")
+		table := t.name
+		if len(t.schema) != 0 {
+			// Django has no notion of schemas; quoting the qualified name works in postgres and oracle
+			table = fmt.Sprintf(`"%s"."%s"`, t.schema, t.name)
+		}
+		models.WriteString(fmt.Sprintf("        db_table = %s\n", strconv.Quote(table)))
+	}
+
+	var py strings.Builder
+	py.WriteString("# Django models generated by ipums2db\n")
+	py.WriteString("# the tables are created and loaded by the dump, so the models are unmanaged (no migrations)\n")
+	if usesArrays {
+		py.WriteString("from django.contrib.postgres.fields import ArrayField\n")
+	}
+	py.WriteString("from django.db import models\n")
+	py.WriteString(models.String())
+	return []byte(py.String()), nil
+}
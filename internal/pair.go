@@ -0,0 +1,106 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// extractPairs pairs DDI and fixed-width files sharing a basename in the same directory ("<name>.xml", and
+// either "<name>.dat" or "<name>.dat.gz"), sorted by name; if both "<name>.dat" and "<name>.dat.gz" exist,
+// the uncompressed file is used. Other files are ignored.
+func extractPairs(files []string) []ExtractPair {
+	have := make(map[string]bool, len(files))
+	for _, f := range files {
+		have[filepath.Clean(f)] = true
+	}
+	var pairs []ExtractPair
+	for f := range have {
+		stem, isXML := strings.CutSuffix(f, ".xml")
+		if !isXML {
+			continue
+		}
+		var datPath string
+		switch {
+		case have[stem+".dat"]:
+			datPath = stem + ".dat"
+		case have[stem+".dat.gz"]:
+			datPath = stem + ".dat.gz"
+		default:
+			continue
+		}
+		pairs = append(pairs, ExtractPair{Name: filepath.Base(stem), DDIPath: f, DatPath: datPath})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Name != pairs[j].Name {
+			return pairs[i].Name < pairs[j].Name
+		}
+		return pairs[i].DDIPath < pairs[j].DDIPath
+	})
+	return pairs
+}
+
+// PairExtract finds the one extract among paths: files (e.g., "usa_00012*", as expanded by the shell), whose
+// DDI and fixed-width file are paired by basename (see extractPairs), and directories, whose files are
+// considered alike. Patterns left unexpanded (e.g., quoted, or by shells that don't expand them) are
+// expanded. Failing a pair, a lone zip archive (e.g., "usa_00012.zip") is the extract (see UnzipMember).
+//
+// returns error if a path doesn't exist, or if paths hold no extract, or several
+func PairExtract(paths []string) (ExtractPair, error) {
+	if len(paths) == 0 {
+		return ExtractPair{}, fmt.Errorf("provide the extract's directory, or its files (e.g., ./downloads/usa_00012*)")
+	}
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			matches, globErr := filepath.Glob(p)
+			if globErr != nil || len(matches) == 0 {
+				return ExtractPair{}, err
+			}
+			files = append(files, matches...)
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return ExtractPair{}, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(p, e.Name()))
+			}
+		}
+	}
+	pairs := extractPairs(files)
+	if len(pairs) == 0 {
+		var zips []string
+		for _, f := range files {
+			if IsZipPath(f) {
+				zips = append(zips, f)
+			}
+		}
+		if len(zips) == 1 {
+			return ExtractPair{Name: strings.TrimSuffix(filepath.Base(zips[0]), filepath.Ext(zips[0])), DDIPath: zips[0], DatPath: zips[0]}, nil
+		}
+	}
+	switch len(pairs) {
+	case 0:
+		return ExtractPair{}, fmt.Errorf("no <name>.xml and <name>.dat[.gz] pair (or lone .zip) found in %s", strings.Join(paths, ", "))
+	case 1:
+		return pairs[0], nil
+	default:
+		names := make([]string, len(pairs))
+		for i, p := range pairs {
+			names[i] = p.Name
+		}
+		return ExtractPair{}, fmt.Errorf("several extracts found (%s); name one (e.g., %s*)", strings.Join(names, ", "), filepath.Join(filepath.Dir(pairs[0].DDIPath), pairs[0].Name))
+	}
+}
@@ -16,7 +16,10 @@ import "fmt"
 // with a combination of N parser goroutines at any one time could mean N * maxBytesPerJob of memory allocated
 // to storing the file contents at any one time. For small files, this will not be a concern. But imagine 7 spawned
 // parser goroutines each parsing, at any given moment, 262144000 bytes (250 MiB), meaning ~1.70 GiB of memory.
-func MakeParsingJobsStream(bytesPerRow, totBytes, maxBytesPerJob int, jobsStream chan ParsingJob) error {
+//
+// If rowsPerPart is positive, rows are assigned to insertion files (parts) in contiguous ranges of rowsPerPart
+// rows (see DumpWriter.AssignRows); jobs don't cross the boundaries of parts, and are tagged with their part.
+func MakeParsingJobsStream(bytesPerRow, totBytes, maxBytesPerJob, rowsPerPart int, jobsStream chan ParsingJob) error {
 	if maxBytesPerJob > totBytes {
 		return fmt.Errorf("maxBytesPerJob (%d) cannot be greater than totBytes (%d)", maxBytesPerJob, totBytes)
 	}
@@ -32,16 +35,18 @@ func MakeParsingJobsStream(bytesPerRow, totBytes, maxBytesPerJob int, jobsStream
 	// nJobs := totRows / rowsPerJob
 
 	defer close(jobsStream)
-	onRow := 0
+	onRow, index := 0, 0
 	for onRow <= totRows {
-		if rowsPerJob >= (totRows - onRow) {
-			lastJob := ParsingJob{onRow, (totRows - onRow)}
-			jobsStream <- lastJob
+		rows, part := min(rowsPerJob, totRows-onRow), 0
+		if rowsPerPart > 0 {
+			rows, part = min(rows, rowsPerPart-onRow%rowsPerPart), onRow/rowsPerPart
+		}
+		jobsStream <- ParsingJob{onRow, rows, index, part}
+		onRow += rows
+		index++
+		if onRow >= totRows {
 			break
 		}
-		job := ParsingJob{onRow, rowsPerJob}
-		jobsStream <- job
-		onRow += rowsPerJob
 	}
 	return nil
 }
@@ -51,7 +56,11 @@ func MakeParsingJobsStream(bytesPerRow, totBytes, maxBytesPerJob int, jobsStream
 //
 // The job requires a DatabaseFormatter to start
 // reading at row StartAtRow, and read through RowsToRead rows.
+// Index numbers the jobs in file order (0, 1, ...), and Part is the index of the
+// insertion file the rows are assigned to, if any (see DumpWriter.AssignRows).
 type ParsingJob struct {
 	StartAtRow int
 	RowsToRead int
+	Index      int
+	Part       int
 }
@@ -0,0 +1,455 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types of postgres' binary COPY format, as the columns of the main table are written (see copyType)
+const (
+	copyInt2 = iota
+	copyInt4
+	copyInt8
+	copyFloat4
+	copyFloat8
+	copyNumeric
+	copyText
+	copyDate
+)
+
+// copySignature opens every binary COPY file, followed by the flags field, and the header extension's length
+var copySignature = []byte("PGCOPY\n\xff\r\n\x00")
+
+// copyTrailer ends every binary COPY file: a tuple of -1 fields
+var copyTrailer = []byte{0xff, 0xff}
+
+// copyEpoch is the origin of postgres dates, which binary COPY counts the days since
+var copyEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// copyTypes map postgres types, as named in the DDL (lowercased, without their parameters), to their binary
+// COPY types; columns of other types (e.g., of a literal type override) can't be written
+var copyTypes = map[string]int{
+	"smallint": copyInt2, "int2": copyInt2,
+	"int": copyInt4, "integer": copyInt4, "int4": copyInt4,
+	"bigint": copyInt8, "int8": copyInt8,
+	"real": copyFloat4, "float4": copyFloat4,
+	"double precision": copyFloat8, "float8": copyFloat8, "float": copyFloat8,
+	"numeric": copyNumeric, "decimal": copyNumeric,
+	"varchar": copyText, "character varying": copyText, "text": copyText, "char": copyText, "character": copyText, "bpchar": copyText,
+	"date": copyDate,
+}
+
+// copyParts are the insertion files of binary COPY dumps: data files, of the form data_{i}.pgcopy
+var copyParts = dumpParts{nameFmt: "data_%d.pgcopy", schemaName: "ddl.sql", ext: ".sql", wrap: newCopyFile}
+
+// copyLoaderName is the name of the script loading a binary COPY dump (see copyLoader)
+const copyLoaderName = "load.sh"
+
+// copiesBinary reports whether rows are written as postgres binary COPY files, loaded by the dump's loader
+// script (see copyLoader), rather than as inserts
+func (dbf *DatabaseFormatter) copiesBinary() bool {
+	return dbf.Format == FORMAT_PGCOPY
+}
+
+// copyType returns the binary COPY type of a column of a SQL type (e.g., "numeric(9,2)")
+//
+// returns error if the type has no binary COPY type
+func copyType(col, sqlType string) (int, error) {
+	name, _, _ := strings.Cut(strings.ToLower(sqlType), "(")
+	if t, ok := copyTypes[strings.TrimSpace(name)]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("column %s: %s columns can't be written in binary COPY format; override its type (see -types)", col, sqlType)
+}
+
+// copyColumnTypes returns the binary COPY types of the main table's columns, in order: the row id column, if
+// any, the variables' columns, then the appended columns
+//
+// returns error if a column's type has no binary COPY type, or the output isn't for postgres
+func (dbf *DatabaseFormatter) copyColumnTypes(ddi *DataDict) ([]int, error) {
+	if dbf.DbType != POSTGRES {
+		return nil, fmt.Errorf("binary COPY files are loaded by postgres (-b postgres), not %s", dbf.DbType)
+	}
+	var types []int
+	add := func(col, sqlType string) error {
+		t, err := copyType(col, sqlType)
+		types = append(types, t)
+		return err
+	}
+	if len(dbf.RowID) != 0 {
+		if err := add(dbf.RowID, dbf.sqlType("bigint")); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range ddi.Vars {
+		col, sqlType := dbf.factColumn(v)
+		if err := add(col, sqlType); err != nil {
+			return nil, err
+		}
+	}
+	vars := dbf.appendedVars()
+	for i, sqlType := range dbf.appendedSQLTypes() {
+		if err := add(dbf.columnName(vars[i]), sqlType); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+// checkCopyTypes ensures that, if rows are written as binary COPY files, every column of the main table
+// can be (see copyColumnTypes)
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkCopyTypes(ddi *DataDict) error {
+	if !dbf.copiesBinary() {
+		return nil
+	}
+	_, err := dbf.copyColumnTypes(ddi)
+	return err
+}
+
+// copyRecord generates a tuple of a binary COPY file from a fixed-width row, in place of an insertion tuple (see
+// insertTuple), given the columns' binary COPY types (see copyColumnTypes): the number of fields, then each
+// field's length (-1 if null), and bytes. Numbers are parsed as they'd be inserted.
+//
+// returns error if start and end positions are not valid for row, or if a field cannot be parsed, or doesn't
+// fit its type
+func (dbf *DatabaseFormatter) copyRecord(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string, types []int) ([]byte, error) {
+	record := binary.BigEndian.AppendUint16(make([]byte, 0, 2*len(row)), uint16(len(types)))
+	var err error
+	if len(dbf.RowID) != 0 {
+		if record, err = appendCopyValue(record, types[0], strconv.Itoa(rowNum)); err != nil {
+			return nil, fmt.Errorf("column %s: %w", dbf.RowID, err)
+		}
+		types = types[1:]
+	}
+	for i, v := range ddi.Vars {
+		start, end := v.Location.Start-1, v.Location.End
+		if (start < 0) || (end > len(row)) {
+			return nil, fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+		}
+		colType := colTypes[v.Name]
+		chars, isNull, err := applyNullPolicy(row[start:end], nullPolicies[i], colType == "string")
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		if !isNull {
+			if chars, isNull, err = dbf.transformChars(v, chars); err != nil {
+				return nil, err
+			}
+		}
+		if isNull {
+			record = appendCopyNull(record)
+			continue
+		}
+		val := string(chars)
+		switch {
+		case dbf.dims[v.Name] != nil:
+			val, err = dbf.dimKey(v, chars)
+		case colType != "string":
+			dcml := 0
+			if colType == "float" {
+				dcml = v.DecimalPoint
+			}
+			val, err = fixedWidthNumber(chars, dcml)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		if record, err = appendCopyValue(record, types[i], val); err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+	}
+	if dbf.hasAppended() {
+		vals, err := dbf.appendedFromRow(ddi, row, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		return dbf.appendCopyAppended(record, vals, types[len(ddi.Vars):])
+	}
+	return record, nil
+}
+
+// copyRecords generates tuples of a binary COPY file (see copyRecord) from comma-delimited records, in place
+// of insertion statements (see BulkInsertRecords); fields are in the order of the data dictionary.
+//
+// returns error if any record cannot be parsed.
+func (dbf *DatabaseFormatter) copyRecords(ddi *DataDict, records [][]string, firstRow int, colIdx []int) ([]byte, error) {
+	types, err := dbf.copyColumnTypes(ddi)
+	if err != nil {
+		return nil, err
+	}
+	varTypes := types
+	if len(dbf.RowID) != 0 {
+		varTypes = types[1:]
+	}
+	var out []byte
+	for r, rec := range records {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(types)))
+		if len(dbf.RowID) != 0 {
+			if out, err = appendCopyValue(out, types[0], strconv.Itoa(firstRow+r)); err != nil {
+				return nil, fmt.Errorf("record %v: column %s: %w", rec, dbf.RowID, err)
+			}
+		}
+		for i, v := range ddi.Vars {
+			var field string
+			if colIdx[i] >= 0 && colIdx[i] < len(rec) {
+				field = strings.TrimSpace(rec[colIdx[i]])
+			}
+			if len(field) != 0 {
+				if field, _, err = dbf.transformField(v, field, 0); err != nil {
+					return nil, fmt.Errorf("record %v: %w", rec, err)
+				}
+			}
+			if len(field) == 0 {
+				out = appendCopyNull(out)
+				continue
+			}
+			if out, err = appendCopyValue(out, varTypes[i], field); err != nil {
+				return nil, fmt.Errorf("record %v: variable %s: %w", rec, v.Name, err)
+			}
+		}
+		if dbf.hasAppended() {
+			vals, err := dbf.appendedFromRecord(rec, colIdx)
+			if err == nil {
+				out, err = dbf.appendCopyAppended(out, vals, varTypes[len(ddi.Vars):])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", rec, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// appendCopyAppended appends the values of the appended columns (see appendedFromRow) to a binary COPY tuple,
+// given their binary COPY types
+//
+// returns error if a value doesn't fit its type
+func (dbf *DatabaseFormatter) appendCopyAppended(record []byte, vals []string, types []int) ([]byte, error) {
+	vars := dbf.appendedVars()
+	for i, t := range types {
+		if len(vals[i]) == 0 {
+			record = appendCopyNull(record)
+			continue
+		}
+		var err error
+		if record, err = appendCopyValue(record, t, vals[i]); err != nil {
+			return nil, fmt.Errorf("column %s: %w", vars[i].Name, err)
+		}
+	}
+	return record, nil
+}
+
+// appendCopyNull appends a null field to a binary COPY tuple
+func appendCopyNull(record []byte) []byte {
+	return binary.BigEndian.AppendUint32(record, math.MaxUint32) // -1
+}
+
+// appendCopyValue appends a field to a binary COPY tuple: a value (a number, as formatted by fixedWidthNumber,
+// a date, as formatted by dateLayout, or a string) in a binary COPY type, preceded by its length
+//
+// returns error if the value doesn't fit the type
+func appendCopyValue(record []byte, t int, val string) ([]byte, error) {
+	switch t {
+	case copyInt2, copyInt4, copyInt8:
+		bits := 64
+		switch t {
+		case copyInt2:
+			bits = 16
+		case copyInt4:
+			bits = 32
+		}
+		n, err := strconv.ParseInt(val, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a %d-bit integer", val, bits)
+		}
+		record = binary.BigEndian.AppendUint32(record, uint32(bits/8))
+		switch t {
+		case copyInt2:
+			return binary.BigEndian.AppendUint16(record, uint16(n)), nil
+		case copyInt4:
+			return binary.BigEndian.AppendUint32(record, uint32(n)), nil
+		default:
+			return binary.BigEndian.AppendUint64(record, uint64(n)), nil
+		}
+	case copyFloat4, copyFloat8:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", val)
+		}
+		if t == copyFloat4 {
+			record = binary.BigEndian.AppendUint32(record, 4)
+			return binary.BigEndian.AppendUint32(record, math.Float32bits(float32(f))), nil
+		}
+		record = binary.BigEndian.AppendUint32(record, 8)
+		return binary.BigEndian.AppendUint64(record, math.Float64bits(f)), nil
+	case copyNumeric:
+		num, err := copyNumericValue(val)
+		if err != nil {
+			return nil, err
+		}
+		record = binary.BigEndian.AppendUint32(record, uint32(len(num)))
+		return append(record, num...), nil
+	case copyDate:
+		d, err := time.Parse(dateLayout, val)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a date", val)
+		}
+		record = binary.BigEndian.AppendUint32(record, 4)
+		return binary.BigEndian.AppendUint32(record, uint32(int32((d.Unix()-copyEpoch.Unix())/(24*60*60)))), nil
+	default:
+		record = binary.BigEndian.AppendUint32(record, uint32(len(val)))
+		return append(record, val...), nil
+	}
+}
+
+// copyNumericValue returns the binary representation of a decimal number (e.g., "-1234.50") as a postgres
+// numeric: its number of base-10000 digits, the weight of the first digit, its sign, and its scale (the
+// decimal digits after the point), followed by the digits, leading and trailing zero digits left out.
+// Numbers in exponent notation (e.g., "1.5e3") are written out in full.
+//
+// returns error if val is not a number
+func copyNumericValue(val string) ([]byte, error) {
+	neg := strings.HasPrefix(val, "-")
+	digits := strings.TrimLeft(val, "+-")
+	if strings.ContainsAny(digits, "eE") {
+		f, err := strconv.ParseFloat(digits, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("'%s' is not a number", val)
+		}
+		digits = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	intPart, frac, _ := strings.Cut(digits, ".")
+	if len(intPart)+len(frac) == 0 || strings.Trim(intPart+frac, "0123456789") != "" || len(val)-len(digits) > 1 {
+		return nil, fmt.Errorf("'%s' is not a number", val)
+	}
+	scale := len(frac)
+	intPart = strings.TrimLeft(intPart, "0")
+	intPart = strings.Repeat("0", (4-len(intPart)%4)%4) + intPart
+	frac += strings.Repeat("0", (4-len(frac)%4)%4)
+	all := intPart + frac
+	groups := make([]uint16, len(all)/4)
+	for i := range groups {
+		n, _ := strconv.Atoi(all[4*i : 4*i+4])
+		groups[i] = uint16(n)
+	}
+	weight := len(intPart)/4 - 1
+	for len(groups) > 0 && groups[0] == 0 {
+		groups, weight = groups[1:], weight-1
+	}
+	for len(groups) > 0 && groups[len(groups)-1] == 0 {
+		groups = groups[:len(groups)-1]
+	}
+	sign := uint16(0x0000)
+	switch {
+	case len(groups) == 0:
+		weight = 0
+	case neg:
+		sign = 0x4000
+	}
+	num := binary.BigEndian.AppendUint16(nil, uint16(len(groups)))
+	num = binary.BigEndian.AppendUint16(num, uint16(int16(weight)))
+	num = binary.BigEndian.AppendUint16(num, sign)
+	num = binary.BigEndian.AppendUint16(num, uint16(scale))
+	for _, g := range groups {
+		num = binary.BigEndian.AppendUint16(num, g)
+	}
+	return num, nil
+}
+
+// NewCopyDumpWriter returns a DumpWriter of a postgres binary COPY dump: a directory holding ddl.sql, the
+// binary COPY data files (data_{i}.pgcopy), in place of insertion files, and the script loading them (see
+// copyLoader), written along with the DDL. Split limits apply to the data files.
+//
+// returns error if dirName is an object storage URL
+func NewCopyDumpWriter(totBytes int, dirName string, split OutputSplit) (DumpWriter, error) {
+	if IsObjectURL(dirName) {
+		return DumpWriter{}, fmt.Errorf("binary COPY dumps can't be written to object storage; write to a local directory")
+	}
+	dw, err := newDumpWriter(totBytes, dirName, true, split, copyParts)
+	if err != nil {
+		return DumpWriter{}, err
+	}
+	dw.copied = true
+	return dw, nil
+}
+
+// copyFile is a DumpFile written as a binary COPY file: the header is written up front, each write, which must
+// be whole tuples (see copyRecord), is appended to it, and closing writes the trailer
+type copyFile struct {
+	f *os.File
+}
+
+// newCopyFile writes the header of a binary COPY file to f, returning it as a copyFile
+//
+// returns error if the header cannot be written
+func newCopyFile(f *os.File) (DumpFile, error) {
+	header := append(append([]byte{}, copySignature...), make([]byte, 8)...) // no flags, and no header extension
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return &copyFile{f: f}, nil
+}
+
+// Write appends tuples to the file
+func (cf *copyFile) Write(p []byte) (int, error) {
+	return cf.f.Write(p)
+}
+
+// Close writes the trailer, and closes the file
+func (cf *copyFile) Close() error {
+	_, err := cf.f.Write(copyTrailer)
+	if closeErr := cf.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Name returns the file name
+func (cf *copyFile) Name() string {
+	return cf.f.Name()
+}
+
+// copyLoader generates the script loading a binary COPY dump (see NewCopyDumpWriter) with psql, from the
+// dump's directory: ddl.sql creates the tables, each data file is then copied into the main table (psql's
+// \copy reads local files), and post.sql, if any, ends the load. psql options (e.g., -h host -d db) are
+// passed on by the script.
+func (dbf *DatabaseFormatter) copyLoader() []byte {
+	table := dbf.ident(dbf.TableName)
+	if len(dbf.UseSchema) != 0 {
+		table = dbf.ident(dbf.UseSchema) + "." + table
+	}
+	var sh strings.Builder
+	sh.WriteString("#!/bin/sh\n")
+	sh.WriteString("# loads this binary COPY dump (generated by ipums2db) into postgres: ddl.sql creates the tables, each\n")
+	sh.WriteString("# data file is copied into the main table, and post.sql, if any, ends the load. psql options are passed on:\n")
+	sh.WriteString("#   sh " + copyLoaderName + " -h localhost -d mydb -U me\n")
+	sh.WriteString("set -e\n")
+	sh.WriteString("cd \"$(dirname \"$0\")\"\n")
+	sh.WriteString("psql -X -v ON_ERROR_STOP=1 \"$@\" -f ddl.sql\n")
+	sh.WriteString(fmt.Sprintf("for f in %s; do\n", strings.Replace(copyParts.nameFmt, "%d", "*", 1)))
+	sh.WriteString("\t[ -e \"$f\" ] || continue\n")
+	sh.WriteString(fmt.Sprintf("\tpsql -X -v ON_ERROR_STOP=1 \"$@\" -c \"\\\\copy %s FROM '$f' WITH (FORMAT binary)\"\n", table))
+	sh.WriteString("done\n")
+	sh.WriteString("if [ -e post.sql ]; then\n")
+	sh.WriteString("\tpsql -X -v ON_ERROR_STOP=1 \"$@\" -f post.sql\n")
+	sh.WriteString("fi\n")
+	return []byte(sh.String())
+}
+
+// writeCopyLoader writes the loader script of a binary COPY dump (see copyLoader) to its directory, executable
+func (dw DumpWriter) writeCopyLoader(dbfmtr *DatabaseFormatter) error {
+	if err := dw.writeDirFile(copyLoaderName, dbfmtr.copyLoader()); err != nil {
+		return err
+	}
+	return os.Chmod(filepath.Join(dw.staging, copyLoaderName), 0o755)
+}
@@ -0,0 +1,179 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Data quality flag handling (see QFlags)
+const (
+	QFLAGS_SIDE string = "side" // flags are moved to a side table, with a row per row of the main table
+	QFLAGS_DROP string = "drop" // flags are left out of the dump
+)
+
+// QFlags sets the data quality flag variables of an extract (e.g., QAGE, QINCWAGE, flagging allocated or
+// edited values of AGE and INCWAGE), which can double the column count, apart from the main table: either
+// in a side table of their own, with a row per row of the main table, keyed like it, or nowhere at all.
+type QFlags struct {
+	mode     string   // QFLAGS_SIDE or QFLAGS_DROP
+	patterns []string // lowercased glob patterns of flag variable names (e.g., "q*"); if none, flags are detected
+
+	// set by checkQFlags
+	flagged map[string]bool // names of flag variables
+	idx     []int           // index of each flag variable in the data dictionary
+	key     []int           // side table: indices of the variables linking flags to their row (see longTableKey)
+}
+
+// NewQFlags returns a QFlags setting apart the data quality flags of an extract, in a mode (QFLAGS_SIDE, or
+// QFLAGS_DROP), named by the -qflags flag argument; if no mode is given, it returns nil (nothing is set
+// apart). Flags are the variables matching any of the comma-delimited glob patterns of the -qflag-vars flag
+// argument (e.g., "Q*,*_FLAG"), case-insensitively; if none are given, they're the variables named Q,
+// followed by the name of another variable of the extract (e.g., QAGE, of AGE).
+//
+// returns error if the mode is not recognized, or a pattern is malformed
+func NewQFlags(qflagsF, patternsF string) (*QFlags, error) {
+	mode := strings.ToLower(strings.TrimSpace(qflagsF))
+	switch mode {
+	case "":
+		if len(strings.TrimSpace(patternsF)) != 0 {
+			return nil, fmt.Errorf("flag variables are matched for -qflags %s or %s only", QFLAGS_SIDE, QFLAGS_DROP)
+		}
+		return nil, nil
+	case QFLAGS_SIDE, QFLAGS_DROP:
+	default:
+		return nil, fmt.Errorf("'%s' is not a data quality flag mode (%s or %s)", qflagsF, QFLAGS_SIDE, QFLAGS_DROP)
+	}
+	qf := &QFlags{mode: mode}
+	if len(strings.TrimSpace(patternsF)) == 0 {
+		return qf, nil
+	}
+	for _, p := range strings.Split(patternsF, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if _, err := path.Match(p, ""); len(p) == 0 || err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid variable name pattern", p)
+		}
+		if !slices.Contains(qf.patterns, p) {
+			qf.patterns = append(qf.patterns, p)
+		}
+	}
+	return qf, nil
+}
+
+// flags reports whether a variable is a data quality flag set apart from the main table
+func (qf *QFlags) flags(v Var) bool {
+	return qf != nil && qf.flagged[v.Name]
+}
+
+// drops reports whether a variable is a data quality flag left out of the dump
+func (qf *QFlags) drops(v Var) bool {
+	return qf.flags(v) && qf.mode == QFLAGS_DROP
+}
+
+// side reports whether data quality flags are moved to a side table
+func (qf *QFlags) side() bool {
+	return qf != nil && qf.mode == QFLAGS_SIDE
+}
+
+// matches reports whether a variable of the data dictionary is a data quality flag: it matches one of the
+// patterns, if any, or else it's named Q, followed by the name of another variable
+func (qf *QFlags) matches(ddi *DataDict, v Var) bool {
+	name := strings.ToLower(v.Name)
+	if len(qf.patterns) != 0 {
+		return slices.ContainsFunc(qf.patterns, func(p string) bool {
+			ok, _ := path.Match(p, name)
+			return ok
+		})
+	}
+	flagged, ok := strings.CutPrefix(name, "q")
+	if !ok || len(flagged) == 0 {
+		return false
+	}
+	_, ok = findVar(ddi, flagged)
+	return ok
+}
+
+// checkQFlags finds the data quality flags of the data dictionary (see QFlags.matches), ensuring that there
+// are some, and that they can be set apart: it's for SQL insert dumps of microdata extracts only, and side
+// tables need a key linking flags to their row (see longTableKey), which can't be a flag itself. Replicate
+// weights and melted variables, already set apart, aren't flags.
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkQFlags(ddi *DataDict) error {
+	qf := dbf.QFlags
+	if qf == nil {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("data quality flags are set apart in microdata extracts only")
+	case !dbf.writesInserts():
+		return fmt.Errorf("data quality flags are set apart in SQL insert dumps only")
+	}
+	qf.flagged, qf.idx, qf.key = make(map[string]bool), nil, nil
+	for i, v := range ddi.Vars {
+		if dbf.RepWeights.groups(v) || dbf.Melts.melts(v) || !qf.matches(ddi, v) {
+			continue
+		}
+		qf.flagged[v.Name] = true
+		qf.idx = append(qf.idx, i)
+	}
+	if len(qf.idx) == 0 {
+		return fmt.Errorf("no variables are data quality flags")
+	}
+	if !qf.side() {
+		return nil
+	}
+	key, err := dbf.longTableKey(ddi)
+	if err != nil {
+		return fmt.Errorf("data quality flag tables are keyed by the row id (-row-id), or the household: %w", err)
+	}
+	for _, ki := range key {
+		if qf.flagged[ddi.Vars[ki].Name] {
+			return fmt.Errorf("variable %s keys the data quality flag table, so it can't be a flag", ddi.Vars[ki].Name)
+		}
+	}
+	qf.key = key
+	return nil
+}
+
+// qflagTable returns the name of the side table of data quality flags (e.g., "ipums_tab_qflags")
+func (dbf *DatabaseFormatter) qflagTable() string {
+	return dbf.ident(dbf.derivedName("qflags"))
+}
+
+// CreateQFlagTable generates the "CREATE TABLE" and "CREATE INDEX" statements of the side table of data
+// quality flags: a column per flag, and a row per row of the main table, keyed like it.
+//
+// For example, the flags of an IPUMS CPS extract would generate:
+//
+// CREATE TABLE ipums_tab_qflags (
+//
+//	"year" int,
+//	"serial" int,
+//	"pernum" int,
+//	"qage" int,	-- Data quality flag for AGE
+//	"qincwage" int	-- Data quality flag for INCWAGE
+//
+// );
+//
+// CREATE INDEX idx_ipums_tab_qflags ON ipums_tab_qflags ("year", "serial", "pernum");
+//
+// returns empty byte slice if flags aren't moved to a side table
+func (dbf *DatabaseFormatter) CreateQFlagTable(ddi *DataDict) []byte {
+	if !dbf.QFlags.side() {
+		return []byte{}
+	}
+	return []byte(dbf.createSideTable(ddi, dbf.qflagTable(), dbf.tableObjectName(DEFAULT_DERIVED_INDEX, dbf.derivedName("qflags"), nil), dbf.QFlags.key, dbf.QFlags.idx))
+}
+
+// qflagInserts generates the insert statement of the side table of data quality flags (see CreateQFlagTable)
+// for a buffer of fixed-width rows, given the (1-based) number of each row in the file
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) qflagInserts(ddi *DataDict, buffer []byte, bytesPerLine int, rowNums []int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	return dbf.sideTableInserts(ddi, dbf.qflagTable(), dbf.QFlags.key, dbf.QFlags.idx, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+}
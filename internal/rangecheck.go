@@ -0,0 +1,161 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// topCodeRe matches the category labels of top codes of continuous variables (e.g., INCWAGE's 999998,
+// "Top coded"), the highest values of variables without declared valid ranges
+var topCodeRe = regexp.MustCompile(`(?i)\btop[- ]?cod(e|ed|ing)\b`)
+
+// numRange is a range of valid values of a variable, in the variable's units; lo is -Inf, or hi +Inf,
+// if left open
+type numRange struct {
+	lo, hi float64
+}
+
+// checkRangeChecks ensures that range CHECK constraints can be written: snowflake has none, and mysql
+// enforces them from 8.0.16 onward, having parsed and ignored them before
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkRangeChecks() error {
+	if !dbf.RangeChecks {
+		return nil
+	}
+	switch {
+	case dbf.DbType == SNOWFLAKE:
+		return fmt.Errorf("snowflake has no CHECK constraints")
+	case dbf.DbType == MYSQL && dbf.DbVersion != nil && dbf.DbVersion.less(DbVersion{8, 0, 16}):
+		return fmt.Errorf("CHECK constraints are ignored by mysql before 8.0.16")
+	}
+	return nil
+}
+
+// validRanges returns the ranges of valid values of a variable, and its valid values outside of them:
+// those of its valid ranges (<valrng>), if declared, or else, for continuous variables, values up to their
+// top code (see topCodeRe), if any; and, either way, its category codes, standing for missing values (e.g.,
+// 9999999, "N/A") as often as not. returns no ranges if the variable's values aren't bounded.
+func validRanges(v Var) (ranges []numRange, vals []float64) {
+	for _, r := range v.ValidRanges {
+		lo, errLo := strconv.ParseFloat(strings.TrimSpace(r.Min), 64)
+		hi, errHi := strconv.ParseFloat(strings.TrimSpace(r.Max), 64)
+		if errLo != nil && errHi != nil {
+			continue
+		}
+		if errLo != nil {
+			lo = math.Inf(-1)
+		}
+		if errHi != nil {
+			hi = math.Inf(1)
+		}
+		ranges = append(ranges, numRange{lo, hi})
+	}
+	for _, it := range v.ValidItems {
+		if val, err := strconv.ParseFloat(strings.TrimSpace(it.Val), 64); err == nil {
+			vals = append(vals, val)
+		}
+	}
+	if len(ranges) == 0 && v.Interval == "contin" {
+		for _, c := range v.Cats {
+			if top, err := strconv.ParseFloat(strings.TrimSpace(c.Val), 64); err == nil && topCodeRe.MatchString(c.Label) {
+				ranges = append(ranges, numRange{math.Inf(-1), top})
+				break
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	for _, c := range v.Cats {
+		lo, hi, ok := catRange(c.Val)
+		if !ok {
+			continue
+		}
+		l, _ := strconv.ParseFloat(lo, 64)
+		switch h, err := strconv.ParseFloat(hi, 64); {
+		case len(hi) == 0:
+			ranges = append(ranges, numRange{l, math.Inf(1)})
+		case err == nil && l == h:
+			vals = append(vals, l)
+		case err == nil:
+			ranges = append(ranges, numRange{l, h})
+		}
+	}
+	return ranges, vals
+}
+
+// rangeCheck returns the condition of a variable's range CHECK constraint (e.g., `"age" BETWEEN 0 AND 135`),
+// or "" if it has none: variables are checked if numeric, and bounded (see validRanges), but not if their
+// values are replaced by recoding or hashing, or by the keys of dimension tables (in the star model), or if
+// they're forced to a literal SQL type. Values within a range are left out of the valid values listed (e.g.,
+// `OR "age" IN (999)`).
+func (dbf *DatabaseFormatter) rangeCheck(v Var) string {
+	if t, ok := dbf.columnOverride(v); ok && !isGenericType(t) {
+		return "" // forced to a literal SQL type, which may not compare as a number
+	}
+	if dbf.columnType(v) == "string" || dbf.Recodes.recodes(v) != nil || dbf.isDimension(v) || dbf.setApart(v) {
+		return ""
+	}
+	ranges, vals := validRanges(v)
+	if len(ranges) == 0 {
+		return ""
+	}
+	col := dbf.quoteIdent(dbf.columnName(v))
+	var conds []string
+	for _, r := range ranges {
+		switch {
+		case math.IsInf(r.lo, -1):
+			conds = append(conds, fmt.Sprintf("%s <= %s", col, dbf.boundLiteral(v, r.hi)))
+		case math.IsInf(r.hi, 1):
+			conds = append(conds, fmt.Sprintf("%s >= %s", col, dbf.boundLiteral(v, r.lo)))
+		default:
+			conds = append(conds, fmt.Sprintf("%s BETWEEN %s AND %s", col, dbf.boundLiteral(v, r.lo), dbf.boundLiteral(v, r.hi)))
+		}
+	}
+	slices.Sort(vals)
+	var in []string
+	for _, val := range slices.Compact(vals) {
+		if !slices.ContainsFunc(ranges, func(r numRange) bool { return val >= r.lo && val <= r.hi }) {
+			in = append(in, dbf.boundLiteral(v, val))
+		}
+	}
+	if len(in) != 0 {
+		conds = append(conds, fmt.Sprintf("%s IN (%s)", col, strings.Join(in, ", ")))
+	}
+	return strings.Join(conds, " OR ")
+}
+
+// boundLiteral formats a value of a variable as a SQL numeric literal, as stored in its column: scaled
+// by its decimal places, if stored as scaled integers (see scales)
+func (dbf *DatabaseFormatter) boundLiteral(v Var, val float64) string {
+	if dbf.scales(v) {
+		val = math.Round(val * math.Pow10(v.DecimalPoint))
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// createRangeChecks generates a CHECK constraint on the main table per variable with valid ranges (see
+// rangeCheck), so that values outside of them (e.g., of a misaligned data file) fail to insert, named by
+// DEFAULT_RANGE_CHECK (e.g., "ck_ipums_tab_age"); "" if range checks aren't requested
+func (dbf *DatabaseFormatter) createRangeChecks(ddi *DataDict) string {
+	if !dbf.RangeChecks {
+		return ""
+	}
+	var ddl strings.Builder
+	for _, v := range ddi.Vars {
+		cond := dbf.rangeCheck(v)
+		if len(cond) == 0 {
+			continue
+		}
+		ddl.WriteString(fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK (%s);\n\n",
+			dbf.ident(dbf.TableName), dbf.objectName(DEFAULT_RANGE_CHECK, []string{dbf.columnName(v)}), cond))
+	}
+	return ddl.String()
+}
@@ -0,0 +1,348 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Keys of a variable's recode rules with special meaning
+const (
+	recodeElse   = "else"   // new value of values matching no rule; unmatched values are kept as is otherwise
+	recodeLabels = "labels" // labels of the new values, by value
+	recodeNull   = "null"   // a new value of "null" writes the value as null
+)
+
+// Recodes holds value recoding rules, collapsing categories as the data is converted (see LoadRecodes)
+type Recodes struct {
+	vars map[string]*varRecode // lowercased variable name -> rules
+}
+
+// varRecode holds the recoding rules of a single variable
+type varRecode struct {
+	rules  []recodeRule
+	els    string // new value of unmatched values; kept as is if empty
+	labels map[string]string
+}
+
+// recodeRule recodes a value, or a range of values, to a new value
+type recodeRule struct {
+	src    string  // value (or range, e.g., "0-61", "90+"), as given
+	lo, hi float64 // bounds of numeric values; hi is +Inf for open ranges
+	numLo  bool    // if true, src is a number or range of numbers
+	to     string
+}
+
+// LoadRecodes reads value recoding rules from a JSON file, or from a YAML file (by ".yaml" or ".yml"
+// extension) of the same shape, mapping each variable to its rules. A rule maps a value, or a range
+// of values (as in category codes, e.g., "0-61", "10..19", "90+"), to a new value; "null" as a new
+// value writes nulls. Values matching no rule are kept as is, unless an "else" rule is given, and
+// "labels" gives the new values' labels. For example:
+//
+//	educ:
+//	  0-61: 1
+//	  62-100: 2
+//	  labels:
+//	    1: Less than high school
+//	    2: High school or more
+//	age: {0-17: 0, 18-64: 1, 65+: 2, else: null}
+//
+// returns error if the file cannot be read or parsed, or if a variable's rules overlap
+func LoadRecodes(fileName string) (*Recodes, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]any
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		tree, err = parseYAMLMappings(data)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fileName, err)
+	}
+
+	rc := &Recodes{vars: make(map[string]*varRecode)}
+	for name, rules := range tree {
+		m, ok := rules.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("parsing %s: rules of %s are not a mapping", fileName, name)
+		}
+		vr := &varRecode{labels: make(map[string]string)}
+		for src, to := range m {
+			if src == recodeLabels {
+				labels, ok := to.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("parsing %s: labels of %s are not a mapping", fileName, name)
+				}
+				for val, label := range labels {
+					vr.labels[strings.TrimSpace(val)] = strings.TrimSpace(fmt.Sprint(label))
+				}
+				continue
+			}
+			if _, ok := to.(map[string]any); ok || to == nil {
+				return nil, fmt.Errorf("parsing %s: %s: rule '%s' has no new value", fileName, name, src)
+			}
+			toVal := strings.TrimSpace(fmt.Sprint(to))
+			if src == recodeElse {
+				vr.els = toVal
+				continue
+			}
+			rule := recodeRule{src: strings.TrimSpace(src), to: toVal}
+			if lo, hi, ok := catRange(rule.src); ok {
+				rule.numLo = true
+				rule.lo, _ = strconv.ParseFloat(lo, 64)
+				rule.hi = math.Inf(1)
+				if len(hi) != 0 {
+					rule.hi, _ = strconv.ParseFloat(hi, 64)
+				}
+			}
+			vr.rules = append(vr.rules, rule)
+		}
+		// rules are matched in a stable order; they may not overlap, so the order is only for errors
+		slices.SortFunc(vr.rules, func(a, b recodeRule) int { return strings.Compare(a.src, b.src) })
+		for i, a := range vr.rules {
+			for _, b := range vr.rules[i+1:] {
+				if a.numLo && b.numLo && a.lo <= b.hi && b.lo <= a.hi {
+					return nil, fmt.Errorf("parsing %s: %s: rules '%s' and '%s' overlap", fileName, name, a.src, b.src)
+				}
+			}
+		}
+		rc.vars[strings.ToLower(strings.TrimSpace(name))] = vr
+	}
+	return rc, nil
+}
+
+// recodes returns the recoding rules of a variable, or nil if it isn't recoded
+func (rc *Recodes) recodes(v Var) *varRecode {
+	if rc == nil {
+		return nil
+	}
+	return rc.vars[strings.ToLower(v.Name)]
+}
+
+// newValue returns the new value of a (trimmed) value, and whether any rule (or else) matched;
+// numeric values are compared as numbers, and character values as strings
+func (vr *varRecode) newValue(val string, numeric bool) (string, bool) {
+	n, err := strconv.ParseFloat(val, 64)
+	for _, r := range vr.rules {
+		if numeric && r.numLo && err == nil && r.lo <= n && n <= r.hi {
+			return r.to, true
+		}
+		if !numeric && r.src == val {
+			return r.to, true
+		}
+	}
+	if len(vr.els) != 0 {
+		return vr.els, true
+	}
+	return val, false
+}
+
+// recodeField recodes a (non-null) field of a variable, returning the field in the same form (a
+// fixed-width field with dcml implied decimals, for numeric variables), or isNull if it's recoded
+// to null. Fields of variables without rules, or matching no rule, are returned as is.
+//
+// returns error if a numeric variable's field is not a number
+func (rc *Recodes) recodeField(v Var, field string, dcml int) (string, bool, error) {
+	vr := rc.recodes(v)
+	if vr == nil {
+		return field, false, nil
+	}
+	numeric := v.VType.VarType != "character"
+	val := strings.TrimSpace(field)
+	if numeric {
+		num, err := fixedWidthNumber([]byte(val), dcml)
+		if err != nil {
+			return "", false, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		val = num
+	}
+	to, ok := vr.newValue(val, numeric)
+	switch {
+	case !ok:
+		return field, false, nil
+	case to == recodeNull:
+		return "", true, nil
+	case numeric && dcml > 0:
+		// new values are written with implied decimals, like the field they replace (e.g., "1.5" -> "150")
+		intPart, frac, _ := strings.Cut(to, ".")
+		return intPart + frac + strings.Repeat("0", dcml-len(frac)), false, nil
+	default:
+		return to, false, nil
+	}
+}
+
+// transformField applies the conversion's value transformations to a (non-null) field of a variable:
+// recoding (see Recodes), then hashing (see Hasher). dcml is the field's implied decimal places (0
+// for comma-delimited records). returns the field, or isNull if it's recoded to null.
+//
+// returns error if a numeric variable's field is not a number
+func (dbf *DatabaseFormatter) transformField(v Var, field string, dcml int) (string, bool, error) {
+	field, isNull, err := dbf.Recodes.recodeField(v, field, dcml)
+	if err != nil || isNull {
+		return "", isNull, err
+	}
+	if dbf.Hash.hashes(v) {
+		field, err = dbf.Hash.sum(v, field, dcml)
+	}
+	return field, false, err
+}
+
+// transformChars applies transformField to a (non-null) fixed-width field, returning it as is
+// if the conversion transforms no values
+func (dbf *DatabaseFormatter) transformChars(v Var, chars []byte) ([]byte, bool, error) {
+	if dbf.Recodes == nil && dbf.Hash == nil {
+		return chars, false, nil
+	}
+	field, isNull, err := dbf.transformField(v, string(chars), v.DecimalPoint)
+	return []byte(field), isNull, err
+}
+
+// checkRecodes ensures that every recoded variable is in the data dictionary, and that each new value
+// fits the variable's column: a number (an integer, for integer columns, or with no more than the
+// variable's decimal places, for others) for numeric variables, and no wider than the variable for
+// character variables
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkRecodes(ddi *DataDict) error {
+	if dbf.Recodes == nil {
+		return nil
+	}
+	for name, vr := range dbf.Recodes.vars {
+		i := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) })
+		if i < 0 {
+			return fmt.Errorf("cannot recode unrecognized variable %s", name)
+		}
+		v := ddi.Vars[i]
+		news := []string{vr.els}
+		for _, r := range vr.rules {
+			news = append(news, r.to)
+		}
+		for _, to := range news {
+			if len(to) == 0 || to == recodeNull {
+				continue
+			}
+			if v.VType.VarType == "character" {
+				if v.Location.Width > 0 && len(to) > v.Location.Width {
+					return fmt.Errorf("new value '%s' of %s is wider than the variable (%d)", to, v.Name, v.Location.Width)
+				}
+				continue
+			}
+			if _, err := strconv.ParseFloat(to, 64); err != nil {
+				return fmt.Errorf("new value '%s' of numeric variable %s is not a number", to, v.Name)
+			}
+			_, frac, _ := strings.Cut(to, ".")
+			dcml := v.DecimalPoint
+			if dbf.columnType(v) != "float" && !dbf.scales(v) {
+				dcml = 0
+			}
+			if len(frac) > dcml {
+				return fmt.Errorf("new value '%s' of %s has more than %d decimal places", to, v.Name, dcml)
+			}
+		}
+	}
+	return nil
+}
+
+// recodeCats replaces the categories of recoded variables in the data dictionary with those of their
+// new values, so that ref_tables (and anything else listing categories) match the recoded data; the
+// variables are made discrete, so that they get ref_tables. Categories matching no rule are kept. A
+// new value's label is taken from the rules' labels, then from the variable's category of the same
+// value, if only that value is recoded to it; otherwise, it lists the values recoded to it (e.g.,
+// "Recoded from 0-61").
+// Categories are only replaced once per data dictionary.
+func (dbf *DatabaseFormatter) recodeCats(ddi *DataDict) {
+	if dbf.Recodes == nil || ddi.recoded {
+		return
+	}
+	ddi.recoded = true
+	for i, v := range ddi.Vars {
+		vr := dbf.Recodes.recodes(v)
+		if vr == nil {
+			continue
+		}
+		numeric := v.VType.VarType != "character"
+		origLabels := make(map[string]string)
+		var cats []Cat
+		seen := make(map[string]bool)
+		for _, c := range v.Cats {
+			val := strings.TrimSpace(c.Val)
+			origLabels[val] = c.Label
+			if _, ok := vr.newValue(val, numeric); !ok && !seen[val] {
+				cats = append(cats, c) // kept as is
+				seen[val] = true
+			}
+		}
+		sources := make(map[string][]string)
+		var news []string
+		for _, r := range vr.rules {
+			if r.to == recodeNull {
+				continue
+			}
+			if _, ok := sources[r.to]; !ok {
+				news = append(news, r.to)
+			}
+			sources[r.to] = append(sources[r.to], r.src)
+		}
+		if len(vr.els) != 0 && vr.els != recodeNull {
+			if _, ok := sources[vr.els]; !ok {
+				news = append(news, vr.els)
+			}
+			sources[vr.els] = append(sources[vr.els], "all other values")
+		}
+		for _, to := range news {
+			label, ok := vr.labels[to]
+			if !ok && len(sources[to]) == 1 && sources[to][0] == to {
+				label, ok = origLabels[to]
+			}
+			if !ok {
+				label = "Recoded from " + strings.Join(sources[to], ", ")
+			}
+			if seen[to] {
+				// a kept category shares the new value; the new value's label wins
+				cats = slices.DeleteFunc(cats, func(c Cat) bool { return strings.TrimSpace(c.Val) == to })
+			}
+			cats = append(cats, Cat{Val: to, Label: label})
+		}
+		if numeric {
+			slices.SortStableFunc(cats, func(a, b Cat) int {
+				x, errX := strconv.ParseFloat(strings.TrimSpace(a.Val), 64)
+				y, errY := strconv.ParseFloat(strings.TrimSpace(b.Val), 64)
+				if errX != nil || errY != nil {
+					return 0
+				}
+				return cmp.Compare(x, y)
+			})
+		}
+		ddi.Vars[i].Cats = cats
+		ddi.Vars[i].Interval = "discrete"
+	}
+}
+
+// CheckRawDataEmit ensures that no requested artifact reads the data file itself (e.g., the Stata
+// import script), for conversions that change values as they're written (e.g., hashing, recoding),
+// as those would read the original values
+//
+// returns error if not the case
+func CheckRawDataEmit(kinds []string, transform string) error {
+	for _, k := range kinds {
+		if emitters[k].ReadsDat {
+			return fmt.Errorf("'%s' reads the data file itself, so values would be read without %s", k, transform)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Hierarchical reports whether a data dictionary describes a hierarchical extract, whose data file
+// interleaves records of several types (e.g., a household record, followed by its persons' records)
+func (dd *DataDict) Hierarchical() bool {
+	return dd.FileStrc == "hierarchical" || len(dd.RecGroups) > 1
+}
+
+// RecTypeVar returns the record type variable of a data dictionary, whose value identifies the type of each
+// record: the variable named by the record groups (recidvar), or else IPUMS's RECTYPE, if in the extract
+func (dd *DataDict) RecTypeVar() (Var, bool) {
+	for _, g := range dd.RecGroups {
+		if len(g.RecIDVar) != 0 {
+			return findVar(dd, g.RecIDVar)
+		}
+	}
+	return findVar(dd, "RECTYPE")
+}
+
+// RecGroup returns the record group of a record type (case-insensitive, e.g., "p"), if declared
+func (dd *DataDict) RecGroup(recType string) (RecGroup, bool) {
+	i := slices.IndexFunc(dd.RecGroups, func(g RecGroup) bool {
+		return strings.EqualFold(strings.TrimSpace(g.RecType), strings.TrimSpace(recType))
+	})
+	if i < 0 {
+		return RecGroup{}, false
+	}
+	return dd.RecGroups[i], true
+}
+
+// RecordTypes returns the record types a variable belongs to (e.g., ["H", "P"]); none, if undeclared (e.g.,
+// in rectangular extracts), in which case it belongs to every record
+func (v Var) RecordTypes() []string {
+	return strings.Fields(v.RecTypes)
+}
+
+// inRecType reports whether a variable belongs to the records of a type (case-insensitive)
+func (v Var) inRecType(recType string) bool {
+	types := v.RecordTypes()
+	return len(types) == 0 || slices.ContainsFunc(types, func(t string) bool { return strings.EqualFold(t, recType) })
+}
+
+// VarsOfRecType returns the variables of the records of a type, in data dictionary order
+func (dd *DataDict) VarsOfRecType(recType string) []Var {
+	var vars []Var
+	for _, v := range dd.Vars {
+		if v.inRecType(recType) {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// KeyVars returns the variables linking the records of a type to those of other types (e.g., SERIAL), as
+// declared by its record group
+func (g RecGroup) KeyVars() []string {
+	return strings.Fields(g.KeyVar)
+}
+
+// RecordLength returns the characters of a record of a type (newline excluded): as declared by its record
+// group, or else the end of its last variable
+func (dd *DataDict) RecordLength(recType string) int {
+	if g, ok := dd.RecGroup(recType); ok && g.RecLen > 0 {
+		return g.RecLen
+	}
+	length := 0
+	for _, v := range dd.VarsOfRecType(recType) {
+		length = max(length, v.Location.End)
+	}
+	return length
+}
+
+// checkRecordStructure ensures that the record structure of a data dictionary holds together: record groups
+// declare distinct record types, and their record type and key variables are in the extract; variables
+// belong to declared record types; and, in hierarchical extracts, the record type variable is in the extract
+//
+// returns error if not the case
+func checkRecordStructure(dd *DataDict) error {
+	seen := make(map[string]bool)
+	for _, g := range dd.RecGroups {
+		recType := strings.ToUpper(strings.TrimSpace(g.RecType))
+		switch {
+		case len(recType) == 0 && dd.Hierarchical():
+			return fmt.Errorf("record group '%s' declares no record type", g.Label)
+		case seen[recType]:
+			return fmt.Errorf("record type %s is declared more than once", g.RecType)
+		}
+		seen[recType] = true
+		if len(g.RecIDVar) != 0 && dd.Hierarchical() {
+			if _, ok := findVar(dd, g.RecIDVar); !ok {
+				return fmt.Errorf("record type variable %s of record type %s is not in the extract", g.RecIDVar, g.RecType)
+			}
+		}
+		for _, key := range g.KeyVars() {
+			if _, ok := findVar(dd, key); !ok && dd.Hierarchical() {
+				return fmt.Errorf("key variable %s of record type %s is not in the extract", key, g.RecType)
+			}
+		}
+	}
+	if !dd.Hierarchical() {
+		return nil
+	}
+	if _, ok := dd.RecTypeVar(); !ok {
+		return fmt.Errorf("hierarchical extract has no record type variable (e.g., RECTYPE)")
+	}
+	for _, v := range dd.Vars {
+		for _, t := range v.RecordTypes() {
+			if len(dd.RecGroups) != 0 && !seen[strings.ToUpper(t)] {
+				return fmt.Errorf("variable %s belongs to undeclared record type %s", v.Name, t)
+			}
+		}
+	}
+	return nil
+}
+
+// OfRecType returns the data dictionary of the records of one type (case-insensitive, e.g., "P") of a
+// hierarchical extract, as if a rectangular extract of its own: its variables, case count, and record group
+// alone. Its rows are those copied out of the data file by FilterRecType.
+//
+// returns error if the extract isn't hierarchical, or doesn't declare the record type
+func (dd *DataDict) OfRecType(recType string) (DataDict, error) {
+	recType = strings.TrimSpace(recType)
+	if !dd.Hierarchical() {
+		return DataDict{}, fmt.Errorf("record types apply to hierarchical extracts; the data dictionary describes a rectangular one")
+	}
+	sub := *dd
+	sub.FileStrc, sub.RecGroups, sub.CaseQnty = "rectangular", nil, 0
+	if len(dd.RecGroups) != 0 {
+		g, ok := dd.RecGroup(recType)
+		if !ok {
+			return DataDict{}, dd.undeclaredRecType(recType)
+		}
+		sub.RecGroups, sub.CaseQnty = []RecGroup{g}, g.CaseQnty
+	}
+	sub.Vars = dd.VarsOfRecType(recType)
+	if len(sub.Vars) == 0 {
+		return DataDict{}, fmt.Errorf("no variables belong to record type %s", recType)
+	}
+	return sub, nil
+}
+
+// undeclaredRecType returns the error of a record type the data dictionary doesn't declare, listing those it does
+func (dd *DataDict) undeclaredRecType(recType string) error {
+	types := make([]string, len(dd.RecGroups))
+	for i, g := range dd.RecGroups {
+		types[i] = g.RecType
+	}
+	return fmt.Errorf("record type '%s' not in {'%s'}", recType, strings.Join(types, "', '"))
+}
+
+// FilterRecType copies the records of one type (case-insensitive, e.g., "P") of a hierarchical fixed-width
+// file (gzip compressed, if it ends with ".gz") into a temporary file, returning the temporary file's path.
+// Records are routed by the value of the record type variable (see eachRecord); those of other types are
+// skipped. Hierarchical files interleave records of several lengths, so the records kept are cut to the end
+// of their type's last variable (see OfRecType), and end with "\n", leaving rows of a single length, as
+// parsers read them by byte offset.
+// The temporary file is created in os.TempDir(); it's up to the caller to remove it.
+//
+// returns error if the file can't be read or written, if a line is malformed (as a ParseError), or if it
+// holds no records of the type
+func FilterRecType(datFileName string, dd *DataDict, recType string) (string, error) {
+	recType = strings.TrimSpace(recType)
+	sub, err := dd.OfRecType(recType)
+	if err != nil {
+		return "", err
+	}
+	rowChars := BytesPerRow(&sub) - max(sub.EOLBytes, 1)
+	return writeTempDat(func(out *bufio.Writer) error {
+		kept := 0
+		err := eachRecord(datFileName, dd, func(lineNum int, t string, row []byte) error {
+			if !strings.EqualFold(t, recType) {
+				return nil
+			}
+			rec, err := cutRecord(row, rowChars, t, lineNum)
+			if err != nil {
+				return err
+			}
+			out.Write(rec)
+			out.WriteByte('\n')
+			kept++
+			return nil
+		})
+		if err == nil && kept == 0 {
+			err = fmt.Errorf("%s holds no records of type %s", datFileName, recType)
+		}
+		return err
+	})
+}
+
+// cutRecord returns the first rowChars characters of a record, those of its type's variables; records
+// may be padded past their last variable, but never cut short of it
+//
+// returns error (a ParseError) if the record is cut short, or holds anything past its last variable
+func cutRecord(row []byte, rowChars int, recType string, lineNum int) ([]byte, error) {
+	if len(row) < rowChars || len(bytes.TrimSpace(row[rowChars:])) != 0 {
+		return nil, &ParseError{Err: fmt.Errorf("line %d holds %d characters, but records of type %s hold %d", lineNum, len(row), recType, rowChars)}
+	}
+	return row[:rowChars], nil
+}
+
+// eachRecord reads a hierarchical fixed-width file (gzip compressed, if it ends with ".gz") line by line,
+// calling fn with each record's (1-based) line number, type (the value of the record type variable, read at
+// its position in the line, trimmed), and characters (line ending excluded), until fn returns an error
+//
+// returns error if the file can't be read, if a line is malformed (as a ParseError), or fn's error
+func eachRecord(datFileName string, dd *DataDict, fn func(lineNum int, recType string, row []byte) error) error {
+	recVar, ok := dd.RecTypeVar()
+	if !ok {
+		return fmt.Errorf("no record type variable (e.g., RECTYPE) to route records by")
+	}
+	datFile, err := os.Open(datFileName)
+	if err != nil {
+		return err
+	}
+	defer datFile.Close()
+	var r io.Reader = datFile
+	if strings.HasSuffix(datFileName, ".gz") {
+		zr, err := gzip.NewReader(datFile)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	in := bufio.NewReaderSize(r, max(1<<20, BytesPerRow(dd)+2))
+	for lineNum := 1; ; lineNum++ {
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return &ParseError{Err: fmt.Errorf("line %d is longer than the %d characters described by the data dictionary", lineNum, BytesPerRow(dd)-1)}
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(line) == 0 {
+			return nil
+		}
+		row := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(row) < recVar.Location.End {
+			return &ParseError{Err: fmt.Errorf("line %d holds %d characters, too few to hold its record type (%s)", lineNum, len(row), recVar.Name)}
+		}
+		if fnErr := fn(lineNum, string(bytes.TrimSpace(row[recVar.Location.Start-1:recVar.Location.End])), row); fnErr != nil {
+			return fnErr
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// writeTempDat writes a temporary fixed-width file, through write, returning its path; the file is removed
+// if it can't be written
+//
+// returns error if the file can't be created or written, or write's error
+func writeTempDat(write func(out *bufio.Writer) error) (string, error) {
+	dst, err := os.CreateTemp("", "ipums2db-*.dat")
+	if err != nil {
+		return "", err
+	}
+	out := bufio.NewWriterSize(dst, 1<<20)
+	if err = write(out); err == nil {
+		err = out.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
@@ -0,0 +1,146 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// householdGroup returns the household record group of a hierarchical extract (the first declared, e.g.,
+// "H"), and the record group of the records joined with it: recType's (case-insensitive), if set, or else
+// the second declared (e.g., "P")
+//
+// returns error if the extract isn't hierarchical, declares fewer than two record types, or doesn't
+// declare recType (or declares it as the household record type)
+func (dd *DataDict) householdGroup(recType string) (RecGroup, RecGroup, error) {
+	switch {
+	case !dd.Hierarchical():
+		return RecGroup{}, RecGroup{}, fmt.Errorf("rectangularizing applies to hierarchical extracts; the data dictionary describes a rectangular one")
+	case len(dd.RecGroups) < 2:
+		return RecGroup{}, RecGroup{}, fmt.Errorf("rectangularizing needs the household and person record types declared (recGrp)")
+	}
+	hh, person := dd.RecGroups[0], dd.RecGroups[1]
+	if len(strings.TrimSpace(recType)) != 0 {
+		g, ok := dd.RecGroup(recType)
+		if !ok {
+			return RecGroup{}, RecGroup{}, dd.undeclaredRecType(recType)
+		}
+		if strings.EqualFold(strings.TrimSpace(g.RecType), strings.TrimSpace(hh.RecType)) {
+			return RecGroup{}, RecGroup{}, fmt.Errorf("record type %s is the household record type; its records can't be joined with themselves", hh.RecType)
+		}
+		person = g
+	}
+	return hh, person, nil
+}
+
+// Rectangularized returns the data dictionary of the rows of a hierarchical extract made rectangular (see
+// Rectangularize): the records of a type (e.g., "P"; the second declared, if unset; see householdGroup),
+// each joined with its household's variables, like IPUMS's own rectangular extracts. A row is its
+// household record, followed by its own record; the variables of the household record alone keep their
+// positions, while the rest (e.g., RECTYPE, SERIAL, declared for both) are read from the record joined,
+// past the household record. Variables keep the data dictionary's order.
+//
+// returns error if the extract can't be rectangularized (see householdGroup)
+func (dd *DataDict) Rectangularized(recType string) (DataDict, error) {
+	hh, person, err := dd.householdGroup(recType)
+	if err != nil {
+		return DataDict{}, err
+	}
+	hhDD, err := dd.OfRecType(hh.RecType)
+	if err != nil {
+		return DataDict{}, err
+	}
+	rect, err := dd.OfRecType(person.RecType)
+	if err != nil {
+		return DataDict{}, err
+	}
+	hhChars := BytesPerRow(&hhDD) - max(hhDD.EOLBytes, 1)
+	rect.Vars = nil
+	for _, v := range dd.Vars {
+		switch {
+		case v.inRecType(person.RecType):
+			v.Location.Start += hhChars
+			v.Location.End += hhChars
+		case !v.inRecType(hh.RecType):
+			continue
+		}
+		rect.Vars = append(rect.Vars, v)
+	}
+	return rect, nil
+}
+
+// Rectangularize copies the records of a type (e.g., "P"; the second declared, if unset) of a hierarchical
+// fixed-width file (gzip compressed, if it ends with ".gz") into a temporary file, each joined with the
+// record of its household (the first declared type, e.g., "H"), returning the temporary file's path: records
+// follow their household's record, which is held until the next one (see Rectangularized for the rows'
+// layout). Records of other types are skipped, as are households without records joined with them (e.g.,
+// vacant units), as in IPUMS's own rectangular extracts.
+// The temporary file is created in os.TempDir(); it's up to the caller to remove it.
+//
+// returns error if the file can't be read or written, if a line is malformed, a record precedes any
+// household record, or its key variables (e.g., SERIAL) don't match its household's (as a ParseError), or
+// if it holds no records of the type
+func Rectangularize(datFileName string, dd *DataDict, recType string) (string, error) {
+	hh, person, err := dd.householdGroup(recType)
+	if err != nil {
+		return "", err
+	}
+	hhDD, err := dd.OfRecType(hh.RecType)
+	if err != nil {
+		return "", err
+	}
+	personDD, err := dd.OfRecType(person.RecType)
+	if err != nil {
+		return "", err
+	}
+	hhChars, personChars := BytesPerRow(&hhDD)-max(hhDD.EOLBytes, 1), BytesPerRow(&personDD)-max(personDD.EOLBytes, 1)
+	// key variables declared for both record types
+	var keys []Var
+	for _, name := range person.KeyVars() {
+		if v, ok := findVar(dd, name); ok && v.inRecType(hh.RecType) {
+			keys = append(keys, v)
+		}
+	}
+
+	return writeTempDat(func(out *bufio.Writer) error {
+		var household []byte // the current household's record
+		hhLine, kept := 0, 0
+		err := eachRecord(datFileName, dd, func(lineNum int, t string, row []byte) error {
+			switch {
+			case strings.EqualFold(t, hh.RecType):
+				rec, err := cutRecord(row, hhChars, t, lineNum)
+				if err != nil {
+					return err
+				}
+				household, hhLine = append(household[:0], rec...), lineNum
+			case strings.EqualFold(t, person.RecType):
+				rec, err := cutRecord(row, personChars, t, lineNum)
+				if err != nil {
+					return err
+				}
+				if household == nil {
+					return &ParseError{Err: fmt.Errorf("line %d: record of type %s precedes any household record (type %s)", lineNum, t, hh.RecType)}
+				}
+				for _, k := range keys {
+					hhKey, key := household[k.Location.Start-1:k.Location.End], rec[k.Location.Start-1:k.Location.End]
+					if !bytes.Equal(bytes.TrimSpace(hhKey), bytes.TrimSpace(key)) {
+						return &ParseError{Err: fmt.Errorf("line %d: %s %s doesn't match that of its household record (line %d: %s)",
+							lineNum, k.Name, bytes.TrimSpace(key), hhLine, bytes.TrimSpace(hhKey))}
+					}
+				}
+				out.Write(household)
+				out.Write(rec)
+				out.WriteByte('\n')
+				kept++
+			}
+			return nil
+		})
+		if err == nil && kept == 0 {
+			err = fmt.Errorf("%s holds no records of type %s", datFileName, person.RecType)
+		}
+		return err
+	})
+}
@@ -0,0 +1,181 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// identifierRe matches the column names accepted as rename targets; quoting rules differ by
+// database system, so renames are limited to names that never need quoting (save for reserved words)
+var identifierRe = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_]*$`)
+
+// ParseRenameFlag parses the -rename flag argument into a map of lowercased variable names and
+// their new column names. The argument is either a comma-delimited list of old=new pairs
+// (e.g., "incwage=income_wages,statefip=state_fips"), or the path to a mapping file holding
+// one old=new pair per line; blank lines and lines starting with "#" are ignored.
+//
+// returns error if the mapping file cannot be read, or if any pair is malformed
+func ParseRenameFlag(renameF string) (map[string]string, error) {
+	renames := make(map[string]string)
+	if len(renameF) == 0 {
+		return renames, nil
+	}
+
+	var pairs []string
+	if strings.Contains(renameF, "=") {
+		pairs = strings.Split(renameF, ",")
+	} else {
+		f, err := os.Open(renameF)
+		if err != nil {
+			return nil, fmt.Errorf("reading mapping file: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			pairs = append(pairs, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading mapping file: %w", err)
+		}
+	}
+
+	for _, p := range pairs {
+		oldName, newName, found := strings.Cut(p, "=")
+		oldName, newName = strings.ToLower(strings.TrimSpace(oldName)), strings.TrimSpace(newName)
+		if !found || len(oldName) == 0 || len(newName) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form old=new", p)
+		}
+		if !identifierRe.MatchString(newName) {
+			return nil, fmt.Errorf("'%s' is not a valid column name (letters, digits, and underscores only)", newName)
+		}
+		if _, dup := renames[oldName]; dup {
+			return nil, fmt.Errorf("%s is renamed more than once", oldName)
+		}
+		renames[oldName] = newName
+	}
+	return renames, nil
+}
+
+// ParseCaseFlag parses the -case flag argument, the casing policy of generated identifiers:
+// one of "lower" (the default), "upper", or "preserve" (as named in the data dictionary).
+//
+// returns error if the policy is not recognized
+func ParseCaseFlag(caseF string) (string, error) {
+	switch c := strings.ToLower(strings.TrimSpace(caseF)); c {
+	case "", CASE_LOWER:
+		return CASE_LOWER, nil
+	case CASE_UPPER, CASE_PRESERVE:
+		return c, nil
+	default:
+		return "", fmt.Errorf("'%s' not in {'lower', 'upper', 'preserve'}", caseF)
+	}
+}
+
+// ident applies the casing policy to a table, column, or index identifier
+func (dbf *DatabaseFormatter) ident(name string) string {
+	switch dbf.Case {
+	case CASE_UPPER:
+		return strings.ToUpper(name)
+	case CASE_PRESERVE:
+		return name
+	default:
+		return strings.ToLower(name)
+	}
+}
+
+// quoteIdent quotes (or "escapes") an identifier. Occasionally, you'll have column names like
+// "where" or "year", which may conflict with reserved keywords; quoting also keeps the case of
+// upper or mixed-case names. The accepted characters for escaping are a little different by system.
+func (dbf *DatabaseFormatter) quoteIdent(name string) string {
+	switch dbf.DbType {
+	case POSTGRES, ORACLE, MSSQL, SNOWFLAKE:
+		return `"` + name + `"`
+	case MYSQL:
+		return "`" + name + "`"
+	default:
+		return name
+	}
+}
+
+// columnName returns the column name of a variable: its name, unless renamed, or unless it
+// collides with a reserved word and dbf.ReservedSuffix is set; cased by the casing policy
+func (dbf *DatabaseFormatter) columnName(v Var) string {
+	name := strings.ToLower(v.Name)
+	if newName, ok := dbf.Renames[name]; ok {
+		return dbf.ident(newName)
+	}
+	if len(dbf.ReservedSuffix) != 0 && isReservedWord(dbf.DbType, name) {
+		return dbf.ident(v.Name + dbf.ReservedSuffix)
+	}
+	return dbf.ident(v.Name)
+}
+
+// lookupColumn returns the column name of a variable (its key column, if a dimension of the star model),
+// referred to by either its variable name or its (renamed) column name, or of a derived or constant column
+func (dbf *DatabaseFormatter) lookupColumn(ddi *DataDict, name string) (string, bool) {
+	for _, v := range ddi.Vars {
+		// grouped replicate weights and melted variables aren't columns of the main table
+		if dbf.setApart(v) {
+			continue
+		}
+		if strings.EqualFold(v.Name, strings.TrimSpace(name)) || strings.EqualFold(dbf.columnName(v), strings.TrimSpace(name)) {
+			col, _ := dbf.factColumn(v)
+			return col, true
+		}
+	}
+	for _, v := range dbf.appendedVars() {
+		if strings.EqualFold(v.Name, strings.TrimSpace(name)) {
+			return dbf.columnName(v), true
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(name)), false
+}
+
+// lookupVarColumn returns the column name of a variable, referred to by either its
+// variable name or its (renamed) column name
+func (dbf *DatabaseFormatter) lookupVarColumn(ddi *DataDict, name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, v := range ddi.Vars {
+		if strings.EqualFold(v.Name, name) || strings.EqualFold(dbf.columnName(v), name) {
+			return dbf.columnName(v), true
+		}
+	}
+	return name, false
+}
+
+// checkRenames ensures that every renamed variable is in the data dictionary, that the
+// reserved word suffix is valid, and that no two columns end up with the same name.
+//
+// returns error if either is not the case
+func (dbf *DatabaseFormatter) checkRenames(ddi *DataDict) error {
+	if len(dbf.ReservedSuffix) != 0 && !identifierRe.MatchString("x"+dbf.ReservedSuffix) {
+		return fmt.Errorf("'%s' is not a valid column name suffix (letters, digits, and underscores only)", dbf.ReservedSuffix)
+	}
+	varNames := make(map[string]bool, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		varNames[strings.ToLower(v.Name)] = true
+	}
+	for oldName := range dbf.Renames {
+		if !varNames[oldName] {
+			return fmt.Errorf("cannot rename unrecognized variable %s", oldName)
+		}
+	}
+	colNames := make(map[string]string, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		col := dbf.columnName(v)
+		if other, dup := colNames[strings.ToLower(col)]; dup {
+			return fmt.Errorf("variables %s and %s would both be named %s", other, v.Name, col)
+		}
+		colNames[strings.ToLower(col)] = v.Name
+	}
+	return nil
+}
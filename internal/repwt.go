@@ -0,0 +1,263 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Replicate weight formats (see RepWeights)
+const (
+	REPWT_LONG  string = "long"
+	REPWT_ARRAY string = "array"
+)
+
+// RepWeights groups replicate weight variables (e.g., REPWTP1, ..., REPWTP80), which would otherwise bloat
+// the main table with dozens of columns, apart from the other variables. Each group is made up of the
+// variables named after a prefix, followed by the replicate number, and is stored either in a long-format
+// table of its own, with a row per weight (key, repnum, value), or (postgres only) in an array column
+// of the main table.
+type RepWeights struct {
+	prefixes []string // lowercased variable name prefixes, each making up a group
+	format   string   // REPWT_LONG or REPWT_ARRAY
+
+	// set by checkRepWeights
+	groupList []repWeightGroup
+	grouped   map[string]bool // names of grouped variables
+	key       []int           // long format: indices of the variables linking weights to their row (see longTableKey)
+}
+
+// repWeightGroup is a group of replicate weight variables, in order of replicate number
+type repWeightGroup struct {
+	name    string // base name of the group's table or column: its prefix, pluralized (e.g., "repwtps")
+	idx     []int  // index of each variable in the data dictionary
+	repnums []int  // replicate number of each variable
+}
+
+// NewRepWeights returns a RepWeights grouping the variables named after each of the comma-delimited prefixes
+// of the -repwts flag argument (e.g., "REPWT,REPWTP"), in a format (REPWT_LONG or REPWT_ARRAY); if no
+// prefixes are given, it returns nil (nothing is grouped).
+//
+// returns error if a prefix is not a valid name, or the format is not recognized
+func NewRepWeights(repwtsF, format string) (*RepWeights, error) {
+	if len(strings.TrimSpace(repwtsF)) == 0 {
+		return nil, nil
+	}
+	if format != REPWT_LONG && format != REPWT_ARRAY {
+		return nil, fmt.Errorf("'%s' is not a replicate weight format (%s or %s)", format, REPWT_LONG, REPWT_ARRAY)
+	}
+	rw := &RepWeights{format: format}
+	for _, p := range strings.Split(repwtsF, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if !identifierRe.MatchString(p) {
+			return nil, fmt.Errorf("'%s' is not a valid variable name prefix (letters, digits, and underscores only)", p)
+		}
+		if !slices.Contains(rw.prefixes, p) {
+			rw.prefixes = append(rw.prefixes, p)
+		}
+	}
+	return rw, nil
+}
+
+// groups reports whether a variable is a grouped replicate weight
+func (rw *RepWeights) groups(v Var) bool {
+	return rw != nil && rw.grouped[v.Name]
+}
+
+// arrays reports whether replicate weights are grouped in array columns of the main table
+func (rw *RepWeights) arrays() bool {
+	return rw != nil && rw.format == REPWT_ARRAY
+}
+
+// long reports whether replicate weights are grouped in long-format tables
+func (rw *RepWeights) long() bool {
+	return rw != nil && rw.format == REPWT_LONG
+}
+
+// checkRepWeights groups the replicate weight variables of the data dictionary, ensuring that every prefix
+// names numeric variables of a single type, and that the format can be written: grouping is for SQL dumps
+// of microdata extracts only, array columns are postgres-only, and long-format tables need a key linking
+// weights to their row (the row id, or else the household key (see householdKeyVars) and PERNUM, if included).
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkRepWeights(ddi *DataDict) error {
+	rw := dbf.RepWeights
+	if rw == nil {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("replicate weights are grouped in microdata extracts only")
+	case !dbf.writesInserts():
+		return fmt.Errorf("replicate weights are grouped in SQL insert dumps only")
+	case rw.arrays() && dbf.DbType != POSTGRES:
+		return fmt.Errorf("replicate weight array columns are postgres-only; group them in %s format instead", REPWT_LONG)
+	}
+	rw.groupList, rw.grouped, rw.key = nil, make(map[string]bool), nil
+	for _, p := range rw.prefixes {
+		type weight struct{ idx, repnum int }
+		var weights []weight
+		for i, v := range ddi.Vars {
+			digits, ok := strings.CutPrefix(strings.ToLower(v.Name), p)
+			if !ok || len(digits) == 0 || len(strings.Trim(digits, "0123456789")) != 0 {
+				continue
+			}
+			repnum, err := strconv.Atoi(digits)
+			if err != nil {
+				return fmt.Errorf("replicate weight %s: %w", v.Name, err)
+			}
+			if dbf.columnType(v) == "string" {
+				return fmt.Errorf("replicate weight %s is not numeric", v.Name)
+			}
+			if len(weights) != 0 && dbf.columnSQLType(ddi.Vars[weights[0].idx]) != dbf.columnSQLType(v) {
+				return fmt.Errorf("replicate weights %s and %s differ in type", ddi.Vars[weights[0].idx].Name, v.Name)
+			}
+			weights = append(weights, weight{i, repnum})
+			rw.grouped[v.Name] = true
+		}
+		if len(weights) == 0 {
+			return fmt.Errorf("no replicate weights are named %s<n>", strings.ToUpper(p))
+		}
+		slices.SortStableFunc(weights, func(a, b weight) int { return cmp.Compare(a.repnum, b.repnum) })
+		g := repWeightGroup{name: p + "s"}
+		for _, w := range weights {
+			g.idx = append(g.idx, w.idx)
+			g.repnums = append(g.repnums, w.repnum)
+		}
+		if rw.arrays() {
+			if col, ok := dbf.lookupColumn(ddi, g.name); ok {
+				return fmt.Errorf("replicate weight column %s is named after column %s", g.name, col)
+			}
+		}
+		rw.groupList = append(rw.groupList, g)
+	}
+	if !rw.long() {
+		return nil
+	}
+	key, err := dbf.longTableKey(ddi)
+	if err != nil {
+		return fmt.Errorf("replicate weight tables are keyed by the row id (-row-id), or the household: %w", err)
+	}
+	rw.key = key
+	return nil
+}
+
+// repWeightArrayColumns returns the array column definitions of the main table (see CreateMainTable),
+// as name, type, and label, for replicate weights grouped in array format
+func (dbf *DatabaseFormatter) repWeightArrayColumns(ddi *DataDict) [][3]string {
+	if !dbf.RepWeights.arrays() {
+		return nil
+	}
+	var cols [][3]string
+	for _, g := range dbf.RepWeights.groupList {
+		first, last := ddi.Vars[g.idx[0]], ddi.Vars[g.idx[len(g.idx)-1]]
+		cols = append(cols, [3]string{dbf.quoteIdent(dbf.columnName(Var{Name: g.name})), dbf.columnSQLType(first) + "[]",
+			fmt.Sprintf("replicate weights %s-%s (%s)", first.Name, last.Name, first.Label)})
+	}
+	return cols
+}
+
+// repWeightArrays formats the replicate weights of a fixed-width row as postgres array literals, each
+// preceded by a comma, for insertion tuples (see insertTuple); the i-th element is the i-th weight, by repnum
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) repWeightArrays(ddi *DataDict, row []byte, colTypes map[string]string, nullPolicies []string) (string, error) {
+	var arrays strings.Builder
+	for _, g := range dbf.RepWeights.groupList {
+		vals := make([]string, len(g.idx))
+		for i, vi := range g.idx {
+			v := ddi.Vars[vi]
+			val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[vi])
+			if err != nil {
+				return "", err
+			}
+			vals[i] = val
+		}
+		arrays.WriteString(",'{" + strings.Join(vals, ",") + "}'")
+	}
+	return arrays.String(), nil
+}
+
+// repWeightTable returns the name of a group's long-format table (e.g., "ipums_tab_repwtps")
+func (dbf *DatabaseFormatter) repWeightTable(g repWeightGroup) string {
+	return dbf.ident(dbf.derivedName(g.name))
+}
+
+// CreateRepWeightTables generates the "CREATE TABLE" and "CREATE INDEX" statements of long-format replicate
+// weight tables: a table per group, with a row per (non-null) weight, keyed like the row it belongs to.
+//
+// For example, the REPWTP group of an IPUMS USA extract would generate:
+//
+// CREATE TABLE ipums_tab_repwtps (
+//
+//	"sample" int,
+//	"serial" int,
+//	"pernum" int,
+//	"repnum" int,
+//	"value" int	-- Person replicate weights
+//
+// );
+//
+// CREATE INDEX idx_ipums_tab_repwtps ON ipums_tab_repwtps ("sample", "serial", "pernum");
+//
+// returns empty byte slice if replicate weights aren't grouped in long format
+func (dbf *DatabaseFormatter) CreateRepWeightTables(ddi *DataDict) []byte {
+	if !dbf.RepWeights.long() {
+		return []byte{}
+	}
+	keyCols, keyTypes := dbf.longKeyCols(ddi, dbf.RepWeights.key)
+	var ddl strings.Builder
+	for _, g := range dbf.RepWeights.groupList {
+		table := dbf.repWeightTable(g)
+		ddl.WriteString(fmt.Sprintf("CREATE TABLE %s (", table))
+		for i, col := range keyCols {
+			ddl.WriteString(fmt.Sprintf("\n\t%s %s,", col, keyTypes[i]))
+		}
+		first := ddi.Vars[g.idx[0]]
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s,", dbf.quoteIdent(dbf.columnName(Var{Name: "repnum"})), dbf.sqlType("int")))
+		ddl.WriteString(fmt.Sprintf("\n\t%s %s\t-- %s\n);\n\n", dbf.quoteIdent(dbf.columnName(Var{Name: "value"})), dbf.columnSQLType(first), first.Label))
+		ddl.WriteString(fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n\n", dbf.tableObjectName(DEFAULT_DERIVED_INDEX, dbf.derivedName(g.name), nil), table, strings.Join(keyCols, ", ")))
+	}
+	return []byte(ddl.String())
+}
+
+// repWeightInserts generates the insert statements of long-format replicate weight tables (see
+// CreateRepWeightTables) for a buffer of fixed-width rows, given the (1-based) number of each row in the file;
+// null weights are skipped.
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) repWeightInserts(ddi *DataDict, buffer []byte, bytesPerLine int, rowNums []int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	var inserts strings.Builder
+	for _, g := range dbf.RepWeights.groupList {
+		var tuples strings.Builder
+		for i := 0; i < len(buffer); i += bytesPerLine {
+			row := buffer[i:(i + bytesPerLine)]
+			key, err := dbf.longKeyValues(ddi, row, rowNums[i/bytesPerLine], dbf.RepWeights.key, colTypes, nullPolicies)
+			if err != nil {
+				return nil, fmt.Errorf("error row %v: %w", row, err)
+			}
+			for w, vi := range g.idx {
+				v := ddi.Vars[vi]
+				val, err := dbf.sqlValue(v, row, colTypes[v.Name], nullPolicies[vi])
+				if err != nil {
+					return nil, fmt.Errorf("error row %v: %w", row, err)
+				}
+				if val == "null" {
+					continue
+				}
+				tuples.WriteString(fmt.Sprintf("\t(%s,%d,%s),\n", key, g.repnums[w], val))
+			}
+		}
+		if tuples.Len() == 0 {
+			continue
+		}
+		stmt := tuples.String()
+		inserts.Write(dbf.appendRows([]byte("INSERT INTO "+dbf.repWeightTable(g)+" "), []byte(stmt[:len(stmt)-2])))
+		inserts.WriteString(";\n")
+	}
+	return []byte(inserts.String()), nil
+}
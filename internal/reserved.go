@@ -0,0 +1,72 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sqlReservedWords are reserved words of the SQL standard that are likely to turn up as
+// IPUMS variable names. Database systems don't reserve all of them (e.g., postgres accepts
+// an unquoted "year" column), but downstream tools often treat them as keywords anyway.
+var sqlReservedWords = []string{
+	"all", "and", "any", "as", "asc", "between", "both", "by", "case", "cast", "check", "column",
+	"constraint", "create", "cross", "current", "current_date", "current_time", "current_user",
+	"day", "default", "delete", "desc", "distinct", "drop", "else", "end", "except", "exists",
+	"false", "fetch", "for", "foreign", "from", "full", "grant", "group", "having", "hour", "in",
+	"inner", "insert", "intersect", "interval", "into", "is", "join", "language", "leading",
+	"left", "like", "limit", "local", "minute", "month", "natural", "not", "null", "of", "offset",
+	"on", "only", "or", "order", "outer", "primary", "range", "rank", "references", "right",
+	"row", "rows", "second", "select", "session_user", "set", "some", "table", "then", "to",
+	"trailing", "true", "union", "unique", "update", "user", "using", "value", "values", "when",
+	"where", "window", "with", "year",
+}
+
+// dialectReservedWords are further reserved words, by database system
+var dialectReservedWords = map[string][]string{
+	POSTGRES: {"analyse", "analyze", "array", "do", "lateral", "placing", "returning", "variadic"},
+	MYSQL: {"change", "condition", "database", "databases", "div", "dual", "index", "key", "keys",
+		"kill", "lines", "load", "lock", "long", "match", "mod", "option", "read", "regexp",
+		"rename", "require", "schema", "show", "signal", "status", "terminated", "usage", "write",
+		"zerofill"},
+	ORACLE: {"access", "audit", "cluster", "comment", "compress", "date", "file", "identified",
+		"immediate", "increment", "index", "initial", "level", "lock", "long", "maxextents",
+		"minus", "mode", "modify", "number", "offline", "online", "pctfree", "prior", "raw",
+		"resource", "rowid", "rownum", "session", "share", "size", "start", "successful",
+		"synonym", "sysdate", "uid", "validate", "view", "whenever"},
+	MSSQL: {"backup", "break", "browse", "bulk", "checkpoint", "close", "clustered", "compute",
+		"contains", "continue", "database", "deny", "disk", "dump", "errlvl", "exec", "execute",
+		"exit", "file", "fillfactor", "goto", "identity", "index", "key", "kill", "lineno",
+		"load", "merge", "national", "nocheck", "nonclustered", "open", "over", "percent", "pivot",
+		"plan", "print", "proc", "procedure", "public", "raiserror", "read", "reconfigure",
+		"restore", "restrict", "return", "revert", "rowcount", "rule", "save", "schema",
+		"shutdown", "statistics", "top", "tran", "transaction", "trigger", "truncate", "unpivot",
+		"use", "view", "waitfor", "while"},
+	SNOWFLAKE: {"account", "connection", "database", "gscluster", "ilike", "increment", "issue",
+		"lateral", "minus", "organization", "qualify", "regexp", "rlike", "sample", "schema",
+		"start", "tablesample", "trigger", "try_cast", "whenever"},
+}
+
+// isReservedWord reports whether a lowercased name is a reserved word, either of
+// the SQL standard, or of the database system
+func isReservedWord(dbType, name string) bool {
+	return slices.Contains(sqlReservedWords, name) || slices.Contains(dialectReservedWords[dbType], name)
+}
+
+// reservedRenames returns the variables renamed for colliding with reserved words, as
+// "old -> new" pairs; variables explicitly renamed by the user are not included
+func (dbf *DatabaseFormatter) reservedRenames(ddi *DataDict) []string {
+	var renamed []string
+	if len(dbf.ReservedSuffix) == 0 {
+		return renamed
+	}
+	for _, v := range ddi.Vars {
+		name := strings.ToLower(v.Name)
+		if _, explicit := dbf.Renames[name]; !explicit && isReservedWord(dbf.DbType, name) {
+			renamed = append(renamed, fmt.Sprintf("%s -> %s", name, dbf.columnName(v)))
+		}
+	}
+	return renamed
+}
@@ -0,0 +1,40 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rowIDVar returns the surrogate row id column (see DatabaseFormatter.RowID) as a variable (for naming,
+// see columnName, and documentation)
+func (dbf *DatabaseFormatter) rowIDVar() Var {
+	return Var{Name: dbf.RowID, Label: "row number in the data file"}
+}
+
+// rowIDSQLType returns the database type of the row id column: a bigint, making up the table's primary key
+func (dbf *DatabaseFormatter) rowIDSQLType() string {
+	return dbf.sqlType("bigint") + " primary key"
+}
+
+// checkRowID ensures that the row id column is validly named, and not named after another column
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkRowID(ddi *DataDict) error {
+	if len(dbf.RowID) == 0 {
+		return nil
+	}
+	if !identifierRe.MatchString(dbf.RowID) {
+		return fmt.Errorf("'%s' is not a valid column name (letters, digits, and underscores only)", dbf.RowID)
+	}
+	if col, ok := dbf.lookupVarColumn(ddi, dbf.RowID); ok {
+		return fmt.Errorf("row id column %s is named after column %s", dbf.RowID, col)
+	}
+	for _, v := range dbf.appendedVars() {
+		if strings.EqualFold(v.Name, dbf.RowID) {
+			return fmt.Errorf("row id column %s is named after a derived or constant column", dbf.RowID)
+		}
+	}
+	return nil
+}
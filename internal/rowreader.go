@@ -0,0 +1,249 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// RowReader decodes the rows of a fixed-width file into typed Go values, for programs consuming an extract
+// directly, rather than through a dump (exported by package ipums2db, along with NewRowReader): character
+// variables are strings, numeric variables are int64s, or float64s (with their implied decimals applied, or
+// holding explicit ones), and blank fields are nil. Fields are decoded as a conversion loads them, under a
+// null policy (see SetNulls): by default, fields holding any blank are nil, as they're loaded as null.
+//
+// For example, reading an IPUMS CPS extract:
+//
+//	ddi, err := NewDataDict("cps_00001.xml")
+//	...
+//	rr := NewRowReader(&ddi, datFile)
+//	for {
+//		row, err := rr.Read()
+//		if errors.Is(err, io.EOF) {
+//			break
+//		}
+//		...
+//		age, _ := row["AGE"].(int64)
+//	}
+type RowReader struct {
+	ddi      *DataDict
+	in       *bufio.Reader
+	rowChars int
+	line     int      // lines read
+	policies []string // null policy of each variable (see SetNulls)
+
+	// fields of the last struct type scanned into (see Scan): the index of each field's variable, or -1
+	scanType  reflect.Type
+	scanIndex []int
+}
+
+// NewRowReader returns a RowReader decoding the rows of a fixed-width file read from r, as described by a
+// data dictionary; r is read through once, so it may be a stream (e.g., a gzip.Reader of a ".dat.gz" file).
+// Both "\n" and "\r\n" line endings are read, and a missing final newline is tolerated.
+func NewRowReader(ddi *DataDict, r io.Reader) *RowReader {
+	rowChars := BytesPerRow(ddi) - 1
+	rr := &RowReader{ddi: ddi, in: bufio.NewReaderSize(r, max(1<<16, rowChars+2)), rowChars: rowChars}
+	rr.policies = (*NullPolicy)(nil).varPolicies(ddi.Vars)
+	return rr
+}
+
+// SetNulls sets the null policy fields are decoded under (see ParseNullsFlag), as a conversion given the
+// same -nulls flag would load them: fields loaded as null are nil, and fields the policy rejects (e.g.,
+// partially blank ones, under "strict") are errors; a nil policy is the default ("any").
+//
+// returns error if a variable with its own policy isn't in the data dictionary
+func (rr *RowReader) SetNulls(np *NullPolicy) error {
+	if err := np.check(rr.ddi); err != nil {
+		return err
+	}
+	rr.policies = np.varPolicies(rr.ddi.Vars)
+	return nil
+}
+
+// next reads the next row of the file, without its line ending
+//
+// returns io.EOF if no rows are left, or error if the row can't be read, or isn't as wide as described (as a ParseError)
+func (rr *RowReader) next() ([]byte, error) {
+	if rr.ddi.Flavor == AGGREGATE {
+		return nil, fmt.Errorf("aggregate extracts are comma-delimited; only fixed-width (microdata) files are read by row")
+	}
+	line, err := rr.in.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, &ParseError{Err: fmt.Errorf("line %d is longer than the %d characters described by the data dictionary", rr.line+1, rr.rowChars)}
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, io.EOF
+	}
+	rr.line++
+	row := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if len(row) != rr.rowChars {
+		return nil, &ParseError{Err: fmt.Errorf("line %d holds %d characters, but the data dictionary describes %d", rr.line, len(row), rr.rowChars)}
+	}
+	return row, nil
+}
+
+// rowValue decodes the field of a variable, under its null policy: a string, an int64, or a float64, or nil,
+// if blank (or null)
+//
+// returns error if the policy rejects the field, or a numeric field isn't a number
+func rowValue(v Var, row []byte, policy string) (any, error) {
+	val, err := policyValue(v, row[v.Location.Start-1:v.Location.End], policy)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(val) == 0:
+		return nil, nil
+	case v.VType.VarType == "character":
+		return val, nil
+	case strings.Contains(val, "."):
+		return strconv.ParseFloat(val, 64)
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is out of range", val)
+	}
+	return n, nil
+}
+
+// Read decodes the next row of the file, keyed by variable name (as named by the data dictionary, e.g., "AGE")
+//
+// returns io.EOF if no rows are left, or error if the row can't be read or decoded (as a ParseError)
+func (rr *RowReader) Read() (map[string]any, error) {
+	row, err := rr.next()
+	if err != nil {
+		return nil, err
+	}
+	vals := make(map[string]any, len(rr.ddi.Vars))
+	for i, v := range rr.ddi.Vars {
+		if vals[v.Name], err = rowValue(v, row, rr.policies[i]); err != nil {
+			return nil, &ParseError{Err: fmt.Errorf("line %d: variable %s: %w", rr.line, v.Name, err)}
+		}
+	}
+	return vals, nil
+}
+
+// Scan decodes the next row of the file into the fields of a struct, given a pointer to it: each exported
+// field is set to the variable named by its "ipums" tag (e.g., `ipums:"AGE"`), or else by its name,
+// case-insensitively; fields naming no variable (or tagged "-") are left as they are. Fields may be of any
+// integer, float, or string kind (or any), or pointers to one, which are set to nil for blank fields; other
+// fields are set to their zero value for blank fields.
+//
+// For example:
+//
+//	type person struct {
+//		Year    int
+//		Age     *int // nil, if blank
+//		IncWage float64 `ipums:"INCWAGE"`
+//	}
+//	var p person
+//	err := rr.Scan(&p)
+//
+// returns io.EOF if no rows are left, or error if dst isn't a pointer to a struct, or if the row can't be read,
+// or decoded into its fields (as a ParseError)
+func (rr *RowReader) Scan(dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rows are scanned into a pointer to a struct, not %T", dst)
+	}
+	st := rv.Elem()
+	if st.Type() != rr.scanType {
+		rr.scanType, rr.scanIndex = st.Type(), scanFields(rr.ddi, st.Type())
+	}
+	row, err := rr.next()
+	if err != nil {
+		return err
+	}
+	for fi, vi := range rr.scanIndex {
+		if vi < 0 {
+			continue
+		}
+		v := rr.ddi.Vars[vi]
+		val, err := rowValue(v, row, rr.policies[vi])
+		if err == nil {
+			err = setField(st.Field(fi), val)
+		}
+		if err != nil {
+			return &ParseError{Err: fmt.Errorf("line %d: variable %s: %w", rr.line, v.Name, err)}
+		}
+	}
+	return nil
+}
+
+// scanFields returns the index of the variable of each field of a struct type (see Scan), or -1
+func scanFields(ddi *DataDict, t reflect.Type) []int {
+	index := make([]int, t.NumField())
+	for fi := range index {
+		index[fi] = -1
+		f := t.Field(fi)
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("ipums"); ok {
+			name = tag
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		for vi, v := range ddi.Vars {
+			if strings.EqualFold(v.Name, name) {
+				index[fi] = vi
+				break
+			}
+		}
+	}
+	return index
+}
+
+// setField sets a struct field to a decoded value (see rowValue), converting it to the field's kind
+//
+// returns error if the value doesn't fit the field
+func setField(f reflect.Value, val any) error {
+	if val == nil {
+		f.SetZero()
+		return nil
+	}
+	if f.Kind() == reflect.Pointer {
+		p := reflect.New(f.Type().Elem())
+		if err := setField(p.Elem(), val); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Interface:
+		f.Set(reflect.ValueOf(val))
+		return nil
+	case reflect.String:
+		f.SetString(fmt.Sprint(val))
+		return nil
+	}
+	switch n := val.(type) {
+	case int64:
+		switch {
+		case f.CanInt() && !f.OverflowInt(n):
+			f.SetInt(n)
+			return nil
+		case f.CanUint() && n >= 0 && !f.OverflowUint(uint64(n)):
+			f.SetUint(uint64(n))
+			return nil
+		case f.CanFloat():
+			f.SetFloat(float64(n))
+			return nil
+		}
+	case float64:
+		if f.CanFloat() {
+			f.SetFloat(n)
+			return nil
+		}
+	}
+	return fmt.Errorf("%v doesn't fit a field of type %s", val, f.Type())
+}
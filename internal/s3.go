@@ -0,0 +1,243 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store is a bucket of an S3-compatible object storage service: AWS S3, S3-compatible services
+// (e.g., MinIO, Ceph), or Google Cloud Storage through its XML API. Requests are signed with
+// AWS Signature Version 4, or authorized with a bearer token.
+type s3Store struct {
+	scheme    string // URL scheme, for naming objects
+	endpoint  string // e.g., "https://s3.us-east-1.amazonaws.com"
+	bucket    string
+	pathStyle bool   // bucket in the path (endpoint/bucket/key), rather than the host (bucket.endpoint/key)
+	region    string // signing region
+	accessKey string
+	secretKey string
+	token     string // session token (AWS), sent as x-amz-security-token
+	bearer    string // OAuth access token, used in place of signing (GCS)
+	client    *http.Client
+}
+
+// newS3Store returns the s3Store of an AWS S3 bucket. Credentials are read from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN (if any), and the region from AWS_REGION or
+// AWS_DEFAULT_REGION (default "us-east-1"). For S3-compatible services, AWS_ENDPOINT_URL_S3
+// (or AWS_ENDPOINT_URL) sets the endpoint, addressing buckets by path.
+//
+// returns error if credentials are missing
+func newS3Store(bucket string) (*s3Store, error) {
+	s := &s3Store{
+		scheme:    "s3",
+		bucket:    bucket,
+		region:    firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{},
+	}
+	if len(s.accessKey) == 0 || len(s.secretKey) == 0 {
+		return nil, fmt.Errorf("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if len(s.region) == 0 {
+		s.region = "us-east-1"
+	}
+	s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); len(endpoint) != 0 {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		s.endpoint, s.pathStyle = strings.TrimSuffix(endpoint, "/"), true
+	}
+	return s, nil
+}
+
+// newGCSStore returns the s3Store of a Google Cloud Storage bucket, through its XML API. Requests are
+// authorized with GOOGLE_OAUTH_ACCESS_TOKEN (e.g., from "gcloud auth print-access-token") if set,
+// or else signed with an HMAC key, from GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET.
+//
+// returns error if credentials are missing
+func newGCSStore(bucket string) (*s3Store, error) {
+	s := &s3Store{
+		scheme:    "gs",
+		endpoint:  "https://storage.googleapis.com",
+		bucket:    bucket,
+		pathStyle: true,
+		region:    "auto",
+		accessKey: os.Getenv("GCS_HMAC_ACCESS_ID"),
+		secretKey: os.Getenv("GCS_HMAC_SECRET"),
+		bearer:    os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+		client:    &http.Client{},
+	}
+	if len(s.bearer) == 0 && (len(s.accessKey) == 0 || len(s.secretKey) == 0) {
+		return nil, fmt.Errorf("gs: GOOGLE_OAUTH_ACCESS_TOKEN, or GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET, must be set")
+	}
+	return s, nil
+}
+
+// url returns the URL of an object
+func (s *s3Store) url(key string) string {
+	return fmt.Sprintf("%s://%s/%s", s.scheme, s.bucket, key)
+}
+
+// startUpload starts a multipart upload, returning its upload ID
+func (s *s3Store) startUpload(key string) (string, error) {
+	_, body, err := s.send(http.MethodPost, key, "uploads=", nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.Unmarshal(body, &res); err != nil || len(res.UploadID) == 0 {
+		return "", fmt.Errorf("starting upload: unexpected response %q", body)
+	}
+	return res.UploadID, nil
+}
+
+// uploadPart uploads a part of a multipart upload, returning its ETag
+func (s *s3Store) uploadPart(key, uploadID string, partNum int, data []byte) (string, error) {
+	query := fmt.Sprintf("partNumber=%d&uploadId=%s", partNum, uriEncode(uploadID, false))
+	resp, _, err := s.send(http.MethodPut, key, query, data)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeUpload completes a multipart upload, making the object visible
+func (s *s3Store) completeUpload(key, uploadID string, etags []string) error {
+	// an upload needs at least one part, even for an empty object
+	if len(etags) == 0 {
+		etag, err := s.uploadPart(key, uploadID, 1, nil)
+		if err != nil {
+			return err
+		}
+		etags = []string{etag}
+	}
+	var parts bytes.Buffer
+	parts.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range etags {
+		parts.WriteString(fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>", i+1))
+		_ = xml.EscapeText(&parts, []byte(etag))
+		parts.WriteString("</ETag></Part>")
+	}
+	parts.WriteString("</CompleteMultipartUpload>")
+	_, body, err := s.send(http.MethodPost, key, "uploadId="+uriEncode(uploadID, false), parts.Bytes())
+	if err != nil {
+		return err
+	}
+	// S3 may report a failure to complete in the body of a 200 response
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("completing upload: %s", body)
+	}
+	return nil
+}
+
+// abortUpload aborts a multipart upload, discarding its parts
+func (s *s3Store) abortUpload(key, uploadID string) error {
+	_, _, err := s.send(http.MethodDelete, key, "uploadId="+uriEncode(uploadID, false), nil)
+	return err
+}
+
+// send sends a request on an object, with a query already in canonical (sorted, encoded) form
+func (s *s3Store) send(method, key, query string, body []byte) (*http.Response, []byte, error) {
+	scheme, host, _ := strings.Cut(s.endpoint, "://")
+	objPath := "/" + uriEncode(key, true)
+	if s.pathStyle {
+		objPath = "/" + uriEncode(s.bucket, false) + objPath
+	} else {
+		host = s.bucket + "." + host
+	}
+	reqURL := fmt.Sprintf("%s://%s%s", scheme, host, objPath)
+	if len(query) != 0 {
+		reqURL += "?" + query
+	}
+	return sendWithRetry(s.client, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		if len(s.bearer) != 0 {
+			req.Header.Set("Authorization", "Bearer "+s.bearer)
+			return req, nil
+		}
+		s.sign(req, host, objPath, query, body, time.Now().UTC())
+		return req, nil
+	})
+}
+
+// sign signs a request with AWS Signature Version 4
+func (s *s3Store) sign(req *http.Request, host, objPath, query string, body []byte, now time.Time) {
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if len(s.token) != 0 {
+		headers["x-amz-security-token"] = s.token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{req.Method, objPath, query, canonHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// sha256Hex returns the hex-encoded SHA-256 hash of data
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// firstEnv returns the value of the first environment variable set, or ""
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); len(v) != 0 {
+			return v
+		}
+	}
+	return ""
+}
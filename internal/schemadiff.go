@@ -0,0 +1,121 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaDiff holds the differences between the main tables of two data dictionaries (see DiffSchemas)
+type SchemaDiff struct {
+	Added   []Var        // variables of the new data dictionary only, in its order
+	Removed []Var        // variables of the old data dictionary only, in its order
+	Retyped []RetypedVar // variables of both, whose column types differ, in the new data dictionary's order
+	oldDDI  *DataDict    // the old data dictionary
+	newDDI  *DataDict    // the new data dictionary
+	dbf     *DatabaseFormatter
+}
+
+// RetypedVar is a variable whose column type differs between two data dictionaries (e.g., a wider INCWAGE)
+type RetypedVar struct {
+	Var              // the variable, as in the new data dictionary
+	OldType, NewType string
+}
+
+// IsEmpty reports whether the main tables of the data dictionaries are the same
+func (sd SchemaDiff) IsEmpty() bool {
+	return len(sd.Added) == 0 && len(sd.Removed) == 0 && len(sd.Retyped) == 0
+}
+
+// DiffSchemas compares the main tables generated by dbf for two data dictionaries (e.g., an extract, and
+// its refresh with extra variables): variables are matched by name, and their column types compared
+func (dbf *DatabaseFormatter) DiffSchemas(oldDDI, newDDI *DataDict) SchemaDiff {
+	sd := SchemaDiff{oldDDI: oldDDI, newDDI: newDDI, dbf: dbf}
+	for _, v := range newDDI.Vars {
+		old, ok := findVar(oldDDI, v.Name)
+		if !ok {
+			sd.Added = append(sd.Added, v)
+			continue
+		}
+		if oldType, newType := dbf.columnSQLType(old), dbf.columnSQLType(v); oldType != newType {
+			sd.Retyped = append(sd.Retyped, RetypedVar{Var: v, OldType: oldType, NewType: newType})
+		}
+	}
+	for _, v := range oldDDI.Vars {
+		if _, ok := findVar(newDDI, v.Name); !ok {
+			sd.Removed = append(sd.Removed, v)
+		}
+	}
+	return sd
+}
+
+// MigrationSQL generates the statements evolving the main table of the old data dictionary into that of the
+// new one, in the syntax of the database system (note: statement terminator (e.g., ";") is included): removed
+// columns are dropped, along with their ref_tables; retyped columns are altered; and added columns are
+// added, along with their ref_tables. For example, in postgres:
+//
+// ALTER TABLE ipums_tab DROP COLUMN "occ1950";
+//
+// ALTER TABLE ipums_tab ALTER COLUMN "incwage" TYPE numeric(9,2);
+//
+// ALTER TABLE ipums_tab ADD COLUMN "occ2010" int;	-- Occupation, 2010 basis
+//
+// Added columns go at the end of the table, rather than in the new data dictionary's order.
+func (sd SchemaDiff) MigrationSQL() []byte {
+	dbf := sd.dbf
+	table := dbf.ident(dbf.TableName)
+	var migration strings.Builder
+	for _, v := range sd.Removed {
+		migration.WriteString(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;\n\n", table, dbf.quoteIdent(dbf.columnName(v))))
+		if dbf.hasRefTable(v) {
+			migration.WriteString(fmt.Sprintf("DROP TABLE %s;\n\n", dbf.refTableName(v)))
+		}
+	}
+	for _, rv := range sd.Retyped {
+		migration.WriteString(fmt.Sprintf("ALTER TABLE %s %s;\t-- was %s\n\n", table, dbf.alterColumnType(dbf.quoteIdent(dbf.columnName(rv.Var)), rv.NewType), rv.OldType))
+	}
+	for _, v := range sd.Added {
+		migration.WriteString(fmt.Sprintf("ALTER TABLE %s %s;\t-- %s\n\n", table, dbf.addColumn(dbf.quoteIdent(dbf.columnName(v)), dbf.columnSQLType(v)), v.Label))
+	}
+	if len(sd.Added) != 0 {
+		added := DataDict{Flavor: sd.newDDI.Flavor, Vars: sd.Added}
+		migration.Write(dbf.CreateRefTables(&added))
+	}
+	return []byte(migration.String())
+}
+
+// WriteMigration writes the migration statements (see MigrationSQL) to a file, atomically
+//
+// returns error if the file can't be written
+func (sd SchemaDiff) WriteMigration(fileName string) error {
+	return writeFileAtomic(fileName, sd.MigrationSQL())
+}
+
+// addColumn returns the clause of an "ALTER TABLE" statement adding a column
+func (dbf *DatabaseFormatter) addColumn(col, sqlType string) string {
+	switch dbf.DbType {
+	case MSSQL:
+		return fmt.Sprintf("ADD %s %s", col, sqlType)
+	case ORACLE:
+		return fmt.Sprintf("ADD (%s %s)", col, sqlType)
+	default:
+		return fmt.Sprintf("ADD COLUMN %s %s", col, sqlType)
+	}
+}
+
+// alterColumnType returns the clause of an "ALTER TABLE" statement changing the type of a column
+func (dbf *DatabaseFormatter) alterColumnType(col, sqlType string) string {
+	switch dbf.DbType {
+	case MYSQL:
+		return fmt.Sprintf("MODIFY COLUMN %s %s", col, sqlType)
+	case MSSQL:
+		return fmt.Sprintf("ALTER COLUMN %s %s", col, sqlType)
+	case ORACLE:
+		return fmt.Sprintf("MODIFY (%s %s)", col, sqlType)
+	case SNOWFLAKE:
+		return fmt.Sprintf("ALTER COLUMN %s SET DATA TYPE %s", col, sqlType)
+	default:
+		return fmt.Sprintf("ALTER COLUMN %s TYPE %s", col, sqlType)
+	}
+}
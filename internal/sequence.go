@@ -0,0 +1,53 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+// Sequencer puts ParsedResults back in file order (by the index of their ParsingJob), as parsers finish
+// jobs out of order, so that dumps are reproducible byte-for-byte from run to run. Results that arrive
+// early wait in a reorder buffer; to bound it, jobs are throttled, so that at most window jobs are
+// issued ahead of the last result sequenced.
+type Sequencer struct {
+	window chan struct{}
+}
+
+// NewSequencer returns a Sequencer holding at most window (at least 1) jobs between being issued and
+// their results being sequenced
+func NewSequencer(window int) Sequencer {
+	return Sequencer{window: make(chan struct{}, max(window, 1))}
+}
+
+// Throttle forwards ParsingJobs from jobStream to throttledStream, waiting for room in the window before
+// each; it closes throttledStream once jobStream is closed
+func (s Sequencer) Throttle(jobStream <-chan ParsingJob, throttledStream chan<- ParsingJob) {
+	defer close(throttledStream)
+	for job := range jobStream {
+		s.window <- struct{}{}
+		throttledStream <- job
+	}
+}
+
+// Sequence reads ParsedResults of throttled jobs from parsedStream, and sends them to orderedStream in
+// order of job index; results with errors are sent right away. It closes orderedStream once
+// parsedStream is closed.
+func (s Sequencer) Sequence(parsedStream <-chan ParsedResult, orderedStream chan<- ParsedResult) {
+	defer close(orderedStream)
+	pending := make(map[int]ParsedResult)
+	next := 0
+	for res := range parsedStream {
+		if res.AnyError != nil {
+			orderedStream <- res
+			continue
+		}
+		pending[res.Index] = res
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			orderedStream <- ready
+			<-s.window
+			next++
+		}
+	}
+}
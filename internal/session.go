@@ -0,0 +1,46 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+)
+
+// UseStatement generates the statement setting the session's namespace to UseSchema, written at the
+// top of every file of the dump, so that each file restores into the same namespace, whichever client
+// (and defaults) it's run with (note: statement terminator (e.g., ";") is included):
+//
+//   - postgres: SET search_path TO <schema>
+//   - mysql, mssql: USE <database>
+//   - oracle: ALTER SESSION SET CURRENT_SCHEMA = <schema>
+//   - snowflake: USE SCHEMA <schema>
+//
+// returns empty byte slice if UseSchema isn't set
+func (dbf *DatabaseFormatter) UseStatement() []byte {
+	if len(dbf.UseSchema) == 0 {
+		return []byte{}
+	}
+	schema := dbf.ident(dbf.UseSchema)
+	var use string
+	switch dbf.DbType {
+	case MYSQL, MSSQL:
+		use = fmt.Sprintf("USE %s;\n\n", schema)
+	case ORACLE:
+		use = fmt.Sprintf("ALTER SESSION SET CURRENT_SCHEMA = %s;\n\n", schema)
+	case SNOWFLAKE:
+		use = fmt.Sprintf("USE SCHEMA %s;\n\n", schema)
+	default:
+		use = fmt.Sprintf("SET search_path TO %s;\n\n", schema)
+	}
+	return dbf.styled([]byte(use))
+}
+
+// checkUseSchema ensures that UseSchema, if set, is a valid schema (or database) name
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkUseSchema() error {
+	if len(dbf.UseSchema) != 0 && !identifierRe.MatchString(dbf.UseSchema) {
+		return fmt.Errorf("'%s' is not a valid schema name (letters, digits, and underscores only)", dbf.UseSchema)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// checkShardBy ensures that the shard variable (see DatabaseFormatter.ShardBy) is in the data dictionary,
+// and that sharding can be written: it's for SQL insert dumps of microdata extracts only
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkShardBy(ddi *DataDict) error {
+	if len(dbf.ShardBy) == 0 {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("insertion files are sharded for microdata extracts only")
+	case !dbf.writesInserts():
+		return fmt.Errorf("insertion files are sharded in SQL insert dumps only")
+	}
+	if _, ok := findVar(ddi, dbf.ShardBy); !ok {
+		return fmt.Errorf("unrecognized shard variable %s", dbf.ShardBy)
+	}
+	return nil
+}
+
+// BulkInsertShards generates multi-tuple database table inserts like BulkInsert, split into a Shard per
+// distinct value of the shard variable (see shardKey), in order of first appearance; each shard's rows
+// keep their order, and their numbers (e.g., for the row id).
+//
+// Returns error if the file can't be read, or if any row cannot be parsed.
+func (dbf *DatabaseFormatter) BulkInsertShards(ddi *DataDict, datFile io.ReaderAt, startAtRow int, numRows int) ([]Shard, error) {
+	buffer, err := readRows(ddi, datFile, startAtRow, numRows)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := findVar(ddi, dbf.ShardBy)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized shard variable %s", dbf.ShardBy)
+	}
+	nullPolicy := dbf.Nulls.policy(v, dbf.columnType(v) == "string")
+	bytesPerLine := BytesPerRow(ddi)
+
+	var keys []string
+	buffers, rowNums := make(map[string][]byte), make(map[string][]int)
+	for i := 0; i < len(buffer); i += bytesPerLine {
+		row := buffer[i:(i + bytesPerLine)]
+		key, err := dbf.shardKey(v, row, nullPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("error row %v: %w", row, err)
+		}
+		if _, ok := buffers[key]; !ok {
+			keys = append(keys, key)
+		}
+		buffers[key] = append(buffers[key], row...)
+		rowNums[key] = append(rowNums[key], startAtRow+i/bytesPerLine+1)
+	}
+	shards := make([]Shard, len(keys))
+	for s, key := range keys {
+		block, err := dbf.insertBlock(ddi, buffers[key], rowNums[key])
+		if err != nil {
+			return nil, err
+		}
+		shards[s] = Shard{Key: key, Block: block}
+	}
+	return shards, nil
+}
+
+// shard keys of null values, and of blank strings (see shardKey)
+const (
+	shardNull  = "null"
+	shardBlank = "blank"
+)
+
+// shardValuePrefix prefixes the shard keys of values spelled as those of null values and blank strings (e.g.,
+// "NULL" -> "=NULL"), so that they don't share their shard; "=" isn't in any other key (see shardKey)
+const shardValuePrefix = "="
+
+// shardKey returns the shard of a fixed-width row: the value of the shard variable, as coded in the data
+// file (before any recoding or hashing), naming the shard's insertion file (e.g., "2023" ->
+// inserts_year_2023.sql); shardNull for null values, and shardBlank for blank strings. Characters other
+// than letters, digits, "-", and "." are replaced by "_", so values differing only in those share a shard;
+// values spelled as shardNull or shardBlank (in any case) are prefixed by shardValuePrefix.
+//
+// returns error if the field cannot be parsed
+func (dbf *DatabaseFormatter) shardKey(v Var, row []byte, nullPolicy string) (string, error) {
+	start, end := v.Location.Start-1, v.Location.End
+	if (start < 0) || (end > len(row)) {
+		return "", fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+	}
+	chars, isNull, err := applyNullPolicy(row[start:end], nullPolicy, dbf.columnType(v) == "string")
+	if err != nil {
+		return "", fmt.Errorf("variable %s: %w", v.Name, err)
+	}
+	if isNull {
+		return shardNull, nil
+	}
+	val := strings.TrimSpace(string(chars))
+	if len(val) == 0 {
+		return shardBlank, nil
+	}
+	if dbf.columnType(v) != "string" {
+		if val, err = fixedWidthNumber(chars, v.DecimalPoint); err != nil {
+			return "", fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+	}
+	key := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, val)
+	if strings.EqualFold(key, shardNull) || strings.EqualFold(key, shardBlank) {
+		key = shardValuePrefix + key
+	}
+	return key, nil
+}
@@ -0,0 +1,239 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// snowflakeEscaper escapes string literal contents for snowflake, which reads backslashes in
+// literals as escape characters
+var snowflakeEscaper = strings.NewReplacer(`\`, `\\`, "'", "''", "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// csvNull is written for nulls in staged CSV files, so that they're told apart from empty strings,
+// which are always enclosed in quotes ("")
+const csvNull = `\N`
+
+// csvParts are the insertion files of staged dumps: gzip compressed CSV files, of the form data_{i}.csv.gz
+var csvParts = dumpParts{nameFmt: "data_%d.csv.gz", schemaName: "ddl.sql", ext: ".sql", wrap: newGzipFile}
+
+// stagesCSV reports whether the database system loads data from staged CSV files, rather than
+// from inserts; at snowflake's scale, multi-tuple inserts are impractically slow
+func (dbf *DatabaseFormatter) stagesCSV() bool {
+	return dbf.DbType == SNOWFLAKE
+}
+
+// NewStagedDumpWriter returns a DumpWriter for database systems that load staged CSV files (see
+// DatabaseFormatter.stagesCSV). The dump is a directory holding ddl.sql and the gzip compressed CSV
+// files (data_{i}.csv.gz), in place of insertion files; WriteDDL follows the DDL with the statements
+// staging and loading them (see stagedLoad).
+//
+// If compressWorkers is positive, the CSV files are compressed by a pool of that many workers, ahead of the
+// writers (see compressBlocks); otherwise, each writer compresses the files it writes.
+func NewStagedDumpWriter(totBytes int, dirName string, split OutputSplit, compressWorkers int) (DumpWriter, error) {
+	if IsObjectURL(dirName) {
+		return DumpWriter{}, fmt.Errorf("staged CSV dumps can't be written to object storage; write to a local directory")
+	}
+	parts := csvParts
+	if compressWorkers > 0 {
+		parts.wrap = newGzipMembersFile
+	}
+	dw, err := newDumpWriter(totBytes, dirName, true, split, parts)
+	if err != nil {
+		return DumpWriter{}, err
+	}
+	dw.staged = true
+	dw.compressWorkers = max(compressWorkers, 0)
+	return dw, nil
+}
+
+// gzipFile is a DumpFile compressed with gzip
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+// newGzipFile wraps a file, compressing everything written to it
+func newGzipFile(f *os.File) (DumpFile, error) {
+	return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+}
+
+// Close flushes the compressed stream, and closes the file
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if closeErr := g.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Name returns the name of the underlying file
+func (g *gzipFile) Name() string {
+	return g.f.Name()
+}
+
+// csvRecord generates a CSV record from a fixed-width row, in place of an insertion tuple (see insertTuple).
+// Numbers are written as they'd be inserted, strings are always enclosed in quotes, and nulls are csvNull.
+//
+// returns error if start and end positions are not valid for row, or if a field cannot be parsed.
+func (dbf *DatabaseFormatter) csvRecord(ddi *DataDict, row []byte, rowNum int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	var record strings.Builder
+	if len(dbf.RowID) != 0 {
+		record.WriteString(strconv.Itoa(rowNum) + ",")
+	}
+	for i, v := range ddi.Vars {
+		if i > 0 {
+			record.WriteByte(',')
+		}
+		start, end := v.Location.Start-1, v.Location.End
+		if (start < 0) || (end > len(row)) {
+			return nil, fmt.Errorf("startAt %d & endAt %d not valid index range for sliceLen %d", start, end, len(row))
+		}
+		chars, isNull, err := applyNullPolicy(row[start:end], nullPolicies[i], colTypes[v.Name] == "string")
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		if !isNull {
+			if chars, isNull, err = dbf.transformChars(v, chars); err != nil {
+				return nil, err
+			}
+		}
+		switch colType := colTypes[v.Name]; {
+		case isNull:
+			record.WriteString(csvNull)
+		case dbf.dims[v.Name] != nil:
+			key, err := dbf.dimKey(v, chars)
+			if err != nil {
+				return nil, err
+			}
+			record.WriteString(key)
+		case colType == "string":
+			record.WriteString(csvQuote(string(chars)))
+		default:
+			dcml := 0
+			if colType == "float" {
+				dcml = v.DecimalPoint
+			}
+			num, err := fixedWidthNumber(chars, dcml)
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+			}
+			record.WriteString(num)
+		}
+	}
+	if dbf.hasAppended() {
+		vals, err := dbf.appendedFromRow(ddi, row, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		record.WriteString(dbf.appendedCSV(vals))
+	}
+	record.WriteByte('\n')
+	return []byte(record.String()), nil
+}
+
+// csvRecords generates CSV records from comma-delimited records, in place of insertion statements
+// (see BulkInsertRecords); columns are written in the order of the data dictionary.
+//
+// returns error if any record cannot be parsed.
+func (dbf *DatabaseFormatter) csvRecords(ddi *DataDict, records [][]string, firstRow int, colIdx []int) ([]byte, error) {
+	colTypes := dbf.columnTypes(ddi)
+	var out strings.Builder
+	for r, rec := range records {
+		if len(dbf.RowID) != 0 {
+			out.WriteString(strconv.Itoa(firstRow+r) + ",")
+		}
+		for i, v := range ddi.Vars {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			var field string
+			if colIdx[i] >= 0 && colIdx[i] < len(rec) {
+				field = strings.TrimSpace(rec[colIdx[i]])
+			}
+			if len(field) != 0 {
+				var err error
+				if field, _, err = dbf.transformField(v, field, 0); err != nil {
+					return nil, fmt.Errorf("record %v: %w", rec, err)
+				}
+			}
+			switch colType := colTypes[v.Name]; {
+			case len(field) == 0:
+				out.WriteString(csvNull)
+			case colType == "string":
+				out.WriteString(csvQuote(field))
+			default:
+				if _, err := strconv.ParseFloat(field, 64); err != nil {
+					return nil, fmt.Errorf("record %v: variable %s: %w", rec, v.Name, err)
+				}
+				out.WriteString(field)
+			}
+		}
+		if dbf.hasAppended() {
+			vals, err := dbf.appendedFromRecord(rec, colIdx)
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", rec, err)
+			}
+			out.WriteString(dbf.appendedCSV(vals))
+		}
+		out.WriteByte('\n')
+	}
+	return []byte(out.String()), nil
+}
+
+// csvQuote encloses a CSV field in quotes, doubling any quotes within
+func csvQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// clusterBy generates an "ALTER TABLE ... CLUSTER BY" statement, in place of index creation (see
+// CreateIndices): snowflake has no indices on standard tables, so the indexed columns make up
+// the table's clustering key instead.
+//
+// returns error if a column is not recognized in the data dictionary, or is given an index method or predicate
+func (dbf *DatabaseFormatter) clusterBy(ddi *DataDict, cols []string) ([]byte, error) {
+	if len(cols) == 0 {
+		return []byte{}, nil
+	}
+	keys := make([]string, len(cols))
+	for i, def := range cols {
+		col, method, pred := splitIndex(def)
+		if len(method) != 0 || len(pred) != 0 {
+			return nil, fmt.Errorf("snowflake clusters on the indexed columns, which take no index method or predicate (%s)", def)
+		}
+		col, ok := dbf.lookupColumn(ddi, col)
+		if !ok {
+			return nil, fmt.Errorf("cannot cluster on unrecognized variable %s", col)
+		}
+		keys[i] = dbf.quoteIdent(col)
+	}
+	return []byte(fmt.Sprintf("ALTER TABLE %s CLUSTER BY (%s);\n\n", dbf.ident(dbf.TableName), strings.Join(keys, ", "))), nil
+}
+
+// stagedLoad generates the statements loading a staged dump's CSV files (found in dirName) into the
+// main table: a "PUT" uploading them to the table's stage, and a "COPY INTO" loading (then purging)
+// them. PUT reads local files, so the statements must be run from a client such as SnowSQL.
+func (dbf *DatabaseFormatter) stagedLoad(dirName string) ([]byte, error) {
+	absDir, err := filepath.Abs(dirName)
+	if err != nil {
+		return nil, err
+	}
+	localPath := filepath.ToSlash(absDir) // e.g., file:///home/me/dump, or file://C:/dump
+	table := dbf.ident(dbf.TableName)
+	var load strings.Builder
+	load.WriteString("-- load the data files of this directory; PUT reads local files, so run this from SnowSQL (or another client)\n")
+	load.WriteString("-- the files are read from the path below; edit it if the directory moves\n")
+	load.WriteString(fmt.Sprintf("PUT 'file://%s/%s' @%%%s AUTO_COMPRESS = FALSE SOURCE_COMPRESSION = GZIP OVERWRITE = TRUE;\n\n",
+		snowflakeEscaper.Replace(localPath), strings.Replace(csvParts.nameFmt, "%d", "*", 1), table))
+	load.WriteString(fmt.Sprintf("COPY INTO %s\nFROM @%%%s\n", table, table))
+	load.WriteString("PATTERN = '.*data_[0-9]+[.]csv[.]gz'\n")
+	load.WriteString("FILE_FORMAT = (TYPE = CSV COMPRESSION = GZIP FIELD_DELIMITER = ',' FIELD_OPTIONALLY_ENCLOSED_BY = '\"'\n")
+	load.WriteString("\tNULL_IF = ('\\\\N') EMPTY_FIELD_AS_NULL = FALSE ENCODING = 'UTF8')\n")
+	load.WriteString("ON_ERROR = ABORT_STATEMENT\nPURGE = TRUE;\n\n")
+	return []byte(load.String()), nil
+}
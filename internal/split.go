@@ -0,0 +1,370 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OutputSplit limits the size of each insertion file in directory format: Rows is the max number
+// of rows, and Bytes is the max size of the generated SQL. Zero values mean no limit; with no limits
+// at all, the insertion files are split by the size of the fixed-width file (see maxBytesPerFile).
+// Alternatively, ShardBy names a variable whose values shard the insertion files, one per distinct value
+// (see DatabaseFormatter.ShardBy).
+type OutputSplit struct {
+	Rows    int
+	Bytes   int
+	ShardBy string
+}
+
+// IsSet reports whether any limit is set
+func (s OutputSplit) IsSet() bool {
+	return s.Rows > 0 || s.Bytes > 0
+}
+
+// MaxBytesPerJob caps the fixed-width bytes parsed per job, so that a single insertion statement
+// doesn't hold more rows than Rows, and is unlikely to be larger than Bytes (SQL is generally
+// larger than its fixed-width source); parts are split between statements, so any statement
+// larger than a limit makes a part larger than the limit
+func (s OutputSplit) MaxBytesPerJob(maxBytesPerJob, bytesPerRow int) int {
+	if s.Rows > 0 {
+		maxBytesPerJob = min(maxBytesPerJob, s.Rows*bytesPerRow)
+	}
+	if s.Bytes > 0 {
+		maxBytesPerJob = min(maxBytesPerJob, max(s.Bytes/2, bytesPerRow))
+	}
+	return maxBytesPerJob
+}
+
+// exceeds reports whether a part of the given rows and size exceeds either limit
+func (s OutputSplit) exceeds(rows, size int) bool {
+	return (s.Rows > 0 && rows > s.Rows) || (s.Bytes > 0 && size > s.Bytes)
+}
+
+// ParseSizeFlag parses a size argument (e.g., "2G", "500MiB", "1048576") into bytes;
+// K, M, G, and T suffixes are binary (e.g., 1G == 1 GiB), and may be followed by "B" or "iB"
+//
+// returns error if the size is malformed or not positive
+func ParseSizeFlag(sizeF string) (int, error) {
+	if len(sizeF) == 0 {
+		return 0, nil
+	}
+	s := strings.ToUpper(strings.TrimSpace(sizeF))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	mult := 1
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size '%s' is not a positive size (e.g., 2G, 500M, 1048576)", sizeF)
+	}
+	return int(n * float64(mult)), nil
+}
+
+// FormatSize formats bytes as a size, with a binary unit (e.g., 1.5 GiB), as read by ParseSizeFlag
+func FormatSize(bytes int64) string {
+	if bytes < 1<<10 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size, unit := float64(bytes)/(1<<10), 0
+	for size >= 1<<10 && unit < 3 {
+		size /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGT"[unit])
+}
+
+// outParts hands out insertion files beyond those created up front, when split by rows or SQL size,
+// and keeps track of them for cleanup
+type outParts struct {
+	mu      sync.Mutex
+	newFile func(name string) (DumpFile, error) // creates a file of the dump, by name
+	nameFmt string                              // name of the i-th insertion file (e.g., "inserts_%d.sql")
+	next    int
+	files   []DumpFile
+}
+
+// create creates the next insertion file (e.g., inserts_{i}.sql)
+func (op *outParts) create() (DumpFile, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	f, err := op.newFile(fmt.Sprintf(op.nameFmt, op.next))
+	if err != nil {
+		return nil, err
+	}
+	op.next++
+	op.files = append(op.files, f)
+	return f, nil
+}
+
+// createAt creates the i-th insertion file (e.g., inserts_{i}.sql), for parts assigned by row (see
+// DumpWriter.AssignRows)
+func (op *outParts) createAt(i int) (DumpFile, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	f, err := op.newFile(fmt.Sprintf(op.nameFmt, i))
+	if err != nil {
+		return nil, err
+	}
+	op.files = append(op.files, f)
+	return f, nil
+}
+
+// cleanup closes and deletes all insertion files created
+func (op *outParts) cleanup() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	for _, f := range op.files {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+}
+
+// writeToParts reads ParsedResults from a channel, and writes the results to an output file,
+// moving on to a new insertion file whenever the next block would push the current one past
+// a split limit. In the case of errors in the ParsedResult, or write errors, the function
+// returns with a non-nil error; the files are left to FileCleanup.
+func (dw DumpWriter) writeToParts(outFile DumpFile, parsedStream <-chan ParsedResult) error {
+	rows, size := 0, 0
+	for res := range parsedStream {
+		if res.AnyError != nil {
+			return &ParseError{Err: fmt.Errorf("encountered error parsing: %w", res.AnyError)}
+		}
+		if size > 0 && dw.split.exceeds(rows+res.Rows, size+len(res.Block)) {
+			if err := outFile.Close(); err != nil {
+				return fmt.Errorf("encountered error closing: %w", err)
+			}
+			f, err := dw.parts.create()
+			if err != nil {
+				return fmt.Errorf("encountered error creating insertion file: %w", err)
+			}
+			outFile, rows, size = f, 0, 0
+		}
+		err := dw.writeBlock(outFile, res.Block)
+		if err != nil {
+			return fmt.Errorf("encountered error writing: %w; deleting in-progress dump files", err)
+		}
+		rows += res.Rows
+		size += len(res.Block)
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("encountered error closing: %w", err)
+	}
+	return nil
+}
+
+// AssignRows assigns contiguous ranges of rows to the insertion files of a directory format dump of totRows
+// rows, so that which rows land in which file doesn't depend on scheduling: the i-th file holds rows
+// [i*n, (i+1)*n), where n is the -split-rows limit, if set, or else the rows split evenly among the files
+// created up front. Results are then routed to the writer of their file (see ParsedResult.Part).
+//
+// returns n, the rows per file; 0 if rows aren't assigned: for single file and sharded dumps, and dumps
+// split by SQL size, whose files depend on the size of the generated SQL
+func (dw *DumpWriter) AssignRows(totRows int) int {
+	dw.partRows, dw.totRows = 0, totRows
+	switch {
+	case !dw.makeItDir || dw.shards != nil || dw.split.Bytes > 0 || totRows == 0:
+	case dw.split.Rows > 0:
+		dw.partRows = dw.split.Rows
+	case len(dw.OutFiles) > 1:
+		dw.partRows = (totRows + len(dw.OutFiles) - 1) / len(dw.OutFiles)
+	}
+	return dw.partRows
+}
+
+// partFile is an insertion file of rows assigned by AssignRows, with the number of rows written to it so far
+type partFile struct {
+	f    DumpFile
+	rows int
+}
+
+// writeAssignedResults spawns a writer per insertion file created up front (see WriteParsedResults), each
+// writing the parts p with p % len(OutFiles) == its index, as routed to it by a dispatcher
+func (dw DumpWriter) writeAssignedResults(wg *sync.WaitGroup, parsedStream <-chan ParsedResult, exitFunc func(err error, topic string)) {
+	nWriters := len(dw.OutFiles)
+	partStreams := make([]chan ParsedResult, nWriters)
+	for w := range partStreams {
+		partStreams[w] = make(chan ParsedResult, cap(parsedStream))
+	}
+	go func() {
+		for res := range parsedStream {
+			partStreams[res.Part%nWriters] <- res
+		}
+		for _, ps := range partStreams {
+			close(ps)
+		}
+	}()
+	wg.Add(nWriters)
+	for w := range nWriters {
+		go func() {
+			defer wg.Done()
+			if err := dw.writeAssignedParts(w, partStreams[w]); err != nil {
+				dw.FileCleanup()
+				exitFunc(err, "DumpWriter")
+			}
+		}()
+	}
+}
+
+// writeAssignedParts reads the ParsedResults routed to writer w, and writes each to the insertion file of
+// its part, creating it if it isn't one created up front; a file is closed once all of its rows are
+// written. In the case of errors in the ParsedResult, or write errors, the function returns with a
+// non-nil error; the files are left to FileCleanup.
+func (dw DumpWriter) writeAssignedParts(w int, partStream <-chan ParsedResult) error {
+	open := make(map[int]*partFile)
+	// the writer's files created up front are closed, even if no rows are assigned to them
+	for p := w; p < len(dw.OutFiles); p += len(dw.OutFiles) {
+		open[p] = &partFile{f: dw.OutFiles[p]}
+	}
+	for res := range partStream {
+		if res.AnyError != nil {
+			return &ParseError{Err: fmt.Errorf("encountered error parsing: %w", res.AnyError)}
+		}
+		pf, ok := open[res.Part]
+		if !ok {
+			f, err := dw.parts.createAt(res.Part)
+			if err != nil {
+				return fmt.Errorf("encountered error creating insertion file: %w", err)
+			}
+			pf = &partFile{f: f}
+			open[res.Part] = pf
+		}
+		if err := dw.writeBlock(pf.f, res.Block); err != nil {
+			return fmt.Errorf("encountered error writing: %w; deleting in-progress dump files", err)
+		}
+		pf.rows += res.Rows
+		if pf.rows == min(dw.partRows, dw.totRows-res.Part*dw.partRows) {
+			if err := pf.f.Close(); err != nil {
+				return fmt.Errorf("encountered error closing: %w", err)
+			}
+			delete(open, res.Part)
+		}
+	}
+	for _, pf := range open {
+		if err := pf.f.Close(); err != nil {
+			return fmt.Errorf("encountered error closing: %w", err)
+		}
+	}
+	return nil
+}
+
+// maxShards caps the shards of a dump, so that a variable of many distinct values (e.g., SERIAL) fails,
+// rather than making a file per row
+const maxShards = 10000
+
+// outShards hands out the insertion files of sharded dumps, one per distinct value of the shard variable
+// (e.g., inserts_year_2023.sql), created as each value is first written; writers share the files, so
+// each is written by one writer at a time
+type outShards struct {
+	mu      sync.Mutex
+	newFile func(name string) (DumpFile, error) // creates a file of the dump, by name
+	shardBy string                              // shard variable
+	nameFmt string                              // name of the insertion file of a shard (e.g., "inserts_year_%s.sql")
+	writers int                                 // number of writers
+	files   map[string]*shardFile
+	names   map[string]bool // file names taken, case-folded
+	order   []string        // shards, in order of creation
+}
+
+// shardFile is the insertion file of a shard
+type shardFile struct {
+	mu sync.Mutex
+	f  DumpFile
+}
+
+// newOutShards returns the outShards of a dump sharded by the variable shardBy, creating files with newFile
+func newOutShards(shardBy string, writers int, newFile func(name string) (DumpFile, error)) *outShards {
+	return &outShards{
+		newFile: newFile,
+		shardBy: shardBy,
+		nameFmt: "inserts_" + strings.ToLower(shardBy) + "_%s.sql",
+		writers: writers,
+		files:   make(map[string]*shardFile),
+		names:   make(map[string]bool),
+	}
+}
+
+// get returns the insertion file of a shard, creating it if needed. Shards whose file name differs from
+// another's only in case (e.g., "a" and "A") would share a file on case-insensitive filesystems, so the
+// later shard's file is suffixed by a number (e.g., inserts_x_A+2.sql); "+" isn't in any shard key.
+//
+// returns error if the file can't be created, or if the dump would have more than maxShards shards
+func (sh *outShards) get(shard string) (*shardFile, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sf, ok := sh.files[shard]; ok {
+		return sf, nil
+	}
+	if len(sh.files) == maxShards {
+		return nil, fmt.Errorf("%s has more than %d distinct values, each making an insertion file; shard by a variable of fewer values (e.g., YEAR)", sh.shardBy, maxShards)
+	}
+	name := fmt.Sprintf(sh.nameFmt, shard)
+	for n := 2; sh.names[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf(sh.nameFmt, shard+"+"+strconv.Itoa(n))
+	}
+	f, err := sh.newFile(name)
+	if err != nil {
+		return nil, err
+	}
+	sf := &shardFile{f: f}
+	sh.files[shard] = sf
+	sh.names[strings.ToLower(name)] = true
+	sh.order = append(sh.order, shard)
+	return sf, nil
+}
+
+// close closes every insertion file, returning the first error encountered
+func (sh *outShards) close() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	var firstErr error
+	for _, shard := range sh.order {
+		if err := sh.files[shard].f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// cleanup closes and deletes every insertion file created
+func (sh *outShards) cleanup() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for _, shard := range sh.order {
+		f := sh.files[shard].f
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+}
+
+// writeToShards reads ParsedResults from a channel, writing each shard of the results (see ParsedResult.Shards)
+// to the insertion file of its shard. In the case of errors in the ParsedResult, or write errors, the function
+// returns with a non-nil error; the files are left to FileCleanup.
+func (dw DumpWriter) writeToShards(parsedStream <-chan ParsedResult) error {
+	for res := range parsedStream {
+		if res.AnyError != nil {
+			return &ParseError{Err: fmt.Errorf("encountered error parsing: %w", res.AnyError)}
+		}
+		for _, s := range res.Shards {
+			sf, err := dw.shards.get(s.Key)
+			if err != nil {
+				return fmt.Errorf("encountered error creating insertion file: %w", err)
+			}
+			sf.mu.Lock()
+			err = dw.writeBlock(sf.f, s.Block)
+			sf.mu.Unlock()
+			if err != nil {
+				return fmt.Errorf("encountered error writing: %w; deleting in-progress dump files", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// emitSQLLoader generates an Oracle SQL*Loader control file, loading the data file directly into
+// the main table created by the DDL, in place of replaying the dump's inserts. Fields are read by
+// position (or, for aggregate extracts, by comma-delimited order, following the data dictionary);
+// blank fields are null, and implied decimals of fixed-width fields are applied in SQL expressions. It's
+// for oracle only (see ParseEmitFlag).
+func emitSQLLoader(ddi *DataDict, dbfmtr *DatabaseFormatter, datFileName string) ([]byte, error) {
+	var ctl strings.Builder
+	ctl.WriteString("-- SQL*Loader control file generated by ipums2db\n")
+	ctl.WriteString("-- create the tables with the DDL first, then load with:\n")
+	ctl.WriteString("--   sqlldr userid=<user>@<db> control=<this file> direct=true\n")
+	ctl.WriteString("-- the data file is read from the INFILE path, uncompressed (decompress a .dat.gz next to it,\n")
+	ctl.WriteString("-- e.g., with gunzip -k, first); edit it if the file moves\n")
+	ctl.WriteString("LOAD DATA\n")
+	ctl.WriteString("CHARACTERSET UTF8\n")
+	ctl.WriteString(fmt.Sprintf("INFILE '%s'\n", strings.ReplaceAll(datFileName, "'", "''")))
+	ctl.WriteString("APPEND\n")
+	ctl.WriteString(fmt.Sprintf("INTO TABLE %s\n", dbfmtr.ident(dbfmtr.TableName)))
+	if ddi.Flavor == AGGREGATE {
+		// the header record is skipped by the OPTIONS clause, which must come first
+		ctlText := ctl.String()
+		ctl.Reset()
+		ctl.WriteString(strings.Replace(ctlText, "LOAD DATA\n", "OPTIONS (SKIP=1)\nLOAD DATA\n", 1))
+		ctl.WriteString("FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"'\n")
+		ctl.WriteString("TRAILING NULLCOLS\n")
+	}
+	ctl.WriteString("(\n")
+	if len(dbfmtr.RowID) != 0 {
+		// numbered as records are read, skipping the header (unlike RECNUM), as in the dump
+		ctl.WriteString(fmt.Sprintf("  %-14s SEQUENCE(1, 1),\n", dbfmtr.quoteIdent(dbfmtr.columnName(dbfmtr.rowIDVar()))))
+	}
+	for i, v := range ddi.Vars {
+		col := dbfmtr.quoteIdent(dbfmtr.columnName(v))
+		field := fmt.Sprintf("  %-14s", col)
+		if ddi.Flavor != AGGREGATE {
+			field += fmt.Sprintf(" POSITION(%d:%d)", v.Location.Start, v.Location.End)
+		}
+		colType := dbfmtr.columnType(v)
+		switch colType {
+		case "string":
+			width := v.Location.Width
+			if width == 0 {
+				width = defaultStringWidth
+			}
+			field += fmt.Sprintf(" CHAR(%d)", width)
+		case "float":
+			field += " DECIMAL EXTERNAL"
+		default:
+			field += " INTEGER EXTERNAL"
+		}
+		field += fmt.Sprintf(" NULLIF %s=BLANKS", col)
+		if v.DecimalPoint > 0 && colType == "float" && ddi.Flavor != AGGREGATE {
+			// fields already holding a decimal point are taken as is; quotes in the SQL string are escaped
+			bind := ":" + strings.ReplaceAll(col, `"`, `\"`)
+			field += fmt.Sprintf(` "CASE WHEN INSTR(%s, '.') > 0 THEN TO_NUMBER(%s) ELSE TO_NUMBER(%s) / 1%s END"`,
+				bind, bind, bind, strings.Repeat("0", v.DecimalPoint))
+		}
+		if i < len(ddi.Vars)-1 {
+			field += ","
+		}
+		ctl.WriteString(field + "\n")
+	}
+	ctl.WriteString(")\n")
+	return []byte(ctl.String()), nil
+}
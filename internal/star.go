@@ -0,0 +1,228 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// table models
+const (
+	MODEL_FLAT string = "flat"
+	MODEL_STAR string = "star"
+)
+
+// unknownKey is the surrogate key of the "unknown" member of every dimension, standing for
+// codes outside the variable's categories
+const unknownKey = 0
+
+// ParseModelFlag returns the table model named by the -model flag: "flat" (the default, if empty), a main
+// table holding every variable, with ref_tables on the side; or "star", a fact table whose discrete
+// variables are replaced by surrogate keys of dimension tables (see dimension)
+//
+// returns error if the model is not supported
+func ParseModelFlag(modelF string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(modelF)); m {
+	case "", MODEL_FLAT:
+		return MODEL_FLAT, nil
+	case MODEL_STAR:
+		return MODEL_STAR, nil
+	default:
+		return "", fmt.Errorf("model '%s' not in {'flat', 'star'}", modelF)
+	}
+}
+
+// dimension is the dimension table of a discrete variable, in the star model: a row per category,
+// keyed by a surrogate key (1, 2, ... in category order), and an "unknown" member (unknownKey).
+// The fact table holds the key of each value's category in place of the value.
+type dimension struct {
+	numKeys map[float64]int // numeric codes -> key
+	strKeys map[string]int  // character codes (trimmed) -> key
+	ranges  []dimRange      // range categories (e.g., "1-5", "90+"), in category order
+}
+
+// dimRange is a range category of a dimension; an open range has no upper bound
+type dimRange struct {
+	lo, hi float64
+	open   bool
+	key    int
+}
+
+// isDimension reports whether a variable gets a dimension table, in the star model: those with categories
+// that would get a ref_table (see hasRefTable), but those set apart from the main table (e.g., melted ones),
+// whose values stay coded (see setApart)
+func (dbf *DatabaseFormatter) isDimension(v Var) bool {
+	return dbf.Model == MODEL_STAR && dbf.hasRefTable(v) && len(v.Cats) != 0 && !dbf.setApart(v)
+}
+
+// checkModel ensures that the star model can be written: its dimension tables take the place of
+// ref_tables, so they can't be skipped or upserted, and surrogate keys are substituted into SQL
+// inserts (or staged CSV files) of microdata extracts only
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkModel(ddi *DataDict) error {
+	if dbf.Model != MODEL_STAR {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("the star model is for microdata extracts only")
+	case !dbf.writesSQL():
+		return fmt.Errorf("the star model is for SQL dumps only")
+	case dbf.NoRefTables:
+		return fmt.Errorf("the star model's dimension tables can't be skipped (-no-ref-tables)")
+	case dbf.RefUpsert:
+		return fmt.Errorf("the star model's dimension tables can't be upserted (-ref-upsert)")
+	}
+	return nil
+}
+
+// buildDimensions builds the dimensions of the star model's discrete variables (see isDimension),
+// from their (possibly recoded) categories
+func (dbf *DatabaseFormatter) buildDimensions(ddi *DataDict) {
+	if dbf.Model != MODEL_STAR {
+		return
+	}
+	dbf.dims = make(map[string]*dimension)
+	for _, v := range ddi.Vars {
+		if !dbf.isDimension(v) {
+			continue
+		}
+		dim := &dimension{numKeys: make(map[float64]int), strKeys: make(map[string]int)}
+		for i, c := range v.Cats {
+			key := i + 1
+			if v.VType.VarType == "character" {
+				dim.strKeys[strings.TrimSpace(c.Val)] = key
+				continue
+			}
+			lo, hi, ok := catRange(c.Val)
+			if !ok {
+				continue // non-numeric codes can't be held by numeric variables
+			}
+			loF, _ := strconv.ParseFloat(lo, 64)
+			if lo == hi {
+				if _, dup := dim.numKeys[loF]; !dup {
+					dim.numKeys[loF] = key
+				}
+				continue
+			}
+			r := dimRange{lo: loF, open: len(hi) == 0, key: key}
+			r.hi, _ = strconv.ParseFloat(hi, 64)
+			dim.ranges = append(dim.ranges, r)
+		}
+		dbf.dims[v.Name] = dim
+	}
+}
+
+// dimKey returns the surrogate key of a (non-null, transformed) value of a dimension variable, as a
+// SQL literal: the key of its category (single values first, then ranges), or else unknownKey
+//
+// returns error if a numeric variable's value is not a number
+func (dbf *DatabaseFormatter) dimKey(v Var, chars []byte) (string, error) {
+	dim := dbf.dims[v.Name]
+	if v.VType.VarType == "character" {
+		if key, ok := dim.strKeys[strings.TrimSpace(string(chars))]; ok {
+			return strconv.Itoa(key), nil
+		}
+		return strconv.Itoa(unknownKey), nil
+	}
+	num, err := fixedWidthNumber(chars, v.DecimalPoint)
+	if err != nil {
+		return "", fmt.Errorf("variable %s: %w", v.Name, err)
+	}
+	x, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return "", fmt.Errorf("variable %s: %w", v.Name, err)
+	}
+	if key, ok := dim.numKeys[x]; ok {
+		return strconv.Itoa(key), nil
+	}
+	for _, r := range dim.ranges {
+		if x >= r.lo && (r.open || x <= r.hi) {
+			return strconv.Itoa(r.key), nil
+		}
+	}
+	return strconv.Itoa(unknownKey), nil
+}
+
+// dimTableName returns the name of a variable's dimension table (e.g., "dim_labforce"), qualified by the
+// ref_table schema, if any
+func (dbf *DatabaseFormatter) dimTableName(v Var) string {
+	name := dbf.ident("dim_" + dbf.columnName(v))
+	if len(dbf.RefSchema) != 0 {
+		return dbf.ident(dbf.RefSchema) + "." + name
+	}
+	return name
+}
+
+// dimKeyColumn returns the name of a dimension's key column, in the fact table and in the dimension
+// table itself (e.g., "labforce_key")
+func (dbf *DatabaseFormatter) dimKeyColumn(v Var) string {
+	return dbf.ident(dbf.columnName(v) + "_key")
+}
+
+// factColumn returns the name and SQL type of a variable's column in the main table: in the star model,
+// dimension variables are replaced by their key column (see dimKeyColumn)
+func (dbf *DatabaseFormatter) factColumn(v Var) (string, string) {
+	if dbf.isDimension(v) {
+		return dbf.dimKeyColumn(v), dbf.sqlType("int")
+	}
+	return dbf.columnName(v), dbf.columnSQLType(v)
+}
+
+// createDimTables generates "CREATE TABLE" and "INSERT INTO dim_var" statements for the dimensions of the
+// star model, in place of ref_tables (see CreateRefTables). For example, the variable LABFORCE would generate:
+//
+// CREATE TABLE dim_labforce (
+//
+//	labforce_key int PRIMARY KEY,
+//	val int,
+//	label varchar(1000)
+//
+// );
+//
+// INSERT INTO dim_labforce (labforce_key, val, label)
+// VALUES
+//
+//	(0, null, 'Unknown'),
+//	(1, 0, 'N/A'),
+//	(2, 1, 'No, not in the labor force'),
+//	(3, 2, 'Yes, in the labor force');
+func (dbf *DatabaseFormatter) createDimTables(ddi *DataDict) []byte {
+	var ddl strings.Builder
+	for _, v := range ddi.Vars {
+		if !dbf.isDimension(v) {
+			continue
+		}
+		table, keyCol := dbf.dimTableName(v), dbf.dimKeyColumn(v)
+		ddl.WriteString(fmt.Sprintf("CREATE TABLE %s (\n\t%s %s PRIMARY KEY,%s);\n\n", table, keyCol, dbf.sqlType("int"), dbf.refTableColDefs(v, false)))
+
+		cols := append([]string{keyCol}, dbf.refTableCols(v)...)
+		unknown := []string{strconv.Itoa(unknownKey)}
+		for range cols[2:] {
+			unknown = append(unknown, "null")
+		}
+		rows := [][]string{append(unknown, dbf.sqlString("Unknown"))}
+		// keys follow category order, including skipped codes (see refTableRows), as dimKey's do
+		catRows, skipped := dbf.refTableRows(v)
+		next := 0
+		for i, c := range v.Cats {
+			if _, _, ok := catRange(c.Val); !ok && v.VType.VarType != "character" {
+				continue
+			}
+			rows = append(rows, append([]string{strconv.Itoa(i + 1)}, catRows[next]...))
+			next++
+		}
+		ddl.WriteString(skippedCatsComment(table, skipped))
+		tuples := make([]string, len(rows))
+		for i, row := range rows {
+			tuples[i] = fmt.Sprintf("\t(%s)", strings.Join(row, ", "))
+		}
+		head := fmt.Sprintf("INSERT INTO %s (%s)\n", table, strings.Join(cols, ", "))
+		ddl.Write(dbf.appendRows([]byte(head), []byte(strings.Join(tuples, ",\n"))))
+		ddl.WriteString("\n;\n\n")
+	}
+	return []byte(ddl.String())
+}
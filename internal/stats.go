@@ -0,0 +1,180 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"encoding/json"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memSampleInterval is how often memory use is sampled for the peak memory of RunStats
+const memSampleInterval = 50 * time.Millisecond
+
+// totalMemMetric is the runtime metric sampled for peak memory: all memory mapped by the Go runtime
+const totalMemMetric = "/memory/classes/total:bytes"
+
+// RunStats collects the metrics of a conversion run, for the end-of-run report (see Report): wall time,
+// bytes read, rows parsed, bytes written (of insertion files), the utilization of the goroutines of each stage (parsing,
+// compressing, and writing), and peak memory. Counters are safe for concurrent use; a nil *RunStats
+// collects nothing.
+type RunStats struct {
+	start     time.Time
+	bytesRead int
+
+	rowsParsed   atomic.Int64
+	bytesWritten atomic.Int64
+	busy         [numStages]atomic.Int64 // nanoseconds spent working, per stage
+	goroutines   [numStages]int          // goroutines of each stage
+
+	peakMem  atomic.Uint64
+	stopOnce sync.Once
+	stopped  chan struct{}
+	end      time.Time
+}
+
+// stages of the conversion pipeline, whose utilization is reported
+const (
+	stageParse int = iota
+	stageCompress
+	stageWrite
+	numStages
+)
+
+// stageNames name the stages, in reports
+var stageNames = [numStages]string{"parse", "compress", "write"}
+
+// NewRunStats starts collecting the metrics of a run started at start, reading bytesRead bytes of data,
+// sampling memory use in the background until Stop is called
+func NewRunStats(start time.Time, bytesRead int) *RunStats {
+	rs := &RunStats{start: start, bytesRead: bytesRead, stopped: make(chan struct{})}
+	go rs.sampleMemory()
+	return rs
+}
+
+// sampleMemory records the peak memory mapped by the runtime, sampling it until Stop is called
+func (rs *RunStats) sampleMemory() {
+	sample := []metrics.Sample{{Name: totalMemMetric}}
+	ticker := time.NewTicker(memSampleInterval)
+	defer ticker.Stop()
+	for {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			if mem := sample[0].Value.Uint64(); mem > rs.peakMem.Load() {
+				rs.peakMem.Store(mem)
+			}
+		}
+		select {
+		case <-rs.stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetParsers records the number of parser goroutines
+func (rs *RunStats) SetParsers(n int) {
+	rs.setStage(stageParse, n)
+}
+
+// setStage records the number of goroutines of a stage
+func (rs *RunStats) setStage(stage, n int) {
+	if rs != nil {
+		rs.goroutines[stage] = n
+	}
+}
+
+// addBusy records time spent working by a goroutine of a stage
+func (rs *RunStats) addBusy(stage int, d time.Duration) {
+	if rs != nil {
+		rs.busy[stage].Add(int64(d))
+	}
+}
+
+// addWritten records bytes written to the dump
+func (rs *RunStats) addWritten(n int) {
+	if rs != nil {
+		rs.bytesWritten.Add(int64(n))
+	}
+}
+
+// tap counts the rows of ParsedResults, and the time spent parsing them, as they pass from parsedStream
+// to the returned channel, which is closed once parsedStream is closed
+func (rs *RunStats) tap(parsedStream <-chan ParsedResult) <-chan ParsedResult {
+	tapped := make(chan ParsedResult, cap(parsedStream))
+	go func() {
+		defer close(tapped)
+		for res := range parsedStream {
+			if res.AnyError == nil {
+				rs.rowsParsed.Add(int64(res.Rows))
+			}
+			rs.addBusy(stageParse, res.ParseTime)
+			tapped <- res
+		}
+	}()
+	return tapped
+}
+
+// Stop ends the run: its wall time, and memory sampling; it may be called more than once
+func (rs *RunStats) Stop() {
+	rs.stopOnce.Do(func() {
+		rs.end = time.Now()
+		close(rs.stopped)
+	})
+}
+
+// stageReport is the utilization of a stage: the share of its goroutines' time spent working
+type stageReport struct {
+	Stage       string  `json:"stage"`
+	Goroutines  int     `json:"goroutines"`
+	BusySeconds float64 `json:"busy_seconds"`
+	Utilization float64 `json:"utilization"`
+}
+
+// statsReport is the end-of-run report of RunStats
+type statsReport struct {
+	WallSeconds     float64       `json:"wall_seconds"`
+	BytesRead       int           `json:"bytes_read"`
+	RowsParsed      int64         `json:"rows_parsed"`
+	BytesWritten    int64         `json:"bytes_written"`
+	Stages          []stageReport `json:"stages"`
+	PeakMemoryBytes uint64        `json:"peak_memory_bytes"`
+}
+
+// Report stops the run (see Stop), and returns its metrics as JSON; stages without goroutines (e.g.,
+// compression, for uncompressed dumps) are left out. Utilization is busy time over the goroutines' wall time.
+func (rs *RunStats) Report() ([]byte, error) {
+	rs.Stop()
+	wall := rs.end.Sub(rs.start)
+	report := statsReport{
+		WallSeconds:     wall.Seconds(),
+		BytesRead:       rs.bytesRead,
+		RowsParsed:      rs.rowsParsed.Load(),
+		BytesWritten:    rs.bytesWritten.Load(),
+		Stages:          []stageReport{},
+		PeakMemoryBytes: rs.peakMem.Load(),
+	}
+	for stage, n := range rs.goroutines {
+		if n == 0 {
+			continue
+		}
+		busy := time.Duration(rs.busy[stage].Load())
+		sr := stageReport{Stage: stageNames[stage], Goroutines: n, BusySeconds: busy.Seconds()}
+		if wall > 0 {
+			sr.Utilization = min(busy.Seconds()/(wall.Seconds()*float64(n)), 1)
+		}
+		report.Stages = append(report.Stages, sr)
+	}
+	return json.MarshalIndent(report, "", "  ")
+}
+
+// WriteReport writes the report of the run (see Report) to fileName, under a temporary name until complete
+func (rs *RunStats) WriteReport(fileName string) error {
+	report, err := rs.Report()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, append(report, '\n'))
+}
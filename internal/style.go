@@ -0,0 +1,259 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxStyleIndent is the widest indentation of -sql-style, in spaces
+const maxStyleIndent = 8
+
+// SQLStyle is the style of the generated SQL, for dumps that match a style guide (see ParseSQLStyleFlag).
+// The zero value leaves the SQL as generated: upper case keywords, lower case type names, tab indentation,
+// and columns commented with their labels.
+type SQLStyle struct {
+	Keywords string  // case of keywords and type names: CASE_UPPER or CASE_LOWER; as generated if empty
+	Indent   *string // a level of indentation, in place of a tab (e.g., 2 spaces); a tab if nil
+	NoLabels bool    // if true, inline label comments (e.g., `"age" int,	-- Age`) are dropped
+}
+
+// sqlKeywords are the keywords of the generated SQL, in upper case, whose case is set by SQLStyle.Keywords;
+// words of the generated SQL (e.g., table names, and dual) that aren't listed are left as they are
+var sqlKeywords = map[string]bool{}
+
+// sqlTypeNames are the type names of the generated SQL (see getDataTypes), in upper case, cased like keywords
+var sqlTypeNames = []string{
+	"BIGINT", "BINARY_DOUBLE", "BINARY_FLOAT", "BOOLEAN", "CHAR", "DATE", "DATETIME", "DATETIME2", "DECIMAL", "DOUBLE",
+	"FLOAT", "INT", "INTEGER", "NUMBER", "NUMERIC", "NVARCHAR", "PRECISION", "REAL", "SMALLINT", "TEXT", "TIMESTAMP",
+	"TIMESTAMP_NTZ", "VARCHAR", "VARCHAR2",
+}
+
+func init() {
+	for _, kw := range strings.Fields(`
+		ABORT_STATEMENT ADD ALL ALTER AND AS AUTHORIZATION AUTO_COMPRESS BEGIN BETWEEN BITMAP BY CASE CAST CHR CLUSTER
+		COLLATE COLUMN COLUMNSTORE COMPRESSION CONFLICT CONSTRAINT COPY COUNT CREATE CSV CURRENT_SCHEMA DEFAULT DELETE
+		DISTINCT DO DROP ELSE EMPTY_FIELD_AS_NULL ENCODING END EXCEPTION EXEC EXECUTE EXISTS FALSE FIELD_DELIMITER
+		FIELD_OPTIONALLY_ENCLOSED_BY FILE_FORMAT FROM GO GRANT GROUP GZIP IF IGNORE IMMEDIATE IN INDEX INSERT INTO IS
+		JOIN KEY MATCHED MERGE MODIFY NONCLUSTERED NOT NOTHING NULL NULLS NULL_IF OBJECT OBJECT_ID ON ON_ERROR OR OTHERS
+		OVERWRITE OWNER OWNERSHIP PATTERN PRIMARY PRIVILEGES PURGE PUT RAISE REFERENCES ROLE SCHEMA SCHEMA_ID SELECT
+		SESSION SET SOURCE_COMPRESSION SQLCODE TABLE THEN TO TRUE TRUNCATE TYPE UNION UNIQUE UPDATE USE USING VALUES
+		VIEW WHEN WHERE WITH`) {
+		sqlKeywords[kw] = true
+	}
+	for _, t := range sqlTypeNames {
+		sqlKeywords[t] = true
+	}
+}
+
+// ParseSQLStyleFlag parses the -sql-style flag argument, a comma-delimited list of style options, each of
+// the form option=value:
+//
+//   - keywords: the case of keywords and type names, "upper" or "lower"
+//   - indent: a level of indentation, "tab", or a number of spaces (e.g., "indent=2")
+//   - labels: whether columns are commented with their labels, "on" or "off"
+//
+// returns nil if the argument is empty; returns error if an option or its value is not recognized
+func ParseSQLStyleFlag(styleF string) (*SQLStyle, error) {
+	if len(strings.TrimSpace(styleF)) == 0 {
+		return nil, nil
+	}
+	style := &SQLStyle{}
+	for _, opt := range strings.Split(styleF, ",") {
+		key, val, found := strings.Cut(opt, "=")
+		key, val = strings.ToLower(strings.TrimSpace(key)), strings.ToLower(strings.TrimSpace(val))
+		if !found || len(val) == 0 {
+			return nil, fmt.Errorf("'%s' is not of the form option=value (e.g., keywords=lower)", opt)
+		}
+		switch key {
+		case "keywords":
+			if val != CASE_UPPER && val != CASE_LOWER {
+				return nil, fmt.Errorf("keywords '%s' not in {'upper', 'lower'}", val)
+			}
+			style.Keywords = val
+		case "indent":
+			if val == "tab" {
+				style.Indent = nil
+				continue
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > maxStyleIndent {
+				return nil, fmt.Errorf("indent '%s' is neither 'tab' nor a number of spaces, up to %d", val, maxStyleIndent)
+			}
+			spaces := strings.Repeat(" ", n)
+			style.Indent = &spaces
+		case "labels":
+			if val != "on" && val != "off" {
+				return nil, fmt.Errorf("labels '%s' not in {'on', 'off'}", val)
+			}
+			style.NoLabels = val == "off"
+		default:
+			return nil, fmt.Errorf("'%s' not in {'keywords', 'indent', 'labels'}", key)
+		}
+	}
+	return style, nil
+}
+
+// styled restyles generated SQL after dbf.Style (see SQLStyle): keywords and type names are cased, the tabs
+// indenting lines are replaced, and inline comments are dropped if labels are off (comments taking whole
+// lines, e.g., the schema's fingerprint, are kept). String literals, quoted identifiers, and comments are
+// copied as they are, so the SQL of dynamic statements (e.g., EXECUTE IMMEDIATE '...') keeps its case.
+//
+// returns sql as is if there's no style, or if it's the SQL as generated
+func (dbf *DatabaseFormatter) styled(sql []byte) []byte {
+	return dbf.restyle(sql, false)
+}
+
+// styledInserts restyles generated inserts (see styled), compacting them if dbf.Compact is set: comments
+// and indentation are dropped, and each statement takes a single line
+func (dbf *DatabaseFormatter) styledInserts(sql []byte) []byte {
+	return dbf.restyle(sql, dbf.Compact)
+}
+
+// restyle restyles generated SQL (see styled), compacting it if compact is true (see styledInserts)
+func (dbf *DatabaseFormatter) restyle(sql []byte, compact bool) []byte {
+	s := dbf.Style
+	if s == nil {
+		s = &SQLStyle{}
+	}
+	if (*s == (SQLStyle{}) && !compact) || len(sql) == 0 {
+		return sql
+	}
+	indent := "\t"
+	if s.Indent != nil {
+		indent = *s.Indent
+	}
+	// mysql and snowflake backslash-escape string literals (as do postgres escape strings, E'...'); see sqlString
+	backslashes := dbf.DbType == MYSQL || dbf.DbType == SNOWFLAKE
+
+	out := make([]byte, 0, len(sql)+len(sql)/16)
+	// atIndent holds at the start of a line, through its indentation; onCode once the line holds SQL
+	atIndent, onCode := true, false
+	escapeNext := false
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\n' && compact:
+			// line breaks (and the indentation following them) are dropped, or make a space between words;
+			// statements still end lines
+			j := i + 1
+			for j < len(sql) && (sql[j] == '\n' || sql[j] == '\t' || sql[j] == ' ') {
+				j++
+			}
+			var prev, next byte
+			if len(out) != 0 {
+				prev = out[len(out)-1]
+			}
+			if j < len(sql) {
+				next = sql[j]
+			}
+			switch {
+			case prev == ';':
+				out = append(out, '\n')
+			case prev == 0 || prev == '\n' || next == 0 || prev == '(' || prev == ',' || next == '(' || next == ')' || next == ',' || next == ';' ||
+				bytes.HasPrefix(sql[j:], []byte("--")):
+			default:
+				out = append(out, ' ')
+			}
+			atIndent, onCode = false, false
+			i = j
+			continue
+		case c == '\n':
+			out = append(out, c)
+			atIndent, onCode = true, false
+			i++
+			continue
+		case c == '\t' && atIndent:
+			out = append(out, indent...)
+			i++
+			continue
+		}
+		atIndent = false
+		switch {
+		case c == '\'':
+			j := literalEnd(sql, i, backslashes || escapeNext)
+			out = append(out, sql[i:j]...)
+			i, onCode, escapeNext = j, true, false
+		case c == '"' || c == '`':
+			j := len(sql)
+			if k := bytes.IndexByte(sql[i+1:], c); k >= 0 {
+				j = i + 1 + k + 1
+			}
+			out = append(out, sql[i:j]...)
+			i, onCode = j, true
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			j := len(sql)
+			if k := bytes.IndexByte(sql[i:], '\n'); k >= 0 {
+				j = i + k
+			}
+			switch {
+			case compact && !onCode:
+			case s.NoLabels && onCode, compact:
+				out = bytes.TrimRight(out, " \t")
+			default:
+				out = append(out, sql[i:j]...)
+			}
+			i = j
+		case c == '\t' && s.Indent != nil:
+			// tabs within lines set comments apart
+			out = append(out, "  "...)
+			i++
+		case isWordByte(c):
+			j := i + 1
+			for j < len(sql) && isWordByte(sql[j]) {
+				j++
+			}
+			word := sql[i:j]
+			// psql meta-commands (e.g., \copy) are case-sensitive
+			afterBackslash := i > 0 && sql[i-1] == '\\'
+			switch {
+			case len(s.Keywords) == 0 || afterBackslash || !isLetter(c) || !sqlKeywords[string(bytes.ToUpper(word))]:
+				out = append(out, word...)
+			case s.Keywords == CASE_LOWER:
+				out = append(out, bytes.ToLower(word)...)
+			default:
+				out = append(out, bytes.ToUpper(word)...)
+			}
+			// postgres escape strings, E'...', are backslash-escaped
+			escapeNext = j < len(sql) && sql[j] == '\'' && (string(word) == "E" || string(word) == "e")
+			i, onCode = j, true
+		default:
+			out = append(out, c)
+			if c != ' ' && c != '\t' {
+				onCode = true
+			}
+			i++
+		}
+	}
+	return out
+}
+
+// literalEnd returns the end of the string literal starting at sql[start] (a quote): the index following
+// its closing quote. Quotes within are doubled, or backslash-escaped if backslashes is true.
+func literalEnd(sql []byte, start int, backslashes bool) int {
+	for i := start + 1; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\\' && backslashes:
+			i++
+		case sql[i] != '\'':
+		case i+1 < len(sql) && sql[i+1] == '\'':
+			i++
+		default:
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// isWordByte reports whether a byte belongs to a word of SQL: a keyword, an identifier, or a number
+func isWordByte(c byte) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || c == '_' || c == '$'
+}
+
+// isLetter reports whether a byte is an ASCII letter
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,166 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// missingLabelRe matches the category labels of codes standing for missing values in continuous variables
+// (e.g., INCWAGE's 9999999, "N/A"); other categories of continuous variables (e.g., AGE's 90, "90+") are
+// values like any other
+var missingLabelRe = regexp.MustCompile(`(?i)\b(n/a|niu|not in universe|missing|unknown)\b`)
+
+// VarSummary holds the summary statistics of a numeric variable of an extract (see Summarize); the
+// statistics are of its non-missing values, with implied decimals applied
+type VarSummary struct {
+	Var     Var
+	Rows    int // rows read
+	Missing int // rows holding a blank (or null) field, or a missing value code (see missingLabelRe)
+	Min     float64
+	Max     float64
+	Mean    float64
+	Median  float64
+}
+
+// MissingShare returns the share of rows holding missing values (0 to 1)
+func (vs VarSummary) MissingShare() float64 {
+	if vs.Rows == 0 {
+		return 0
+	}
+	return float64(vs.Missing) / float64(vs.Rows)
+}
+
+// summaryScanner counts the values of numeric variables, so that medians are exact without holding every
+// row; variables, even continuous ones, hold far fewer distinct values than rows
+type summaryScanner struct {
+	vars     []Var
+	policies []string          // null policy of each variable
+	missing  []map[string]bool // missing value codes, by variable (see freqValue)
+	counts   []map[float64]int
+	nMissing []int
+}
+
+// scan counts the values of a row
+func (ss *summaryScanner) scan(row []byte, rowNum int) error {
+	for i, v := range ss.vars {
+		val, err := policyValue(v, row[v.Location.Start-1:v.Location.End], ss.policies[i])
+		if err != nil {
+			return fmt.Errorf("row %d: variable %s: %w", rowNum, v.Name, err)
+		}
+		if len(val) == 0 || ss.missing[i][val] {
+			ss.nMissing[i]++
+			continue
+		}
+		n, _ := strconv.ParseFloat(val, 64)
+		ss.counts[i][n]++
+	}
+	return nil
+}
+
+// Summarize computes the summary statistics (min, max, mean, median, and share of missing values) of the
+// named numeric variables (case-insensitive) from every row of a fixed-width file, read in parallel (see
+// scanRows), returning a summary per variable, in the order named; if none are named, every continuous
+// numeric variable is summarized. Blank fields, fields loaded as null under a null policy (the default, if
+// nil), and values coded as missing (see missingLabelRe), are left out of the statistics.
+//
+// returns error if a variable isn't in the data dictionary, or isn't numeric, or if the data file can't be
+// read or parsed
+func Summarize(datFileName string, ddi *DataDict, names []string, np *NullPolicy) ([]VarSummary, error) {
+	if err := np.check(ddi); err != nil {
+		return nil, err
+	}
+	var vars []Var
+	for _, name := range names {
+		v, ok := findVar(ddi, strings.TrimSpace(name))
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unrecognized variable %s", name)
+		case v.VType.VarType == "character":
+			return nil, fmt.Errorf("variable %s is not numeric", v.Name)
+		}
+		vars = append(vars, v)
+	}
+	if len(names) == 0 {
+		for _, v := range ddi.Vars {
+			if v.Interval == "contin" && v.VType.VarType != "character" {
+				vars = append(vars, v)
+			}
+		}
+		if len(vars) == 0 {
+			return nil, fmt.Errorf("no continuous numeric variables to summarize; name some with -vars")
+		}
+	}
+	missing := make([]map[string]bool, len(vars))
+	for i, v := range vars {
+		missing[i] = make(map[string]bool)
+		for _, c := range v.Cats {
+			if !missingLabelRe.MatchString(c.Label) {
+				continue
+			}
+			if val, err := freqValue(Var{VType: v.VType}, []byte(c.Val)); err == nil {
+				missing[i][val] = true
+			}
+		}
+	}
+	scanners, totRows, err := scanRows(datFileName, ddi, func() *summaryScanner {
+		ss := &summaryScanner{vars: vars, policies: np.varPolicies(vars), missing: missing, counts: make([]map[float64]int, len(vars)), nMissing: make([]int, len(vars))}
+		for i := range ss.counts {
+			ss.counts[i] = make(map[float64]int)
+		}
+		return ss
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]VarSummary, len(vars))
+	for i, v := range vars {
+		vs := VarSummary{Var: v, Rows: totRows}
+		counts := make(map[float64]int)
+		for _, ss := range scanners {
+			vs.Missing += ss.nMissing[i]
+			for n, c := range ss.counts[i] {
+				counts[n] += c
+			}
+		}
+		summaries[i] = vs.withStats(counts)
+	}
+	return summaries, nil
+}
+
+// withStats returns the summary with the statistics of its non-missing values, given their counts
+func (vs VarSummary) withStats(counts map[float64]int) VarSummary {
+	values := make([]float64, 0, len(counts))
+	var sum float64
+	for n, c := range counts {
+		values = append(values, n)
+		sum += n * float64(c)
+	}
+	if len(values) == 0 {
+		return vs
+	}
+	slices.Sort(values)
+	total := vs.Rows - vs.Missing
+	vs.Min, vs.Max, vs.Mean = values[0], values[len(values)-1], sum/float64(total)
+	// the median is the middle value, or the mean of the two middle values
+	lo, hi := (total-1)/2, total/2
+	seen := 0
+	var loVal float64
+	for _, n := range values {
+		next := seen + counts[n]
+		if lo >= seen && lo < next {
+			loVal = n
+		}
+		if hi >= seen && hi < next {
+			vs.Median = (loVal + n) / 2
+			break
+		}
+		seen = next
+	}
+	return vs
+}
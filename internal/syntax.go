@@ -0,0 +1,483 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// IPUMS ships SPSS (.sps), SAS (.sas), and Stata (.do) command files alongside each extract.
+// These describe the same layout as the DDI (column positions, formats, and labels), so
+// they can be used as the data dictionary when the DDI isn't at hand. As none of the three
+// record whether a variable is discrete or continuous, variables with value labels are
+// considered discrete, and the rest continuous.
+
+// newDataDictFromSyntax returns a DataDict, given the file path to an SPSS, SAS, or Stata syntax file.
+//
+// returns error if the file extension is not recognized, or the file describes no variables
+func newDataDictFromSyntax(syntaxFileName string) (DataDict, error) {
+	in, err := openInput(syntaxFileName)
+	if err != nil {
+		return DataDict{}, err
+	}
+	defer in.Close()
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return DataDict{}, err
+	}
+	src := strings.ReplaceAll(string(b), "\r\n", "\n")
+
+	var ddi DataDict
+	switch ext := strings.ToLower(filepath.Ext(syntaxFileName)); ext {
+	case ".sps":
+		ddi, err = parseSPSS(src)
+	case ".sas":
+		ddi, err = parseSAS(src)
+	case ".do":
+		ddi, err = parseStata(src)
+	default:
+		return DataDict{}, fmt.Errorf("unrecognized syntax file extension '%s'", ext)
+	}
+	if err != nil {
+		return DataDict{}, fmt.Errorf("%s: %w", syntaxFileName, err)
+	}
+	if len(ddi.Vars) == 0 {
+		return DataDict{}, fmt.Errorf("%s: no variables found", syntaxFileName)
+	}
+	ddi.Flavor = MICRODATA
+	return ddi, nil
+}
+
+// isSyntaxFile reports whether a data dictionary path is an SPSS, SAS, or Stata syntax file
+func isSyntaxFile(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".sps", ".sas", ".do":
+		return true
+	}
+	return false
+}
+
+// syntaxToken is a single whitespace-delimited token of a syntax file;
+// quoted tokens have their quotes removed (and escaped quotes unescaped)
+type syntaxToken struct {
+	text   string
+	quoted bool
+}
+
+// syntaxTokens splits a statement into tokens. Supported quoting styles are "..." and '...'
+// (with doubled quotes as escapes), as well as Stata's compound quotes (`"..."').
+func syntaxTokens(s string) []syntaxToken {
+	var tokens []syntaxToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '`' && i+1 < len(s) && s[i+1] == '"':
+			end := strings.Index(s[i+2:], `"'`)
+			if end < 0 {
+				end = len(s) - (i + 2)
+				tokens = append(tokens, syntaxToken{s[i+2:], true})
+				i = len(s)
+				continue
+			}
+			tokens = append(tokens, syntaxToken{s[i+2 : i+2+end], true})
+			i += end + 4
+		case c == '"' || c == '\'':
+			var text strings.Builder
+			j := i + 1
+			for j < len(s) {
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c { // escaped quote
+						text.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				text.WriteByte(s[j])
+				j++
+			}
+			tokens = append(tokens, syntaxToken{text.String(), true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '\t' && s[j] != '\n' {
+				j++
+			}
+			tokens = append(tokens, syntaxToken{s[i:j], false})
+			i = j
+		}
+	}
+	return tokens
+}
+
+// splitStatements splits a syntax file into statements ending with terminator (outside of quotes)
+func splitStatements(src string, terminator byte) []string {
+	var (
+		statements []string
+		cur        strings.Builder
+		inQuote    byte
+	)
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == terminator:
+			statements = append(statements, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(c)
+	}
+	if len(strings.TrimSpace(cur.String())) != 0 {
+		statements = append(statements, cur.String())
+	}
+	return statements
+}
+
+// posRangeRe matches a column position range, such as "19-28" (or "19" for single-column variables)
+var posRangeRe = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+
+// parsePosRange parses a column position range into a Loc
+func parsePosRange(s string) (Loc, bool) {
+	m := posRangeRe.FindStringSubmatch(s)
+	if m == nil {
+		return Loc{}, false
+	}
+	start, _ := strconv.Atoi(m[1])
+	end := start
+	if len(m[2]) != 0 {
+		end, _ = strconv.Atoi(m[2])
+	}
+	return Loc{Start: start, End: end, Width: end - start + 1}, true
+}
+
+// syntaxDict accumulates variables, labels, and value labels while a syntax file is parsed,
+// keeping variables in the order of their column positions definition
+type syntaxDict struct {
+	vars   []Var
+	byName map[string]int
+}
+
+// newSyntaxDict returns an empty syntaxDict
+func newSyntaxDict() *syntaxDict {
+	return &syntaxDict{byName: make(map[string]int)}
+}
+
+// addVar adds a variable with the given location and type
+func (sd *syntaxDict) addVar(name string, loc Loc, varType string, decimals int) {
+	sd.byName[strings.ToUpper(name)] = len(sd.vars)
+	sd.vars = append(sd.vars, Var{
+		Name:         strings.ToUpper(name),
+		VType:        VarFormat{VarType: varType},
+		DecimalPoint: decimals,
+		Interval:     "contin",
+		Location:     loc,
+	})
+}
+
+// get returns a pointer to a previously added variable, or nil if there's no such variable
+func (sd *syntaxDict) get(name string) *Var {
+	i, ok := sd.byName[strings.ToUpper(name)]
+	if !ok {
+		return nil
+	}
+	return &sd.vars[i]
+}
+
+// addCat adds a value label to a variable; variables with value labels are discrete
+func (sd *syntaxDict) addCat(name, val, label string) {
+	if v := sd.get(name); v != nil {
+		v.Cats = append(v.Cats, Cat{Val: val, Label: label})
+		v.Interval = "discrete"
+	}
+}
+
+// dataDict returns the accumulated DataDict
+func (sd *syntaxDict) dataDict() DataDict {
+	return DataDict{Vars: sd.vars}
+}
+
+// parseSPSS parses an SPSS syntax file. The relevant commands are:
+//
+//	data list file = "usa_00001.dat" /
+//	  YEAR      1-4
+//	  HHWT      19-28 (2)
+//	  NAME      29-40 (a)
+//	.
+//	variable labels
+//	  YEAR      "Census year"
+//	.
+//	value labels
+//	  /YEAR
+//	    1850    "1850"
+//	.
+func parseSPSS(src string) (DataDict, error) {
+	sd := newSyntaxDict()
+	for _, cmd := range spssCommands(src) {
+		tokens := syntaxTokens(cmd)
+		if len(tokens) < 2 {
+			continue
+		}
+		keyword := strings.ToLower(tokens[0].text + " " + tokens[1].text)
+		switch keyword {
+		case "data list":
+			// variable definitions follow the first "/"
+			i := 2
+			for i < len(tokens) && (tokens[i].quoted || !strings.HasPrefix(tokens[i].text, "/")) {
+				i++
+			}
+			if i < len(tokens) {
+				tokens[i].text = strings.TrimPrefix(tokens[i].text, "/")
+				if len(tokens[i].text) == 0 {
+					i++
+				}
+			}
+			for i+1 < len(tokens) {
+				name := tokens[i].text
+				loc, ok := parsePosRange(tokens[i+1].text)
+				if !ok {
+					return DataDict{}, fmt.Errorf("data list: invalid position '%s' for %s", tokens[i+1].text, name)
+				}
+				i += 2
+				varType, decimals := "numeric", 0
+				if i < len(tokens) && strings.HasPrefix(tokens[i].text, "(") {
+					spec := strings.ToLower(strings.Trim(tokens[i].text, "()"))
+					if spec == "a" {
+						varType = "character"
+					} else if d, err := strconv.Atoi(spec); err == nil {
+						decimals = d
+					}
+					i++
+				}
+				sd.addVar(name, loc, varType, decimals)
+			}
+		case "variable labels":
+			for i := 2; i+1 < len(tokens); i += 2 {
+				name := strings.TrimPrefix(tokens[i].text, "/")
+				if v := sd.get(name); v != nil {
+					v.Label = tokens[i+1].text
+				}
+			}
+		case "value labels":
+			var name string
+			for i := 2; i < len(tokens); i++ {
+				if !tokens[i].quoted && strings.HasPrefix(tokens[i].text, "/") {
+					name = strings.TrimPrefix(tokens[i].text, "/")
+					if len(name) == 0 && i+1 < len(tokens) {
+						i++
+						name = tokens[i].text
+					}
+					continue
+				}
+				if i+1 < len(tokens) {
+					sd.addCat(name, tokens[i].text, tokens[i+1].text)
+					i++
+				}
+			}
+		}
+	}
+	return sd.dataDict(), nil
+}
+
+// spssCommands splits an SPSS syntax file into commands; a command ends
+// with a period at the end of a line (outside of quotes)
+func spssCommands(src string) []string {
+	var (
+		commands []string
+		cur      strings.Builder
+	)
+	for _, line := range strings.Split(src, "\n") {
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+		trimmed := strings.TrimSpace(line)
+		if strings.HasSuffix(trimmed, ".") && strings.Count(trimmed, `"`)%2 == 0 {
+			cmd := strings.TrimSpace(cur.String())
+			commands = append(commands, strings.TrimSuffix(cmd, "."))
+			cur.Reset()
+		}
+	}
+	return commands
+}
+
+// parseSAS parses a SAS syntax file. The relevant statements are:
+//
+//	value YEAR_f
+//	  1850 = "1850"
+//	;
+//	input
+//	  YEAR      1-4
+//	  HHWT      19-28 .2
+//	  NAME    $ 29-40
+//	;
+//	label
+//	  YEAR     = "Census year"
+//	;
+//	format
+//	  YEAR      YEAR_f.
+//	;
+func parseSAS(src string) (DataDict, error) {
+	sd := newSyntaxDict()
+	formats := make(map[string][]Cat) // format name -> value labels
+	varFormats := make(map[string]string)
+	for _, stmt := range splitStatements(src, ';') {
+		tokens := syntaxTokens(stmt)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch strings.ToLower(tokens[0].text) {
+		case "value":
+			if len(tokens) < 2 {
+				continue
+			}
+			fmtName := strings.ToUpper(strings.TrimPrefix(tokens[1].text, "$"))
+			for i := 2; i+2 < len(tokens); i += 3 {
+				if tokens[i+1].text != "=" {
+					return DataDict{}, fmt.Errorf("value %s: expected '=' after %s", fmtName, tokens[i].text)
+				}
+				formats[fmtName] = append(formats[fmtName], Cat{Val: tokens[i].text, Label: tokens[i+2].text})
+			}
+		case "input":
+			for i := 1; i+1 < len(tokens); {
+				name := tokens[i].text
+				i++
+				varType := "numeric"
+				if tokens[i].text == "$" {
+					varType = "character"
+					i++
+				}
+				if i >= len(tokens) {
+					return DataDict{}, fmt.Errorf("input: missing position for %s", name)
+				}
+				loc, ok := parsePosRange(tokens[i].text)
+				if !ok {
+					return DataDict{}, fmt.Errorf("input: invalid position '%s' for %s", tokens[i].text, name)
+				}
+				i++
+				decimals := 0
+				if i < len(tokens) && strings.HasPrefix(tokens[i].text, ".") {
+					decimals, _ = strconv.Atoi(strings.TrimPrefix(tokens[i].text, "."))
+					i++
+				}
+				sd.addVar(name, loc, varType, decimals)
+			}
+		case "label":
+			for i := 1; i+2 < len(tokens); i += 3 {
+				if v := sd.get(tokens[i].text); v != nil && tokens[i+1].text == "=" {
+					v.Label = tokens[i+2].text
+				}
+			}
+		case "format":
+			for i := 1; i+1 < len(tokens); i += 2 {
+				fmtName := strings.ToUpper(strings.TrimSuffix(strings.TrimPrefix(tokens[i+1].text, "$"), "."))
+				varFormats[tokens[i].text] = fmtName
+			}
+		}
+	}
+	for name, fmtName := range varFormats {
+		for _, c := range formats[fmtName] {
+			sd.addCat(name, c.Val, c.Label)
+		}
+	}
+	return sd.dataDict(), nil
+}
+
+// stataReplaceRe matches the implied decimal adjustment of a Stata variable (e.g., "replace hhwt = hhwt / 100")
+var stataReplaceRe = regexp.MustCompile(`^replace\s+(\w+)\s*=\s*(\w+)\s*/\s*(10+)\s*$`)
+
+// parseStata parses a Stata do file. The relevant commands are:
+//
+//	quietly infix                 ///
+//	  int     year      1-4       ///
+//	  double  hhwt      19-28     ///
+//	  str     name      29-40     ///
+//	  using `"usa_00001.dat"'
+//	replace hhwt      = hhwt      / 100
+//	label var year      `"Census year"'
+//	label define year_lbl 1850 `"1850"'
+//	label values year year_lbl
+func parseStata(src string) (DataDict, error) {
+	sd := newSyntaxDict()
+	labelSets := make(map[string][]Cat) // label set name -> value labels
+	varLabelSets := make(map[string]string)
+
+	// join lines continued with "///"
+	var lines []string
+	var cur strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(src))
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<24)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if before, found := strings.CutSuffix(strings.TrimRight(line, " \t"), "///"); found {
+			cur.WriteString(before)
+			cur.WriteByte(' ')
+			continue
+		}
+		cur.WriteString(line)
+		lines = append(lines, strings.TrimSpace(cur.String()))
+		cur.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return DataDict{}, err
+	}
+
+	for _, line := range lines {
+		if m := stataReplaceRe.FindStringSubmatch(line); m != nil && m[1] == m[2] {
+			if v := sd.get(m[1]); v != nil {
+				v.DecimalPoint = len(m[3]) - 1
+			}
+			continue
+		}
+		tokens := syntaxTokens(line)
+		if len(tokens) > 0 && tokens[0].text == "quietly" {
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			continue
+		}
+		switch {
+		case tokens[0].text == "infix":
+			for i := 1; i+2 < len(tokens) && tokens[i].text != "using"; i += 3 {
+				varType := "numeric"
+				if strings.HasPrefix(tokens[i].text, "str") {
+					varType = "character"
+				}
+				loc, ok := parsePosRange(tokens[i+2].text)
+				if !ok {
+					return DataDict{}, fmt.Errorf("infix: invalid position '%s' for %s", tokens[i+2].text, tokens[i+1].text)
+				}
+				sd.addVar(tokens[i+1].text, loc, varType, 0)
+			}
+		case tokens[0].text == "label" && len(tokens) >= 4:
+			switch tokens[1].text {
+			case "var", "variable":
+				if v := sd.get(tokens[2].text); v != nil {
+					v.Label = tokens[3].text
+				}
+			case "define", "def":
+				if len(tokens) >= 5 {
+					labelSets[tokens[2].text] = append(labelSets[tokens[2].text], Cat{Val: tokens[3].text, Label: tokens[4].text})
+				}
+			case "values", "val":
+				varLabelSets[tokens[2].text] = tokens[3].text
+			}
+		}
+	}
+	for name, set := range varLabelSets {
+		for _, c := range labelSets[set] {
+			sd.addCat(name, c.Val, c.Label)
+		}
+	}
+	return sd.dataDict(), nil
+}
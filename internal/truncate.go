@@ -0,0 +1,53 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CreateTruncation generates the "TRUNCATE TABLE" statements emptying the main table, and its long-format
+// tables, ahead of the inserts, for refreshes replacing the data of tables that already exist (note:
+// statement terminator (e.g., ";") is included). Ref_tables are emptied as they're created, ahead of
+// their inserts (see truncateRefTable).
+//
+// returns empty byte slice if dbf.Truncate isn't set
+func (dbf *DatabaseFormatter) CreateTruncation(ddi *DataDict) []byte {
+	if !dbf.Truncate {
+		return []byte{}
+	}
+	var truncate strings.Builder
+	truncate.WriteString("-- the tables are emptied ahead of the inserts\n")
+	truncate.WriteString(fmt.Sprintf("TRUNCATE TABLE %s;\n", dbf.ident(dbf.TableName)))
+	if dbf.RepWeights.long() {
+		for _, g := range dbf.RepWeights.groupList {
+			truncate.WriteString(fmt.Sprintf("TRUNCATE TABLE %s;\n", dbf.repWeightTable(g)))
+		}
+	}
+	if dbf.Melts != nil {
+		for _, g := range dbf.Melts.groups {
+			truncate.WriteString(fmt.Sprintf("TRUNCATE TABLE %s;\n", dbf.meltTable(g)))
+		}
+	}
+	if dbf.QFlags.side() {
+		truncate.WriteString(fmt.Sprintf("TRUNCATE TABLE %s;\n", dbf.qflagTable()))
+	}
+	if dbf.VarGroups != nil {
+		for _, g := range dbf.VarGroups.groupList {
+			truncate.WriteString(fmt.Sprintf("TRUNCATE TABLE %s;\n", dbf.varGroupTable(g)))
+		}
+	}
+	truncate.WriteString("\n")
+	return []byte(truncate.String())
+}
+
+// truncateRefTable generates the "TRUNCATE TABLE" statement emptying a ref_table that may already exist (see
+// createRefTableIfNotExists) ahead of its inserts, so that its categories are replaced, rather than merged;
+// "" if dbf.Truncate isn't set
+func (dbf *DatabaseFormatter) truncateRefTable(tableName string) string {
+	if !dbf.Truncate {
+		return ""
+	}
+	return fmt.Sprintf("TRUNCATE TABLE %s;\n\n", tableName)
+}
@@ -0,0 +1,314 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// genericTypes are the traditional types of the built-in type map (see getDataTypes)
+// that a column may be forced to; any other override is used as a literal SQL type
+var genericTypes = []string{"int", "bigint", "float", "string"}
+
+// TypeOverrides holds user-supplied overrides of the built-in type map.
+//
+// Types overrides the database type of a traditional type (e.g., "float": "double precision"),
+// and Columns forces the type of a variable's column (e.g., "serial": "bigint"), either to a
+// traditional type, or to a literal SQL type. Dialects holds further overrides for a single
+// database system, applied on top of the others.
+type TypeOverrides struct {
+	Types    map[string]string         `json:"types"`
+	Columns  map[string]string         `json:"columns"`
+	Dialects map[string]*TypeOverrides `json:"dialects"`
+}
+
+// LoadTypeOverrides reads type overrides from a JSON file, or from a YAML file (by ".yaml" or ".yml"
+// extension) of the same shape; only YAML's block mappings of scalars are supported. For example:
+//
+//	types:
+//	  float: double precision
+//	columns:
+//	  serial: bigint
+//	dialects:
+//	  oracle:
+//	    columns:
+//	      perwt: binary_double
+//
+// returns error if the file cannot be read or parsed
+func LoadTypeOverrides(fileName string) (*TypeOverrides, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		tree, err := parseYAMLMappings(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", fileName, err)
+		}
+		// YAML mappings have the same shape as JSON objects
+		if data, err = json.Marshal(tree); err != nil {
+			return nil, err
+		}
+	}
+	var overrides TypeOverrides
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fileName, err)
+	}
+	return &overrides, nil
+}
+
+// merge returns the overrides for a database system: the general overrides,
+// with the system's own overrides applied on top
+func (to *TypeOverrides) merge(dbType string) (types, columns map[string]string, err error) {
+	types, columns = make(map[string]string), make(map[string]string)
+	layers := []*TypeOverrides{to}
+	for dialect, o := range to.Dialects {
+		switch d := strings.ToLower(dialect); d {
+		case POSTGRES, ORACLE, MYSQL, MSSQL, SNOWFLAKE:
+			if d == dbType && o != nil {
+				layers = append(layers, o)
+			}
+		default:
+			return nil, nil, fmt.Errorf("dialect '%s' not in {'postgres', 'oracle', 'mysql', mssql', 'snowflake'}", dialect)
+		}
+	}
+	for _, o := range layers {
+		for k, t := range o.Types {
+			k, t = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(t)
+			if !isBuiltinType(k) {
+				return nil, nil, fmt.Errorf("cannot override unrecognized type '%s'", k)
+			}
+			if len(t) == 0 {
+				return nil, nil, fmt.Errorf("type '%s' is overridden with an empty type", k)
+			}
+			types[k] = t
+		}
+		for col, t := range o.Columns {
+			col, t = strings.ToLower(strings.TrimSpace(col)), strings.TrimSpace(t)
+			if len(t) == 0 {
+				return nil, nil, fmt.Errorf("column '%s' is overridden with an empty type", col)
+			}
+			columns[col] = t
+		}
+	}
+	return types, columns, nil
+}
+
+// isBuiltinType reports whether a traditional type is in the built-in type map
+func isBuiltinType(genericType string) bool {
+	types2DBtypes, _ := getDataTypes(POSTGRES)
+	_, ok := types2DBtypes[genericType]
+	return ok
+}
+
+// sqlType returns the database type of a traditional type, with params (e.g., length, or
+// precision and scale) appended. User-overridden types are used as is, without params.
+func (dbf *DatabaseFormatter) sqlType(genericType string, params ...int) string {
+	if dbf.overriddenTypes[genericType] || len(params) == 0 {
+		return dbf.DataTypes[genericType]
+	}
+	ps := make([]string, len(params))
+	for i, p := range params {
+		ps[i] = strconv.Itoa(p)
+	}
+	return fmt.Sprintf("%s(%s)", dbf.DataTypes[genericType], strings.Join(ps, ","))
+}
+
+// columnOverride returns the forced type of a variable's column, if any
+func (dbf *DatabaseFormatter) columnOverride(v Var) (string, bool) {
+	t, ok := dbf.columnTypeOverrides[strings.ToLower(v.Name)]
+	return t, ok
+}
+
+// isGenericType reports whether a forced column type names a traditional type
+func isGenericType(t string) bool {
+	for _, g := range genericTypes {
+		if strings.EqualFold(t, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTypeOverrides ensures that every forced column type belongs to a variable in the data
+// dictionary, and that it can hold the variable's values as they're written to the dump.
+//
+// returns error if either is not the case
+func (dbf *DatabaseFormatter) checkTypeOverrides(ddi *DataDict) error {
+	vars := make(map[string]Var, len(ddi.Vars))
+	for _, v := range ddi.Vars {
+		vars[strings.ToLower(v.Name)] = v
+	}
+	for col, t := range dbf.columnTypeOverrides {
+		v, ok := vars[col]
+		if !ok {
+			return fmt.Errorf("cannot override type of unrecognized variable %s", col)
+		}
+		t = strings.ToLower(t)
+		if (t == "int" || t == "bigint") && (v.DecimalPoint > 0 || v.VType.VarType == "character") {
+			return fmt.Errorf("cannot force %s type on variable %s, which is not an integer", t, v.Name)
+		}
+		if t == "float" && v.VType.VarType == "character" {
+			return fmt.Errorf("cannot force float type on character variable %s", v.Name)
+		}
+	}
+	return nil
+}
+
+// parseYAMLMappings parses YAML block mappings of scalars (nested by indentation) into a tree
+// of maps; quoted scalars, single-line flow mappings of scalars (e.g., "{0-61: 1, 62-100: 2}"),
+// blank lines, and comments are supported, and nothing else is
+//
+// returns error if a line is not a mapping entry, or is not properly indented
+func parseYAMLMappings(data []byte) (map[string]any, error) {
+	type frame struct {
+		indent int
+		m      map[string]any
+	}
+	type entry struct {
+		key    string
+		indent int
+		parent map[string]any
+	}
+	root := make(map[string]any)
+	stack := []frame{{indent: 0, m: root}}
+	var pending *entry // last entry without a value, which may start a nested mapping
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		indent := len(line) - len(trimmed)
+
+		if pending != nil {
+			if indent > pending.indent {
+				nested := make(map[string]any)
+				pending.parent[pending.key] = nested
+				stack = append(stack, frame{indent: indent, m: nested})
+			} else {
+				pending.parent[pending.key] = nil
+			}
+			pending = nil
+		}
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		cur := stack[len(stack)-1]
+		if indent != cur.indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", lineNo)
+		}
+
+		key, val, found := strings.Cut(trimmed, ":")
+		if !found || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", lineNo)
+		}
+		key, err := yamlScalar(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		val = strings.TrimSpace(val)
+		if i := strings.Index(val, " #"); i >= 0 && !strings.HasPrefix(val, `"`) && !strings.HasPrefix(val, "'") {
+			val = strings.TrimSpace(val[:i])
+		}
+		if len(val) == 0 {
+			pending = &entry{key: key, indent: indent, parent: cur.m}
+			continue
+		}
+		if strings.HasPrefix(val, "{") {
+			if cur.m[key], err = yamlFlowMapping(val); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			continue
+		}
+		if cur.m[key], err = yamlScalar(val); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		pending.parent[pending.key] = nil
+	}
+	return root, nil
+}
+
+// yamlFlowMapping parses a single-line YAML flow mapping of scalars (e.g., "{a: 1, b: 'x, y'}")
+//
+// returns error if the mapping is not closed, or an entry is not a 'key: value' pair of scalars
+func yamlFlowMapping(s string) (map[string]any, error) {
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("unclosed flow mapping %s", s)
+	}
+	// split entries on commas outside of quotes
+	var entries []string
+	var quote rune
+	start := 1
+	for i, r := range s[1 : len(s)-1] {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == ',':
+			entries = append(entries, s[start:i+1])
+			start = i + 2
+		}
+	}
+	entries = append(entries, s[start:len(s)-1])
+
+	m := make(map[string]any)
+	for _, e := range entries {
+		if len(strings.TrimSpace(e)) == 0 {
+			continue
+		}
+		key, val, found := strings.Cut(e, ":")
+		if !found || len(strings.TrimSpace(val)) == 0 {
+			return nil, fmt.Errorf("expected 'key: value' in flow mapping, got '%s'", strings.TrimSpace(e))
+		}
+		key, err := yamlScalar(strings.TrimSpace(key))
+		if err != nil {
+			return nil, err
+		}
+		if m[key], err = yamlScalar(strings.TrimSpace(val)); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// yamlScalar returns the string value of a plain, single-quoted, or double-quoted YAML scalar
+//
+// returns error if the scalar is empty, or of an unsupported kind (e.g., an anchor)
+func yamlScalar(s string) (string, error) {
+	switch {
+	case len(s) == 0:
+		return "", fmt.Errorf("empty YAML scalar")
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:1], `"'{[&*!|>%@`+"`"):
+		return "", fmt.Errorf("unsupported YAML scalar %s", s)
+	default:
+		return s, nil
+	}
+}
@@ -0,0 +1,78 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseUniqueFlag parses the -unique flag argument, a comma-delimited list of unique keys, each made of one
+// or more variables (or columns) joined by "+" (e.g., "serial+pernum,cpsidp"), into the variables of each key
+//
+// returns error if a key is malformed (e.g., "serial+")
+func ParseUniqueFlag(uniqueF string) ([][]string, error) {
+	if len(strings.TrimSpace(uniqueF)) == 0 {
+		return nil, nil
+	}
+	var keys [][]string
+	for _, key := range strings.Split(uniqueF, ",") {
+		var names []string
+		for _, name := range strings.Split(key, "+") {
+			name = strings.TrimSpace(name)
+			if len(name) == 0 {
+				return nil, fmt.Errorf("'%s' is not of the form var1[+var2...]", strings.TrimSpace(key))
+			}
+			names = append(names, name)
+		}
+		keys = append(keys, names)
+	}
+	return keys, nil
+}
+
+// checkUniqueKeys ensures that each unique key, if any, is made of distinct columns of the main table, and is
+// enforced: snowflake declares unique constraints, but doesn't enforce them
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkUniqueKeys(ddi *DataDict) error {
+	if len(dbf.UniqueKeys) == 0 {
+		return nil
+	}
+	switch {
+	case !dbf.writesSQL():
+		return fmt.Errorf("unique keys apply to SQL dumps only")
+	case dbf.DbType == SNOWFLAKE:
+		return fmt.Errorf("snowflake doesn't enforce unique constraints, so unique keys can't catch duplicate rows")
+	}
+	constraints := make(map[string]bool)
+	if len(dbf.NaturalKey) != 0 {
+		constraints[strings.ToLower(dbf.naturalKeyName(ddi))] = true
+	}
+	for _, names := range dbf.UniqueKeys {
+		if err := dbf.checkKeyColumns(ddi, names, "unique key"); err != nil {
+			return err
+		}
+		name := dbf.uniqueKeyName(ddi, names)
+		if constraints[strings.ToLower(name)] {
+			return fmt.Errorf("constraint name %s is generated more than once; name constraints apart (see -constraint-name-template)", name)
+		}
+		constraints[strings.ToLower(name)] = true
+	}
+	return nil
+}
+
+// createUniqueKeys generates a unique constraint on the main table per unique key (e.g., "uq_ipums_tab_serial_pernum"),
+// so that rows loaded twice (e.g., by running a dump twice) fail to insert; "" if there are no unique keys
+func (dbf *DatabaseFormatter) createUniqueKeys(ddi *DataDict) string {
+	var ddl strings.Builder
+	for _, names := range dbf.UniqueKeys {
+		ddl.WriteString(fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s UNIQUE (%s);\n\n",
+			dbf.ident(dbf.TableName), dbf.uniqueKeyName(ddi, names), strings.Join(dbf.keyColumns(ddi, names), ", ")))
+	}
+	return ddl.String()
+}
+
+// uniqueKeyName returns the name of a unique key's constraint (see ConstraintNames)
+func (dbf *DatabaseFormatter) uniqueKeyName(ddi *DataDict, names []string) string {
+	return dbf.objectName(orDefault(dbf.ConstraintNames, DEFAULT_UNIQUE_KEY), dbf.keyColumnNames(ddi, names))
+}
@@ -0,0 +1,107 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// extract files looked for in zip archives, by extension (see UnzipMember)
+var (
+	ZIP_DDI = []string{".xml"}
+	ZIP_DAT = []string{".dat.gz", ".dat"}
+)
+
+// IsZipPath reports whether a path (or URL) names a zip archive (e.g., an extract as downloaded, holding its
+// .dat and DDI), by its extension
+func IsZipPath(p string) bool {
+	return strings.HasSuffix(strings.ToLower(InputName(p)), ".zip")
+}
+
+// zipStem returns a member's name without its directory and extract extension (e.g., "usa_00001" of
+// "usa_00001/usa_00001.dat.gz")
+func zipStem(member string, exts []string) string {
+	base := strings.ToLower(path.Base(member))
+	for _, ext := range exts {
+		if stem, ok := strings.CutSuffix(base, ext); ok {
+			return stem
+		}
+	}
+	return base
+}
+
+// UnzipMember copies the member of a zip archive ending with one of the extensions (ZIP_DDI, or ZIP_DAT)
+// to a temporary file, keeping its extension (so that a ".dat.gz" member stays gzip compressed), returning
+// the temporary file's path, and the member's name. If several members match, the one named stem (e.g.,
+// "usa_00001", of the DDI found in the same, or another archive) is used, if any. Directories, and macOS
+// resource forks (__MACOSX/), are skipped. The temporary file is created in os.TempDir(); it's up to the
+// caller to remove it.
+//
+// returns error if the archive cannot be read, or if no member, or several, match
+func UnzipMember(zipPath string, exts []string, stem string) (string, string, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer zr.Close()
+	var matches []*zip.File
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__macosx/") {
+			continue
+		}
+		if slices.ContainsFunc(exts, func(ext string) bool { return strings.HasSuffix(name, ext) }) {
+			matches = append(matches, f)
+		}
+	}
+	if len(matches) > 1 && len(stem) != 0 {
+		named := slices.DeleteFunc(slices.Clone(matches), func(f *zip.File) bool { return zipStem(f.Name, exts) != strings.ToLower(stem) })
+		if len(named) != 0 {
+			matches = named
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", "", fmt.Errorf("%s holds no %s file", zipPath, strings.Join(exts, " or "))
+	case 1:
+	default:
+		names := make([]string, len(matches))
+		for i, f := range matches {
+			names[i] = f.Name
+		}
+		return "", "", fmt.Errorf("%s holds several %s files (%s)", zipPath, strings.Join(exts, " or "), strings.Join(names, ", "))
+	}
+	member := matches[0]
+	src, err := member.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+	ext := exts[slices.IndexFunc(exts, func(ext string) bool { return strings.HasSuffix(strings.ToLower(member.Name), ext) })]
+	dst, err := os.CreateTemp("", "ipums2db-*"+ext)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		_ = os.Remove(dst.Name())
+		return "", "", err
+	}
+	if err = dst.Close(); err != nil {
+		_ = os.Remove(dst.Name())
+		return "", "", err
+	}
+	return dst.Name(), member.Name, nil
+}
+
+// ZipStem returns the name of a zip archive's member without its directory and extract extension (e.g.,
+// "usa_00001" of "usa_00001.xml"), pairing it with the members of other archives (see UnzipMember)
+func ZipStem(member string) string {
+	return zipStem(member, append(slices.Clone(ZIP_DDI), ZIP_DAT...))
+}
@@ -0,0 +1,69 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// createRefTableIfNotExists generates the statements of a ref_table that may already exist (e.g., created
+// by a previously loaded extract): a "CREATE TABLE" statement that's skipped if the table exists, and
+// an insertion of the variable's categories that skips categories already in the table. The val (or
+// val_min) column is the ref_table's primary key, so that categories can be matched.
+func (dbf *DatabaseFormatter) createRefTableIfNotExists(tableName string, v Var) string {
+	var refTable strings.Builder
+	refTable.WriteString(dbf.createTableIfNotExists(tableName, dbf.refTableColDefs(v, true)))
+	refTable.WriteString(dbf.truncateRefTable(tableName))
+	rows, skipped := dbf.refTableRows(v)
+	refTable.WriteString(skippedCatsComment(tableName, skipped))
+	if len(rows) == 0 {
+		return refTable.String()
+	}
+
+	cols := dbf.refTableCols(v)
+	key, colList := cols[0], strings.Join(cols, ", ")
+	srcCols := make([]string, len(cols))
+	for i, c := range cols {
+		srcCols[i] = "src." + c
+	}
+	tuples := make([]string, len(rows))
+	for i, row := range rows {
+		switch dbf.DbType {
+		case ORACLE:
+			selected := make([]string, len(row))
+			for j, val := range row {
+				selected[j] = fmt.Sprintf("%s AS %s", val, cols[j])
+			}
+			tuples[i] = fmt.Sprintf("\n\tSELECT %s FROM dual", strings.Join(selected, ", "))
+		default:
+			tuples[i] = fmt.Sprintf("\n\t(%s)", strings.Join(row, ", "))
+		}
+	}
+	switch dbf.DbType {
+	case POSTGRES:
+		refTable.WriteString(fmt.Sprintf("INSERT INTO %s (%s)\nVALUES%s\nON CONFLICT DO NOTHING;\n\n",
+			tableName, colList, strings.Join(tuples, ",")))
+	case MYSQL:
+		refTable.WriteString(fmt.Sprintf("INSERT IGNORE INTO %s (%s)\nVALUES%s;\n\n",
+			tableName, colList, strings.Join(tuples, ",")))
+	case MSSQL:
+		refTable.WriteString(fmt.Sprintf("MERGE INTO %s AS tgt\nUSING (VALUES%s\n) AS src (%s)\nON tgt.%s = src.%s\n"+
+			"WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);\n\n",
+			tableName, strings.Join(tuples, ","), colList, key, key, colList, strings.Join(srcCols, ", ")))
+	case ORACLE:
+		refTable.WriteString(fmt.Sprintf("MERGE INTO %s tgt\nUSING (%s\n) src\nON (tgt.%s = src.%s)\n"+
+			"WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);\n\n",
+			tableName, strings.Join(tuples, " UNION ALL"), key, key, colList, strings.Join(srcCols, ", ")))
+	case SNOWFLAKE:
+		// the columns of a VALUES clause are named column1, column2, ...
+		selected := make([]string, len(cols))
+		for j, c := range cols {
+			selected[j] = fmt.Sprintf("column%d AS %s", j+1, c)
+		}
+		refTable.WriteString(fmt.Sprintf("MERGE INTO %s AS tgt\nUSING (SELECT %s FROM VALUES%s\n) AS src\nON tgt.%s = src.%s\n"+
+			"WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);\n\n",
+			tableName, strings.Join(selected, ", "), strings.Join(tuples, ","), key, key, colList, strings.Join(srcCols, ", ")))
+	}
+	return refTable.String()
+}
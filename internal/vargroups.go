@@ -0,0 +1,198 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SPLIT_ALL selects every variable group declared by the data dictionary (see VarGroups)
+const SPLIT_ALL string = "all"
+
+// VarGroups splits the variables of selected variable groups declared by the data dictionary (<varGrp>,
+// e.g., demographics, income, or geography) out of the main table, into a table per group, with a row
+// per row of the main table, keyed like it: a normalized layout, rather than one wide table. Variables
+// outside of the selected groups (and the key) stay in the main table.
+type VarGroups struct {
+	selected []string // lowercased identifiers or labels of the selected groups, or SPLIT_ALL
+
+	// set by checkVarGroups
+	groupList []splitGroup
+	grouped   map[string]bool // names of split variables
+	key       []int           // indices of the variables linking the groups' rows to their row (see longTableKey)
+}
+
+// splitGroup is a variable group split out of the main table
+type splitGroup struct {
+	name string // base name of the group's table: its lowercased identifier (e.g., "demo" -> "ipums_tab_demo")
+	idx  []int  // index of each variable in the data dictionary
+}
+
+// NewVarGroups returns a VarGroups splitting out the variable groups named by the comma-delimited identifiers,
+// or labels, of the -split-groups flag argument (e.g., "demo,inc", or "Demographics"), or every group, if
+// "all"; if no groups are given, it returns nil (nothing is split).
+//
+// returns error if a group is named more than once
+func NewVarGroups(splitF string) (*VarGroups, error) {
+	if len(strings.TrimSpace(splitF)) == 0 {
+		return nil, nil
+	}
+	vg := &VarGroups{}
+	for _, g := range strings.Split(splitF, ",") {
+		g = strings.ToLower(strings.TrimSpace(g))
+		switch {
+		case len(g) == 0:
+			return nil, fmt.Errorf("'%s' names an empty variable group", splitF)
+		case slices.Contains(vg.selected, g):
+			return nil, fmt.Errorf("variable group %s is named more than once", g)
+		}
+		vg.selected = append(vg.selected, g)
+	}
+	if slices.Contains(vg.selected, SPLIT_ALL) && len(vg.selected) != 1 {
+		return nil, fmt.Errorf("'%s' selects every variable group, so it can't be combined with others", SPLIT_ALL)
+	}
+	return vg, nil
+}
+
+// groups reports whether a variable is split out of the main table
+func (vg *VarGroups) groups(v Var) bool {
+	return vg != nil && vg.grouped[v.Name]
+}
+
+// selectedGroups returns the variable groups of the data dictionary selected by name, in order of selection
+// (or of declaration, if every group is selected)
+//
+// returns error if a group is not declared by the data dictionary
+func (vg *VarGroups) selectedGroups(ddi *DataDict) ([]VarGroup, error) {
+	if vg.selected[0] == SPLIT_ALL {
+		return ddi.VarGroups, nil
+	}
+	var groups []VarGroup
+	for _, name := range vg.selected {
+		i := slices.IndexFunc(ddi.VarGroups, func(g VarGroup) bool {
+			return strings.EqualFold(g.ID, name) || strings.EqualFold(strings.TrimSpace(g.Label), name)
+		})
+		if i < 0 {
+			declared := make([]string, len(ddi.VarGroups))
+			for gi, g := range ddi.VarGroups {
+				declared[gi] = g.ID
+			}
+			return nil, fmt.Errorf("unrecognized variable group %s (declared: %s)", name, strings.Join(declared, ", "))
+		}
+		groups = append(groups, ddi.VarGroups[i])
+	}
+	return groups, nil
+}
+
+// checkVarGroups splits the variables of the selected groups out of the main table, ensuring that splitting
+// can be written: it's for SQL insert dumps of microdata extracts declaring variable groups only, and the
+// groups' tables need a key linking their rows to the main table's (see longTableKey), which stays in the
+// main table. Variables of several selected groups go to the first; grouped replicate weights, melted
+// variables, and data quality flags stay set apart as they are. Groups without variables left to split
+// (e.g., of technical variables, all part of the key) get no table.
+//
+// returns error if not the case
+func (dbf *DatabaseFormatter) checkVarGroups(ddi *DataDict) error {
+	vg := dbf.VarGroups
+	if vg == nil {
+		return nil
+	}
+	switch {
+	case ddi.Flavor == AGGREGATE:
+		return fmt.Errorf("variable groups are split in microdata extracts only")
+	case !dbf.writesInserts():
+		return fmt.Errorf("variable groups are split in SQL insert dumps only")
+	case len(ddi.VarGroups) == 0:
+		return fmt.Errorf("the data dictionary declares no variable groups (<varGrp>)")
+	}
+	vg.groupList, vg.grouped, vg.key = nil, make(map[string]bool), nil
+	key, err := dbf.longTableKey(ddi)
+	if err != nil {
+		return fmt.Errorf("variable group tables are keyed by the row id (-row-id), or the household: %w", err)
+	}
+	groups, err := vg.selectedGroups(ddi)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		sg := splitGroup{name: strings.ToLower(strings.TrimSpace(g.ID))}
+		if !identifierRe.MatchString(sg.name) {
+			return fmt.Errorf("variable group '%s' doesn't name a valid table (letters, digits, and underscores only)", g.ID)
+		}
+		if slices.ContainsFunc(vg.groupList, func(other splitGroup) bool { return other.name == sg.name }) {
+			return fmt.Errorf("variable group %s is declared more than once", g.ID)
+		}
+		for _, name := range strings.Fields(g.Vars) {
+			i := slices.IndexFunc(ddi.Vars, func(v Var) bool { return strings.EqualFold(v.Name, name) })
+			// variables left out of the extract are skipped, as are those of the key, or already set apart
+			if i < 0 || slices.Contains(key, i) || dbf.setApart(ddi.Vars[i]) {
+				continue
+			}
+			sg.idx = append(sg.idx, i)
+			vg.grouped[ddi.Vars[i].Name] = true
+		}
+		if len(sg.idx) != 0 {
+			vg.groupList = append(vg.groupList, sg)
+		}
+	}
+	if len(vg.groupList) == 0 {
+		return fmt.Errorf("no variables of the selected groups are left to split out of the main table")
+	}
+	vg.key = key
+	return nil
+}
+
+// varGroupTable returns the name of a variable group's table (e.g., "ipums_tab_demo")
+func (dbf *DatabaseFormatter) varGroupTable(g splitGroup) string {
+	return dbf.ident(dbf.derivedName(g.name))
+}
+
+// CreateVarGroupTables generates the "CREATE TABLE" and "CREATE INDEX" statements of the tables of split
+// variable groups: a table per group, with a column per variable, and a row per row of the main table,
+// keyed like it.
+//
+// For example, -split-groups demo,inc on an IPUMS CPS extract would generate:
+//
+// CREATE TABLE ipums_tab_demo (
+//
+//	"year" int,
+//	"serial" int,
+//	"pernum" int,
+//	"age" int,	-- Age
+//	"sex" int	-- Sex
+//
+// );
+//
+// CREATE INDEX idx_ipums_tab_demo ON ipums_tab_demo ("year", "serial", "pernum");
+//
+// and likewise for ipums_tab_inc.
+//
+// returns empty byte slice if no variable groups are split
+func (dbf *DatabaseFormatter) CreateVarGroupTables(ddi *DataDict) []byte {
+	if dbf.VarGroups == nil {
+		return []byte{}
+	}
+	var ddl strings.Builder
+	for _, g := range dbf.VarGroups.groupList {
+		ddl.WriteString(dbf.createSideTable(ddi, dbf.varGroupTable(g), dbf.tableObjectName(DEFAULT_DERIVED_INDEX, dbf.derivedName(g.name), nil), dbf.VarGroups.key, g.idx))
+	}
+	return []byte(ddl.String())
+}
+
+// varGroupInserts generates the insert statements of the tables of split variable groups (see
+// CreateVarGroupTables) for a buffer of fixed-width rows, given the (1-based) number of each row in the file
+//
+// returns error if a field cannot be parsed
+func (dbf *DatabaseFormatter) varGroupInserts(ddi *DataDict, buffer []byte, bytesPerLine int, rowNums []int, colTypes map[string]string, nullPolicies []string) ([]byte, error) {
+	var inserts []byte
+	for _, g := range dbf.VarGroups.groupList {
+		grouped, err := dbf.sideTableInserts(ddi, dbf.varGroupTable(g), dbf.VarGroups.key, g.idx, buffer, bytesPerLine, rowNums, colTypes, nullPolicies)
+		if err != nil {
+			return nil, err
+		}
+		inserts = append(inserts, grouped...)
+	}
+	return inserts, nil
+}
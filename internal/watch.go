@@ -0,0 +1,163 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NewWatcher returns a pointer to a Watcher, given the directory to monitor and
+// the settle duration; a pair of files is only reported as ready once neither file
+// has changed in size or modification time for at least the settle duration.
+func NewWatcher(dir string, settle time.Duration) *Watcher {
+	return &Watcher{
+		Dir:      dir,
+		Settle:   settle,
+		seen:     make(map[string]fileState),
+		reported: make(map[string]pairState),
+	}
+}
+
+// Watcher monitors a directory for new DDI and fixed-width file pairs. A pair
+// is made up of "<name>.xml" and either "<name>.dat" or "<name>.dat.gz".
+type Watcher struct {
+	Dir      string
+	Settle   time.Duration
+	seen     map[string]fileState // last observed state of each file
+	reported map[string]pairState // pairs already returned by Poll
+}
+
+// ExtractPair represents a DDI and its fixed-width file, sharing the same basename
+type ExtractPair struct {
+	Name    string // shared basename (e.g., "cps_00001")
+	DDIPath string // path to the DDI XML file
+	DatPath string // path to the fixed-width file (may be gzip compressed)
+}
+
+// fileState is the size and modification time of a file, along with the
+// time at which that combination was first observed
+type fileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// pairState holds the file states of a pair at the time it was reported
+type pairState struct {
+	ddi fileState
+	dat fileState
+}
+
+// Poll scans the watched directory once, returning the pairs that have finished
+// downloading since the last call. A pair is returned again only if either of its
+// files changes afterwards (e.g., the extract is downloaded a second time).
+//
+// returns error if the directory cannot be read
+func (w *Watcher) Poll(now time.Time) ([]ExtractPair, error) {
+	pairs, err := FindExtractPairs(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ready []ExtractPair
+	for _, p := range pairs {
+		ddiState, ok := w.observe(p.DDIPath, now)
+		if !ok {
+			continue
+		}
+		datState, ok := w.observe(p.DatPath, now)
+		if !ok {
+			continue
+		}
+		// both files must have settled
+		if now.Sub(ddiState.since) < w.Settle || now.Sub(datState.since) < w.Settle {
+			continue
+		}
+		// already reported, and nothing has changed since
+		if prev, ok := w.reported[p.Name]; ok && prev.ddi.same(ddiState) && prev.dat.same(datState) {
+			continue
+		}
+		w.reported[p.Name] = pairState{ddi: ddiState, dat: datState}
+		ready = append(ready, p)
+	}
+	return ready, nil
+}
+
+// observe stats a file and records its state, resetting the settle timer if
+// the size or modification time changed since the previous observation.
+//
+// returns false if the file cannot be stat'd (e.g., removed mid-download)
+func (w *Watcher) observe(path string, now time.Time) (fileState, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(w.seen, path)
+		return fileState{}, false
+	}
+	cur := fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+	if prev, ok := w.seen[path]; ok && prev.same(cur) {
+		return prev, true
+	}
+	w.seen[path] = cur
+	return cur, true
+}
+
+// same reports whether two file states share the same size and modification time
+func (fs fileState) same(other fileState) bool {
+	return fs.size == other.size && fs.modTime.Equal(other.modTime)
+}
+
+// FindExtractPairs returns all DDI and fixed-width file pairs in a directory, sorted
+// by name. If both "<name>.dat" and "<name>.dat.gz" exist, the uncompressed file is used.
+//
+// returns error if the directory cannot be read
+func FindExtractPairs(dir string) ([]ExtractPair, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return extractPairs(files), nil
+}
+
+// DecompressDat decompresses a gzip compressed fixed-width file into a temporary file,
+// returning the temporary file's path. Parsers read the fixed-width file at arbitrary offsets,
+// which a gzip stream does not allow, so the file must be decompressed up front.
+// The temporary file is created in os.TempDir(); it's up to the caller to remove it.
+//
+// returns error if the file cannot be read or decompressed
+func DecompressDat(gzPath string) (string, error) {
+	src, err := os.Open(gzPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	dst, err := os.CreateTemp("", "ipums2db-*.dat")
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, zr); err != nil {
+		dst.Close()
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	if err = dst.Close(); err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
@@ -0,0 +1,549 @@
+// Package internal provides all functionality for ipums2db
+// from data-dictionary parsing to SQL statement creation
+package internal
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"slices"
+)
+
+// zstdBlockSize is the max size of a block of a zstd frame (as written by zstdWriter), and its window: matches
+// are found within a block
+const zstdBlockSize = 1 << 17
+
+// zstdMinMatch is the shortest match encoded as a sequence, rather than as literals: shorter matches, of
+// far offsets, cost more than their literals (e.g., digits of numeric columns)
+const zstdMinMatch = 8
+
+// zstdHashLog is the size (log2) of the hash table of the positions of a block, by their first bytes
+const zstdHashLog = 15
+
+// zstdWriter compresses what's written to it into a single zstd frame (RFC 8878), as read by zstd and
+// its libraries: blocks of up to zstdBlockSize bytes, each compressed by greedy matching of repeated
+// strings, encoded as sequences of the predefined FSE distributions, and Huffman coded literals. Blocks
+// that don't compress are stored as is. It compresses less than the zstd command does, about as well as
+// gzip does.
+type zstdWriter struct {
+	w       io.Writer
+	buf     []byte // pending block
+	out     []byte // encoded block, reused
+	table   []int32
+	started bool // whether the frame header was written
+	err     error
+}
+
+// newZstdWriter returns a zstdWriter writing a zstd frame to w; the frame is complete once it's closed
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, buf: make([]byte, 0, zstdBlockSize), table: make([]int32, 1<<zstdHashLog)}
+}
+
+// Write buffers p, compressing a block each time the buffer fills up (and more follows)
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(z.buf) == zstdBlockSize {
+			if err := z.writeBlock(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		take := min(len(p), zstdBlockSize-len(z.buf))
+		z.buf = append(z.buf, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// Close compresses the last block, completing the frame; it doesn't close the underlying writer
+func (z *zstdWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	err := z.writeBlock(true)
+	if err == nil {
+		z.err = errors.New("zstd: write to closed writer")
+	}
+	return err
+}
+
+// writeBlock writes the pending block, compressed if that makes it smaller, preceded by the frame header
+// if it's the first: the frame has no content size, or checksum, and a window of zstdBlockSize
+func (z *zstdWriter) writeBlock(last bool) error {
+	out := z.out[:0]
+	if !z.started {
+		// magic number, frame header descriptor, and window descriptor (2^(10+7) bytes)
+		out = append(out, 0x28, 0xb5, 0x2f, 0xfd, 0x00, 7<<3)
+		z.started = true
+	}
+	hdrAt := len(out)
+	out = append(out, 0, 0, 0)
+	out = z.compressBlock(out, z.buf)
+	// block header: last block flag, block type (0: raw, 2: compressed), and block size
+	hdr := uint32(0)
+	if last {
+		hdr = 1
+	}
+	if size := len(out) - hdrAt - 3; size < len(z.buf) {
+		hdr |= 2<<1 | uint32(size)<<3
+	} else {
+		out = append(out[:hdrAt+3], z.buf...)
+		hdr |= uint32(len(z.buf)) << 3
+	}
+	out[hdrAt], out[hdrAt+1], out[hdrAt+2] = byte(hdr), byte(hdr>>8), byte(hdr>>16)
+	z.out = out
+	if _, err := z.w.Write(out); err != nil {
+		z.err = err
+		return err
+	}
+	z.buf = z.buf[:0]
+	return nil
+}
+
+// zstdSeq is a sequence of a compressed block: literals, followed by a match of an earlier string
+type zstdSeq struct {
+	litLen, matchLen, offset int
+}
+
+// compressBlock appends the compressed block of src to out: its literals section (see appendLiterals), and
+// its sequences section, of the matches found in src
+func (z *zstdWriter) compressBlock(out, src []byte) []byte {
+	clear(z.table)
+	var seqs []zstdSeq
+	var lits []byte
+	anchor := 0
+	for i := 0; i+zstdMinMatch <= len(src); {
+		cur := zstdPrefix(src[i:])
+		h := zstdHash(cur)
+		c := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+		if c < 0 || zstdPrefix(src[c:]) != cur {
+			i++
+			continue
+		}
+		l := zstdMinMatch
+		for i+l < len(src) && src[c+l] == src[i+l] {
+			l++
+		}
+		for i > anchor && c > 0 && src[i-1] == src[c-1] {
+			i, c, l = i-1, c-1, l+1
+		}
+		seqs = append(seqs, zstdSeq{litLen: i - anchor, matchLen: l, offset: i - c})
+		lits = append(lits, src[anchor:i]...)
+		for j := i + 1; j < i+l && j+zstdMinMatch <= len(src); j++ {
+			z.table[zstdHash(zstdPrefix(src[j:]))] = int32(j + 1)
+		}
+		i += l
+		anchor = i
+	}
+	lits = append(lits, src[anchor:]...)
+
+	out = appendLiterals(out, lits)
+
+	// sequences section: their number, the compression modes of their codes (predefined), and their bitstream
+	switch n := len(seqs); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8+0x80), byte(n))
+	default:
+		out = append(out, 0xff, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if len(seqs) == 0 {
+		return out
+	}
+	out = append(out, 0x00)
+	return encodeZstdSeqs(out, seqs)
+}
+
+// appendLiterals appends the literals section of a block to out: the literals, Huffman coded, if that makes
+// them smaller, or else raw, with a header of their size
+func appendLiterals(out, lits []byte) []byte {
+	start := len(out)
+	if huf := appendHuffLiterals(out, lits); huf != nil && len(huf)-start < len(lits) {
+		return huf
+	}
+	switch n := len(lits); {
+	case n < 1<<5:
+		out = append(out[:start], byte(n<<3))
+	case n < 1<<12:
+		out = append(out[:start], byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out[:start], byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(out, lits...)
+}
+
+// zstdMaxHuffBits is the longest Huffman code of literals
+const zstdMaxHuffBits = 11
+
+// appendHuffLiterals appends the literals section of Huffman coded literals to out: its header, the
+// Huffman tree (as the weights of symbols, uncompressed), and one stream of the literals, or four, with a
+// jump table, if there are 1024 or more. Returns nil if the literals can't be coded so: fewer than two
+// distinct bytes, or bytes above 127, whose weights aren't stored uncompressed.
+func appendHuffLiterals(out, lits []byte) []byte {
+	var counts [256]int
+	last, distinct := 0, 0
+	for _, b := range lits {
+		if counts[b] == 0 {
+			distinct++
+		}
+		counts[b]++
+		last = max(last, int(b))
+	}
+	if distinct < 2 || last > 127 {
+		return nil
+	}
+	lens := huffLengths(counts[:last+1], zstdMaxHuffBits)
+	maxBits := uint8(0)
+	for _, l := range lens {
+		maxBits = max(maxBits, l)
+	}
+	// canonical codes, from the longest to the shortest, by symbol within each length
+	codes := make([]uint16, len(lens))
+	code := uint16(0)
+	for l := maxBits; l > 0; l-- {
+		for s := range lens {
+			if lens[s] == l {
+				codes[s] = code
+				code++
+			}
+		}
+		code >>= 1
+	}
+	stream := func(out, lits []byte) []byte {
+		bw := &bitWriter{out: out}
+		for i := len(lits) - 1; i >= 0; i-- {
+			bw.addBits(uint64(codes[lits[i]]), uint(lens[lits[i]]))
+		}
+		return bw.close()
+	}
+
+	hdrAt := len(out)
+	out = append(out, 0, 0, 0, 0, 0)
+	treeAt := len(out)
+	// the weights of each symbol but the last, whose weight is implied, packed two to a byte
+	out = append(out, byte(127+last))
+	for s := 0; s < last; s += 2 {
+		b := huffWeight(lens[s], maxBits) << 4
+		if s+1 < last {
+			b |= huffWeight(lens[s+1], maxBits)
+		}
+		out = append(out, b)
+	}
+	var hdrLen int
+	n := len(lits)
+	if n < 1<<10 {
+		out = stream(out, lits)
+		hdrLen = 3
+	} else {
+		jumpAt := len(out)
+		out = append(out, 0, 0, 0, 0, 0, 0)
+		per := (n + 3) / 4
+		for i := range 4 {
+			streamAt := len(out)
+			out = stream(out, lits[min(i*per, n):min((i+1)*per, n)])
+			if i < 3 {
+				if len(out)-streamAt >= 1<<16 {
+					return nil
+				}
+				binary.LittleEndian.PutUint16(out[jumpAt+2*i:], uint16(len(out)-streamAt))
+			}
+		}
+		hdrLen = 4
+		if max(n, len(out)-treeAt) >= 1<<14 {
+			hdrLen = 5
+		}
+	}
+	// header: block type (compressed), size format, and regenerated and compressed sizes
+	size := uint64(len(out) - treeAt)
+	var hdr uint64
+	switch hdrLen {
+	case 3:
+		if size >= 1<<10 {
+			return nil
+		}
+		hdr = 2 | uint64(n)<<4 | size<<14
+	case 4:
+		hdr = 2 | 2<<2 | uint64(n)<<4 | size<<18
+	default:
+		if size >= 1<<18 {
+			return nil
+		}
+		hdr = 2 | 3<<2 | uint64(n)<<4 | size<<22
+	}
+	for i := range hdrLen {
+		out[hdrAt+i] = byte(hdr >> (8 * i))
+	}
+	return append(out[:hdrAt+hdrLen], out[treeAt:]...)
+}
+
+// huffWeight returns the weight of a symbol of a Huffman code of length l: 0 for absent symbols
+func huffWeight(l, maxBits uint8) byte {
+	if l == 0 {
+		return 0
+	}
+	return maxBits + 1 - l
+}
+
+// huffLengths returns the lengths of the Huffman codes of symbols, given their counts (0 for absent
+// symbols), of at most maxBits; counts are flattened until the longest code is short enough
+func huffLengths(counts []int, maxBits uint8) []uint8 {
+	type node struct {
+		count       int
+		left, right int // children, or -1 for a leaf
+		sym         int
+	}
+	counts = slices.Clone(counts)
+	for {
+		var nodes []node
+		for s, c := range counts {
+			if c > 0 {
+				nodes = append(nodes, node{count: c, left: -1, right: -1, sym: s})
+			}
+		}
+		slices.SortStableFunc(nodes, func(a, b node) int { return cmp.Compare(a.count, b.count) })
+		// two queues: the leaves, and the internal nodes, each in order of count
+		leaves := len(nodes)
+		li, ni := 0, leaves
+		pop := func() int {
+			if li < leaves && (ni >= len(nodes) || nodes[li].count <= nodes[ni].count) {
+				li++
+				return li - 1
+			}
+			ni++
+			return ni - 1
+		}
+		for len(nodes)-leaves < leaves-1 {
+			a, b := pop(), pop()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+		}
+		lens := make([]uint8, len(counts))
+		depths := make([]uint8, len(nodes))
+		longest := uint8(0)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nd := nodes[i]; nd.left < 0 {
+				lens[nd.sym] = depths[i]
+				longest = max(longest, depths[i])
+			} else {
+				depths[nd.left], depths[nd.right] = depths[i]+1, depths[i]+1
+			}
+		}
+		if longest <= maxBits {
+			return lens
+		}
+		for s, c := range counts {
+			if c > 0 {
+				counts[s] = c>>1 | 1
+			}
+		}
+	}
+}
+
+// zstdPrefix returns the first zstdMinMatch bytes of b, by which matches are found
+func zstdPrefix(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+// zstdHash returns the hash table slot of a prefix (see zstdPrefix)
+func zstdHash(prefix uint64) uint32 {
+	return uint32((prefix * 0x9e3779b185ebca87) >> (64 - zstdHashLog))
+}
+
+// literal length, match length, and offset codes: the baseline of each code, and its number of extra bits
+var (
+	zstdLLBase = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40,
+		48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLLBits = []uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3,
+		4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMLBase = []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26,
+		27, 28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = []uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+)
+
+// predefined FSE tables of literal length, match length, and offset codes
+var (
+	zstdLLTable = newFSETable([]int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2,
+		2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}, 6)
+	zstdMLTable = newFSETable([]int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}, 6)
+	zstdOFTable = newFSETable([]int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1, -1}, 5)
+)
+
+// zstdCode returns the code of a value, given the baselines of the codes: the last whose baseline is at most v
+func zstdCode(v int, base []int) int {
+	c := len(base) - 1
+	for base[c] > v {
+		c--
+	}
+	return c
+}
+
+// encodeZstdSeqs appends the bitstream of sequences to out: the codes of each sequence, FSE encoded, and
+// their extra bits, written backward, from the last sequence to the first, as they're read forward
+func encodeZstdSeqs(out []byte, seqs []zstdSeq) []byte {
+	type codes struct {
+		ll, ml, of          int
+		llExtra, mlExtra    uint64
+		ofExtra             uint64
+		llBits, mlBits, ofN uint
+	}
+	code := func(s zstdSeq) codes {
+		var c codes
+		c.ll = zstdCode(s.litLen, zstdLLBase)
+		c.llExtra, c.llBits = uint64(s.litLen-zstdLLBase[c.ll]), zstdLLBits[c.ll]
+		c.ml = zstdCode(s.matchLen, zstdMLBase)
+		c.mlExtra, c.mlBits = uint64(s.matchLen-zstdMLBase[c.ml]), zstdMLBits[c.ml]
+		// offsets are sent as offset values above 3, which would be repeat offsets
+		ofVal := uint64(s.offset + 3)
+		c.of = bits.Len64(ofVal) - 1
+		c.ofExtra, c.ofN = ofVal-1<<c.of, uint(c.of)
+		return c
+	}
+	bw := &bitWriter{out: out}
+	last := code(seqs[len(seqs)-1])
+	var ll, ml, of fseState
+	ml.init(zstdMLTable, last.ml)
+	of.init(zstdOFTable, last.of)
+	ll.init(zstdLLTable, last.ll)
+	bw.addBits(last.llExtra, last.llBits)
+	bw.addBits(last.mlExtra, last.mlBits)
+	bw.addBits(last.ofExtra, last.ofN)
+	for i := len(seqs) - 2; i >= 0; i-- {
+		c := code(seqs[i])
+		of.encode(bw, c.of)
+		ml.encode(bw, c.ml)
+		ll.encode(bw, c.ll)
+		bw.addBits(c.llExtra, c.llBits)
+		bw.addBits(c.mlExtra, c.mlBits)
+		bw.addBits(c.ofExtra, c.ofN)
+	}
+	ml.flush(bw)
+	of.flush(bw)
+	ll.flush(bw)
+	return bw.close()
+}
+
+// bitWriter writes a bitstream, least significant bits first, as read backward by zstd decoders
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// addBits writes the n low bits of v
+func (bw *bitWriter) addBits(v uint64, n uint) {
+	bw.acc |= (v & (1<<n - 1)) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.n -= 8
+	}
+}
+
+// close writes the end mark (a 1 bit) and the last, partial, byte, returning the bitstream
+func (bw *bitWriter) close() []byte {
+	bw.addBits(1, 1)
+	if bw.n > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+	}
+	return bw.out
+}
+
+// fseTable is an FSE encoding table, built from the normalized counts of symbols (as zstd's FSE_buildCTable)
+type fseTable struct {
+	tableLog   uint
+	stateTable []uint16
+	symbolTT   []fseSymbol
+}
+
+// fseSymbol is how a symbol moves the encoder from state to state
+type fseSymbol struct {
+	deltaFindState int32
+	deltaNbBits    uint32
+}
+
+// newFSETable returns the FSE encoding table of normalized counts (-1 for "less than 1"), of accuracy tableLog
+func newFSETable(norm []int16, tableLog uint) *fseTable {
+	tableSize := 1 << tableLog
+	highThreshold := tableSize - 1
+	cumul := make([]int, len(norm)+1)
+	symbols := make([]byte, tableSize)
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[highThreshold] = byte(s)
+			highThreshold--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+	// spread the symbols over the table
+	step, pos := tableSize>>1+tableSize>>3+3, 0
+	for s, n := range norm {
+		for range max(n, 0) {
+			symbols[pos] = byte(s)
+			pos = (pos + step) & (tableSize - 1)
+			for pos > highThreshold {
+				pos = (pos + step) & (tableSize - 1)
+			}
+		}
+	}
+	t := &fseTable{tableLog: tableLog, stateTable: make([]uint16, tableSize), symbolTT: make([]fseSymbol, len(norm))}
+	for u, s := range symbols {
+		t.stateTable[cumul[s]] = uint16(tableSize + u)
+		cumul[s]++
+	}
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			t.symbolTT[s] = fseSymbol{deltaFindState: total - 1, deltaNbBits: uint32(tableLog<<16) - uint32(tableSize)}
+			total++
+		default:
+			maxBitsOut := tableLog - uint(bits.Len32(uint32(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.symbolTT[s] = fseSymbol{deltaFindState: total - int32(n), deltaNbBits: uint32(maxBitsOut<<16) - minStatePlus}
+			total += int32(n)
+		}
+	}
+	return t
+}
+
+// fseState is the state of an FSE encoder
+type fseState struct {
+	value uint32
+	t     *fseTable
+}
+
+// init starts the encoder at the state of the first symbol encoded (the last one decoded)
+func (st *fseState) init(t *fseTable, symbol int) {
+	tt := t.symbolTT[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	v := nbBitsOut<<16 - tt.deltaNbBits
+	st.t, st.value = t, uint32(t.stateTable[int32(v>>nbBitsOut)+tt.deltaFindState])
+}
+
+// encode writes the bits moving the encoder to the state of a symbol
+func (st *fseState) encode(bw *bitWriter, symbol int) {
+	tt := st.t.symbolTT[symbol]
+	nbBitsOut := (st.value + tt.deltaNbBits) >> 16
+	bw.addBits(uint64(st.value), uint(nbBitsOut))
+	st.value = uint32(st.t.stateTable[int32(st.value>>nbBitsOut)+tt.deltaFindState])
+}
+
+// flush writes the final state, which the decoder starts from
+func (st *fseState) flush(bw *bitWriter) {
+	bw.addBits(uint64(st.value), st.t.tableLog)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// zstdInputs are the inputs compressed by the tests: empty, shorter than a block, and of several blocks,
+// both compressible (fixed-width rows) and not (random bytes)
+func zstdInputs() map[string][]byte {
+	var rows strings.Builder
+	for i := 0; rows.Len() < 3*zstdBlockSize+100; i++ {
+		rows.WriteString(fmt.Sprintf("2023%08d%02d%03d%07d  \n", i/4, i%4+1, 18+i%70, (i*7919)%1000000))
+	}
+	random := make([]byte, zstdBlockSize+1)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":         {},
+		"short":         []byte("hello, hello, hello, hello, zstd\n"),
+		"one block":     []byte(rows.String()[:zstdBlockSize]),
+		"several rows":  []byte(rows.String()),
+		"random blocks": random,
+	}
+}
+
+// zstdCompress compresses src with a zstdWriter, in writes of uneven sizes
+func zstdCompress(t *testing.T, src []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := newZstdWriter(&buf)
+	for p := src; len(p) > 0; {
+		n := min(len(p), 1000+len(p)%7919)
+		if _, err := z.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestZstdFrame checks the structure of the frames written: the magic number and frame header, then blocks
+// of up to zstdBlockSize bytes, raw or compressed, the last one flagged as such and ending the output; raw
+// blocks hold their part of the input as is
+func TestZstdFrame(t *testing.T) {
+	for name, src := range zstdInputs() {
+		t.Run(name, func(t *testing.T) {
+			frame := zstdCompress(t, src)
+			if !bytes.HasPrefix(frame, []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 7 << 3}) {
+				t.Fatalf("frame header = % x, want magic number, descriptor, and window of 2^17", frame[:min(len(frame), 6)])
+			}
+			wantBlocks := max(1, (len(src)+zstdBlockSize-1)/zstdBlockSize)
+			pos, blocks := 6, 0
+			for last := false; !last; blocks++ {
+				if pos+3 > len(frame) {
+					t.Fatalf("block %d: header cut at byte %d of %d", blocks, pos, len(frame))
+				}
+				hdr := uint32(frame[pos]) | uint32(frame[pos+1])<<8 | uint32(frame[pos+2])<<16
+				size := int(hdr >> 3)
+				last = hdr&1 == 1
+				pos += 3
+				if pos+size > len(frame) {
+					t.Fatalf("block %d: %d bytes, past the frame's end", blocks, size)
+				}
+				part := src[min(blocks*zstdBlockSize, len(src)):min((blocks+1)*zstdBlockSize, len(src))]
+				switch blockType := (hdr >> 1) & 3; blockType {
+				case 0:
+					if !bytes.Equal(frame[pos:pos+size], part) {
+						t.Errorf("block %d: raw block doesn't hold its %d bytes of input", blocks, len(part))
+					}
+				case 2:
+					if size >= len(part) {
+						t.Errorf("block %d: compressed to %d bytes, from %d; want it stored raw", blocks, size, len(part))
+					}
+				default:
+					t.Fatalf("block %d: type %d, want raw (0) or compressed (2)", blocks, blockType)
+				}
+				pos += size
+			}
+			if blocks != wantBlocks {
+				t.Errorf("%d blocks, want %d", blocks, wantBlocks)
+			}
+			if pos != len(frame) {
+				t.Errorf("%d bytes follow the last block", len(frame)-pos)
+			}
+		})
+	}
+	// compressible input is compressed
+	src := zstdInputs()["several rows"]
+	if frame := zstdCompress(t, src); len(frame) > len(src)/2 {
+		t.Errorf("%d bytes of rows compressed to %d", len(src), len(frame))
+	}
+}
+
+// TestZstdRoundTrip checks that the frames written are decompressed into their input by the zstd command,
+// if installed
+func TestZstdRoundTrip(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+	for name, src := range zstdInputs() {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command(zstd, "-d", "-c", "-q")
+			cmd.Stdin = bytes.NewReader(zstdCompress(t, src))
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d: %v: %s", err, stderr.String())
+			}
+			if !bytes.Equal(got, src) {
+				t.Errorf("decompressed %d bytes, want the %d compressed", len(got), len(src))
+			}
+		})
+	}
+}
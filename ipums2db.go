@@ -0,0 +1,65 @@
+// Package ipums2db reads IPUMS extracts from Go programs, without going through a dump: a data dictionary
+// (see NewDataDict) describes the rows of a fixed-width data file, decoded into typed Go values by a
+// RowReader (see NewRowReader). The ipums2db command converts extracts into database dumps.
+//
+// For example, reading an IPUMS CPS extract into a struct generated by "ipums2db -emit go":
+//
+//	ddi, err := ipums2db.NewDataDict("cps_00001.xml")
+//	...
+//	rr := ipums2db.NewRowReader(&ddi, datFile)
+//	for {
+//		var row ipums.Row
+//		if err := rr.Scan(&row); errors.Is(err, io.EOF) {
+//			break
+//		} else if err != nil {
+//			return err
+//		}
+//		...
+//	}
+package ipums2db
+
+import (
+	"io"
+
+	棕熊 "github.com/rhawrami/ipums2db/internal"
+)
+
+// DataDict is the data dictionary of an extract: its variables, and their positions in the data file
+type DataDict = 棕熊.DataDict
+
+// Var is a variable of a data dictionary
+type Var = 棕熊.Var
+
+// RowReader decodes the rows of a fixed-width file into typed Go values (see NewRowReader)
+type RowReader = 棕熊.RowReader
+
+// ParseError is an error decoding a row of the data file (e.g., a malformed field)
+type ParseError = 棕熊.ParseError
+
+// NullPolicy determines which fields are null (see RowReader.SetNulls), as the -nulls flag of the ipums2db
+// command does
+type NullPolicy = 棕熊.NullPolicy
+
+// NewDataDict returns the data dictionary of an extract, given the path to its DDI XML file; SPSS (.sps),
+// SAS (.sas), and Stata (.do) syntax files are accepted in its place.
+//
+// returns error if the file can't be read or parsed
+func NewDataDict(ddiFileName string) (DataDict, error) {
+	return 棕熊.NewDataDict(ddiFileName)
+}
+
+// NewRowReader returns a RowReader decoding the rows of a fixed-width file read from r, as described by a
+// data dictionary: Read returns each row as a map of values keyed by variable name, and Scan decodes each
+// row into a struct (e.g., as generated by "ipums2db -emit go"). r is read through once, so it may be a
+// stream (e.g., a gzip.Reader of a ".dat.gz" file).
+func NewRowReader(ddi *DataDict, r io.Reader) *RowReader {
+	return 棕熊.NewRowReader(ddi, r)
+}
+
+// ParseNulls returns the null policy of a -nulls flag argument (e.g., "string=trim,numeric=strict"), for
+// RowReader.SetNulls
+//
+// returns error if a policy is not recognized
+func ParseNulls(nullsF string) (*NullPolicy, error) {
+	return 棕熊.ParseNullsFlag(nullsF)
+}